@@ -0,0 +1,575 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// LZMA and LZMA2 decoders - just enough to read 7z archives (see LzmaSpec.cpp in LZMA SDK for reference).
+
+const (
+	lzmaNumStates         = 12
+	lzmaNumPosBitsMax     = 4
+	lzmaNumLenToPosStates = 4
+	lzmaNumAlignBits      = 4
+	lzmaEndPosModelIndex  = 14
+	lzmaNumFullDistances  = 1 << (lzmaEndPosModelIndex >> 1)
+	lzmaMatchMinLen       = 2
+	lzmaMatchMaxLen       = 273
+	lzmaMinWindow         = 1 << 12
+)
+
+var (
+	errLZMACorrupted = errors.New("lzma: corrupted data")
+	errLZMAEndMarker = errors.New("lzma: end marker")
+)
+
+type lzmaProb uint16
+
+func initProbs(probs []lzmaProb) {
+	for i := range probs {
+		probs[i] = 1 << 10
+	}
+}
+
+type rangeDecoder struct {
+	r    io.ByteReader
+	rng  uint32
+	code uint32
+	err  error
+}
+
+func (rd *rangeDecoder) init(r io.ByteReader) error {
+	rd.r, rd.rng, rd.code, rd.err = r, 0xFFFFFFFF, 0, nil
+	b := rd.readByte()
+	for i := 0; i < 4; i++ {
+		rd.code = rd.code<<8 | uint32(rd.readByte())
+	}
+	if rd.err == nil && (b != 0 || rd.code == rd.rng) {
+		return errLZMACorrupted
+	}
+	return rd.err
+}
+
+func (rd *rangeDecoder) readByte() byte {
+	b, err := rd.r.ReadByte()
+	if err != nil && rd.err == nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		rd.err = err
+	}
+	return b
+}
+
+func (rd *rangeDecoder) normalize() {
+	if rd.rng < 1<<24 {
+		rd.rng <<= 8
+		rd.code = rd.code<<8 | uint32(rd.readByte())
+	}
+}
+
+func (rd *rangeDecoder) bit(p *lzmaProb) uint32 {
+	bound := (rd.rng >> 11) * uint32(*p)
+	var b uint32
+	if rd.code < bound {
+		rd.rng = bound
+		*p += (1<<11 - *p) >> 5
+	} else {
+		rd.rng -= bound
+		rd.code -= bound
+		*p -= *p >> 5
+		b = 1
+	}
+	rd.normalize()
+	return b
+}
+
+func (rd *rangeDecoder) direct(bits int) uint32 {
+	var res uint32
+	for ; bits > 0; bits-- {
+		rd.rng >>= 1
+		rd.code -= rd.rng
+		t := 0 - (rd.code >> 31)
+		rd.code += rd.rng & t
+		rd.normalize()
+		res = res<<1 + t + 1
+	}
+	return res
+}
+
+func (rd *rangeDecoder) tree(probs []lzmaProb, bits int) uint32 {
+	m := uint32(1)
+	for i := 0; i < bits; i++ {
+		m = m<<1 + rd.bit(&probs[m])
+	}
+	return m - 1<<bits
+}
+
+func (rd *rangeDecoder) reverse(probs []lzmaProb, bits int) uint32 {
+	m, sym := uint32(1), uint32(0)
+	for i := 0; i < bits; i++ {
+		b := rd.bit(&probs[m])
+		m = m<<1 + b
+		sym |= b << i
+	}
+	return sym
+}
+
+type lzmaLenDecoder struct {
+	choice [2]lzmaProb
+	low    [1 << lzmaNumPosBitsMax][1 << 3]lzmaProb
+	mid    [1 << lzmaNumPosBitsMax][1 << 3]lzmaProb
+	high   [1 << 8]lzmaProb
+}
+
+func (ld *lzmaLenDecoder) init() {
+	initProbs(ld.choice[:])
+	for i := range ld.low {
+		initProbs(ld.low[i][:])
+		initProbs(ld.mid[i][:])
+	}
+	initProbs(ld.high[:])
+}
+
+func (ld *lzmaLenDecoder) decode(rd *rangeDecoder, posState uint32) uint32 {
+	if rd.bit(&ld.choice[0]) == 0 {
+		return rd.tree(ld.low[posState][:], 3)
+	}
+	if rd.bit(&ld.choice[1]) == 0 {
+		return 8 + rd.tree(ld.mid[posState][:], 3)
+	}
+	return 16 + rd.tree(ld.high[:], 8)
+}
+
+// lzmaWindow is sliding dictionary which also keeps decoded bytes until they are read.
+type lzmaWindow struct {
+	buf    []byte
+	pos    int    // next write position
+	filled int    // number of bytes available as dictionary
+	unread int    // number of decoded bytes not yet read
+	total  uint32 // bytes decoded since dictionary reset, used for position states
+}
+
+func newLZMAWindow(dict uint32, size int64) lzmaWindow {
+	n := int64(dict)
+	if size >= 0 && size < n {
+		// there is no need for dictionary larger than content
+		n = size
+	}
+	return lzmaWindow{buf: make([]byte, max(n, lzmaMinWindow))}
+}
+
+func (w *lzmaWindow) reset() {
+	w.filled, w.total = 0, 0
+}
+
+func (w *lzmaWindow) put(b byte) {
+	w.buf[w.pos] = b
+	if w.pos++; w.pos == len(w.buf) {
+		w.pos = 0
+	}
+	if w.filled < len(w.buf) {
+		w.filled++
+	}
+	w.unread++
+	w.total++
+}
+
+func (w *lzmaWindow) get(dist int) byte {
+	i := w.pos - dist
+	if i < 0 {
+		i += len(w.buf)
+	}
+	return w.buf[i]
+}
+
+func (w *lzmaWindow) space() int {
+	return len(w.buf) - w.unread
+}
+
+func (w *lzmaWindow) read(p []byte) int {
+	n := min(len(p), w.unread)
+	start := w.pos - w.unread
+	if start < 0 {
+		start += len(w.buf)
+	}
+	c := copy(p[:n], w.buf[start:])
+	copy(p[c:n], w.buf)
+	w.unread -= n
+	return n
+}
+
+// lzmaState is LZMA decoder state, which in case of LZMA2 survives between chunks.
+type lzmaState struct {
+	lc, lp, pb uint
+	literal    []lzmaProb
+	isMatch    [lzmaNumStates << lzmaNumPosBitsMax]lzmaProb
+	isRep      [lzmaNumStates]lzmaProb
+	isRepG0    [lzmaNumStates]lzmaProb
+	isRepG1    [lzmaNumStates]lzmaProb
+	isRepG2    [lzmaNumStates]lzmaProb
+	isRep0Long [lzmaNumStates << lzmaNumPosBitsMax]lzmaProb
+	posSlot    [lzmaNumLenToPosStates][1 << 6]lzmaProb
+	posDecoder [1 + lzmaNumFullDistances - lzmaEndPosModelIndex]lzmaProb
+	align      [1 << lzmaNumAlignBits]lzmaProb
+	lenDecoder lzmaLenDecoder
+	repDecoder lzmaLenDecoder
+	state      uint32
+	rep        [4]uint32
+}
+
+// setProps decodes lc, lp and pb properties from single byte.
+func (s *lzmaState) setProps(d byte) error {
+	if d >= 9*5*5 {
+		return errLZMACorrupted
+	}
+	s.lc, s.lp, s.pb = uint(d%9), uint(d/9%5), uint(d/45)
+	if n := 0x300 << (s.lc + s.lp); len(s.literal) != n {
+		s.literal = make([]lzmaProb, n)
+	}
+	return nil
+}
+
+func (s *lzmaState) reset() {
+	initProbs(s.literal)
+	initProbs(s.isMatch[:])
+	initProbs(s.isRep[:])
+	initProbs(s.isRepG0[:])
+	initProbs(s.isRepG1[:])
+	initProbs(s.isRepG2[:])
+	initProbs(s.isRep0Long[:])
+	for i := range s.posSlot {
+		initProbs(s.posSlot[i][:])
+	}
+	initProbs(s.posDecoder[:])
+	initProbs(s.align[:])
+	s.lenDecoder.init()
+	s.repDecoder.init()
+	s.state, s.rep = 0, [4]uint32{}
+}
+
+// decode decodes single literal or match putting at most limit bytes to the window, returns number of decoded bytes.
+func (s *lzmaState) decode(rd *rangeDecoder, w *lzmaWindow, limit int) (int, error) {
+
+	posState := w.total & (1<<s.pb - 1)
+	state := s.state
+
+	if rd.bit(&s.isMatch[state<<lzmaNumPosBitsMax+posState]) == 0 {
+		s.decodeLiteral(rd, w)
+		return 1, rd.err
+	}
+
+	var length uint32
+	if rd.bit(&s.isRep[state]) != 0 {
+		if w.filled == 0 {
+			return 0, errLZMACorrupted
+		}
+		if rd.bit(&s.isRepG0[state]) == 0 {
+			if rd.bit(&s.isRep0Long[state<<lzmaNumPosBitsMax+posState]) == 0 {
+				// short rep
+				if int(s.rep[0]) >= w.filled {
+					return 0, errLZMACorrupted
+				}
+				s.state = 11
+				if state < 7 {
+					s.state = 9
+				}
+				w.put(w.get(int(s.rep[0]) + 1))
+				return 1, rd.err
+			}
+		} else {
+			var dist uint32
+			if rd.bit(&s.isRepG1[state]) == 0 {
+				dist = s.rep[1]
+			} else {
+				if rd.bit(&s.isRepG2[state]) == 0 {
+					dist = s.rep[2]
+				} else {
+					dist = s.rep[3]
+					s.rep[3] = s.rep[2]
+				}
+				s.rep[2] = s.rep[1]
+			}
+			s.rep[1] = s.rep[0]
+			s.rep[0] = dist
+		}
+		length = s.repDecoder.decode(rd, posState)
+		s.state = 11
+		if state < 7 {
+			s.state = 8
+		}
+	} else {
+		s.rep[3], s.rep[2], s.rep[1] = s.rep[2], s.rep[1], s.rep[0]
+		length = s.lenDecoder.decode(rd, posState)
+		s.state = 10
+		if state < 7 {
+			s.state = 7
+		}
+		s.rep[0] = s.decodeDistance(rd, length)
+		if s.rep[0] == 0xFFFFFFFF {
+			return 0, errLZMAEndMarker
+		}
+	}
+
+	dist := int(s.rep[0]) + 1
+	if dist > w.filled {
+		return 0, errLZMACorrupted
+	}
+	n := min(int(length)+lzmaMatchMinLen, limit)
+	for i := 0; i < n; i++ {
+		w.put(w.get(dist))
+	}
+	return n, rd.err
+}
+
+func (s *lzmaState) decodeLiteral(rd *rangeDecoder, w *lzmaWindow) {
+
+	var prev uint32
+	if w.filled > 0 {
+		prev = uint32(w.get(1))
+	}
+	litState := (w.total&(1<<s.lp-1))<<s.lc + prev>>(8-s.lc)
+	probs := s.literal[0x300*litState:]
+
+	sym := uint32(1)
+	if s.state >= 7 && w.filled > int(s.rep[0]) {
+		match := uint32(w.get(int(s.rep[0]) + 1))
+		for sym < 0x100 {
+			mbit := (match >> 7) & 1
+			match <<= 1
+			b := rd.bit(&probs[(1+mbit)<<8+sym])
+			sym = sym<<1 | b
+			if mbit != b {
+				break
+			}
+		}
+	}
+	for sym < 0x100 {
+		sym = sym<<1 | rd.bit(&probs[sym])
+	}
+	w.put(byte(sym))
+
+	switch {
+	case s.state < 4:
+		s.state = 0
+	case s.state < 10:
+		s.state -= 3
+	default:
+		s.state -= 6
+	}
+}
+
+func (s *lzmaState) decodeDistance(rd *rangeDecoder, length uint32) uint32 {
+
+	slot := rd.tree(s.posSlot[min(length, lzmaNumLenToPosStates-1)][:], 6)
+	if slot < 4 {
+		return slot
+	}
+	bits := int(slot>>1) - 1
+	dist := (2 | slot&1) << bits
+	if slot < lzmaEndPosModelIndex {
+		return dist + rd.reverse(s.posDecoder[dist-slot:], bits)
+	}
+	dist += rd.direct(bits-lzmaNumAlignBits) << lzmaNumAlignBits
+	return dist + rd.reverse(s.align[:], lzmaNumAlignBits)
+}
+
+// lzmaReader decodes LZMA stream of known size as stored in 7z archives.
+type lzmaReader struct {
+	rd   rangeDecoder
+	s    lzmaState
+	w    lzmaWindow
+	left int64
+	err  error
+}
+
+func newLZMAReader(r io.Reader, props []byte, size int64) (io.Reader, error) {
+
+	if len(props) != 5 {
+		return nil, errors.New("lzma: unsupported properties")
+	}
+	lz := &lzmaReader{left: size}
+	if err := lz.s.setProps(props[0]); err != nil {
+		return nil, err
+	}
+	lz.s.reset()
+	lz.w = newLZMAWindow(binary.LittleEndian.Uint32(props[1:]), size)
+	if err := lz.rd.init(bufio.NewReader(r)); err != nil {
+		return nil, err
+	}
+	return lz, nil
+}
+
+func (lz *lzmaReader) Read(p []byte) (int, error) {
+
+	for lz.w.unread < len(p) && lz.w.space() >= lzmaMatchMaxLen && lz.left > 0 && lz.err == nil {
+		n, err := lz.s.decode(&lz.rd, &lz.w, int(min(lz.left, lzmaMatchMaxLen)))
+		lz.left -= int64(n)
+		if err == errLZMAEndMarker {
+			if lz.left > 0 {
+				err = io.ErrUnexpectedEOF
+			} else {
+				err = nil
+			}
+			lz.left = 0
+		}
+		lz.err = err
+	}
+	if lz.w.unread > 0 {
+		return lz.w.read(p), nil
+	}
+	if lz.err != nil {
+		return 0, lz.err
+	}
+	return 0, io.EOF
+}
+
+// lzma2Reader decodes LZMA2 stream - sequence of LZMA and uncompressed chunks sharing the same dictionary.
+type lzma2Reader struct {
+	r        *bufio.Reader
+	rd       rangeDecoder
+	s        lzmaState
+	w        lzmaWindow
+	chunk    []byte
+	left     int  // bytes left in the current chunk
+	plain    bool // current chunk is not compressed
+	needDict bool
+	needProp bool
+	eof      bool
+	err      error
+}
+
+func newLZMA2Reader(r io.Reader, props []byte, size int64) (io.Reader, error) {
+
+	if len(props) != 1 || props[0] > 40 {
+		return nil, errors.New("lzma2: unsupported properties")
+	}
+	dict := uint32(0xFFFFFFFF)
+	if props[0] < 40 {
+		dict = (2 | uint32(props[0])&1) << (props[0]/2 + 11)
+	}
+	return &lzma2Reader{
+		r:        bufio.NewReader(r),
+		w:        newLZMAWindow(dict, size),
+		needDict: true,
+		needProp: true,
+	}, nil
+}
+
+func (lz *lzma2Reader) Read(p []byte) (int, error) {
+
+	for lz.w.unread < len(p) && lz.w.space() >= lzmaMatchMaxLen && !lz.eof && lz.err == nil {
+		if lz.left == 0 {
+			lz.err = lz.nextChunk()
+			continue
+		}
+		if lz.plain {
+			b, err := lz.r.ReadByte()
+			if err != nil {
+				lz.err = io.ErrUnexpectedEOF
+				continue
+			}
+			lz.w.put(b)
+			lz.left--
+			continue
+		}
+		n, err := lz.s.decode(&lz.rd, &lz.w, min(lz.left, lzmaMatchMaxLen))
+		lz.left -= n
+		if err == errLZMAEndMarker {
+			err = errLZMACorrupted
+		}
+		lz.err = err
+	}
+	if lz.w.unread > 0 {
+		return lz.w.read(p), nil
+	}
+	if lz.err != nil {
+		return 0, lz.err
+	}
+	return 0, io.EOF
+}
+
+func (lz *lzma2Reader) nextChunk() error {
+
+	var hdr [5]byte
+	if _, err := io.ReadFull(lz.r, hdr[:1]); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	c := hdr[0]
+	switch {
+	case c == 0:
+		lz.eof = true
+		return nil
+	case c == 1 || c == 2:
+		if _, err := io.ReadFull(lz.r, hdr[1:3]); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		if c == 1 {
+			lz.w.reset()
+			lz.needDict = false
+		} else if lz.needDict {
+			return errLZMACorrupted
+		}
+		lz.left = int(binary.BigEndian.Uint16(hdr[1:3])) + 1
+		lz.plain = true
+		return nil
+	case c < 0x80:
+		return errLZMACorrupted
+	}
+
+	if _, err := io.ReadFull(lz.r, hdr[1:5]); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	unpacked := int(c&0x1F)<<16 + int(binary.BigEndian.Uint16(hdr[1:3])) + 1
+	packed := int(binary.BigEndian.Uint16(hdr[3:5])) + 1
+
+	switch mode := c >> 5 & 3; {
+	case mode == 3:
+		lz.w.reset()
+		lz.needDict = false
+		fallthrough
+	case mode == 2:
+		if lz.needDict {
+			return errLZMACorrupted
+		}
+		d, err := lz.r.ReadByte()
+		if err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		if err := lz.s.setProps(d); err != nil {
+			return err
+		}
+		if lz.s.lc+lz.s.lp > 4 {
+			return errLZMACorrupted
+		}
+		lz.needProp = false
+		fallthrough
+	case mode == 1:
+		if lz.needDict || lz.needProp {
+			return errLZMACorrupted
+		}
+		lz.s.reset()
+	default:
+		if lz.needDict || lz.needProp {
+			return errLZMACorrupted
+		}
+	}
+
+	if cap(lz.chunk) < packed {
+		lz.chunk = make([]byte, packed)
+	}
+	lz.chunk = lz.chunk[:packed]
+	if _, err := io.ReadFull(lz.r, lz.chunk); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	if err := lz.rd.init(bytes.NewReader(lz.chunk)); err != nil {
+		return err
+	}
+	lz.left = unpacked
+	lz.plain = false
+	return nil
+}
@@ -0,0 +1,55 @@
+package archive
+
+import (
+	"bufio"
+	"io"
+	"unicode/utf8"
+
+	"github.com/nwaples/rardecode"
+	"golang.org/x/text/encoding"
+)
+
+// RAR archives are read sequentially, only single volume archives without password are supported.
+
+type rarWalker struct {
+	r      io.Reader
+	cpage  encoding.Encoding
+	closer io.Closer
+}
+
+func openRar(ra io.ReaderAt, size int64, cpage encoding.Encoding, closer io.Closer) (Walker, error) {
+	return &rarWalker{r: bufio.NewReader(io.NewSectionReader(ra, 0, size)), cpage: cpage, closer: closer}, nil
+}
+
+func (w *rarWalker) Walk(walkFn func(file File, err error) error) error {
+
+	rr, err := rardecode.NewReader(w.r, "")
+	if err != nil {
+		return err
+	}
+	for {
+		h, err := rr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if h.IsDir || !h.Mode().IsRegular() {
+			continue
+		}
+		// RAR 5 names are always UTF-8, older archives without unicode names use OEM code page
+		name, err := decodeName(h.Name, !utf8.ValidString(h.Name), w.cpage)
+
+		f := &streamFile{name: name, read: func() ([]byte, error) { return io.ReadAll(rr) }}
+		err = walkFn(f, err)
+		f.release()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (w *rarWalker) Close() error {
+	return closeAll(w.closer)
+}
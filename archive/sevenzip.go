@@ -0,0 +1,702 @@
+package archive
+
+import (
+	"compress/bzip2"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+// 7z archive reader. Only folders compressed by a single coder are supported: copy, LZMA, LZMA2, deflate or bzip2 -
+// this covers pretty much everything produced from books with default settings. Encrypted archives are not supported.
+
+const sevenZipSignature = "7z\xBC\xAF\x27\x1C"
+
+// Property IDs used in 7z headers.
+const (
+	szEnd = iota
+	szHeader
+	szArchiveProperties
+	szAdditionalStreamsInfo
+	szMainStreamsInfo
+	szFilesInfo
+	szPackInfo
+	szUnpackInfo
+	szSubStreamsInfo
+	szSize
+	szCRC
+	szFolder
+	szCodersUnpackSize
+	szNumUnpackStream
+	szEmptyStream
+	szEmptyFile
+	szAnti
+	szName
+	szCTime
+	szATime
+	szMTime
+	szWinAttributes
+	szComment
+	szEncodedHeader
+)
+
+// sane limits to protect from broken archives
+const (
+	szMaxCount      = 1 << 24
+	szMaxHeaderSize = 1 << 28
+	// content of files is kept in memory, books are never that large
+	szMaxFileSize = 1 << 28
+)
+
+var errSevenZipHeader = errors.New("7z: malformed header")
+
+type szCoder struct {
+	id    string
+	props []byte
+}
+
+type szFolderInfo struct {
+	coders  []szCoder
+	packed  int     // number of packed streams used by folder
+	unpack  []int64 // sizes of all coders output streams
+	main    int     // index of folder output stream
+	crc     uint32
+	hasCRC  bool
+	sizes   []int64 // files (substreams) stored in folder
+	crcs    []uint32
+	hasCRCs []bool
+}
+
+func (f *szFolderInfo) size() int64 {
+	return f.unpack[f.main]
+}
+
+type szStreams struct {
+	packPos   int64
+	packSizes []int64
+	folders   []*szFolderInfo
+}
+
+type szEntry struct {
+	name   string
+	dir    bool
+	folder int
+	offset int64
+	size   int64
+	crc    uint32
+	hasCRC bool
+}
+
+type sevenZipWalker struct {
+	r       io.ReaderAt
+	size    int64
+	closer  io.Closer
+	streams *szStreams
+	entries []szEntry
+	// files in solid archive are decoded sequentially
+	folder int
+	fr     io.Reader
+	pos    int64
+}
+
+func openSevenZip(r io.ReaderAt, size int64, closer io.Closer) (Walker, error) {
+	w := &sevenZipWalker{r: r, size: size, closer: closer, streams: &szStreams{}, folder: -1}
+	if err := w.readHeader(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *sevenZipWalker) Walk(walkFn func(file File, err error) error) error {
+	for i := range w.entries {
+		e := &w.entries[i]
+		if e.dir {
+			continue
+		}
+		f := &streamFile{name: e.name, read: func() ([]byte, error) { return w.read(e) }}
+		err := walkFn(f, nil)
+		f.release()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *sevenZipWalker) Close() error {
+	return closeAll(w.closer)
+}
+
+// read decodes file content, restarting folder decoding only when necessary.
+func (w *sevenZipWalker) read(e *szEntry) ([]byte, error) {
+
+	if e.folder < 0 {
+		return []byte{}, nil
+	}
+	// sizes come from archive header and should not be trusted
+	if f := w.streams.folders[e.folder]; e.size < 0 || e.offset < 0 || e.offset+e.size > f.size() {
+		return nil, errors.New("7z: file is outside of its folder: " + e.name)
+	}
+	if e.size > szMaxFileSize {
+		return nil, fmt.Errorf("7z: file is too large (%d bytes): %s", e.size, e.name)
+	}
+	if e.folder != w.folder || e.offset < w.pos {
+		r, err := w.streams.reader(w.r, e.folder)
+		if err != nil {
+			return nil, err
+		}
+		w.folder, w.fr, w.pos = e.folder, r, 0
+	}
+
+	if _, err := io.CopyN(io.Discard, w.fr, e.offset-w.pos); err != nil {
+		w.folder = -1
+		return nil, err
+	}
+	// memory is only taken for content which was actually decoded
+	data, err := io.ReadAll(io.LimitReader(w.fr, e.size))
+	if err == nil && int64(len(data)) != e.size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		w.folder = -1
+		return nil, err
+	}
+	w.pos = e.offset + e.size
+
+	if e.hasCRC && crc32.ChecksumIEEE(data) != e.crc {
+		return nil, errors.New("7z: checksum mismatch: " + e.name)
+	}
+	return data, nil
+}
+
+func (w *sevenZipWalker) readHeader() error {
+
+	var sig [32]byte
+	if _, err := w.r.ReadAt(sig[:], 0); err != nil {
+		return err
+	}
+	if string(sig[:6]) != sevenZipSignature {
+		return errors.New("7z: bad signature")
+	}
+	if crc32.ChecksumIEEE(sig[12:]) != binary.LittleEndian.Uint32(sig[8:]) {
+		return errors.New("7z: start header checksum mismatch")
+	}
+	offset := binary.LittleEndian.Uint64(sig[12:])
+	size := binary.LittleEndian.Uint64(sig[20:])
+	if size == 0 {
+		// empty archive
+		return nil
+	}
+
+	if offset > uint64(w.size) || size > uint64(w.size)-offset || size > szMaxHeaderSize {
+		return errSevenZipHeader
+	}
+	data := make([]byte, size)
+	if _, err := w.r.ReadAt(data, int64(len(sig))+int64(offset)); err != nil {
+		return err
+	}
+	if crc32.ChecksumIEEE(data) != binary.LittleEndian.Uint32(sig[28:]) {
+		return errors.New("7z: header checksum mismatch")
+	}
+
+	b := &szBuf{data: data}
+	for {
+		switch b.number() {
+		case szHeader:
+			return w.readMainHeader(b)
+		case szEncodedHeader:
+			s := b.readStreams()
+			if b.err != nil {
+				return b.err
+			}
+			if len(s.folders) == 0 || s.folders[0].size() > szMaxHeaderSize {
+				return errSevenZipHeader
+			}
+			r, err := s.reader(w.r, 0)
+			if err != nil {
+				return err
+			}
+			data := make([]byte, s.folders[0].size())
+			if _, err := io.ReadFull(r, data); err != nil {
+				return err
+			}
+			if s.folders[0].hasCRC && crc32.ChecksumIEEE(data) != s.folders[0].crc {
+				return errors.New("7z: header checksum mismatch")
+			}
+			b = &szBuf{data: data}
+		default:
+			return errSevenZipHeader
+		}
+	}
+}
+
+func (w *sevenZipWalker) readMainHeader(b *szBuf) error {
+
+	id := b.number()
+	if id == szArchiveProperties {
+		for b.err == nil && b.number() != szEnd {
+			b.bytes(b.number())
+		}
+		id = b.number()
+	}
+	if id == szAdditionalStreamsInfo {
+		b.readStreams()
+		id = b.number()
+	}
+	if id == szMainStreamsInfo {
+		w.streams = b.readStreams()
+		id = b.number()
+	}
+	if id == szFilesInfo {
+		w.entries = b.readFiles(w.streams)
+		id = b.number()
+	}
+	if b.err != nil {
+		return b.err
+	}
+	if id != szEnd {
+		return errSevenZipHeader
+	}
+	return nil
+}
+
+// reader returns decoder for folder content.
+func (s *szStreams) reader(file io.ReaderAt, i int) (io.Reader, error) {
+
+	f := s.folders[i]
+	if len(f.coders) != 1 || f.packed != 1 {
+		return nil, errors.New("7z: only single coder compression methods are supported")
+	}
+
+	start := 0
+	for _, f := range s.folders[:i] {
+		start += f.packed
+	}
+	if start >= len(s.packSizes) {
+		return nil, errSevenZipHeader
+	}
+	offset := 32 + s.packPos
+	for _, n := range s.packSizes[:start] {
+		offset += n
+	}
+	r := io.NewSectionReader(file, offset, s.packSizes[start])
+
+	var (
+		dr  io.Reader
+		err error
+	)
+	switch c := f.coders[0]; c.id {
+	case "\x00":
+		dr = r
+	case "\x03\x01\x01":
+		dr, err = newLZMAReader(r, c.props, f.size())
+	case "\x21":
+		dr, err = newLZMA2Reader(r, c.props, f.size())
+	case "\x04\x01\x08":
+		dr = flate.NewReader(r)
+	case "\x04\x02\x02":
+		dr = bzip2.NewReader(r)
+	case "\x06\xF1\x07\x01":
+		err = errors.New("7z: encrypted archives are not supported")
+	default:
+		err = fmt.Errorf("7z: unsupported compression method %X", c.id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return io.LimitReader(dr, f.size()), nil
+}
+
+// szBuf reads 7z header structures, the first error is remembered and stops parsing.
+type szBuf struct {
+	data []byte
+	err  error
+}
+
+func (b *szBuf) fail() {
+	if b.err == nil {
+		b.err = errSevenZipHeader
+	}
+	b.data = nil
+}
+
+func (b *szBuf) byte() byte {
+	if len(b.data) == 0 {
+		b.fail()
+		return 0
+	}
+	c := b.data[0]
+	b.data = b.data[1:]
+	return c
+}
+
+func (b *szBuf) bytes(n uint64) []byte {
+	if uint64(len(b.data)) < n {
+		b.fail()
+		return nil
+	}
+	p := b.data[:n]
+	b.data = b.data[n:]
+	return p
+}
+
+func (b *szBuf) uint32() uint32 {
+	if p := b.bytes(4); p != nil {
+		return binary.LittleEndian.Uint32(p)
+	}
+	return 0
+}
+
+// number reads variable length integer, number of bytes is encoded by leading bits of the first byte.
+func (b *szBuf) number() uint64 {
+	first := b.byte()
+	var v uint64
+	for i := 0; i < 8; i++ {
+		mask := byte(0x80) >> i
+		if first&mask == 0 {
+			return v | uint64(first&(mask-1))<<(8*i)
+		}
+		v |= uint64(b.byte()) << (8 * i)
+	}
+	return v
+}
+
+func (b *szBuf) count() int {
+	n := b.number()
+	if n > szMaxCount {
+		b.fail()
+		return 0
+	}
+	return int(n)
+}
+
+func (b *szBuf) size() int64 {
+	n := b.number()
+	if n > 1<<62 {
+		b.fail()
+		return 0
+	}
+	return int64(n)
+}
+
+func (b *szBuf) bits(n int) []bool {
+	v := make([]bool, n)
+	var c, mask byte
+	for i := range v {
+		if mask == 0 {
+			c, mask = b.byte(), 0x80
+		}
+		v[i] = c&mask != 0
+		mask >>= 1
+	}
+	return v
+}
+
+func (b *szBuf) defined(n int) []bool {
+	if b.byte() == 0 {
+		return b.bits(n)
+	}
+	v := make([]bool, n)
+	for i := range v {
+		v[i] = true
+	}
+	return v
+}
+
+func (b *szBuf) digests(n int) ([]bool, []uint32) {
+	defined := b.defined(n)
+	crcs := make([]uint32, n)
+	for i := range crcs {
+		if defined[i] {
+			crcs[i] = b.uint32()
+		}
+	}
+	return defined, crcs
+}
+
+func (b *szBuf) readStreams() *szStreams {
+	s := &szStreams{}
+	for b.err == nil {
+		switch b.number() {
+		case szEnd:
+			return s
+		case szPackInfo:
+			b.readPackInfo(s)
+		case szUnpackInfo:
+			b.readUnpackInfo(s)
+		case szSubStreamsInfo:
+			b.readSubStreams(s)
+		default:
+			b.fail()
+		}
+	}
+	return s
+}
+
+func (b *szBuf) readPackInfo(s *szStreams) {
+	s.packPos = b.size()
+	s.packSizes = make([]int64, b.count())
+	for b.err == nil {
+		switch b.number() {
+		case szEnd:
+			return
+		case szSize:
+			for i := range s.packSizes {
+				s.packSizes[i] = b.size()
+			}
+		case szCRC:
+			b.digests(len(s.packSizes))
+		default:
+			b.fail()
+		}
+	}
+}
+
+func (b *szBuf) readUnpackInfo(s *szStreams) {
+
+	if b.number() != szFolder {
+		b.fail()
+		return
+	}
+	s.folders = make([]*szFolderInfo, b.count())
+	if b.byte() != 0 {
+		b.err = errors.New("7z: external folders are not supported")
+		return
+	}
+	for i := range s.folders {
+		s.folders[i] = b.readFolder()
+	}
+	if b.number() != szCodersUnpackSize {
+		b.fail()
+		return
+	}
+	for _, f := range s.folders {
+		for i := range f.unpack {
+			f.unpack[i] = b.size()
+		}
+	}
+	for b.err == nil {
+		switch b.number() {
+		case szEnd:
+			// each folder keeps single file unless substreams say otherwise
+			for _, f := range s.folders {
+				f.sizes, f.crcs, f.hasCRCs = []int64{f.size()}, []uint32{f.crc}, []bool{f.hasCRC}
+			}
+			return
+		case szCRC:
+			defined, crcs := b.digests(len(s.folders))
+			for i, f := range s.folders {
+				f.hasCRC, f.crc = defined[i], crcs[i]
+			}
+		default:
+			b.fail()
+		}
+	}
+}
+
+func (b *szBuf) readFolder() *szFolderInfo {
+
+	f := &szFolderInfo{unpack: []int64{0}}
+
+	var in, out int
+	for i, n := 0, b.count(); i < n && b.err == nil; i++ {
+		flag := b.byte()
+		if flag&0x80 != 0 {
+			b.err = errors.New("7z: alternative coder methods are not supported")
+			return f
+		}
+		c := szCoder{id: string(b.bytes(uint64(flag & 0x0F)))}
+		cin, cout := 1, 1
+		if flag&0x10 != 0 {
+			cin, cout = b.count(), b.count()
+		}
+		if flag&0x20 != 0 {
+			c.props = b.bytes(b.number())
+		}
+		f.coders = append(f.coders, c)
+		in, out = in+cin, out+cout
+	}
+	if out == 0 || in < out {
+		b.fail()
+		return f
+	}
+
+	bound := make([]bool, out)
+	for i := 0; i < out-1; i++ {
+		b.number()
+		if o := b.count(); o < out {
+			bound[o] = true
+		}
+	}
+	if f.packed = in - (out - 1); f.packed > 1 {
+		for i := 0; i < f.packed; i++ {
+			b.number()
+		}
+	}
+	f.unpack = make([]int64, out)
+	for i := range bound {
+		if !bound[i] {
+			f.main = i
+			break
+		}
+	}
+	return f
+}
+
+func (b *szBuf) readSubStreams(s *szStreams) {
+
+	num := make([]int, len(s.folders))
+	for i := range num {
+		num[i] = 1
+	}
+
+	id := b.number()
+	if id == szNumUnpackStream {
+		for i := range num {
+			num[i] = b.count()
+		}
+		id = b.number()
+	}
+
+	for i, f := range s.folders {
+		f.sizes = make([]int64, num[i])
+		f.crcs = make([]uint32, num[i])
+		f.hasCRCs = make([]bool, num[i])
+		if num[i] == 0 {
+			continue
+		}
+		var sum int64
+		if id == szSize {
+			for j := 0; j < num[i]-1; j++ {
+				f.sizes[j] = b.size()
+				sum += f.sizes[j]
+			}
+		}
+		if f.sizes[num[i]-1] = f.size() - sum; f.sizes[num[i]-1] < 0 {
+			b.fail()
+			return
+		}
+		if num[i] == 1 && f.hasCRC {
+			f.crcs[0], f.hasCRCs[0] = f.crc, true
+		}
+	}
+	if id == szSize {
+		id = b.number()
+	}
+
+	for ; id != szEnd && b.err == nil; id = b.number() {
+		if id != szCRC {
+			b.fail()
+			return
+		}
+		total := 0
+		for i, f := range s.folders {
+			if num[i] != 1 || !f.hasCRC {
+				total += num[i]
+			}
+		}
+		defined, crcs := b.digests(total)
+		k := 0
+		for i, f := range s.folders {
+			if num[i] == 1 && f.hasCRC {
+				continue
+			}
+			for j := 0; j < num[i]; j++ {
+				f.hasCRCs[j], f.crcs[j] = defined[k], crcs[k]
+				k++
+			}
+		}
+	}
+}
+
+func (b *szBuf) readFiles(s *szStreams) []szEntry {
+
+	entries := make([]szEntry, b.count())
+
+	var empty, emptyFile []bool
+	for b.err == nil {
+		id := b.number()
+		if id == szEnd {
+			break
+		}
+		p := &szBuf{data: b.bytes(b.number())}
+		switch id {
+		case szEmptyStream:
+			empty = p.bits(len(entries))
+			n := 0
+			for _, e := range empty {
+				if e {
+					n++
+				}
+			}
+			// default - all empty streams are directories
+			emptyFile = make([]bool, n)
+		case szEmptyFile:
+			emptyFile = p.bits(len(emptyFile))
+		case szName:
+			if p.byte() != 0 {
+				b.err = errors.New("7z: external file names are not supported")
+				break
+			}
+			for i := range entries {
+				entries[i].name = p.utf16()
+			}
+		case szWinAttributes:
+			defined := p.defined(len(entries))
+			if p.byte() != 0 {
+				b.err = errors.New("7z: external file attributes are not supported")
+				break
+			}
+			for i := range entries {
+				if defined[i] {
+					entries[i].dir = p.uint32()&0x10 != 0
+				}
+			}
+		}
+		if p.err != nil && b.err == nil {
+			b.err = p.err
+		}
+	}
+
+	var k, folder, sub int
+	var offset int64
+	for i := range entries {
+		e := &entries[i]
+		if len(empty) > 0 && empty[i] {
+			e.folder = -1
+			e.dir = e.dir || !emptyFile[k]
+			k++
+			continue
+		}
+		for folder < len(s.folders) && sub >= len(s.folders[folder].sizes) {
+			folder, sub, offset = folder+1, 0, 0
+		}
+		if folder == len(s.folders) {
+			b.fail()
+			break
+		}
+		f := s.folders[folder]
+		e.folder, e.offset, e.size, e.crc, e.hasCRC = folder, offset, f.sizes[sub], f.crcs[sub], f.hasCRCs[sub]
+		offset += e.size
+		sub++
+	}
+	return entries
+}
+
+func (b *szBuf) utf16() string {
+	var u []uint16
+	for b.err == nil {
+		c := b.bytes(2)
+		if c == nil || c[0] == 0 && c[1] == 0 {
+			break
+		}
+		u = append(u, binary.LittleEndian.Uint16(c))
+	}
+	// archives created on Windows may keep native separators
+	return strings.ReplaceAll(string(utf16.Decode(u)), `\`, "/")
+}
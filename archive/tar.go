@@ -0,0 +1,67 @@
+package archive
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+)
+
+type tarWalker struct {
+	r      io.Reader
+	cpage  encoding.Encoding
+	closer io.Closer
+}
+
+func openTar(ra io.ReaderAt, size int64, format Format, cpage encoding.Encoding, closer io.Closer) (Walker, error) {
+
+	var (
+		r   io.Reader = bufio.NewReader(io.NewSectionReader(ra, 0, size))
+		err error
+	)
+	switch format {
+	case TarGzip:
+		if r, err = gzip.NewReader(r); err != nil {
+			return nil, err
+		}
+	case TarBzip2:
+		r = bzip2.NewReader(r)
+	}
+	return &tarWalker{r: r, cpage: cpage, closer: closer}, nil
+}
+
+func (w *tarWalker) Walk(walkFn func(file File, err error) error) error {
+
+	tr := tar.NewReader(w.r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		// old style archives have no notion of name encoding, PAX names are always UTF-8
+		raw := strings.TrimPrefix(h.Name, "./")
+		name, err := decodeName(raw, !utf8.ValidString(raw), w.cpage)
+
+		f := &streamFile{name: name, read: func() ([]byte, error) { return io.ReadAll(tr) }}
+		err = walkFn(f, err)
+		f.release()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (w *tarWalker) Close() error {
+	return closeAll(w.closer)
+}
@@ -1,33 +1,321 @@
-// Package archive builds Walk abstraction on top of "archive/zip".
+// Package archive builds Walk abstraction on top of various archive formats: zip, 7z, rar and tar (plain, gzip or
+// bzip2 compressed).
 package archive
 
 import (
-	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
 	"strings"
+
+	"github.com/h2non/filetype"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/ianaindex"
+)
+
+// Format is archive format.
+type Format int
+
+// Supported archive formats.
+const (
+	Unknown Format = iota
+	Zip
+	SevenZip
+	Tar
+	TarGzip
+	TarBzip2
+	Rar
 )
 
+// Format is recognized by file name first and then checked by content.
+var formats = []struct {
+	ext     string
+	format  Format
+	matcher string
+}{
+	{".zip", Zip, "zip"},
+	{".7z", SevenZip, "7z"},
+	{".tar", Tar, "tar"},
+	{".tar.gz", TarGzip, "gz"},
+	{".tgz", TarGzip, "gz"},
+	{".tar.bz2", TarBzip2, "bz2"},
+	{".tbz2", TarBzip2, "bz2"},
+	{".tbz", TarBzip2, "bz2"},
+	{".rar", Rar, "rar"},
+}
+
+// File is a regular file stored in archive.
+type File interface {
+	// Name returns path to the file inside archive, converted from forced code page if necessary.
+	Name() string
+	// Open returns reader for the file content.
+	Open() (io.ReadCloser, error)
+}
+
+// Walker enumerates files stored in archive of particular format.
+type Walker interface {
+	// Walk calls walkFn for each regular file in archive in the order they are stored. Files could only be opened
+	// from inside walkFn and Walk could only be called once.
+	Walk(walkFn func(file File, err error) error) error
+	// Close releases archive resources.
+	Close() error
+}
+
 // WalkFunc is the type of the function called for each file in archive
 // visited by Walk. The archive argument contains path to archive passed to Walk
-// The file argument is the zip.File structure for file in archive which satisfies
-// match condition. If an error is returned, processing stops.
-type WalkFunc func(archive string, file *zip.File) error
+// The file argument is the File for file in archive which satisfies
+// match condition. The err argument describes problem with the file: either
+// its name could not be converted from requested code page (name is left as
+// stored) or it looks like nested archive which could not be opened.
+// If an error is returned, processing stops.
+type WalkFunc func(archive string, file File, err error) error
+
+// Detect checks if file is supported archive judging by both its name and content.
+func Detect(path string) (Format, error) {
+
+	if formatByName(path) == Unknown {
+		return Unknown, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return Unknown, err
+	}
+	defer file.Close()
+
+	header := make([]byte, 262)
+	count, err := io.ReadFull(file, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return Unknown, err
+	}
+	return detect(path, header[:count]), nil
+}
+
+// Open detects archive format and returns corresponding Walker. When cpage is not nil it is used to convert non UTF-8
+// file names.
+func Open(path string, cpage encoding.Encoding) (Walker, error) {
+
+	format, err := Detect(path)
+	if err != nil {
+		return nil, err
+	}
+	if format == Unknown {
+		return nil, errors.New("unsupported archive format: " + path)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	w, err := openReader(file, fi.Size(), format, cpage, file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return w, nil
+}
 
 // Walk walks the all files in the archive which satisfy match condition,
-// calling walkFn for each item.
-func Walk(archive, pattern string, walkFn WalkFunc) error {
+// calling walkFn for each item. Archives inside archive are opened up to
+// depth levels deep, names of files inside nested archives include full
+// chain of archive names: "inner.fb2.zip/book.fb2".
+func Walk(archive, pattern string, cpage encoding.Encoding, depth int, walkFn WalkFunc) error {
 
-	r, err := zip.OpenReader(archive)
+	w, err := Open(archive, cpage)
 	if err != nil {
 		return err
 	}
-	defer r.Close()
+	defer w.Close()
+
+	return walk(archive, w, "", pattern, cpage, depth, walkFn)
+}
 
-	for _, f := range r.File {
-		if !f.FileInfo().IsDir() && strings.HasPrefix(f.FileHeader.Name, pattern) {
-			if err := walkFn(archive, f); err != nil {
-				return err
+// walk visits files of opened archive descending into nested archives.
+func walk(archive string, w Walker, prefix, pattern string, cpage encoding.Encoding, depth int, walkFn WalkFunc) error {
+
+	return w.Walk(func(f File, err error) error {
+
+		if len(prefix) > 0 {
+			f = &nestedFile{File: f, name: prefix + f.Name()}
+		}
+		name := f.Name()
+
+		if err == nil && depth > 0 && formatByName(name) != Unknown &&
+			(strings.HasPrefix(name, pattern) || strings.HasPrefix(pattern, name+"/")) {
+
+			nested, err := openNested(f, cpage)
+			if err != nil {
+				return walkFn(archive, f, fmt.Errorf("unable to open nested archive: %w", err))
+			}
+			if nested != nil {
+				defer nested.Close()
+				return walk(archive, nested, name+"/", pattern, cpage, depth-1, walkFn)
 			}
 		}
+
+		if !strings.HasPrefix(name, pattern) {
+			return nil
+		}
+		return walkFn(archive, f, err)
+	})
+}
+
+// openReader returns Walker for archive content, closer (if any) is called when walker is closed.
+func openReader(r io.ReaderAt, size int64, format Format, cpage encoding.Encoding, closer io.Closer) (Walker, error) {
+	switch format {
+	case Zip:
+		return openZip(r, size, cpage, closer)
+	case SevenZip:
+		return openSevenZip(r, size, closer)
+	case Tar, TarGzip, TarBzip2:
+		return openTar(r, size, format, cpage, closer)
+	case Rar:
+		return openRar(r, size, cpage, closer)
+	}
+	return nil, errors.New("unsupported archive format")
+}
+
+// detect checks if content header corresponds to the archive format expected from the name.
+func detect(name string, header []byte) Format {
+	format := formatByName(name)
+	for _, f := range formats {
+		if f.format == format && filetype.Is(header, f.matcher) {
+			return format
+		}
+	}
+	return Unknown
+}
+
+func formatByName(name string) Format {
+	name = strings.ToLower(name)
+	for _, f := range formats {
+		if strings.HasSuffix(name, f.ext) {
+			return f.format
+		}
+	}
+	return Unknown
+}
+
+// decodeName converts file name from forced code page when name is not in UTF-8.
+func decodeName(name string, nonUTF8 bool, cpage encoding.Encoding) (string, error) {
+	if cpage == nil || !nonUTF8 {
+		return name, nil
+	}
+	n, err := cpage.NewDecoder().String(name)
+	if err != nil {
+		charset, _ := ianaindex.IANA.Name(cpage)
+		return name, fmt.Errorf("unable to convert file name from %s: %w", charset, err)
+	}
+	return n, nil
+}
+
+// streamFile is a file from archive which could only be read sequentially. Its content is kept in memory while file
+// is being visited, so it could be opened more than once.
+type streamFile struct {
+	name string
+	read func() ([]byte, error)
+	data []byte
+}
+
+func (f *streamFile) Name() string {
+	return f.name
+}
+
+func (f *streamFile) Open() (io.ReadCloser, error) {
+	if f.data == nil {
+		if f.read == nil {
+			return nil, errors.New("archive file could not be opened outside of walk: " + f.name)
+		}
+		data, err := f.read()
+		if err != nil {
+			return nil, err
+		}
+		f.data, f.read = data, nil
+	}
+	return io.NopCloser(bytes.NewReader(f.data)), nil
+}
+
+// release drops file content when walk moves to the next file.
+func (f *streamFile) release() {
+	f.data, f.read = nil, nil
+}
+
+// nestedFile is a file from archive inside archive, its name includes names of all archives in the chain.
+type nestedFile struct {
+	File
+	name string
+}
+
+func (f *nestedFile) Name() string {
+	return f.name
+}
+
+// Nested archives larger than this are extracted to temporary files rather than kept in memory.
+const nestedMemoryLimit = 64 << 20
+
+// openNested returns Walker for archive stored in another archive or nil if file content is not an archive.
+func openNested(f File, cpage encoding.Encoding) (Walker, error) {
+
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(io.LimitReader(r, nestedMemoryLimit+1))
+	if err != nil {
+		return nil, err
+	}
+	format := detect(f.Name(), data[:min(len(data), 262)])
+	if format == Unknown {
+		return nil, nil
+	}
+	if len(data) <= nestedMemoryLimit {
+		return openReader(bytes.NewReader(data), int64(len(data)), format, cpage, nil)
+	}
+
+	tmp, err := os.CreateTemp("", "fb2c-archive.*")
+	if err != nil {
+		return nil, err
+	}
+	t := &tempFile{tmp}
+	size, err := io.Copy(tmp, io.MultiReader(bytes.NewReader(data), r))
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+	w, err := openReader(tmp, size, format, cpage, t)
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// tempFile is removed when closed.
+type tempFile struct {
+	*os.File
+}
+
+func (t *tempFile) Close() error {
+	err := t.File.Close()
+	if e := os.Remove(t.Name()); err == nil {
+		err = e
+	}
+	return err
+}
+
+// closeAll is used by walkers to release underlying archive.
+func closeAll(closer io.Closer) error {
+	if closer == nil {
+		return nil
 	}
-	return nil
+	return closer.Close()
 }
@@ -0,0 +1,435 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Archives with the same books directory made by bsdtar with LZMA, LZMA2, copy, deflate and bzip2 compression.
+var sevenZipArchives = map[string]string{
+	"lzma.7z": "N3q8ryccAAMcoSG3QAEAAAAAAAAjAAAAAAAAADhITwwAHg/LhxHYzmaRD4Meyv17M9R/6bfb46lxNDvelOgI6XSCYyvBZ+YyTyxz" +
+		"+bK7O2cYXuHW5nQN80O/IY2g7fw4ufO4yH2RsTKXxSICc3JYuU/ywHGNkWnxxTBBOiC6iidOsPLdqumLE4IwM3rJ0iPgYYQzI9dq" +
+		"4ENNQhjNXlDSr7KkmqB8vj/e/81mpWFC8yDSKs6/Psko7YJuvJRlXQeHmYg1t87FZ31/K8hA73fh20Hfrrf/0gtTNwAAgTMHrg/V" +
+		"MOrLVyTT/rN+L4mSvr482phlZ1sqDZXtjZ63g0o5v1ViP/MmNZjt4+XYZ8xxIkCo9zFnF0YVKMIPX9kwRsQtM8xW1nQI9AfqonaZ" +
+		"85GwuhRCf8Q3S30Nf7xsJ24i1F3gpodRFbe7cQTI72FP75Z3IibySgd2A7AJEpf/1YpAABcGgLkBCYCHAAcLAQABIwMBAQVdAACA" +
+		"AAyA2AoB4nOK6QAA",
+	"lzma2.7z": "N3q8ryccAAPf7tKcOgEAAAAAAAAcAAAAAAAAAECLJyHgC+kAs10AHg/LhxHYzmaRD4Meyv17M9R/6bfb46lxNDvelOgI6XSCYyvB" +
+		"Z+YyTyxz+bK7O2cYXuHW5nQN80O/IY2g7fw4ufO4yH2RsTKXxSICc3JYuU/ywHGNkWnxxTBBOiC6iidOsPLdqumLE4IwM3rJ0iPg" +
+		"YYQzI9dq4ENNQhjNXlDSr7KkmqB8vj/e/81mpWFC8yDSKs6/Psko7YJuvJRlXQeHmYg1t87FZ31/K8hA73fh2vZIGwAA4ADRAHdd" +
+		"AACBMweuD9Uw9iPXJNP+s3AWsX3Yvxyr0Qf0efpwdQTorfyW5c1t2YWG0yO3TTwZ/QeJdYp8rGUaflupkw7Cip5Mq6YWv1NIZVlW" +
+		"vuwRTuIOPtqMbvDPl+EOavkwbMa0kCoyOGgGsF/42XmnosOaZ0kif18gAAAAABcGgLsBCX8ABwsBAAEhIQEWDIDSCgEqVNzCAAA=",
+	"copy.7z": "N3q8ryccAAOsROXo6gsAAAAAAADSAAAAAAAAAEeQbgI8P3htbCB2ZXJzaW9uPSIxLjAiPz4KPEZpY3Rpb25Cb29rPlRoZSBxdWlj" +
+		"ayBicm93biBmb3gganVtcHMgb3ZlciB0aGUgbGF6eSBkb2cuIFRoZSBxdWljayBicm93biBmb3gganVtcHMgb3ZlciB0aGUgbGF6" +
+		"eSBkb2cuIFRoZSBxdWljayBicm93biBmb3gganVtcHMgb3ZlciB0aGUgbGF6eSBkb2cuIFRoZSBxdWljayBicm93biBmb3gganVt" +
+		"cHMgb3ZlciB0aGUgbGF6eSBkb2cuIFRoZSBxdWljayBicm93biBmb3gganVtcHMgb3ZlciB0aGUgbGF6eSBkb2cuIFRoZSBxdWlj" +
+		"ayBicm93biBmb3gganVtcHMgb3ZlciB0aGUgbGF6eSBkb2cuIFRoZSBxdWljayBicm93biBmb3gganVtcHMgb3ZlciB0aGUgbGF6" +
+		"eSBkb2cuIFRoZSBxdWljayBicm93biBmb3gganVtcHMgb3ZlciB0aGUgbGF6eSBkb2cuIFRoZSBxdWljayBicm93biBmb3gganVt" +
+		"cHMgb3ZlciB0aGUgbGF6eSBkb2cuIFRoZSBxdWljayBicm93biBmb3gganVtcHMgb3ZlciB0aGUgbGF6eSBkb2cuIFRoZSBxdWlj" +
+		"ayBicm93biBmb3gganVtcHMgb3ZlciB0aGUgbGF6eSBkb2cuIFRoZSBxdWljayBicm93biBmb3gganVtcHMgb3ZlciB0aGUgbGF6" +
+		"eSBkb2cuIFRoZSBxdWljayBicm93biBmb3gganVtcHMgb3ZlciB0aGUgbGF6eSBkb2cuIFRoZSBxdWljayBicm93biBmb3gganVt" +
+		"cHMgb3ZlciB0aGUgbGF6eSBkb2cuIFRoZSBxdWljayBicm93biBmb3gganVtcHMgb3ZlciB0aGUgbGF6eSBkb2cuIFRoZSBxdWlj" +
+		"ayBicm93biBmb3gganVtcHMgb3ZlciB0aGUgbGF6eSBkb2cuIFRoZSBxdWljayBicm93biBmb3gganVtcHMgb3ZlciB0aGUgbGF6" +
+		"eSBkb2cuIFRoZSBxdWljayBicm93biBmb3gganVtcHMgb3ZlciB0aGUgbGF6eSBkb2cuIFRoZSBxdWljayBicm93biBmb3gganVt" +
+		"cHMgb3ZlciB0aGUgbGF6eSBkb2cuIFRoZSBxdWljayBicm93biBmb3gganVtcHMgb3ZlciB0aGUgbGF6eSBkb2cuIFRoZSBxdWlj" +
+		"ayBicm93biBmb3gganVtcHMgb3ZlciB0aGUgbGF6eSBkb2cuIFRoZSBxdWljayBicm93biBmb3gganVtcHMgb3ZlciB0aGUgbGF6" +
+		"eSBkb2cuIFRoZSBxdWljayBicm93biBmb3gganVtcHMgb3ZlciB0aGUgbGF6eSBkb2cuIFRoZSBxdWljayBicm93biBmb3gganVt" +
+		"cHMgb3ZlciB0aGUgbGF6eSBkb2cuIFRoZSBxdWljayBicm93biBmb3gganVtcHMgb3ZlciB0aGUgbGF6eSBkb2cuIFRoZSBxdWlj" +
+		"ayBicm93biBmb3gganVtcHMgb3ZlciB0aGUgbGF6eSBkb2cuIFRoZSBxdWljayBicm93biBmb3gganVtcHMgb3ZlciB0aGUgbGF6" +
+		"eSBkb2cuIFRoZSBxdWljayBicm93biBmb3gganVtcHMgb3ZlciB0aGUgbGF6eSBkb2cuIFRoZSBxdWljayBicm93biBmb3gganVt" +
+		"cHMgb3ZlciB0aGUgbGF6eSBkb2cuIFRoZSBxdWljayBicm93biBmb3gganVtcHMgb3ZlciB0aGUgbGF6eSBkb2cuIDwvRmljdGlv" +
+		"bkJvb2s+Cjw/eG1sIHZlcnNpb249IjEuMCI/Pgo8RmljdGlvbkJvb2s+0KHRitC10YjRjCDQttC1INC10YnRkSDRjdGC0LjRhSDQ" +
+		"vNGP0LPQutC40YUg0YTRgNCw0L3RhtGD0LfRgdC60LjRhSDQsdGD0LvQvtC6LiDQodGK0LXRiNGMINC20LUg0LXRidGRINGN0YLQ" +
+		"uNGFINC80Y/Qs9C60LjRhSDRhNGA0LDQvdGG0YPQt9GB0LrQuNGFINCx0YPQu9C+0LouINCh0YrQtdGI0Ywg0LbQtSDQtdGJ0ZEg" +
+		"0Y3RgtC40YUg0LzRj9Cz0LrQuNGFINGE0YDQsNC90YbRg9C30YHQutC40YUg0LHRg9C70L7Qui4g0KHRitC10YjRjCDQttC1INC1" +
+		"0YnRkSDRjdGC0LjRhSDQvNGP0LPQutC40YUg0YTRgNCw0L3RhtGD0LfRgdC60LjRhSDQsdGD0LvQvtC6LiDQodGK0LXRiNGMINC2" +
+		"0LUg0LXRidGRINGN0YLQuNGFINC80Y/Qs9C60LjRhSDRhNGA0LDQvdGG0YPQt9GB0LrQuNGFINCx0YPQu9C+0LouINCh0YrQtdGI" +
+		"0Ywg0LbQtSDQtdGJ0ZEg0Y3RgtC40YUg0LzRj9Cz0LrQuNGFINGE0YDQsNC90YbRg9C30YHQutC40YUg0LHRg9C70L7Qui4g0KHR" +
+		"itC10YjRjCDQttC1INC10YnRkSDRjdGC0LjRhSDQvNGP0LPQutC40YUg0YTRgNCw0L3RhtGD0LfRgdC60LjRhSDQsdGD0LvQvtC6" +
+		"LiDQodGK0LXRiNGMINC20LUg0LXRidGRINGN0YLQuNGFINC80Y/Qs9C60LjRhSDRhNGA0LDQvdGG0YPQt9GB0LrQuNGFINCx0YPQ" +
+		"u9C+0LouINCh0YrQtdGI0Ywg0LbQtSDQtdGJ0ZEg0Y3RgtC40YUg0LzRj9Cz0LrQuNGFINGE0YDQsNC90YbRg9C30YHQutC40YUg" +
+		"0LHRg9C70L7Qui4g0KHRitC10YjRjCDQttC1INC10YnRkSDRjdGC0LjRhSDQvNGP0LPQutC40YUg0YTRgNCw0L3RhtGD0LfRgdC6" +
+		"0LjRhSDQsdGD0LvQvtC6LiDQodGK0LXRiNGMINC20LUg0LXRidGRINGN0YLQuNGFINC80Y/Qs9C60LjRhSDRhNGA0LDQvdGG0YPQ" +
+		"t9GB0LrQuNGFINCx0YPQu9C+0LouINCh0YrQtdGI0Ywg0LbQtSDQtdGJ0ZEg0Y3RgtC40YUg0LzRj9Cz0LrQuNGFINGE0YDQsNC9" +
+		"0YbRg9C30YHQutC40YUg0LHRg9C70L7Qui4g0KHRitC10YjRjCDQttC1INC10YnRkSDRjdGC0LjRhSDQvNGP0LPQutC40YUg0YTR" +
+		"gNCw0L3RhtGD0LfRgdC60LjRhSDQsdGD0LvQvtC6LiDQodGK0LXRiNGMINC20LUg0LXRidGRINGN0YLQuNGFINC80Y/Qs9C60LjR" +
+		"hSDRhNGA0LDQvdGG0YPQt9GB0LrQuNGFINCx0YPQu9C+0LouINCh0YrQtdGI0Ywg0LbQtSDQtdGJ0ZEg0Y3RgtC40YUg0LzRj9Cz" +
+		"0LrQuNGFINGE0YDQsNC90YbRg9C30YHQutC40YUg0LHRg9C70L7Qui4g0KHRitC10YjRjCDQttC1INC10YnRkSDRjdGC0LjRhSDQ" +
+		"vNGP0LPQutC40YUg0YTRgNCw0L3RhtGD0LfRgdC60LjRhSDQsdGD0LvQvtC6LiDQodGK0LXRiNGMINC20LUg0LXRidGRINGN0YLQ" +
+		"uNGFINC80Y/Qs9C60LjRhSDRhNGA0LDQvdGG0YPQt9GB0LrQuNGFINCx0YPQu9C+0LouINCh0YrQtdGI0Ywg0LbQtSDQtdGJ0ZEg" +
+		"0Y3RgtC40YUg0LzRj9Cz0LrQuNGFINGE0YDQsNC90YbRg9C30YHQutC40YUg0LHRg9C70L7Qui4g0KHRitC10YjRjCDQttC1INC1" +
+		"0YnRkSDRjdGC0LjRhSDQvNGP0LPQutC40YUg0YTRgNCw0L3RhtGD0LfRgdC60LjRhSDQsdGD0LvQvtC6LiDQodGK0LXRiNGMINC2" +
+		"0LUg0LXRidGRINGN0YLQuNGFINC80Y/Qs9C60LjRhSDRhNGA0LDQvdGG0YPQt9GB0LrQuNGFINCx0YPQu9C+0LouIDwvRmljdGlv" +
+		"bkJvb2s+CgEEBgACCYV4hnIABwsCAAEBAAEBAAyFeIZyAAgKAYgC6TMcOAVFAAAFAw4BIBE9AGIAbwBvAGsAcwAvAGIALgBmAGIA" +
+		"MgAAAGIAbwBvAGsAcwAvAGEALgBmAGIAMgAAAGIAbwBvAGsAcwAAABQaAQA97LsdVV3dARXjux1VXd0BFeO7HVVd3QESGgEAPey7" +
+		"HVVd3QEV47sdVV3dARXjux1VXd0BExoBABXjux1VXd0B+x67HVVd3QG7Ta4dVV3dARUOAQAggKSBIICkgRCA7UEAAA==",
+	"deflate.7z": "N3q8ryccAANCUQ95OgEAAAAAAAAiAAAAAAAAACDH/RXtlUsOwWAQx/dOMekBin1pYuEELkC9qq0PbSkr7yBEHMENiBSpxxlmbuSL" +
+		"WEg3DmB28/jNb/kfTQ8cG7qVjmuKZkZJqylFzya0vGl4cpATwsoW6hVo+6ZhQakjek2oigAavtNyQcg78OTaLg76UBY1FRhmmGGG" +
+		"GY7BWvI7UxPa79zFPa0wpAWtAc8YgqyXtAPa0BivNAO80xZPGL0bmtIQD/igOU3wQqPPGI+yveETIxXYxz72sY99/+GLfZwXAACB" +
+		"MweuD9UxByiXJNP+spd6wRPoiJGBxktOMT2HprO5X4fLXi38KtXCvCGjS6gzby1/qhyQ+oRrvSFVYStTsIHQ5KbXB8nAzCJTtQoR" +
+		"AdjoW3nnlSgPQnypmwqMtBHHwF+JT43xyU90PyxovbTxA8pCrZB7i8H/+xVwABcGgL4BCXwABwsBAAEjAwEBBV0AAIAADIDSCgHf" +
+		"twdjAAA=",
+	"bzip2.7z": "N3q8ryccAAM6SsUTpAEAAAAAAAAiAAAAAAAAAOnhnO1CWmg2MUFZJlNZPtd7rgAA8F/6ABBQAeAHkQAEAD////B/dqAAIABr32AA" +
+		"MAF2Qgc0xMBGmBGEYAAAAmEYCaqlTaEZGgGQNqNqNqemSYBMQxGmBUqmoxAA02p6g0AAADIyGTJ6nkrEHuhlh8oZYbMMkMIZIY7Q" +
+		"kPAjER7EUCMBF1cY+NJLEhS3GkpUqS4uqlhZW2eVKFuJKriSUJJyoMIZKGeqvFDLDeh9IZ4blY7FWpD7Q1azWlDcvHDRDTn3hhWx" +
+		"N2tWH1hmhrQ0obsM0MLPDUsUNitENEPLDFYUMdvw34d9JLvoki1IXvIigjCRjIwkZwi+R3EXyLBFZGAjIRZItEYyMxGIjKRkI/CM" +
+		"pFsjMSSsjII/iMxFkisisj/F3JFOFCQPtd7rgAAAgTMHrg/VOLS7FyTT/rKXes6wRDq76p94DNIb5C+/chKUfOTF0zIFPVXQBeRV" +
+		"cswqmPTpHmbynGk7rU7d+vpdo9w7uN+jh7EWIoBkpcfbu1ESNrW1T0Cgk0965nIPqvYw++Lkq4CK5HpV2t2ol5vx/OkzKZh5//pI" +
+		"0AAXBoEoAQl8AAcLAQABIwMBAQVdAACAAAyA0goBWWFxHAAA",
+}
+
+func testBooks() map[string]string {
+	return map[string]string{
+		"books/a.fb2": "<?xml version=\"1.0\"?>\n<FictionBook>" + strings.Repeat("Съешь же ещё этих мягких французских булок. ", 20) + "</FictionBook>\n",
+		"books/b.fb2": "<?xml version=\"1.0\"?>\n<FictionBook>" + strings.Repeat("The quick brown fox jumps over the lazy dog. ", 30) + "</FictionBook>\n",
+	}
+}
+
+func writeZip(t *testing.T, fname string, books map[string]string) {
+	f, err := os.Create(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	z := zip.NewWriter(f)
+	for name, content := range books {
+		w, err := z.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeTarGz(t *testing.T, fname string, books map[string]string) {
+	f, err := os.Create(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	if err := tw.WriteHeader(&tar.Header{Name: "./books/", Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range books {
+		if err := tw.WriteHeader(&tar.Header{Name: "./" + name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWalk(t *testing.T) {
+
+	dir := t.TempDir()
+	books := testBooks()
+
+	names := []string{"books.zip", "books.tar.gz", "books.rar"}
+	writeZip(t, filepath.Join(dir, names[0]), books)
+	writeTarGz(t, filepath.Join(dir, names[1]), books)
+	writeRar(t, filepath.Join(dir, names[2]), books)
+	for name, data := range sevenZipArchives {
+		buf, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), buf, 0644); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		if format, err := Detect(path); err != nil || format == Unknown {
+			t.Fatalf("%s: archive format not detected: %v", name, err)
+		}
+
+		found := make(map[string]bool)
+		err := Walk(path, "books/b", nil, 0, func(archive string, f File, err error) error {
+			if err != nil {
+				return err
+			}
+			// books are opened twice when their type is detected
+			for i := 0; i < 2; i++ {
+				r, err := f.Open()
+				if err != nil {
+					return err
+				}
+				data, err := io.ReadAll(r)
+				r.Close()
+				if err != nil {
+					return err
+				}
+				if string(data) != books[f.Name()] {
+					t.Errorf("%s: unexpected content of %s", name, f.Name())
+				}
+			}
+			found[f.Name()] = true
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(found) != 1 || !found["books/b.fb2"] {
+			t.Errorf("%s: unexpected files visited %v", name, found)
+		}
+	}
+}
+
+func TestWalkNested(t *testing.T) {
+
+	dir := t.TempDir()
+	books := testBooks()
+
+	inner := filepath.Join(dir, "books.tar.gz")
+	writeTarGz(t, inner, books)
+	data, err := os.ReadFile(inner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outer := filepath.Join(dir, "outer.zip")
+	writeZip(t, outer, map[string]string{"daily/books.tar.gz": string(data), "daily/note.txt": "not a book"})
+
+	for _, c := range []struct {
+		pattern string
+		depth   int
+		names   []string
+	}{
+		{"", 0, []string{"daily/books.tar.gz", "daily/note.txt"}},
+		{"", 1, []string{"daily/books.tar.gz/books/a.fb2", "daily/books.tar.gz/books/b.fb2", "daily/note.txt"}},
+		{"daily/books.tar.gz/books/a", 1, []string{"daily/books.tar.gz/books/a.fb2"}},
+	} {
+		var names []string
+		err := Walk(outer, c.pattern, nil, c.depth, func(archive string, f File, err error) error {
+			if err != nil {
+				return err
+			}
+			names = append(names, f.Name())
+			if content, ok := books[strings.TrimPrefix(f.Name(), "daily/books.tar.gz/")]; ok {
+				r, err := f.Open()
+				if err != nil {
+					return err
+				}
+				defer r.Close()
+				if data, err := io.ReadAll(r); err != nil || string(data) != content {
+					t.Errorf("unexpected content of %s: %v", f.Name(), err)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		slices.Sort(names)
+		if !slices.Equal(names, c.names) {
+			t.Errorf("pattern %q, depth %d: visited %v, expected %v", c.pattern, c.depth, names, c.names)
+		}
+	}
+}
+
+// readAll walks 7z archive reading content of all files.
+func readAll(data []byte) error {
+	w, err := openReader(bytes.NewReader(data), int64(len(data)), SevenZip, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	return w.Walk(func(f File, err error) error {
+		if err != nil {
+			return err
+		}
+		r, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		_, err = io.Copy(io.Discard, r)
+		return err
+	})
+}
+
+func TestSevenZipCorrupted(t *testing.T) {
+
+	for name, enc := range sevenZipArchives {
+		data, err := base64.StdEncoding.DecodeString(enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := readAll(data); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		for _, size := range []int{0, 6, 31, 32, len(data) / 2, len(data) - 1} {
+			if err := readAll(data[:size]); err == nil {
+				t.Errorf("%s: archive truncated to %d bytes was read", name, size)
+			}
+		}
+
+		// signature header (protected by its CRC) and next header (protected by CRC stored in signature header)
+		next := 32 + int(binary.LittleEndian.Uint64(data[12:]))
+		for i := range data {
+			corrupted := bytes.Clone(data)
+			corrupted[i] ^= 0x55
+			err := readAll(corrupted)
+			if err == nil && (i >= 8 && i < 32 || i >= next) {
+				t.Errorf("%s: archive with header corrupted at %d was read", name, i)
+			}
+		}
+	}
+}
+
+// rarVint appends RAR 5 variable length integer.
+func rarVint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+// rarBlock appends RAR 5 block with its CRC and size.
+func rarBlock(b, header []byte) []byte {
+	size := rarVint(nil, uint64(len(header)))
+	b = binary.LittleEndian.AppendUint32(b, crc32.ChecksumIEEE(append(slices.Clone(size), header...)))
+	return append(append(b, size...), header...)
+}
+
+// writeRar creates RAR 5 archive with files stored without compression.
+func writeRar(t *testing.T, fname string, books map[string]string) {
+
+	data := []byte("Rar!\x1a\x07\x01\x00")
+	// main archive header: type, flags, archive flags
+	data = rarBlock(data, []byte{1, 0, 0})
+	for _, name := range slices.Sorted(maps.Keys(books)) {
+		content := books[name]
+		// type, flags (has data), data size
+		h := rarVint([]byte{2, 2}, uint64(len(content)))
+		// file flags (has CRC32), unpacked size, attributes, CRC32
+		h = rarVint(append(h, 4), uint64(len(content)))
+		h = rarVint(h, 0o644)
+		h = binary.LittleEndian.AppendUint32(h, crc32.ChecksumIEEE([]byte(content)))
+		// compression (stored), host OS (unix), name
+		h = rarVint(append(h, 0, 1), uint64(len(name)))
+		h = append(h, name...)
+		data = append(rarBlock(data, h), content...)
+	}
+	// end of archive: type, flags, end flags
+	data = rarBlock(data, []byte{5, 0, 0})
+
+	if err := os.WriteFile(fname, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRar(t *testing.T) {
+
+	dir := t.TempDir()
+	books := testBooks()
+
+	path := filepath.Join(dir, "books.rar")
+	writeRar(t, path, books)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outer := filepath.Join(dir, "outer.zip")
+	writeZip(t, outer, map[string]string{"daily/books.rar": string(data)})
+
+	for _, c := range []struct {
+		archive, prefix string
+	}{
+		{path, ""},
+		{outer, "daily/books.rar/"},
+	} {
+		found := make(map[string]bool)
+		err := Walk(c.archive, "", nil, 1, func(archive string, f File, err error) error {
+			if err != nil {
+				return err
+			}
+			r, err := f.Open()
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			content, err := io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			if string(content) != books[strings.TrimPrefix(f.Name(), c.prefix)] {
+				t.Errorf("%s: unexpected content of %s", c.archive, f.Name())
+			}
+			found[f.Name()] = true
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", c.archive, err)
+		}
+		if len(found) != len(books) {
+			t.Errorf("%s: unexpected files visited %v", c.archive, found)
+		}
+	}
+
+	// content is checked against stored CRC
+	data[len(data)-20] ^= 0x55
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = Walk(path, "", nil, 0, func(archive string, f File, err error) error {
+		if err != nil {
+			return err
+		}
+		r, err := f.Open()
+		if err != nil {
+			return err
+		}
+		return r.Close()
+	})
+	if err == nil {
+		t.Error("corrupted rar archive was read")
+	}
+}
+
+func TestSevenZipSizes(t *testing.T) {
+
+	// sizes taken from crafted header are checked before anything is read
+	w := &sevenZipWalker{
+		streams: &szStreams{folders: []*szFolderInfo{{unpack: []int64{1 << 40}, sizes: []int64{1 << 40}}}},
+		folder:  -1,
+	}
+	for _, e := range []szEntry{
+		{name: "huge.fb2", size: 1 << 40},
+		{name: "outside.fb2", offset: 1 << 40, size: 1},
+		{name: "negative.fb2", size: -1},
+	} {
+		if _, err := w.read(&e); err == nil {
+			t.Errorf("%s: file was read", e.name)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package archive
+
+import (
+	"archive/zip"
+	"io"
+
+	"golang.org/x/text/encoding"
+)
+
+type zipWalker struct {
+	r      *zip.Reader
+	cpage  encoding.Encoding
+	closer io.Closer
+}
+
+type zipFile struct {
+	f    *zip.File
+	name string
+}
+
+func openZip(ra io.ReaderAt, size int64, cpage encoding.Encoding, closer io.Closer) (Walker, error) {
+	r, err := zip.NewReader(ra, size)
+	if err != nil {
+		return nil, err
+	}
+	return &zipWalker{r: r, cpage: cpage, closer: closer}, nil
+}
+
+func (w *zipWalker) Walk(walkFn func(file File, err error) error) error {
+	for _, f := range w.r.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		name, err := decodeName(f.Name, f.NonUTF8, w.cpage)
+		if err := walkFn(&zipFile{f: f, name: name}, err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *zipWalker) Close() error {
+	return closeAll(w.closer)
+}
+
+func (f *zipFile) Name() string {
+	return f.name
+}
+
+func (f *zipFile) Open() (io.ReadCloser, error) {
+	return f.f.Open()
+}
@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"time"
 
 	"github.com/pkg/profile"
 	"github.com/urfave/cli/v2"
@@ -85,6 +86,23 @@ func (w *appWrapper) beforeAppRun(c *cli.Context) error {
 }
 
 func (w *appWrapper) beforeCommandRun(c *cli.Context) error {
+	return w.prepareCommand(c, false)
+}
+
+// beforeStdoutCommandRun is used by commands which print their results to STDOUT, busy tells if it is the case for
+// particular command line. Console log is kept out of the way then.
+func (w *appWrapper) beforeStdoutCommandRun(busy func(c *cli.Context) bool) cli.BeforeFunc {
+	return func(c *cli.Context) error {
+		return w.prepareCommand(c, busy(c))
+	}
+}
+
+// stdoutAlways is for commands which always print results to STDOUT.
+func stdoutAlways(*cli.Context) bool {
+	return true
+}
+
+func (w *appWrapper) prepareCommand(c *cli.Context, stdoutBusy bool) error {
 
 	const (
 		errPrefix = "\n*** ERROR ***\n\npreparing: "
@@ -94,8 +112,8 @@ func (w *appWrapper) beforeCommandRun(c *cli.Context) error {
 
 	env := c.Generic(state.FlagName).(*state.LocalEnv)
 
-	// Prepare logs
-	env.Log, err = env.Cfg.PrepareLog(env.Rpt)
+	// Prepare logs, keep STDOUT clean when command prints results there
+	env.Log, err = env.Cfg.PrepareLog(env.Rpt, stdoutBusy)
 	if err != nil {
 		return cli.Exit(fmt.Errorf("%sunable to create logs: %w", errPrefix, err), errCode)
 	}
@@ -202,30 +220,366 @@ func main() {
 	app.Commands = []*cli.Command{
 		{
 			Name:   "convert",
-			Usage:  "Converts FB2 file(s) to specified format",
+			Usage:  "Converts FB2 and EPUB file(s) to specified format",
 			Action: commands.Convert,
-			Before: wrap.beforeCommandRun,
-			After:  wrap.afterCommandRun,
+			Before: wrap.beforeStdoutCommandRun(func(c *cli.Context) bool {
+				// converted book is streamed to STDOUT
+				return c.Args().Get(1) == "-"
+			}),
+			After: wrap.afterCommandRun,
 			Flags: []cli.Flag{
-				&cli.StringFlag{Name: "to", Value: "epub", Usage: "conversion output `TYPE` (supported types: epub, kepub, azw3, mobi)"},
+				&cli.StringFlag{Name: "to", Value: "epub", Usage: "conversion output `TYPE` (supported types: epub, epub3, kepub, azw3, mobi, fb2, fb2.zip, txt, md, html)"},
 				&cli.BoolFlag{Name: "nodirs", Aliases: []string{"nd"}, Usage: "when producing output do not keep input directory structure"},
-				&cli.BoolFlag{Name: "sendtokindle", Aliases: []string{"stk"}, Usage: "send converted file to kindle via e-mail (epub only)"},
+				&cli.BoolFlag{Name: "sendtokindle", Aliases: []string{"stk"}, Usage: "send converted file to kindle via e-mail (epub and epub3 only)"},
 				&cli.BoolFlag{Name: "overwrite", Aliases: []string{"ow"}, Usage: "continue even if destination exits, overwrite files"},
-				&cli.StringFlag{Name: "force-zip-cp", Usage: "Force `ENCODING` for ALL file names in archives (see IANA.org for character set names)"},
+				&cli.StringFlag{Name: "force-zip-cp", Usage: "Force `ENCODING` for ALL non UTF-8 file names in zip and tar archives (see IANA.org for character set names)"},
+				&cli.IntFlag{Name: "jobs", Aliases: []string{"j"}, Value: 1, DefaultText: "1", Usage: "convert up to `N` books in parallel when processing directories and archives"},
+				&cli.DurationFlag{Name: "timeout", Value: 0, DefaultText: "no limit", Usage: "abandon conversion of a single book taking longer than `DURATION`"},
+				&cli.IntFlag{Name: "archive-depth", Value: 2, DefaultText: "2", Usage: "open archives inside archives up to `LEVELS` deep (0 - do not open nested archives)"},
+				&cli.BoolFlag{Name: "cache", Usage: "keep track of converted books in DESTINATION, skip books which did not change since previous run"},
+				&cli.BoolFlag{Name: "prune", Usage: "with --cache remove converted books which sources are no longer present in SOURCE"},
 			},
 			ArgsUsage: "SOURCE [DESTINATION]",
 			CustomHelpTemplate: fmt.Sprintf(`%sSOURCE:
-    path to fb2 file(s) to process, following formats are supported:
-        path to a file: "[path_to_file]file.fb2"
+    path to fb2 or epub file(s) to process, following formats are supported:
+        path to a file: "[path_to_file]file.fb2" or "[path_to_file]file.epub"
         path to a directory: "[path_to_directory]directory" - recursively process all files under directory (symbolic links are not followed)
-        path to archive with path inside archive to a particular fb2 file: "[path_to_archive]archive.zip[path_in_archive]/file.fb2"
-        path to archive with path inside archive: "[path_to_archive]archive.zip[path_in_archive]" - recursively process all fb2 files under archive path
-
-    When working on archive recursively only fb2 files will be considered, processing of archives inside archives is not supported.
+        path to archive with path inside archive to a particular book file: "[path_to_archive]archive.zip[path_in_archive]/file.fb2"
+        path to archive with path inside archive: "[path_to_archive]archive.zip[path_in_archive]" - recursively process all book files under archive path
+        "-" - read single book from STDIN, it is named "stdin.fb2" or "stdin.epub" (for output file name and metadata overwrites)
+
+    Supported archives are zip, 7z, rar, tar, tar.gz (tgz) and tar.bz2 (tbz2). 7z archives compressed with methods other than LZMA, LZMA2,
+    deflate, bzip2 or copy are not supported, neither are multi-volume or password protected rar archives.
+    When working on archive recursively only fb2 and epub files will be considered, archives inside archives are opened up to --archive-depth
+    levels deep. Path inside archive includes names of all nested archives: "[path_to_archive]outer.zip/inner.fb2.zip/file.fb2".
+    EPUB files could only be converted to kepub, azw3 or mobi - metadata overwrites from configuration are applied to them, kepub
+    output gets Kobo spans inserted, other content is left as is.
+    azw3 is produced by built-in writer, mobi output still requires kindlegen.
 
 DESTINATION:
     always a path, output file name(s) and extension will be derived from other parameters
     if absent - current working directory
+    if "-" - resulting book is written to STDOUT (SOURCE must be a single book) and all console logging goes to STDERR
+
+When interrupted (SIGINT or SIGTERM) books being converted are abandoned, their temporary files removed and the rest of SOURCE
+is skipped - summary lists what was done. Second interrupt terminates program immediately.
+
+With --cache source hash, effective configuration and output path of every converted book are recorded in DESTINATION
+(".fb2c-cache.json"). On the next run books which did not change are skipped, changed books are converted again replacing
+their previous results. Books are tracked separately for every SOURCE and output format, --prune removes results (of the
+requested format) of books which are no longer found in SOURCE and does not touch books converted from other sources or
+into other formats. Books in directories, archives or files which could not be read are never pruned.
+`, cli.CommandHelpTemplate),
+		},
+		{
+			Name:   "watch",
+			Usage:  "Converts FB2 and EPUB file(s) as they appear in directory",
+			Action: commands.Watch,
+			Before: wrap.beforeCommandRun,
+			After:  wrap.afterCommandRun,
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "to", Value: "epub", Usage: "conversion output `TYPE` (supported types: epub, epub3, kepub, azw3, mobi, fb2, fb2.zip, txt, md, html)"},
+				&cli.BoolFlag{Name: "nodirs", Aliases: []string{"nd"}, Usage: "when producing output do not keep input directory structure"},
+				&cli.BoolFlag{Name: "overwrite", Aliases: []string{"ow"}, Usage: "continue even if destination exits, overwrite files"},
+				&cli.StringFlag{Name: "force-zip-cp", Usage: "Force `ENCODING` for ALL non UTF-8 file names in zip and tar archives (see IANA.org for character set names)"},
+				&cli.IntFlag{Name: "jobs", Aliases: []string{"j"}, Value: 1, DefaultText: "1", Usage: "convert up to `N` books in parallel when processing archives"},
+				&cli.DurationFlag{Name: "timeout", Value: 0, DefaultText: "no limit", Usage: "abandon conversion of a single book taking longer than `DURATION`"},
+				&cli.IntFlag{Name: "archive-depth", Value: 2, DefaultText: "2", Usage: "open archives inside archives up to `LEVELS` deep (0 - do not open nested archives)"},
+				&cli.DurationFlag{Name: "delay", Value: 2 * time.Second, DefaultText: "2s", Usage: "start conversion when file was not changed for `DURATION`"},
+				&cli.StringFlag{Name: "done", Usage: "move successfully converted files to `DIRECTORY`"},
+				&cli.StringFlag{Name: "failed", Usage: "move files which could not be converted to `DIRECTORY`"},
+				&cli.BoolFlag{Name: "existing", Usage: "convert files already present in SOURCE_DIR on start"},
+			},
+			ArgsUsage: "SOURCE_DIR DEST_DIR",
+			CustomHelpTemplate: fmt.Sprintf(`%s
+SOURCE_DIR:
+    directory to watch (with all subdirectories), fb2, epub and archive files (same as supported by "convert") created or changed
+    there are converted, results of files changed in place replace previous ones even without --overwrite
+DEST_DIR:
+    directory for converted books, source directory structure is kept unless --nodirs is specified
+
+Runs until interrupted (SIGINT or SIGTERM). Files are converted after they were not changed for --delay, so books which are still
+being copied are not picked up. When --done or --failed are specified original files are moved there (keeping their path relative
+to SOURCE_DIR) after conversion. Destination, done and failed directories are created when necessary and are not watched even if
+they are inside SOURCE_DIR.
+`, cli.CommandHelpTemplate),
+		},
+		{
+			Name:   "serve",
+			Usage:  "Runs HTTP server converting uploaded books",
+			Action: commands.Serve,
+			Before: wrap.beforeCommandRun,
+			After:  wrap.afterCommandRun,
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "listen", Value: "localhost:8080", DefaultText: "localhost:8080", Usage: "listen on `ADDRESS`"},
+				&cli.IntFlag{Name: "jobs", Aliases: []string{"j"}, Value: 1, DefaultText: "1", Usage: "convert up to `N` books in parallel, other requests wait for their turn"},
+				&cli.DurationFlag{Name: "timeout", Value: 0, DefaultText: "no limit", Usage: "abandon conversion of a single book taking longer than `DURATION`"},
+				&cli.IntFlag{Name: "max-size", Value: 64, DefaultText: "64", Usage: "maximum size of uploaded file in `MB`"},
+				&cli.DurationFlag{Name: "keep", Value: time.Hour, DefaultText: "1h", Usage: "keep results of asynchronous conversions for `DURATION`"},
+				&cli.IntFlag{Name: "archive-depth", Value: 2, DefaultText: "2", Usage: "open archives inside archives up to `LEVELS` deep (0 - do not open nested archives)"},
+			},
+			CustomHelpTemplate: fmt.Sprintf(`%s
+Runs until interrupted (SIGINT or SIGTERM). Endpoints:
+
+    GET    /api/health              server status
+    GET    /api/formats             supported output formats
+    POST   /api/convert             convert book, following query parameters are recognized:
+                                        to    - output format (epub by default)
+                                        name  - file name of the book when it is sent as request body
+                                        async - when "true" job is returned immediately instead of converted book
+                                        config - JSON configuration fragment applied on top of server configuration,
+                                                 could be sent as multipart form field as well
+                                    book is sent either as request body or as "file" field of multipart form,
+                                    fb2, epub or archive with single book are accepted
+    GET    /api/jobs/{id}           status of asynchronous conversion
+    GET    /api/jobs/{id}/result    converted book
+    DELETE /api/jobs/{id}           remove job and its results, conversion in progress is abandoned
+
+Every book is converted in its own temporary directory with the same configuration used for "convert" command, adjusted
+by request "config" if present ("overwrites" for uploaded book are matched by its name). Request cannot set options naming
+files on server (style, cover and vignette images, fonts, kindlegen, logs, output file name format), such requests are
+rejected.
+Conversions in progress are abandoned when server is stopping.
+`, cli.CommandHelpTemplate),
+		},
+		{
+			Name:   "validate",
+			Usage:  "Checks FB2 file(s) against FictionBook 2.x schema",
+			Action: commands.Validate,
+			Before: wrap.beforeStdoutCommandRun(stdoutAlways),
+			After:  wrap.afterCommandRun,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{Name: "json", Usage: "report results as JSON, one line per book"},
+				&cli.StringFlag{Name: "force-zip-cp", Usage: "Force `ENCODING` for ALL non UTF-8 file names in zip and tar archives (see IANA.org for character set names)"},
+				&cli.IntFlag{Name: "archive-depth", Value: 2, DefaultText: "2", Usage: "open archives inside archives up to `LEVELS` deep (0 - do not open nested archives)"},
+			},
+			ArgsUsage: "SOURCE",
+			CustomHelpTemplate: fmt.Sprintf(`%s
+SOURCE:
+    path to fb2 file(s) to check, has the same meaning as for "convert" command (files, directories, archives and "-" for STDIN)
+
+Reports structural problems which would make conversion worse: unknown elements, missing description or title-info, dangling
+internal links, images without binaries, binaries which are never referenced or are not valid base64. Results are written to
+STDOUT (all logging goes to STDERR), exit code is not zero when errors were found in any book. EPUB files are skipped.
+`, cli.CommandHelpTemplate),
+		},
+		{
+			Name:   "info",
+			Usage:  "Prints FB2 book(s) metadata without converting",
+			Action: commands.Info,
+			Before: wrap.beforeStdoutCommandRun(stdoutAlways),
+			After:  wrap.afterCommandRun,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{Name: "csv", Usage: "print CSV with header line instead of JSON lines"},
+				&cli.StringFlag{Name: "force-zip-cp", Usage: "Force `ENCODING` for ALL non UTF-8 file names in zip and tar archives (see IANA.org for character set names)"},
+				&cli.IntFlag{Name: "archive-depth", Value: 2, DefaultText: "2", Usage: "open archives inside archives up to `LEVELS` deep (0 - do not open nested archives)"},
+			},
+			ArgsUsage: "SOURCE",
+			CustomHelpTemplate: fmt.Sprintf(`%s
+SOURCE:
+    path to fb2 file(s), has the same meaning as for "convert" command (files, directories, archives and "-" for STDIN)
+
+Prints title, authors, sequence, genres, language, ID, date, annotation, cover presence and number of images for every book as
+conversion would see them - metadata overwrites from configuration are applied. Only book description is processed, nothing
+is written to disk. Results are written to STDOUT (all logging goes to STDERR). EPUB files are skipped.
+`, cli.CommandHelpTemplate),
+		},
+		{
+			Name:   "stats",
+			Usage:  "Collects content statistics for FB2 book(s) without converting",
+			Action: commands.Stats,
+			Before: wrap.beforeStdoutCommandRun(stdoutAlways),
+			After:  wrap.afterCommandRun,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{Name: "json", Usage: "print JSON report instead of text table"},
+				&cli.IntFlag{Name: "jobs", Aliases: []string{"j"}, Value: 1, DefaultText: "1", Usage: "process up to `N` books in parallel when processing directories and archives"},
+				&cli.StringFlag{Name: "force-zip-cp", Usage: "Force `ENCODING` for ALL non UTF-8 file names in zip and tar archives (see IANA.org for character set names)"},
+				&cli.IntFlag{Name: "archive-depth", Value: 2, DefaultText: "2", Usage: "open archives inside archives up to `LEVELS` deep (0 - do not open nested archives)"},
+			},
+			ArgsUsage: "SOURCE",
+			CustomHelpTemplate: fmt.Sprintf(`%s
+SOURCE:
+    path to fb2 file(s), has the same meaning as for "convert" command (files, directories, archives and "-" for STDIN)
+
+For every book counts characters and words of the main text, estimates pages (using "characters_per_page" from
+configuration), counts notes in every notes body, images and their total size, broken images, reports language, declared
+encoding and BOM presence and whether conversion would have to use default cover (book has no usable cover image).
+Library totals follow. Results are written to STDOUT (all logging goes to STDERR). EPUB files are skipped.
+`, cli.CommandHelpTemplate),
+		},
+		{
+			Name:   "dedupe",
+			Usage:  "Finds duplicate FB2 books",
+			Action: commands.Dedupe,
+			Before: wrap.beforeStdoutCommandRun(stdoutAlways),
+			After:  wrap.afterCommandRun,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{Name: "json", Usage: "print JSON report instead of text"},
+				&cli.Float64Flag{Name: "similarity", Value: 0.8, DefaultText: "0.8", Usage: "treat books as duplicates when `FRACTION` of their text is the same"},
+				&cli.StringFlag{Name: "quarantine", Usage: "move all but the best book of every group to `DIRECTORY`"},
+				&cli.IntFlag{Name: "jobs", Aliases: []string{"j"}, Value: 1, DefaultText: "1", Usage: "process up to `N` books in parallel when processing directories and archives"},
+				&cli.StringFlag{Name: "force-zip-cp", Usage: "Force `ENCODING` for ALL non UTF-8 file names in zip and tar archives (see IANA.org for character set names)"},
+				&cli.IntFlag{Name: "archive-depth", Value: 2, DefaultText: "2", Usage: "open archives inside archives up to `LEVELS` deep (0 - do not open nested archives)"},
+			},
+			ArgsUsage: "SOURCE",
+			CustomHelpTemplate: fmt.Sprintf(`%s
+SOURCE:
+    path to fb2 file(s), has the same meaning as for "convert" command (files, directories, archives and "-" for STDIN)
+
+Books are put into the same group when they have the same document-info/id (as conversion would use it, including UUID
+derived from non UUID identifiers), the same authors, title and sequence (compared ignoring case and punctuation) or
+when most of their main text is the same (estimated with MinHash of word shingles, see --similarity). Best book in the
+group is the largest one, the newest document-info/version wins among books of the same size, it is marked with "*".
+
+With --quarantine all other books of the group are moved into DIRECTORY keeping their path relative to SOURCE. Books
+inside archives are reported, but never moved. Keep DIRECTORY outside of SOURCE. Results are written to STDOUT (all
+logging goes to STDERR). EPUB files are skipped.
+`, cli.CommandHelpTemplate),
+		},
+		{
+			Name:   "meta",
+			Usage:  "Reads or changes description of FB2 book in place",
+			Before: wrap.beforeStdoutCommandRun(stdoutAlways),
+			After:  wrap.afterCommandRun,
+			Subcommands: []*cli.Command{
+				{
+					Name:      "get",
+					Usage:     "Prints FB2 book description as JSON",
+					Action:    commands.MetaGet,
+					ArgsUsage: "SOURCE",
+					CustomHelpTemplate: fmt.Sprintf(`%s
+SOURCE:
+    path to fb2 file, zip archive with single fb2 book or path to fb2 book inside zip archive
+
+Prints book description in the same form "meta" section of configuration overwrites uses, so result could be edited and
+passed back to "meta set --from". Results are written to STDOUT (all logging goes to STDERR).
+`, cli.CommandHelpTemplate),
+				},
+				{
+					Name:   "set",
+					Usage:  "Changes FB2 book description",
+					Action: commands.MetaSet,
+					Flags: []cli.Flag{
+						&cli.StringFlag{Name: "from", Usage: "read meta information from JSON `FILE` (\"-\" for STDIN), other flags take precedence"},
+						&cli.StringFlag{Name: "title", Usage: "book `TITLE`"},
+						&cli.StringSliceFlag{Name: "author", Usage: "book `AUTHOR` as \"First [Middle] Last\", could be repeated"},
+						&cli.StringSliceFlag{Name: "genre", Usage: "book `GENRE`, could be repeated"},
+						&cli.StringFlag{Name: "lang", Usage: "book `LANGUAGE`"},
+						&cli.StringFlag{Name: "id", Usage: "document `UUID`"},
+						&cli.StringFlag{Name: "sequence", Usage: "book sequence `NAME`"},
+						&cli.IntFlag{Name: "sequence-number", Usage: "book `NUMBER` in sequence"},
+						&cli.StringFlag{Name: "date", Usage: "book `DATE`"},
+						&cli.StringFlag{Name: "annotation", Usage: "book `ANNOTATION`, every line becomes separate paragraph"},
+						&cli.StringFlag{Name: "cover", Usage: "replace cover with image from `FILE`"},
+						&cli.BoolFlag{Name: "remove-cover", Usage: "remove cover image"},
+					},
+					ArgsUsage: "SOURCE",
+					CustomHelpTemplate: fmt.Sprintf(`%s
+SOURCE:
+    path to fb2 file, zip archive with single fb2 book or path to fb2 book inside zip archive
+
+Changes book description following the same rules as "meta" section of configuration overwrites. Only description (and cover
+image when it is replaced) is rewritten, the rest of the document is preserved as is. Books in zip archives are updated by
+rewriting the archive, other archive entries are copied unchanged.
+`, cli.CommandHelpTemplate),
+				},
+			},
+		},
+		{
+			Name:   "split",
+			Usage:  "Splits omnibus FB2 book into separate books",
+			Action: commands.Split,
+			Before: wrap.beforeCommandRun,
+			After:  wrap.afterCommandRun,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{Name: "overwrite", Aliases: []string{"ow"}, Usage: "overwrite existing files"},
+			},
+			ArgsUsage: "SOURCE [DESTINATION]",
+			CustomHelpTemplate: fmt.Sprintf(`%s
+SOURCE:
+    path to fb2 file, zip archive with single fb2 book or path to fb2 book inside zip archive
+
+DESTINATION:
+    always path to directory, where parts are written, by default directory of SOURCE
+
+Every top level section of the main body becomes separate book named "SOURCE - N.fb2". Part is titled after its section,
+gets number N in sequence named after book sequence (or book itself when it does not belong to any) and new document
+id, keeps only notes and binaries it uses. Text is never changed.
+`, cli.CommandHelpTemplate),
+		},
+		{
+			Name:   "merge",
+			Usage:  "Merges FB2 books into one",
+			Action: commands.Merge,
+			Before: wrap.beforeCommandRun,
+			After:  wrap.afterCommandRun,
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "title", Usage: "`TITLE` of the merged book (by default name of the sequence books belong to)"},
+				&cli.BoolFlag{Name: "by-sequence", Usage: "order books by their number in sequence rather than as specified"},
+				&cli.BoolFlag{Name: "overwrite", Aliases: []string{"ow"}, Usage: "overwrite existing file"},
+			},
+			ArgsUsage: "SOURCE... DESTINATION",
+			CustomHelpTemplate: fmt.Sprintf(`%s
+SOURCE:
+    path to fb2 file, zip archive with single fb2 book or path to fb2 book inside zip archive, at least two are required
+
+DESTINATION:
+    path to resulting fb2 file
+
+Every book becomes top level section of the merged book (so its TOC lists all books), notes are collected into single
+notes body and renumbered, identical binaries are stored once. Description is taken from the first book with authors and
+genres of all books added, sequence and annotation removed.
+`, cli.CommandHelpTemplate),
+		},
+		{
+			Name:   "opds",
+			Usage:  "Creates static OPDS catalog for converted books",
+			Action: commands.Opds,
+			Before: wrap.beforeCommandRun,
+			After:  wrap.afterCommandRun,
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "title", Value: "Library", DefaultText: "Library", Usage: "catalog `TITLE`"},
+				&cli.StringFlag{Name: "catalog", Value: "opds", DefaultText: "opds", Usage: "write catalog to `DIRECTORY` inside LIBRARY"},
+				&cli.BoolFlag{Name: "nodirs", Aliases: []string{"nd"}, Usage: "books were converted without keeping input directory structure"},
+				&cli.IntFlag{Name: "new", Value: 50, DefaultText: "50", Usage: "put `N` most recently converted books into new books feed"},
+				&cli.IntFlag{Name: "width", Value: 330, DefaultText: "330", Usage: "width of the cover thumbnail"},
+				&cli.IntFlag{Name: "height", Value: 470, DefaultText: "470", Usage: "height of the cover thumbnail"},
+				&cli.StringFlag{Name: "force-zip-cp", Usage: "Force `ENCODING` for ALL non UTF-8 file names in zip and tar archives (see IANA.org for character set names)"},
+				&cli.IntFlag{Name: "archive-depth", Value: 2, DefaultText: "2", Usage: "open archives inside archives up to `LEVELS` deep (0 - do not open nested archives)"},
+			},
+			ArgsUsage: "SOURCE LIBRARY",
+			CustomHelpTemplate: fmt.Sprintf(`%s
+SOURCE:
+    path to fb2 file(s) books were converted from, has the same meaning as for "convert" command
+LIBRARY:
+    directory conversion results were written to (DESTINATION of "convert" command)
+
+Book metadata is read from sources (metadata overwrites from configuration are applied) and conversion results are located
+using the same naming rules conversion uses, so configuration and --nodirs must match ones used for conversion. Books without
+conversion results are not included, fb2 sources found inside LIBRARY are offered for download as well.
+OPDS 1.2 feeds (by author, by series, by genre and new books) together with covers and thumbnails are written to catalog
+directory inside LIBRARY, catalog root is "index.xml". Serve LIBRARY with any static web server.
+`, cli.CommandHelpTemplate),
+		},
+		{
+			Name:   "unpack",
+			Usage:  "Dumps Kindle book structure for debugging",
+			Action: commands.Unpack,
+			Before: wrap.beforeCommandRun,
+			After:  wrap.afterCommandRun,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{Name: "overwrite", Aliases: []string{"ow"}, Usage: "replace previously unpacked book in DESTINATION"},
+			},
+			ArgsUsage: "SOURCE DESTINATION",
+			CustomHelpTemplate: fmt.Sprintf(`%s
+SOURCE:
+    mobi or azw3 file
+DESTINATION:
+    directory to unpack book into, created if necessary
+
+Writes "book.json" (PDB records, headers of mobi7 and KF8 parts, EXTH records including ASIN (113), CDE content key (504),
+cdetype (501) and cover offsets), raw PDB records, images and fonts, mobi7 text and KF8 text reassembled into parts
+together with CSS and SVG flows. Encrypted and HUFF/CDIC compressed books are unpacked without text.
 `, cli.CommandHelpTemplate),
 		},
 		{
@@ -0,0 +1,228 @@
+package commands
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"fb2converter/misc"
+	"fb2converter/processor"
+	"fb2converter/state"
+)
+
+// cacheName is name of conversion cache file in destination directory.
+const cacheName = ".fb2c-cache.json"
+
+// cacheEntry describes last successful conversion of a book.
+type cacheEntry struct {
+	// hash of the book content
+	Source string `json:"source_hash"`
+	// hash of effective configuration and program version
+	Settings string `json:"settings_hash"`
+	// path relative to destination directory
+	Output string `json:"output"`
+}
+
+// convCache remembers results of previous conversions into the same destination, so books which did not change since
+// could be skipped. Books are identified by their source path as seen by processBook, separately for every source root
+// and output format, so different sources could be converted into the same destination in more than one format.
+type convCache struct {
+	fname    string
+	dst      string
+	format   string
+	settings string
+
+	mu sync.Mutex
+	// all known conversions by absolute source root, source path and output format
+	roots map[string]map[string]map[string]*cacheEntry
+	// conversions from the source processed by this run
+	books map[string]map[string]*cacheEntry
+	// books visited during this run
+	seen map[string]bool
+}
+
+func hashOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// loadCache reads conversion cache from destination directory, missing cache is not an error. Root is absolute source
+// path books are taken from, format is output format of this run. Settings affecting conversion results are passed in
+// so their changes make all cached results obsolete.
+func loadCache(dst, root string, format processor.OutputFmt, settings ...[]byte) (*convCache, error) {
+
+	c := &convCache{
+		fname:    filepath.Join(dst, cacheName),
+		dst:      dst,
+		format:   format.String(),
+		settings: hashOf(bytes.Join(append(settings, []byte(misc.GetVersion()+misc.GetGitHash())), []byte{0})),
+		roots:    make(map[string]map[string]map[string]*cacheEntry),
+		seen:     make(map[string]bool),
+	}
+
+	data, err := os.ReadFile(c.fname)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("unable to read conversion cache: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &c.roots); err != nil {
+			return nil, fmt.Errorf("unable to parse conversion cache (%s): %w", c.fname, err)
+		}
+	}
+	if c.books = c.roots[root]; c.books == nil {
+		c.books = make(map[string]map[string]*cacheEntry)
+		c.roots[root] = c.books
+	}
+	return c, nil
+}
+
+// process converts book unless result of its previous conversion is still valid. Book which was converted before is
+// always overwritten, its old result is removed when output name has changed.
+func (c *convCache) process(r io.Reader, t *bookTask, overwrite bool, env *state.LocalEnv,
+	convert func(r io.Reader, overwrite bool) (string, error)) error {
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("unable to read book: %w", err)
+	}
+	hash := hashOf(data)
+
+	c.mu.Lock()
+	c.seen[t.src] = true
+	old := c.books[t.src][c.format]
+	c.mu.Unlock()
+
+	if old != nil {
+		if old.Source == hash && old.Settings == c.settings {
+			if _, err := os.Stat(filepath.Join(c.dst, old.Output)); err == nil {
+				env.Log.Info("Book did not change since last conversion, skipping", zap.String("from", t.src), zap.String("to", old.Output))
+				return nil
+			}
+		}
+		overwrite = true
+	}
+
+	fname, err := convert(bytes.NewReader(data), overwrite)
+	if err != nil {
+		return err
+	}
+	if len(fname) == 0 {
+		// nothing was written to destination, so there is nothing to remember
+		return nil
+	}
+
+	out, err := filepath.Rel(c.dst, fname)
+	if err != nil {
+		return fmt.Errorf("unable to remember conversion result: %w", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.books[t.src] == nil {
+		c.books[t.src] = make(map[string]*cacheEntry)
+	}
+	c.books[t.src][c.format] = &cacheEntry{Source: hash, Settings: c.settings, Output: out}
+	if old != nil && old.Output != out {
+		c.remove(old.Output, env)
+	}
+	return nil
+}
+
+// prune removes results of conversions into the format of this run for books which were not seen during it. Unread are
+// sources (directories, archives, files) which could not be read this time, books inside them are kept.
+func (c *convCache) prune(unread []string, env *state.LocalEnv) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for src, formats := range c.books {
+		e := formats[c.format]
+		if e == nil || c.seen[src] || insideOf(src, unread) {
+			continue
+		}
+		env.Log.Info("Book source is gone, removing its conversion result", zap.String("from", src), zap.String("to", e.Output))
+		delete(formats, c.format)
+		if len(formats) == 0 {
+			delete(c.books, src)
+		}
+		c.remove(e.Output, env)
+	}
+}
+
+// insideOf checks if source path is one of the paths or is located under one of them, empty path is the whole source.
+// Books from archives have their paths starting with separator, so it is ignored.
+func insideOf(src string, paths []string) bool {
+
+	sep := string(filepath.Separator)
+	src = strings.TrimPrefix(src, sep)
+	for _, p := range paths {
+		p = strings.Trim(p, sep)
+		if len(p) == 0 || src == p || strings.HasPrefix(src, p+sep) {
+			return true
+		}
+	}
+	return false
+}
+
+// remove deletes obsolete conversion result unless it is used by another book, should be called under lock.
+func (c *convCache) remove(out string, env *state.LocalEnv) {
+
+	for _, books := range c.roots {
+		for _, formats := range books {
+			for _, e := range formats {
+				if e.Output == out {
+					return
+				}
+			}
+		}
+	}
+	fname := filepath.Join(c.dst, out)
+	if err := os.Remove(fname); err != nil && !errors.Is(err, os.ErrNotExist) {
+		env.Log.Warn("Unable to remove obsolete conversion result", zap.String("file", out), zap.Error(err))
+	}
+	// page map which may accompany Kindle book, next to it or in its .sdr directory
+	base := strings.TrimSuffix(fname, filepath.Ext(fname))
+	os.Remove(base + ".apnx")
+	os.Remove(filepath.Join(base+".sdr", filepath.Base(base)+".apnx"))
+	os.Remove(base + ".sdr")
+}
+
+// save writes conversion cache back to destination directory.
+func (c *convCache) save() error {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for root, books := range c.roots {
+		if len(books) == 0 {
+			// everything was pruned
+			delete(c.roots, root)
+		}
+	}
+	data, err := json.MarshalIndent(c.roots, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to prepare conversion cache: %w", err)
+	}
+	if err := os.MkdirAll(c.dst, 0755); err != nil {
+		return fmt.Errorf("unable to create destination directory: %w", err)
+	}
+	// replace cache atomically, so interrupted write would not lose results of previous runs
+	tmp := c.fname + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("unable to write conversion cache: %w", err)
+	}
+	if err := os.Rename(tmp, c.fname); err != nil {
+		return fmt.Errorf("unable to write conversion cache: %w", err)
+	}
+	return nil
+}
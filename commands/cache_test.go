@@ -0,0 +1,139 @@
+package commands
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"fb2converter/processor"
+	"fb2converter/state"
+)
+
+func TestConvCache(t *testing.T) {
+
+	dst := t.TempDir()
+	env := &state.LocalEnv{Log: zap.NewNop()}
+
+	// fake conversion writes book content to destination, output name follows source root and name
+	var converted []string
+	convert := func(root, src string, format processor.OutputFmt) func(r io.Reader, overwrite bool) (string, error) {
+		return func(r io.Reader, overwrite bool) (string, error) {
+			fname := filepath.Join(dst, filepath.Base(root)+"-"+strings.TrimSuffix(src, ".fb2")+"."+format.String())
+			if _, err := os.Stat(fname); err == nil && !overwrite {
+				return "", os.ErrExist
+			}
+			data, _ := io.ReadAll(r)
+			if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+				return "", err
+			}
+			if err := os.WriteFile(fname, data, 0644); err != nil {
+				return "", err
+			}
+			converted = append(converted, src)
+			return fname, nil
+		}
+	}
+
+	runFormat := func(root, settings string, format processor.OutputFmt, books map[string]string, prune bool, unread ...string) []string {
+		t.Helper()
+		converted = nil
+		c, err := loadCache(dst, root, format, []byte(settings))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for src, content := range books {
+			task := &bookTask{src: src}
+			if err := c.process(strings.NewReader(content), task, false, env, convert(root, src, format)); err != nil {
+				t.Fatalf("%s: %v", src, err)
+			}
+		}
+		if prune {
+			c.prune(unread, env)
+		}
+		if err := c.save(); err != nil {
+			t.Fatal(err)
+		}
+		return converted
+	}
+	run := func(root, settings string, books map[string]string, prune bool, unread ...string) []string {
+		t.Helper()
+		return runFormat(root, settings, processor.OEpub, books, prune, unread...)
+	}
+
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(dst, name))
+		return err == nil
+	}
+
+	if got := run("/lib", "cfg", map[string]string{"a.fb2": "a", "b.fb2": "b"}, false); len(got) != 2 {
+		t.Errorf("first run should convert everything, converted %v", got)
+	}
+	if got := run("/lib", "cfg", map[string]string{"a.fb2": "a", "b.fb2": "b"}, false); len(got) != 0 {
+		t.Errorf("unchanged books should be skipped, converted %v", got)
+	}
+	if got := run("/lib", "cfg", map[string]string{"a.fb2": "a", "b.fb2": "changed"}, false); len(got) != 1 || got[0] != "b.fb2" {
+		t.Errorf("only changed book should be converted, converted %v", got)
+	}
+	if got := run("/lib", "other", map[string]string{"a.fb2": "a", "b.fb2": "changed"}, false); len(got) != 2 {
+		t.Errorf("settings change should invalidate all books, converted %v", got)
+	}
+
+	// books with the same relative path from another source are not confused with ours
+	if got := run("/other", "other", map[string]string{"c.fb2": "c", "a.fb2": "a"}, false); len(got) != 2 {
+		t.Errorf("books from another source should be converted, converted %v", got)
+	}
+	if got := run("/lib", "other", map[string]string{"a.fb2": "a"}, true); len(got) != 0 {
+		t.Errorf("unchanged book should be skipped, converted %v", got)
+	}
+	if exists("lib-b.epub") {
+		t.Error("result of removed book was not pruned")
+	}
+	if !exists("lib-a.epub") || !exists("other-a.epub") || !exists("other-c.epub") {
+		t.Error("results of present books or books from another source were pruned")
+	}
+	if got := run("/other", "other", map[string]string{"c.fb2": "c", "a.fb2": "a"}, false); len(got) != 0 {
+		t.Errorf("prune should not affect another source, converted %v", got)
+	}
+
+	// the same books converted into another format do not replace or prune results of the first one
+	if got := runFormat("/lib", "other", processor.OAzw3, map[string]string{"a.fb2": "a"}, false); len(got) != 1 {
+		t.Errorf("book should be converted into new format, converted %v", got)
+	}
+	if got := run("/lib", "other", map[string]string{"a.fb2": "a"}, true); len(got) != 0 {
+		t.Errorf("book converted into another format should be skipped, converted %v", got)
+	}
+	if got := runFormat("/lib", "other", processor.OAzw3, map[string]string{}, true); len(got) != 0 {
+		t.Errorf("nothing should be converted, converted %v", got)
+	}
+	if !exists("lib-a.epub") || exists("lib-a.azw3") {
+		t.Error("prune of one format should only remove results of this format")
+	}
+
+	// books which could not be read are not pruned
+	if got := run("/lib", "other", map[string]string{"sub/e.fb2": "e", "sub/f.fb2": "f"}, false); len(got) != 2 {
+		t.Errorf("new books should be converted, converted %v", got)
+	}
+	if got := run("/lib", "other", map[string]string{"a.fb2": "a"}, true, "sub"); len(got) != 0 {
+		t.Errorf("unchanged book should be skipped, converted %v", got)
+	}
+	if !exists("lib-sub/e.epub") || !exists("lib-sub/f.epub") {
+		t.Error("books from unreadable directory were pruned")
+	}
+
+	// conversion without result is not remembered
+	c, err := loadCache(dst, "/lib", processor.OEpub, []byte("other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nothing := func(io.Reader, bool) (string, error) { return "", nil }
+	if err := c.process(strings.NewReader("d"), &bookTask{src: "d.fb2"}, false, env, nothing); err != nil {
+		t.Errorf("conversion without result: %v", err)
+	}
+	if _, ok := c.books["d.fb2"]; ok {
+		t.Error("conversion without result was remembered")
+	}
+}
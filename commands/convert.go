@@ -2,15 +2,18 @@
 package commands
 
 import (
-	"archive/zip"
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"math"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime/debug"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/urfave/cli/v2"
@@ -24,46 +27,58 @@ import (
 	"fb2converter/state"
 )
 
-// processBook processes single FB2 file. "src" is part of the source path (always including file name) relative to the original
+// processBook processes single FB2 or EPUB file. "src" is part of the source path (always including file name) relative to the original
 // path. When actual file was specified it will be just base file name without a path. When looking inside archive or directory
-// it will be relative path inside archive or directory (including base file name).
-func processBook(r io.Reader, enc srcEncoding, src, dst string, nodirs, stk, overwrite bool, format processor.OutputFmt, env *state.LocalEnv) error {
+// it will be relative path inside archive or directory (including base file name). Path to the resulting file is returned.
+// When context is canceled conversion stops and all temporary files are removed.
+func processBook(ctx context.Context, r io.Reader, kind processor.InputFmt, enc processor.SrcEncoding, src, dst string, nodirs, stk, overwrite bool, format processor.OutputFmt, env *state.LocalEnv) (fname string, err error) {
 
-	var fname, id string
+	var id string
 
 	env.Log.Info("Conversion starting", zap.String("from", src))
 	defer func(start time.Time) {
 		if r := recover(); r != nil {
+			// book must be accounted for as failed
+			fname, err = "", fmt.Errorf("panic: %v", r)
 			env.Log.Error("Conversion ended with panic", zap.Any("panic", r), zap.Duration("elapsed", time.Since(start)), zap.String("to", fname), zap.ByteString("stack", debug.Stack()))
 		} else {
 			env.Log.Info("Conversion completed", zap.Duration("elapsed", time.Since(start)), zap.String("to", fname), zap.String("ref_id", id))
 		}
 	}(time.Now())
 
-	p, err := processor.NewFB2(selectReader(r, enc), enc == encUnknown, src, dst, nodirs, stk, overwrite, format, env)
+	var p *processor.Processor
+	if kind == processor.InEpub {
+		p, err = processor.NewEPUB(r, src, dst, nodirs, stk, overwrite, format, env)
+	} else {
+		p, err = processor.NewFB2(processor.UnicodeReader(r, enc), enc == processor.EncUnknown, src, dst, nodirs, stk, overwrite, format, env)
+	}
 	if err != nil {
-		return err
+		return "", err
 	}
+	defer p.Clean()
+
 	id = p.Book.ID.String() // store for reference in the log
 
-	if err = p.Process(); err != nil {
-		return err
+	if err = p.Process(ctx); err != nil {
+		return "", err
 	}
-	if fname, err = p.Save(); err != nil {
-		return err
+	if fname, err = p.Save(ctx); err != nil {
+		return "", err
 	}
 
-	// store convertion result
-	env.Rpt.Store(fmt.Sprintf("fb2c-%s/%s", id, filepath.Base(fname)), fname)
+	if len(fname) > 0 {
+		// store convertion result
+		env.Rpt.Store(fmt.Sprintf("fb2c-%s/%s", id, filepath.Base(fname)), fname)
+	}
 
 	if err = p.SendToKindle(fname); err != nil {
-		return err
+		return "", err
 	}
-	return p.Clean()
+	return fname, p.Clean()
 }
 
-// processDir walks directory tree finding fb2 files and processes them.
-func processDir(dir string, format processor.OutputFmt, nodirs, stk, overwrite bool, cpage encoding.Encoding, dst string, env *state.LocalEnv) (err error) {
+// processDir walks directory tree finding fb2 and epub files and submits them for processing.
+func processDir(dir string, cpage encoding.Encoding, depth int, bp *bookPool, env *state.LocalEnv) (err error) {
 
 	count := 0
 	defer func() {
@@ -73,33 +88,52 @@ func processDir(dir string, format processor.OutputFmt, nodirs, stk, overwrite b
 	}()
 
 	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if bp.ctx.Err() != nil {
+			// interrupted, there is no point looking further
+			return filepath.SkipAll
+		}
+		src := strings.TrimPrefix(strings.TrimPrefix(path, dir), string(filepath.Separator))
 		if err != nil {
 			env.Log.Warn("Skipping path", zap.String("path", path), zap.Error(err))
+			bp.unreadable(src)
 		} else if info.Mode().IsRegular() {
-			var enc srcEncoding
+			var enc processor.SrcEncoding
 			if ok, err := isArchiveFile(path); err != nil {
 				// checking format - but cannot open target file
 				env.Log.Warn("Skipping file", zap.String("file", path), zap.Error(err))
+				// it could be either book or archive, books from archive are placed next to it
+				bp.unreadable(src)
+				bp.unreadable(filepath.Dir(strings.TrimPrefix(path, dir)))
 			} else if ok {
-				if err := processArchive(path, "", filepath.Dir(strings.TrimPrefix(path, dir)), format, nodirs, stk, overwrite, cpage, dst, env); err != nil {
+				if err := processArchive(path, "", filepath.Dir(strings.TrimPrefix(path, dir)), cpage, depth, bp, env); err != nil {
 					env.Log.Error("Unable to process archive", zap.String("file", path), zap.Error(err))
 				}
 			} else if ok, enc, err = isBookFile(path); err != nil {
 				env.Log.Warn("Skipping file", zap.String("file", path), zap.Error(err))
+				bp.unreadable(src)
 			} else if ok {
 				count++
-				// encoding will be handled properly by processBook
-				if file, err := os.Open(path); err != nil {
-					env.Log.Error("Unable to process file", zap.String("file", path), zap.Error(err))
-				} else {
-					defer file.Close()
-					if err := processBook(file, enc,
-						strings.TrimPrefix(strings.TrimPrefix(path, dir), string(filepath.Separator)), dst,
-						nodirs, stk, overwrite, format, env); err != nil {
-
-						env.Log.Error("Unable to process file", zap.String("file", path), zap.Error(err))
-					}
-				}
+				bp.submit(&bookTask{
+					kind:   processor.InFb2,
+					enc:    enc,
+					src:    src,
+					path:   path,
+					msg:    "Unable to process file",
+					fields: []zap.Field{zap.String("file", path)},
+				})
+			} else if ok, err = isEpubFile(path); err != nil {
+				env.Log.Warn("Skipping file", zap.String("file", path), zap.Error(err))
+				bp.unreadable(src)
+			} else if ok {
+				count++
+				bp.submit(&bookTask{
+					kind:   processor.InEpub,
+					enc:    processor.EncUnknown,
+					src:    src,
+					path:   path,
+					msg:    "Unable to process file",
+					fields: []zap.Field{zap.String("file", path)},
+				})
 			} else {
 				env.Log.Debug("Skipping file, not recognized as book or archive", zap.String("file", path))
 			}
@@ -109,8 +143,10 @@ func processDir(dir string, format processor.OutputFmt, nodirs, stk, overwrite b
 	return err
 }
 
-// processArchive walks all files inside archive, finds fb2 files under "pathIn" and processes them.
-func processArchive(path, pathIn, pathOut string, format processor.OutputFmt, nodirs, stk, overwrite bool, cpage encoding.Encoding, dst string, env *state.LocalEnv) (err error) {
+// processArchive walks all files inside archive (and archives inside it up to "depth" levels), finds fb2 and epub files
+// under "pathIn" and submits them for processing. Files could only be read while archive is walked, so book content is
+// kept in memory until its conversion starts.
+func processArchive(path, pathIn, pathOut string, cpage encoding.Encoding, depth int, bp *bookPool, env *state.LocalEnv) (err error) {
 
 	count := 0
 	defer func() {
@@ -119,112 +155,103 @@ func processArchive(path, pathIn, pathOut string, format processor.OutputFmt, no
 		}
 	}()
 
-	err = archive.Walk(path, pathIn, func(archive string, f *zip.File) error {
-		if ok, enc, err := isBookInArchive(f); err != nil {
+	err = archive.Walk(path, pathIn, cpage, depth, func(archive string, f archive.File, err error) error {
+		if err := bp.ctx.Err(); err != nil {
+			// interrupted, there is no point reading the rest of archive
+			return err
+		}
+		if err != nil {
+			env.Log.Warn("Problem with file in archive", zap.String("archive", archive), zap.String("path", f.Name()), zap.Error(err))
+			bp.unreadable(filepath.Join(pathOut, f.Name()))
+		}
+		kind := processor.InFb2
+		ok, enc, err := isBookInArchive(f)
+		if err == nil && !ok {
+			if ok, err = isEpubInArchive(f); ok {
+				kind = processor.InEpub
+			}
+		}
+		if err != nil {
 			env.Log.Warn("Skipping file in archive",
 				zap.String("archive", archive),
-				zap.String("path", f.FileHeader.Name),
+				zap.String("path", f.Name()),
 				zap.Error(err))
+			bp.unreadable(filepath.Join(pathOut, f.Name()))
 		} else if ok {
 			count++
-			// encoding will be handled properly by processBook
-			if r, err := f.Open(); err != nil {
+			if data, err := readArchiveFile(f); err != nil {
 				env.Log.Error("Unable to process file in archive",
 					zap.String("archive", archive),
-					zap.String("file", f.FileHeader.Name),
+					zap.String("file", f.Name()),
 					zap.Error(err))
+				bp.unreadable(filepath.Join(pathOut, f.Name()))
 			} else {
-				defer r.Close()
-				apath := f.FileHeader.Name
-				if cpage != nil && f.FileHeader.NonUTF8 {
-					// forcing zip file name encoding
-					if n, err := cpage.NewDecoder().String(apath); err == nil {
-						apath = n
-					} else {
-						n, _ = ianaindex.IANA.Name(cpage)
-						env.Log.Warn("Unable to convert archive name from specified encoding", zap.String("charset", n), zap.String("path", apath), zap.Error(err))
-					}
-				}
-				if err := processBook(r, enc, filepath.Join(pathOut, apath), dst, nodirs, stk, overwrite, format, env); err != nil {
-					env.Log.Error("Unable to process file in archive",
-						zap.String("archive", archive),
-						zap.String("file", f.FileHeader.Name),
-						zap.Error(err))
-				}
+				bp.submit(&bookTask{
+					kind:   kind,
+					enc:    enc,
+					src:    filepath.Join(pathOut, f.Name()),
+					data:   data,
+					msg:    "Unable to process file in archive",
+					fields: []zap.Field{zap.String("archive", archive), zap.String("file", f.Name())},
+				})
 			}
 		} else {
-			env.Log.Debug("Skipping file, not recognized as book", zap.String("archive", archive), zap.String("file", f.FileHeader.Name))
+			env.Log.Debug("Skipping file, not recognized as book", zap.String("archive", archive), zap.String("file", f.Name()))
 		}
 		return nil
 	})
+	if err != nil && bp.ctx.Err() != nil {
+		// walk was stopped, interruption is reported by the pool
+		return nil
+	}
+	if err != nil {
+		// books archive has are placed next to it
+		bp.unreadable(pathOut)
+	}
 	return err
 }
 
-// Convert is "convert" command body.
-func Convert(ctx *cli.Context) (err error) {
-
-	const (
-		errPrefix = "convert: "
-		errCode   = 1
-	)
+// readArchiveFile reads whole content of the file in archive.
+func readArchiveFile(f archive.File) ([]byte, error) {
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
 
-	env := ctx.Generic(state.FlagName).(*state.LocalEnv)
+// sourcePath returns normalized SOURCE argument of the command.
+func sourcePath(ctx *cli.Context) (string, error) {
 
 	src := ctx.Args().Get(0)
 	if len(src) == 0 {
-		return cli.Exit(errors.New(errPrefix+"no input source has been specified"), errCode)
+		return "", errors.New("no input source has been specified")
 	}
-	src, err = filepath.Abs(src)
-	if err != nil {
-		return cli.Exit(fmt.Errorf("%snormalizing source path failed", errPrefix), errCode)
-	}
-
-	dst := ctx.Args().Get(1)
-	if len(dst) == 0 {
-		if dst, err = os.Getwd(); err != nil {
-			return cli.Exit(fmt.Errorf("%sunable to get working directory", errPrefix), errCode)
-		}
-	} else {
-		if dst, err = filepath.Abs(dst); err != nil {
-			return cli.Exit(fmt.Errorf("%snormalizing destination path failed", errPrefix), errCode)
-		}
-		if ctx.Args().Len() > 2 {
-			env.Log.Warn("Mailformed command line, too many destinations", zap.Strings("ignoring", ctx.Args().Slice()[2:]))
+	if src == processor.StdStream {
+		for _, c := range ctx.StringSlice("config") {
+			if c == processor.StdStream {
+				return "", errors.New("STDIN cannot be used for both configuration and input source")
+			}
 		}
+		return src, nil
 	}
-
-	var format processor.OutputFmt
-	switch env.Mhl {
-	case config.MhlMobi:
-		format = processor.ParseFmtString(env.Cfg.Fb2Mobi.OutputFormat)
-		if format == processor.UnsupportedOutputFmt || format == processor.OEpub || format == processor.OKepub {
-			env.Log.Warn("Unknown output format in MHL mode requested, switching to mobi", zap.String("format", env.Cfg.Fb2Mobi.OutputFormat))
-			format = processor.OMobi
-		}
-	case config.MhlEpub:
-		format = processor.ParseFmtString(env.Cfg.Fb2Epub.OutputFormat)
-		if format == processor.UnsupportedOutputFmt || format == processor.OMobi || format == processor.OAzw3 {
-			env.Log.Warn("Unknown output format in MHL mode requested, switching to epub", zap.String("format", env.Cfg.Fb2Epub.OutputFormat))
-			format = processor.OEpub
-		}
-	default:
-		format = processor.ParseFmtString(ctx.String("to"))
-		if format == processor.UnsupportedOutputFmt {
-			env.Log.Warn("Unknown output format requested, switching to epub", zap.String("format", ctx.String("to")))
-			format = processor.OEpub
-		}
+	src, err := filepath.Abs(src)
+	if err != nil {
+		return "", errors.New("normalizing source path failed")
 	}
-	nodirs := ctx.Bool("nodirs")
-	overwrite := ctx.Bool("ow")
+	return src, nil
+}
 
-	if !env.Cfg.Doc.ChapterPerFile && (env.Cfg.Doc.PagesPerFile != math.MaxInt32 || len(env.Cfg.Doc.ChapterDividers) > 0) {
-		env.Log.Warn("With chapter_per_file=false settings to control resulting content size (ex: pages_per_file, chapter_subtitle_dividers) will be ignored")
-	}
+// archiveOptions returns code page for non UTF-8 file names in archives and depth for nested archives requested on
+// command line.
+func archiveOptions(ctx *cli.Context, env *state.LocalEnv) (encoding.Encoding, int) {
 
 	var cpage encoding.Encoding
 
 	page := ctx.String("force-zip-cp")
 	if len(page) > 0 {
+		var err error
 		cpage, err = ianaindex.IANA.Encoding(page)
 		if err != nil {
 			env.Log.Warn("Unknown character set specification. Ignoring...", zap.String("charset", page), zap.Error(err))
@@ -235,22 +262,50 @@ func Convert(ctx *cli.Context) (err error) {
 		}
 	}
 
-	stk := ctx.Bool("stk")
-	if env.Mhl == config.MhlEpub {
-		stk = env.Cfg.Fb2Epub.SendToKindle
+	depth := ctx.Int("archive-depth")
+	if depth < 0 {
+		env.Log.Warn("Negative nested archives depth requested, nested archives will not be opened", zap.Int("depth", depth))
+		depth = 0
 	}
-	if stk && format != processor.OEpub {
-		env.Log.Warn("Send to Kindle could only be used with epub output format, turning off", zap.Stringer("format", format))
-		stk = false
+	return cpage, depth
+}
+
+// readStdin reads single FB2 or EPUB book from STDIN. Since there is no file name the book is named "stdin" (with proper
+// extension) for the purposes of output naming and meta overwrites.
+func readStdin() (*bookTask, error) {
+
+	data, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return nil, err
 	}
-	if stk {
-		env.Cfg.Doc.Cover.Convert = true
+
+	ok, kind, enc := detectBook(data)
+	if !ok {
+		return nil, errors.New("input was not recognized as FB2 or EPUB book")
 	}
 
-	env.Log.Info("Processing starting", zap.String("source", src), zap.String("destination", dst), zap.Stringer("format", format))
-	defer func(start time.Time) {
-		env.Log.Info("Processing completed", zap.Duration("elapsed", time.Since(start)))
-	}(time.Now())
+	src := "stdin.fb2"
+	if kind == processor.InEpub {
+		src = "stdin.epub"
+	}
+	return &bookTask{kind: kind, enc: enc, src: src, data: data, msg: "Unable to process STDIN"}, nil
+}
+
+// processSource finds books specified by source path and submits them to the pool, waiting for all of them to be
+// processed. Source could be "-" (STDIN), path to a book file, directory, archive or path inside archive. When single is
+// set source must resolve to a single book.
+func processSource(src string, single bool, cpage encoding.Encoding, depth int, bp *bookPool, env *state.LocalEnv) error {
+
+	if src == processor.StdStream {
+		t, err := readStdin()
+		if err != nil {
+			return fmt.Errorf("unable to process STDIN: %w", err)
+		}
+		if err := bp.perform(bytes.NewReader(t.data), t, env); err != nil {
+			return fmt.Errorf("unable to process STDIN: %w", err)
+		}
+		return nil
+	}
 
 	var head, tail string
 	for head = src; len(head) != 0; head, tail = filepath.Split(head) {
@@ -266,10 +321,15 @@ func Convert(ctx *cli.Context) (err error) {
 		if fi.Mode().IsDir() {
 			if len(tail) != 0 {
 				// directory cannot have tail - it would be simple file
-				return cli.Exit(fmt.Errorf("%sinput source was not found (%s) => (%s)", errPrefix, head, strings.TrimPrefix(src, head)), errCode)
+				return fmt.Errorf("input source was not found (%s) => (%s)", head, strings.TrimPrefix(src, head))
+			}
+			if single {
+				return fmt.Errorf("only single book could be written to STDOUT, (%s) is a directory", head)
 			}
-			if err := processDir(head, format, nodirs, stk, overwrite, cpage, dst, env); err != nil {
-				return cli.Exit(fmt.Errorf("%sunable to process directory", errPrefix), errCode)
+			err := processDir(head, cpage, depth, bp, env)
+			bp.wait()
+			if err != nil {
+				return errors.New("unable to process directory")
 			}
 			break
 		}
@@ -279,48 +339,211 @@ func Convert(ctx *cli.Context) (err error) {
 			ok, err := isArchiveFile(head)
 			if err != nil {
 				// checking format - but cannot open target file
-				return cli.Exit(fmt.Errorf("%sunable to check archive type: %w", errPrefix, err), errCode)
+				return fmt.Errorf("unable to check archive type: %w", err)
 			}
 
 			if ok {
 				// we need to look inside to see if path makes sense
 				tail = strings.TrimPrefix(strings.TrimPrefix(src, head), string(filepath.Separator))
-				if err := processArchive(head, tail, "", format, nodirs, stk, overwrite, cpage, dst, env); err != nil {
-					return cli.Exit(fmt.Errorf("%sunable to process archive: %w", errPrefix, err), errCode)
+				if single && !isBookName(tail) {
+					return fmt.Errorf("only single book could be written to STDOUT, specify path to the book inside archive (%s)", head)
+				}
+				err := processArchive(head, tail, "", cpage, depth, bp, env)
+				bp.wait()
+				if err != nil {
+					return fmt.Errorf("unable to process archive: %w", err)
 				}
 				break
 			}
 
-			var enc srcEncoding
+			var enc processor.SrcEncoding
+			kind := processor.InFb2
 			ok, enc, err = isBookFile(head)
+			if err == nil && !ok {
+				if ok, err = isEpubFile(head); ok {
+					kind = processor.InEpub
+				}
+			}
 			if err != nil {
 				// checking format - but cannot open target file
-				return cli.Exit(fmt.Errorf("%sunable to check file type: %w", errPrefix, err), errCode)
+				return fmt.Errorf("unable to check file type: %w", err)
 
 			}
 
 			if ok && len(tail) == 0 {
 				// we have book, it cannot have tail
-				// encoding will be handled properly by processBook
-				if file, err := os.Open(head); err != nil {
-					env.Log.Error("Unable to process file", zap.String("file", head), zap.Error(err))
-				} else {
-					defer file.Close()
-					if err := processBook(file, enc, filepath.Base(head), dst, nodirs, stk, overwrite, format, env); err != nil {
-						env.Log.Error("Unable to process file", zap.String("file", head), zap.Error(err))
-					}
-				}
+				bp.submit(&bookTask{
+					kind:   kind,
+					enc:    enc,
+					src:    filepath.Base(head),
+					path:   head,
+					msg:    "Unable to process file",
+					fields: []zap.Field{zap.String("file", head)},
+				})
+				bp.wait()
 				break
 			}
 
-			return cli.Exit(fmt.Errorf("%sinput was not recognized as FB2 book (%s)", errPrefix, head), errCode)
+			return fmt.Errorf("input was not recognized as FB2 or EPUB book (%s)", head)
 		}
 
-		return cli.Exit(fmt.Errorf("%sunexpected path mode for (%s) => (%s)", errPrefix, head, strings.TrimPrefix(src, head)), errCode)
+		return fmt.Errorf("unexpected path mode for (%s) => (%s)", head, strings.TrimPrefix(src, head))
 	}
 	if len(head) == 0 {
-		return cli.Exit(fmt.Errorf("%sinput source was not found (%s)", errPrefix, src), errCode)
+		return fmt.Errorf("input source was not found (%s)", src)
+	}
+	return nil
+}
+
+// Convert is "convert" command body.
+func Convert(ctx *cli.Context) error {
+
+	const (
+		errPrefix = "convert: "
+		errCode   = 1
+	)
+
+	env := ctx.Generic(state.FlagName).(*state.LocalEnv)
+
+	src, err := sourcePath(ctx)
+	if err != nil {
+		return cli.Exit(fmt.Errorf("%s%w", errPrefix, err), errCode)
+	}
+
+	dst := ctx.Args().Get(1)
+	if len(dst) == 0 {
+		if dst, err = os.Getwd(); err != nil {
+			return cli.Exit(fmt.Errorf("%sunable to get working directory", errPrefix), errCode)
+		}
+	} else {
+		if dst != processor.StdStream {
+			if dst, err = filepath.Abs(dst); err != nil {
+				return cli.Exit(fmt.Errorf("%snormalizing destination path failed", errPrefix), errCode)
+			}
+		}
+		if ctx.Args().Len() > 2 {
+			env.Log.Warn("Mailformed command line, too many destinations", zap.Strings("ignoring", ctx.Args().Slice()[2:]))
+		}
+	}
+
+	var format processor.OutputFmt
+	switch env.Mhl {
+	case config.MhlMobi:
+		format = processor.ParseFmtString(env.Cfg.Fb2Mobi.OutputFormat)
+		if format != processor.OMobi && format != processor.OAzw3 {
+			env.Log.Warn("Unknown output format in MHL mode requested, switching to mobi", zap.String("format", env.Cfg.Fb2Mobi.OutputFormat))
+			format = processor.OMobi
+		}
+	case config.MhlEpub:
+		format = processor.ParseFmtString(env.Cfg.Fb2Epub.OutputFormat)
+		if format != processor.OEpub && format != processor.OKepub && format != processor.OEpub3 {
+			env.Log.Warn("Unknown output format in MHL mode requested, switching to epub", zap.String("format", env.Cfg.Fb2Epub.OutputFormat))
+			format = processor.OEpub
+		}
+	default:
+		format = processor.ParseFmtString(ctx.String("to"))
+		if format == processor.UnsupportedOutputFmt {
+			env.Log.Warn("Unknown output format requested, switching to epub", zap.String("format", ctx.String("to")))
+			format = processor.OEpub
+		}
+	}
+	if format == processor.OMobi {
+		// built-in writer only produces azw3, there is no point going through the whole source without kindlegen
+		if _, err := env.Cfg.GetKindlegenPath(); err != nil {
+			return cli.Exit(fmt.Errorf("%smobi output requires kindlegen, convert to azw3 instead: %w", errPrefix, err), errCode)
+		}
+	}
+	nodirs := ctx.Bool("nodirs")
+	overwrite := ctx.Bool("ow")
+
+	if !env.Cfg.Doc.ChapterPerFile && (env.Cfg.Doc.PagesPerFile != math.MaxInt32 || len(env.Cfg.Doc.ChapterDividers) > 0) {
+		env.Log.Warn("With chapter_per_file=false settings to control resulting content size (ex: pages_per_file, chapter_subtitle_dividers) will be ignored")
+	}
+
+	cpage, depth := archiveOptions(ctx, env)
+
+	jobs := ctx.Int("jobs")
+	if jobs < 1 {
+		env.Log.Warn("Number of parallel jobs should be positive, converting books one by one", zap.Int("jobs", jobs))
+		jobs = 1
+	}
+
+	stk := ctx.Bool("stk")
+	if env.Mhl == config.MhlEpub {
+		stk = env.Cfg.Fb2Epub.SendToKindle
+	}
+	if stk && format != processor.OEpub && format != processor.OEpub3 {
+		env.Log.Warn("Send to Kindle could only be used with epub output format, turning off", zap.Stringer("format", format))
+		stk = false
+	}
+	if stk && dst == processor.StdStream {
+		env.Log.Warn("Send to Kindle could not be used when writing to STDOUT, turning off")
+		stk = false
+	}
+	if stk {
+		env.Cfg.Doc.Cover.Convert = true
 	}
 
+	var cache *convCache
+	if ctx.Bool("cache") {
+		if dst == processor.StdStream {
+			env.Log.Warn("Conversion cache could not be used when writing to STDOUT, turning off")
+		} else {
+			actual, err := env.Cfg.GetActualBytes()
+			if err != nil {
+				return cli.Exit(fmt.Errorf("%sunable to get actual configuration: %w", errPrefix, err), errCode)
+			}
+			if cache, err = loadCache(dst, src, format, actual, fmt.Appendf(nil, "nodirs=%t", nodirs)); err != nil {
+				return cli.Exit(fmt.Errorf("%s%w", errPrefix, err), errCode)
+			}
+		}
+	}
+	prune := ctx.Bool("prune")
+	if prune && cache == nil {
+		env.Log.Warn("Only books tracked by conversion cache could be pruned, turning off")
+		prune = false
+	}
+
+	env.Log.Info("Processing starting", zap.String("source", src), zap.String("destination", dst), zap.Stringer("format", format))
+	defer func(start time.Time) {
+		env.Log.Info("Processing completed", zap.Duration("elapsed", time.Since(start)))
+	}(time.Now())
+
+	// first interrupt stops the batch gracefully, the second one kills the process
+	sctx, stop := signal.NotifyContext(ctx.Context, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-sctx.Done()
+		stop()
+	}()
+
+	bp := newBookPool(sctx, jobs, func(ctx context.Context, r io.Reader, t *bookTask, env *state.LocalEnv) error {
+		// encoding will be handled properly by processBook
+		convert := func(r io.Reader, overwrite bool) (string, error) {
+			return processBook(ctx, r, t.kind, t.enc, t.src, dst, nodirs, stk, overwrite, format, env)
+		}
+		if cache != nil {
+			return cache.process(r, t, overwrite, env, convert)
+		}
+		_, err := convert(r, overwrite)
+		return err
+	}, env)
+	bp.timeout = ctx.Duration("timeout")
+	err = processSource(src, dst == processor.StdStream, cpage, depth, bp, env)
+	if cache != nil {
+		// results of books converted so far are kept even if processing was interrupted
+		if prune && err == nil && sctx.Err() == nil {
+			cache.prune(bp.unread, env)
+		}
+		if err := cache.save(); err != nil {
+			env.Log.Error("Unable to save conversion cache", zap.Error(err))
+		}
+	}
+	if err != nil {
+		return cli.Exit(fmt.Errorf("%s%w", errPrefix, err), errCode)
+	}
+	if sctx.Err() != nil {
+		return cli.Exit(fmt.Errorf("%sprocessing was interrupted", errPrefix), errCode)
+	}
 	return nil
 }
@@ -0,0 +1,263 @@
+package commands
+
+import (
+	"archive/zip"
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"fb2converter/config"
+	"fb2converter/state"
+)
+
+const convertTestBook = `<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+<description>
+  <title-info><book-title>Book</book-title><lang>en</lang></title-info>
+  <document-info><id>1</id></document-info>
+</description>
+<body><section><title><p>One</p></title><p>Text.</p></section></body>
+</FictionBook>`
+
+// runConvert runs convert command the way program does it, with standard streams replaced by files. It returns what
+// was written to STDOUT and STDERR. Default configuration is used when cfg is nil.
+func runConvert(t *testing.T, ctx context.Context, cfg *config.Config, stdin string, args ...string) (string, string, error) {
+	t.Helper()
+
+	dir := t.TempDir()
+	streams := make([]*os.File, 3)
+	for i, name := range []string{"stdin", "stdout", "stderr"} {
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		streams[i] = f
+	}
+	if _, err := streams[0].WriteString(stdin); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := streams[0].Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	saved := []*os.File{os.Stdin, os.Stdout, os.Stderr}
+	os.Stdin, os.Stdout, os.Stderr = streams[0], streams[1], streams[2]
+	defer func() {
+		os.Stdin, os.Stdout, os.Stderr = saved[0], saved[1], saved[2]
+	}()
+
+	if cfg == nil {
+		var err error
+		if cfg, err = config.BuildConfig(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg.ConsoleLogger.Level = "debug"
+	cfg.FileLogger.Level = "none"
+	env := &state.LocalEnv{Cfg: cfg}
+
+	app := &cli.App{
+		Flags:          []cli.Flag{&cli.GenericFlag{Name: state.FlagName, Hidden: true, Value: env}},
+		ExitErrHandler: func(*cli.Context, error) {},
+		Commands: []*cli.Command{{
+			Name:   "convert",
+			Action: Convert,
+			Before: func(c *cli.Context) (err error) {
+				// the same way program prepares logs
+				env.Log, err = env.Cfg.PrepareLog(nil, c.Args().Get(1) == "-")
+				return
+			},
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "to", Value: "epub"},
+				&cli.BoolFlag{Name: "nodirs"},
+				&cli.BoolFlag{Name: "stk"},
+				&cli.BoolFlag{Name: "ow"},
+				&cli.StringFlag{Name: "force-zip-cp"},
+				&cli.IntFlag{Name: "jobs", Value: 1},
+				&cli.DurationFlag{Name: "timeout"},
+				&cli.IntFlag{Name: "archive-depth", Value: 2},
+				&cli.BoolFlag{Name: "cache"},
+				&cli.BoolFlag{Name: "prune"},
+			},
+		}},
+	}
+	err := app.RunContext(ctx, append([]string{"fb2c", "convert"}, args...))
+	_ = env.Log.Sync()
+
+	out, e := os.ReadFile(streams[1].Name())
+	if e != nil {
+		t.Fatal(e)
+	}
+	log, e := os.ReadFile(streams[2].Name())
+	if e != nil {
+		t.Fatal(e)
+	}
+	return string(out), string(log), err
+}
+
+func TestConvertStdStreams(t *testing.T) {
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "book.fb2")
+	if err := os.WriteFile(src, []byte(convertTestBook), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// book from STDIN to STDOUT, nothing but the book is written there
+	out, log, err := runConvert(t, context.Background(), nil, convertTestBook, "--to", "fb2", "-", "-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out, `<?xml version="1.0" encoding="UTF-8"?>`) || strings.TrimSpace(out[strings.LastIndex(out, "</FictionBook>"):]) != "</FictionBook>" {
+		t.Errorf("unexpected STDOUT content %q", out)
+	}
+	if !strings.Contains(log, "Conversion starting") || !strings.Contains(log, "stdin.fb2") {
+		t.Errorf("console log was not sent to STDERR: %q", log)
+	}
+
+	// book file to STDOUT
+	out, _, err = runConvert(t, context.Background(), nil, "", src, "-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(strings.NewReader(out), int64(len(out)))
+	if err != nil || !strings.HasPrefix(out, "PK\x03\x04") {
+		t.Fatalf("STDOUT does not contain EPUB: %v", err)
+	}
+	if f, err := zr.Open("OEBPS/content.opf"); err != nil {
+		t.Error(err)
+	} else {
+		f.Close()
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("files were created next to the source: %v", entries)
+	}
+
+	// book from STDIN to directory is named after the stream
+	dst := filepath.Join(dir, "out")
+	if _, _, err = runConvert(t, context.Background(), nil, convertTestBook, "-", dst); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "stdin.epub")); err != nil {
+		t.Error(err)
+	}
+
+	for _, c := range []struct {
+		stdin string
+		args  []string
+		err   string
+	}{
+		{"", []string{dir, "-"}, "only single book could be written to STDOUT"},
+		{"not a book", []string{"-", "-"}, "input was not recognized as FB2 or EPUB book"},
+	} {
+		out, _, err := runConvert(t, context.Background(), nil, c.stdin, c.args...)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%v: unexpected error %v", c.args, err)
+		}
+		if len(out) != 0 {
+			t.Errorf("%v: STDOUT is not empty: %q", c.args, out)
+		}
+	}
+}
+
+func TestConvertInterrupted(t *testing.T) {
+
+	if runtime.GOOS == "windows" {
+		t.Skip("shell script could not be used as kindlegen")
+	}
+
+	// working directories of all conversions are kept here
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+
+	root := t.TempDir()
+	src, dst := filepath.Join(root, "in"), filepath.Join(root, "out")
+	if err := os.MkdirAll(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.fb2", "b.fb2", "slow.fb2", "z.fb2"} {
+		if err := os.WriteFile(filepath.Join(src, name), []byte(convertTestBook), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// kindlegen stand-in produces some content quickly, except for the slow book where it hangs
+	started := filepath.Join(root, "started")
+	kindlegen := filepath.Join(root, "kindlegen")
+	if err := os.WriteFile(kindlegen, []byte(`#!/bin/sh
+in=$1
+while [ $# -gt 0 ]; do
+	[ "$1" = "-o" ] && out=$2
+	shift
+done
+case "$out" in
+*slow*) touch '`+started+`'; exec sleep 30 ;;
+esac
+echo mobi > "$(dirname "$in")/$out"
+`), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := config.BuildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Doc.Kindlegen.Path = kindlegen
+	cfg.Doc.Kindlegen.NoOptimization = true
+
+	// batch is interrupted while slow book is being converted
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		for {
+			if _, err := os.Stat(started); err == nil {
+				cancel()
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+		}
+	}()
+
+	start := time.Now()
+	out, _, err := runConvert(t, ctx, cfg, "", "--to", "mobi", src, dst)
+	if err == nil || !strings.Contains(err.Error(), "processing was interrupted") {
+		t.Errorf("unexpected error %v", err)
+	}
+	if time.Since(start) > 20*time.Second {
+		t.Error("kindlegen was not stopped")
+	}
+
+	// report accounts for every book reached before interruption, the rest of directory is not looked at
+	if !strings.Contains(out, "Processing was interrupted, batch is incomplete") ||
+		!strings.Contains(out, `{"books": 3, "processed": 2, "failed": 0, "interrupted": 1}`) {
+		t.Errorf("unexpected report %q", out)
+	}
+	if strings.Contains(out, "Book was not processed") {
+		t.Error("interrupted books are reported as failed")
+	}
+
+	var results []string
+	entries, _ := os.ReadDir(dst)
+	for _, e := range entries {
+		results = append(results, e.Name())
+	}
+	if strings.Join(results, ",") != "a.mobi,b.mobi" {
+		t.Errorf("unexpected results %v", results)
+	}
+	entries, _ = os.ReadDir(tmp)
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "fb2c-") {
+			t.Errorf("working directory was left behind: %s", e.Name())
+		}
+	}
+}
@@ -0,0 +1,321 @@
+package commands
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+
+	"fb2converter/processor"
+	"fb2converter/state"
+)
+
+// Content fingerprints are compared with locality sensitive hashing: fingerprint is split into bands and only books
+// sharing at least one band are compared, so we do not have to compare every pair of books.
+const dedupeBands = 16
+
+// Reasons books were put into the same group.
+const (
+	dupByID       = "id"
+	dupByMetadata = "metadata"
+	dupByContent  = "content"
+)
+
+type dupBook struct {
+	*processor.BookFingerprint
+	Best    bool   `json:"best"`
+	MovedTo string `json:"moved_to,omitempty"`
+	// file on disk, empty for books inside archives
+	path string
+	// path relative to source as walk reported it
+	src string
+}
+
+type dupGroup struct {
+	Reasons []string   `json:"reasons"`
+	Books   []*dupBook `json:"books"`
+}
+
+// unionFind keeps sets of books known to be duplicates of each other.
+type unionFind []int
+
+func (u unionFind) find(i int) int {
+	for u[i] != i {
+		u[i] = u[u[i]]
+		i = u[i]
+	}
+	return i
+}
+
+func (u unionFind) union(a, b int) {
+	u[u.find(a)] = u.find(b)
+}
+
+// groupDuplicates splits books into groups of duplicates, books without duplicates are not reported.
+func groupDuplicates(books []*dupBook, similarity float64) []*dupGroup {
+
+	type link struct {
+		a, b   int
+		reason string
+	}
+
+	var links []link
+	byKey := func(reason string, key func(b *dupBook) string) {
+		first := make(map[string]int)
+		for i, b := range books {
+			k := key(b)
+			if len(k) == 0 {
+				continue
+			}
+			if j, ok := first[k]; ok {
+				links = append(links, link{j, i, reason})
+			} else {
+				first[k] = i
+			}
+		}
+	}
+	byKey(dupByID, func(b *dupBook) string { return b.ID })
+	byKey(dupByMetadata, func(b *dupBook) string { return b.Key })
+
+	rows := processor.FingerprintLen / dedupeBands
+	buckets := make(map[uint64][]int)
+	for i, b := range books {
+		if len(b.Content) != processor.FingerprintLen {
+			continue
+		}
+		for band := 0; band < dedupeBands; band++ {
+			h := fnv.New64a()
+			binary.Write(h, binary.BigEndian, uint64(band))
+			binary.Write(h, binary.BigEndian, b.Content[band*rows:(band+1)*rows])
+			buckets[h.Sum64()] = append(buckets[h.Sum64()], i)
+		}
+	}
+	compared := make(map[[2]int]bool)
+	for _, list := range buckets {
+		for x := 0; x < len(list); x++ {
+			for y := x + 1; y < len(list); y++ {
+				pair := [2]int{list[x], list[y]}
+				if compared[pair] {
+					continue
+				}
+				compared[pair] = true
+				if books[pair[0]].Similarity(books[pair[1]].BookFingerprint) >= similarity {
+					links = append(links, link{pair[0], pair[1], dupByContent})
+				}
+			}
+		}
+	}
+
+	uf := make(unionFind, len(books))
+	for i := range uf {
+		uf[i] = i
+	}
+	for _, l := range links {
+		uf.union(l.a, l.b)
+	}
+
+	groups := make(map[int]*dupGroup)
+	for i, b := range books {
+		root := uf.find(i)
+		g, ok := groups[root]
+		if !ok {
+			g = &dupGroup{}
+			groups[root] = g
+		}
+		g.Books = append(g.Books, b)
+	}
+	for _, l := range links {
+		g := groups[uf.find(l.a)]
+		found := false
+		for _, r := range g.Reasons {
+			found = found || r == l.reason
+		}
+		if !found {
+			g.Reasons = append(g.Reasons, l.reason)
+		}
+	}
+
+	var res []*dupGroup
+	for _, g := range groups {
+		if len(g.Books) < 2 {
+			continue
+		}
+		sort.Strings(g.Reasons)
+		// best book first: largest, then newest document version
+		sort.SliceStable(g.Books, func(i, j int) bool {
+			a, b := g.Books[i], g.Books[j]
+			if a.Size != b.Size {
+				return a.Size > b.Size
+			}
+			if a.VersionNumber() != b.VersionNumber() {
+				return a.VersionNumber() > b.VersionNumber()
+			}
+			return a.Source < b.Source
+		})
+		g.Books[0].Best = true
+		res = append(res, g)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Books[0].Source < res[j].Books[0].Source })
+	return res
+}
+
+// quarantine moves book into directory keeping its path relative to source.
+func (b *dupBook) quarantine(dir string, env *state.LocalEnv) {
+
+	if len(b.path) == 0 {
+		env.Log.Warn("Unable to move duplicate, book is inside archive", zap.String("book", b.Source))
+		return
+	}
+	to := filepath.Join(dir, b.src)
+	if _, err := os.Stat(to); err == nil {
+		env.Log.Warn("Unable to move duplicate, file already exists in quarantine", zap.String("file", b.path), zap.String("to", to))
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		env.Log.Error("Unable to move duplicate", zap.String("file", b.path), zap.String("to", to), zap.Error(err))
+		return
+	}
+	if err := moveFile(b.path, to); err != nil {
+		env.Log.Error("Unable to move duplicate", zap.String("file", b.path), zap.String("to", to), zap.Error(err))
+		return
+	}
+	b.MovedTo = to
+	env.Log.Debug("Duplicate moved", zap.String("file", b.path), zap.String("to", to))
+}
+
+func writeGroups(out io.Writer, groups []*dupGroup) {
+
+	dups := 0
+	for i, g := range groups {
+		fmt.Fprintf(out, "Group %d (%s):\n", i+1, strings.Join(g.Reasons, ", "))
+		for _, b := range g.Books {
+			mark := " "
+			if b.Best {
+				mark = "*"
+			} else {
+				dups++
+			}
+			fmt.Fprintf(out, "  %s %s, %d bytes", mark, b.Source, b.Size)
+			if len(b.Version) > 0 {
+				fmt.Fprintf(out, ", version %s", b.Version)
+			}
+			fmt.Fprintf(out, ", %q", b.Title)
+			if len(b.Authors) > 0 {
+				fmt.Fprintf(out, " by %s", strings.Join(b.Authors, ", "))
+			}
+			if len(b.MovedTo) > 0 {
+				fmt.Fprintf(out, " => %s", b.MovedTo)
+			}
+			fmt.Fprintln(out)
+		}
+	}
+	fmt.Fprintf(out, "%d group(s), %d duplicate book(s)\n", len(groups), dups)
+}
+
+// Dedupe is "dedupe" command body.
+func Dedupe(ctx *cli.Context) error {
+
+	const (
+		errPrefix = "dedupe: "
+		errCode   = 1
+	)
+
+	env := ctx.Generic(state.FlagName).(*state.LocalEnv)
+
+	src, err := sourcePath(ctx)
+	if err != nil {
+		return cli.Exit(fmt.Errorf("%s%w", errPrefix, err), errCode)
+	}
+	if ctx.Args().Len() > 1 {
+		env.Log.Warn("Mailformed command line, too many sources", zap.Strings("ignoring", ctx.Args().Slice()[1:]))
+	}
+
+	similarity := ctx.Float64("similarity")
+	if similarity <= 0 || similarity > 1 {
+		return cli.Exit(fmt.Errorf("%ssimilarity must be in (0, 1] range", errPrefix), errCode)
+	}
+	quarantine, err := watchDir(ctx.String("quarantine"), "quarantine directory", false)
+	if err != nil {
+		return cli.Exit(fmt.Errorf("%s%w", errPrefix, err), errCode)
+	}
+	if len(quarantine) > 0 && strings.HasPrefix(quarantine+string(filepath.Separator), src+string(filepath.Separator)) {
+		env.Log.Warn("Quarantine directory is inside source, moved books will be found again next time", zap.String("quarantine", quarantine))
+	}
+	cpage, depth := archiveOptions(ctx, env)
+
+	env.Log.Info("Dedupe starting", zap.String("source", src))
+	defer func(start time.Time) {
+		env.Log.Info("Dedupe completed", zap.Duration("elapsed", time.Since(start)))
+	}(time.Now())
+
+	var (
+		mu    sync.Mutex
+		books []*dupBook
+	)
+	bp := newBookPool(ctx.Context, ctx.Int("jobs"), func(_ context.Context, r io.Reader, t *bookTask, env *state.LocalEnv) error {
+
+		if t.kind != processor.InFb2 {
+			env.Log.Debug("Skipping file, only FB2 books could be compared", zap.String("file", t.src))
+			return nil
+		}
+
+		f, err := processor.ReadFingerprint(processor.UnicodeReader(r, t.enc), t.enc == processor.EncUnknown, t.src, env)
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		books = append(books, &dupBook{BookFingerprint: f, path: t.path, src: t.src})
+		return nil
+	}, env)
+
+	if err := processSource(src, false, cpage, depth, bp, env); err != nil {
+		return cli.Exit(fmt.Errorf("%s%w", errPrefix, err), errCode)
+	}
+
+	// parallel processing makes order random
+	sort.Slice(books, func(i, j int) bool { return books[i].Source < books[j].Source })
+	groups := groupDuplicates(books, similarity)
+
+	if len(quarantine) > 0 {
+		for _, g := range groups {
+			for _, b := range g.Books {
+				if !b.Best {
+					b.quarantine(quarantine, env)
+				}
+			}
+		}
+	}
+
+	if ctx.Bool("json") {
+		if groups == nil {
+			groups = []*dupGroup{}
+		}
+		data, err := json.MarshalIndent(struct {
+			Groups []*dupGroup `json:"groups"`
+		}{groups}, "", "  ")
+		if err != nil {
+			return cli.Exit(fmt.Errorf("%s%w", errPrefix, err), errCode)
+		}
+		fmt.Fprintf(os.Stdout, "%s\n", data)
+	} else {
+		writeGroups(os.Stdout, groups)
+	}
+
+	if failed := bp.failures(); failed > 0 {
+		return cli.Exit(fmt.Errorf("%sunable to process %d book(s)", errPrefix, failed), errCode)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package commands
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+
+	"fb2converter/processor"
+	"fb2converter/state"
+)
+
+var infoColumns = []string{"source", "id", "asin", "title", "authors", "sequence", "sequence_number", "genres", "lang", "date", "annotation", "cover", "images"}
+
+func infoRecord(info *processor.BookInfo) []string {
+	var num string
+	if info.SequenceNumber > 0 {
+		num = strconv.Itoa(info.SequenceNumber)
+	}
+	return []string{
+		info.Source,
+		info.ID,
+		info.ASIN,
+		info.Title,
+		strings.Join(info.Authors, "; "),
+		info.Sequence,
+		num,
+		strings.Join(info.Genres, "; "),
+		info.Lang,
+		info.Date,
+		info.Annotation,
+		strconv.FormatBool(info.Cover),
+		strconv.Itoa(info.Images),
+	}
+}
+
+// Info is "info" command body.
+func Info(ctx *cli.Context) error {
+
+	const (
+		errPrefix = "info: "
+		errCode   = 1
+	)
+
+	env := ctx.Generic(state.FlagName).(*state.LocalEnv)
+
+	src, err := sourcePath(ctx)
+	if err != nil {
+		return cli.Exit(fmt.Errorf("%s%w", errPrefix, err), errCode)
+	}
+	if ctx.Args().Len() > 1 {
+		env.Log.Warn("Mailformed command line, too many sources", zap.Strings("ignoring", ctx.Args().Slice()[1:]))
+	}
+
+	asCSV := ctx.Bool("csv")
+	cpage, depth := archiveOptions(ctx, env)
+
+	env.Log.Info("Info starting", zap.String("source", src))
+	defer func(start time.Time) {
+		env.Log.Info("Info completed", zap.Duration("elapsed", time.Since(start)))
+	}(time.Now())
+
+	var (
+		mu  sync.Mutex
+		out = csv.NewWriter(os.Stdout)
+	)
+	if asCSV {
+		if err := out.Write(infoColumns); err != nil {
+			return cli.Exit(fmt.Errorf("%sunable to write results: %w", errPrefix, err), errCode)
+		}
+	}
+
+	bp := newBookPool(ctx.Context, 1, func(_ context.Context, r io.Reader, t *bookTask, env *state.LocalEnv) error {
+
+		if t.kind != processor.InFb2 {
+			env.Log.Debug("Skipping file, only FB2 information could be extracted", zap.String("file", t.src))
+			return nil
+		}
+
+		info, err := processor.ReadInfo(processor.UnicodeReader(r, t.enc), t.enc == processor.EncUnknown, t.src, env)
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		if asCSV {
+			if err := out.Write(infoRecord(info)); err != nil {
+				return err
+			}
+			out.Flush()
+			return out.Error()
+		}
+		data, err := json.Marshal(info)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(os.Stdout, "%s\n", data)
+		return err
+	}, env)
+
+	if err := processSource(src, false, cpage, depth, bp, env); err != nil {
+		return cli.Exit(fmt.Errorf("%s%w", errPrefix, err), errCode)
+	}
+	if failed := bp.failures(); failed > 0 {
+		return cli.Exit(fmt.Errorf("%sunable to get information for %d book(s)", errPrefix, failed), errCode)
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"fb2converter/processor"
+	"fb2converter/state"
+)
+
+// bookTask is a single book to be converted by processBook.
+type bookTask struct {
+	kind processor.InputFmt
+	enc  processor.SrcEncoding
+	// source path as expected by processBook
+	src string
+	// book content is either read from file or already in memory (books from archives could only be read during walk)
+	path string
+	data []byte
+	// context for logging conversion errors
+	msg    string
+	fields []zap.Field
+}
+
+func (t *bookTask) open() (io.ReadCloser, error) {
+	if t.data != nil {
+		return io.NopCloser(bytes.NewReader(t.data)), nil
+	}
+	return os.Open(t.path)
+}
+
+// bookResult is kept for final summary.
+type bookResult struct {
+	src string
+	err error
+}
+
+// bookFunc does actual work on a single book, reader gives book content. Context is canceled when batch is interrupted
+// or book takes too long.
+type bookFunc func(ctx context.Context, r io.Reader, t *bookTask, env *state.LocalEnv) error
+
+// bookPool runs book processing on a bounded number of workers. With single job books are processed right away by
+// the caller, exactly as if there were no pool. Once pool context is canceled remaining books are skipped.
+type bookPool struct {
+	ctx    context.Context
+	jobs   int
+	action bookFunc
+	env    *state.LocalEnv
+	// limits processing time of a single book, no limit when 0
+	timeout time.Duration
+
+	tasks chan *bookTask
+	wg    sync.WaitGroup
+
+	mu      sync.Mutex
+	results []bookResult
+	// sources (directories, archives, files) which could not be read, books they may contain were never submitted
+	unread []string
+}
+
+func newBookPool(ctx context.Context, jobs int, action bookFunc, env *state.LocalEnv) *bookPool {
+
+	bp := &bookPool{ctx: ctx, jobs: jobs, action: action, env: env}
+	if jobs > 1 {
+		bp.tasks = make(chan *bookTask)
+		for i := 0; i < jobs; i++ {
+			bp.wg.Add(1)
+			go func() {
+				defer bp.wg.Done()
+				for t := range bp.tasks {
+					bp.run(t)
+				}
+			}()
+		}
+	}
+	return bp
+}
+
+// submit queues book for processing, blocking while all workers are busy.
+func (bp *bookPool) submit(t *bookTask) {
+	if bp.tasks == nil {
+		bp.run(t)
+		return
+	}
+	bp.tasks <- t
+}
+
+// run processes single book and records result.
+func (bp *bookPool) run(t *bookTask) {
+
+	if err := bp.ctx.Err(); err != nil {
+		// batch was interrupted, book is only accounted for in the summary
+		bp.record(t, err)
+		return
+	}
+
+	// all log lines for the book carry its source so output of concurrent workers could be told apart
+	env := *bp.env
+	if bp.jobs > 1 {
+		env.Log = bp.env.Log.With(zap.String("book", t.src))
+	}
+
+	r, err := t.open()
+	if err == nil {
+		err = bp.perform(r, t, &env)
+		r.Close()
+	}
+	switch {
+	case err == nil:
+	case bp.ctx.Err() != nil && errors.Is(err, context.Canceled):
+		env.Log.Warn("Processing was interrupted", append(t.fields, zap.Error(err))...)
+	default:
+		env.Log.Error(t.msg, append(t.fields, zap.Error(err))...)
+	}
+	bp.record(t, err)
+}
+
+// perform runs action on a single book with its own context limited by timeout. Panic in action only fails the book.
+func (bp *bookPool) perform(r io.Reader, t *bookTask, env *state.LocalEnv) (err error) {
+
+	ctx, cancel := context.WithCancel(bp.ctx)
+	if bp.timeout > 0 {
+		ctx, cancel = context.WithTimeout(bp.ctx, bp.timeout)
+	}
+	defer cancel()
+
+	defer func() {
+		if r := recover(); r != nil {
+			env.Log.Error("Processing ended with panic", zap.Any("panic", r), zap.ByteString("stack", debug.Stack()))
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	err = bp.action(ctx, r, t, env)
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = fmt.Errorf("book was not processed in %s: %w", bp.timeout, err)
+	}
+	return err
+}
+
+// unreadable remembers source path (in the form bookTask.src uses) which could not be read.
+func (bp *bookPool) unreadable(src string) {
+	bp.mu.Lock()
+	bp.unread = append(bp.unread, src)
+	bp.mu.Unlock()
+}
+
+// record remembers book result for the summary.
+func (bp *bookPool) record(t *bookTask, err error) {
+	bp.mu.Lock()
+	bp.results = append(bp.results, bookResult{src: t.src, err: err})
+	bp.mu.Unlock()
+}
+
+// wait waits for all submitted books to be processed and logs summary in the order of source names, so it does not
+// depend on the order in which workers have finished. Summary is only logged when there was more than one book.
+func (bp *bookPool) wait() {
+
+	if bp.tasks != nil {
+		close(bp.tasks)
+		bp.wg.Wait()
+	}
+
+	interrupted := bp.ctx.Err() != nil
+	if len(bp.results) < 2 && !interrupted {
+		return
+	}
+	sort.SliceStable(bp.results, func(i, j int) bool {
+		return bp.results[i].src < bp.results[j].src
+	})
+
+	var failed, skipped int
+	for _, r := range bp.results {
+		switch {
+		case r.err == nil:
+		case interrupted && errors.Is(r.err, context.Canceled):
+			skipped++
+		default:
+			failed++
+		}
+	}
+	fields := []zap.Field{
+		zap.Int("books", len(bp.results)),
+		zap.Int("processed", len(bp.results)-failed-skipped),
+		zap.Int("failed", failed),
+	}
+	if interrupted {
+		bp.env.Log.Warn("Processing was interrupted, batch is incomplete", append(fields, zap.Int("interrupted", skipped))...)
+	} else {
+		bp.env.Log.Info("Processing summary", fields...)
+	}
+	for _, r := range bp.results {
+		if r.err != nil && !(interrupted && errors.Is(r.err, context.Canceled)) {
+			bp.env.Log.Warn("Book was not processed", zap.String("book", r.src), zap.Error(r.err))
+		}
+	}
+}
+
+// failures returns number of books which could not be processed, should be called after wait.
+func (bp *bookPool) failures() int {
+
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	count := 0
+	for _, r := range bp.results {
+		if r.err != nil {
+			count++
+		}
+	}
+	return count
+}
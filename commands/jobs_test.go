@@ -0,0 +1,187 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"fb2converter/state"
+)
+
+// logEntries parses JSON log lines.
+func logEntries(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var entries []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if len(line) == 0 {
+			continue
+		}
+		e := make(map[string]any)
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("bad log line %q: %v", line, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// findEntry returns first log entry with the message.
+func findEntry(entries []map[string]any, msg string) map[string]any {
+	for _, e := range entries {
+		if e["msg"] == msg {
+			return e
+		}
+	}
+	return nil
+}
+
+func testPoolEnv() (*state.LocalEnv, *bytes.Buffer) {
+	buf := &bytes.Buffer{}
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), zapcore.AddSync(buf), zap.DebugLevel)
+	return &state.LocalEnv{Log: zap.New(core)}, buf
+}
+
+func TestBookPool(t *testing.T) {
+
+	t.Run("jobs bound", func(t *testing.T) {
+		env, _ := testPoolEnv()
+		var running, peak atomic.Int32
+		bp := newBookPool(context.Background(), 3, func(ctx context.Context, r io.Reader, t *bookTask, env *state.LocalEnv) error {
+			n := running.Add(1)
+			defer running.Add(-1)
+			for {
+				p := peak.Load()
+				if n <= p || peak.CompareAndSwap(p, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			return nil
+		}, env)
+		for i := 0; i < 12; i++ {
+			bp.submit(&bookTask{src: fmt.Sprintf("%02d.fb2", i), data: []byte("book")})
+		}
+		bp.wait()
+		if p := peak.Load(); p > 3 {
+			t.Errorf("%d books were processed at the same time", p)
+		}
+		if len(bp.results) != 12 || bp.failures() != 0 {
+			t.Errorf("%d results, %d failures", len(bp.results), bp.failures())
+		}
+	})
+
+	t.Run("failures and panics", func(t *testing.T) {
+		env, buf := testPoolEnv()
+		bp := newBookPool(context.Background(), 2, func(ctx context.Context, r io.Reader, t *bookTask, env *state.LocalEnv) error {
+			data, _ := io.ReadAll(r)
+			switch string(data) {
+			case "bad":
+				return errors.New("broken book")
+			case "panic":
+				panic("processor bug")
+			}
+			return nil
+		}, env)
+		for _, src := range []string{"c.fb2", "a.fb2", "bad.fb2", "panic.fb2", "b.fb2"} {
+			bp.submit(&bookTask{src: src, data: []byte(strings.TrimSuffix(src, ".fb2")), msg: "Unable to process file"})
+		}
+		bp.wait()
+
+		if n := bp.failures(); n != 2 {
+			t.Errorf("%d failures, expected 2", n)
+		}
+		entries := logEntries(t, buf)
+		summary := findEntry(entries, "Processing summary")
+		if summary == nil || summary["books"] != 5.0 || summary["processed"] != 3.0 || summary["failed"] != 2.0 {
+			t.Errorf("unexpected summary %v", summary)
+		}
+		var failed []string
+		for _, e := range entries {
+			if e["msg"] == "Book was not processed" {
+				failed = append(failed, fmt.Sprintf("%s: %s", e["book"], e["error"]))
+			}
+		}
+		if strings.Join(failed, ", ") != "bad.fb2: broken book, panic.fb2: panic: processor bug" {
+			t.Errorf("failed books are not listed in order: %v", failed)
+		}
+	})
+
+	t.Run("single book", func(t *testing.T) {
+		env, buf := testPoolEnv()
+		bp := newBookPool(context.Background(), 1, func(ctx context.Context, r io.Reader, t *bookTask, env *state.LocalEnv) error {
+			return nil
+		}, env)
+		bp.submit(&bookTask{src: "a.fb2", data: []byte("a")})
+		bp.wait()
+		if findEntry(logEntries(t, buf), "Processing summary") != nil {
+			t.Error("summary is logged for a single book")
+		}
+	})
+
+	t.Run("cancellation", func(t *testing.T) {
+		env, buf := testPoolEnv()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		var processed []string
+		bp := newBookPool(ctx, 1, func(ctx context.Context, r io.Reader, t *bookTask, env *state.LocalEnv) error {
+			processed = append(processed, t.src)
+			if t.src == "b.fb2" {
+				// batch is interrupted while book is being converted
+				cancel()
+				<-ctx.Done()
+				return ctx.Err()
+			}
+			return nil
+		}, env)
+		for _, src := range []string{"a.fb2", "b.fb2", "c.fb2", "d.fb2"} {
+			bp.submit(&bookTask{src: src, data: []byte("book")})
+		}
+		bp.wait()
+
+		if strings.Join(processed, ",") != "a.fb2,b.fb2" {
+			t.Errorf("books processed after interruption: %v", processed)
+		}
+		entries := logEntries(t, buf)
+		summary := findEntry(entries, "Processing was interrupted, batch is incomplete")
+		if summary == nil || summary["books"] != 4.0 || summary["processed"] != 1.0 || summary["failed"] != 0.0 || summary["interrupted"] != 3.0 {
+			t.Errorf("unexpected summary %v", summary)
+		}
+		if findEntry(entries, "Book was not processed") != nil {
+			t.Error("interrupted books are reported as failed")
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		env, _ := testPoolEnv()
+		bp := newBookPool(context.Background(), 1, func(ctx context.Context, r io.Reader, t *bookTask, env *state.LocalEnv) error {
+			if t.src == "slow.fb2" {
+				<-ctx.Done()
+				return ctx.Err()
+			}
+			return nil
+		}, env)
+		bp.timeout = 10 * time.Millisecond
+		bp.submit(&bookTask{src: "slow.fb2", data: []byte("book")})
+		bp.submit(&bookTask{src: "fast.fb2", data: []byte("book")})
+		bp.wait()
+
+		if bp.failures() != 1 {
+			t.Fatalf("%d failures, expected 1", bp.failures())
+		}
+		for _, r := range bp.results {
+			if r.src == "slow.fb2" && !errors.Is(r.err, context.DeadlineExceeded) {
+				t.Errorf("slow book: unexpected error %v", r.err)
+			}
+		}
+	})
+}
@@ -0,0 +1,353 @@
+package commands
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+
+	"fb2converter/config"
+	"fb2converter/processor"
+	"fb2converter/state"
+)
+
+// metaSource is FB2 file which description is being edited, either plain file or book inside zip archive.
+type metaSource struct {
+	path  string // file on disk
+	entry string // name of the book in archive, empty for plain files
+}
+
+func (s *metaSource) String() string {
+	if len(s.entry) == 0 {
+		return s.path
+	}
+	return s.path + string(filepath.Separator) + filepath.FromSlash(s.entry)
+}
+
+// locateMetaSource finds book specified by SOURCE argument: path to fb2 file, path to zip archive with single fb2 book
+// or path to fb2 book inside zip archive.
+func locateMetaSource(src string) (*metaSource, error) {
+
+	var head, tail string
+	for head = src; len(head) != 0; head, tail = filepath.Split(head) {
+
+		head = strings.TrimSuffix(head, string(filepath.Separator))
+
+		fi, err := os.Stat(head)
+		if err != nil {
+			// does not exists - probably path in archive
+			continue
+		}
+		if !fi.Mode().IsRegular() {
+			return nil, fmt.Errorf("source must be fb2 file or zip archive (%s)", head)
+		}
+
+		if strings.EqualFold(filepath.Ext(head), ".fb2") {
+			if len(tail) != 0 {
+				return nil, fmt.Errorf("input source was not found (%s) => (%s)", head, strings.TrimPrefix(src, head))
+			}
+			return &metaSource{path: head}, nil
+		}
+
+		ok, err := isArchiveFile(head)
+		if err != nil {
+			return nil, fmt.Errorf("unable to check archive type: %w", err)
+		}
+		if !ok || !strings.EqualFold(filepath.Ext(head), ".zip") {
+			return nil, fmt.Errorf("only fb2 files and zip archives are supported (%s)", head)
+		}
+
+		entry := filepath.ToSlash(strings.TrimPrefix(strings.TrimPrefix(src, head), string(filepath.Separator)))
+		zr, err := zip.OpenReader(head)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open archive: %w", err)
+		}
+		defer zr.Close()
+
+		var books []string
+		for _, f := range zr.File {
+			if f.FileInfo().IsDir() || !strings.EqualFold(path.Ext(f.Name), ".fb2") {
+				continue
+			}
+			if len(entry) == 0 || f.Name == entry {
+				books = append(books, f.Name)
+			}
+		}
+		switch {
+		case len(books) == 0 && len(entry) == 0:
+			return nil, fmt.Errorf("archive has no fb2 books (%s)", head)
+		case len(books) == 0:
+			return nil, fmt.Errorf("book was not found in archive (%s) => (%s)", head, entry)
+		case len(books) > 1:
+			return nil, fmt.Errorf("archive has %d fb2 books, specify path to the book inside archive (%s)", len(books), head)
+		}
+		return &metaSource{path: head, entry: books[0]}, nil
+	}
+	return nil, fmt.Errorf("input source was not found (%s)", src)
+}
+
+// read returns content of the book.
+func (s *metaSource) read() ([]byte, error) {
+
+	if len(s.entry) == 0 {
+		return os.ReadFile(s.path)
+	}
+
+	zr, err := zip.OpenReader(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	for _, f := range zr.File {
+		if f.Name != s.entry {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	}
+	return nil, fmt.Errorf("book was not found in archive (%s)", s.entry)
+}
+
+// write replaces content of the book. Archives are rewritten with all other entries copied as is. New content goes to a
+// temporary file first, so original is not damaged if anything goes wrong.
+func (s *metaSource) write(data []byte) (err error) {
+
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.CreateTemp(filepath.Dir(s.path), "."+filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			out.Close()
+			os.Remove(out.Name())
+		}
+	}()
+
+	if len(s.entry) == 0 {
+		if _, err = out.Write(data); err != nil {
+			return err
+		}
+	} else if err = s.writeArchive(out, data); err != nil {
+		return err
+	}
+
+	if err = out.Chmod(fi.Mode().Perm()); err != nil {
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), s.path)
+}
+
+func (s *metaSource) writeArchive(out io.Writer, data []byte) error {
+
+	zr, err := zip.OpenReader(s.path)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	zw := zip.NewWriter(out)
+	if err := zw.SetComment(zr.Comment); err != nil {
+		return err
+	}
+	for _, f := range zr.File {
+		if f.Name != s.entry {
+			if err := zw.Copy(f); err != nil {
+				return fmt.Errorf("unable to copy archive entry (%s): %w", f.Name, err)
+			}
+			continue
+		}
+		fh := f.FileHeader
+		fh.CRC32, fh.CompressedSize, fh.CompressedSize64, fh.UncompressedSize, fh.UncompressedSize64 = 0, 0, 0, 0, 0
+		w, err := zw.CreateHeader(&fh)
+		if err != nil {
+			return fmt.Errorf("unable to create archive entry (%s): %w", f.Name, err)
+		}
+		if _, err := w.Write(data); err != nil {
+			return fmt.Errorf("unable to write archive entry (%s): %w", f.Name, err)
+		}
+	}
+	return zw.Close()
+}
+
+// metaSourceArg returns normalized SOURCE argument of meta subcommands.
+func metaSourceArg(ctx *cli.Context, env *state.LocalEnv) (*metaSource, error) {
+
+	src := ctx.Args().Get(0)
+	if len(src) == 0 {
+		return nil, errors.New("no input source has been specified")
+	}
+	if ctx.Args().Len() > 1 {
+		env.Log.Warn("Mailformed command line, too many sources", zap.Strings("ignoring", ctx.Args().Slice()[1:]))
+	}
+	src, err := filepath.Abs(src)
+	if err != nil {
+		return nil, errors.New("normalizing source path failed")
+	}
+	return locateMetaSource(src)
+}
+
+// MetaGet is "meta get" command body.
+func MetaGet(ctx *cli.Context) error {
+
+	const (
+		errPrefix = "meta get: "
+		errCode   = 1
+	)
+
+	env := ctx.Generic(state.FlagName).(*state.LocalEnv)
+
+	src, err := metaSourceArg(ctx, env)
+	if err != nil {
+		return cli.Exit(fmt.Errorf("%s%w", errPrefix, err), errCode)
+	}
+	data, err := src.read()
+	if err != nil {
+		return cli.Exit(fmt.Errorf("%sunable to read book: %w", errPrefix, err), errCode)
+	}
+
+	meta, err := processor.GetMeta(data, env)
+	if err != nil {
+		return cli.Exit(fmt.Errorf("%sunable to read description (%s): %w", errPrefix, src, err), errCode)
+	}
+	out, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return cli.Exit(fmt.Errorf("%s%w", errPrefix, err), errCode)
+	}
+	fmt.Fprintf(os.Stdout, "%s\n", out)
+	return nil
+}
+
+// parseAuthorName splits "First [Middle] Last" into author name parts, single word is treated as last name.
+func parseAuthorName(s string) *config.AuthorName {
+	parts := strings.Fields(s)
+	switch len(parts) {
+	case 0:
+		return nil
+	case 1:
+		return &config.AuthorName{Last: parts[0]}
+	case 2:
+		return &config.AuthorName{First: parts[0], Last: parts[1]}
+	default:
+		return &config.AuthorName{First: parts[0], Middle: strings.Join(parts[1:len(parts)-1], " "), Last: parts[len(parts)-1]}
+	}
+}
+
+// metaFromFlags builds meta information from JSON file (if specified) and command line flags, flags take precedence.
+func metaFromFlags(ctx *cli.Context) (*config.MetaInfo, error) {
+
+	meta := &config.MetaInfo{}
+
+	if from := ctx.String("from"); len(from) > 0 {
+		var (
+			data []byte
+			err  error
+		)
+		if from == processor.StdStream {
+			data, err = io.ReadAll(os.Stdin)
+		} else {
+			data, err = os.ReadFile(from)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read meta information: %w", err)
+		}
+		if err := json.Unmarshal(data, meta); err != nil {
+			return nil, fmt.Errorf("unable to parse meta information: %w", err)
+		}
+	}
+
+	for name, v := range map[string]*string{
+		"id": &meta.ID, "title": &meta.Title, "lang": &meta.Lang, "sequence": &meta.SeqName, "date": &meta.Date,
+		"annotation": &meta.Annotation, "cover": &meta.CoverImage,
+	} {
+		if ctx.IsSet(name) {
+			*v = ctx.String(name)
+		}
+	}
+	if ctx.IsSet("sequence-number") {
+		meta.SeqNum = ctx.Int("sequence-number")
+	}
+	if ctx.IsSet("genre") {
+		meta.Genres = ctx.StringSlice("genre")
+	}
+	if ctx.IsSet("author") {
+		meta.Authors = nil
+		for _, a := range ctx.StringSlice("author") {
+			if an := parseAuthorName(a); an != nil {
+				meta.Authors = append(meta.Authors, an)
+			}
+		}
+	}
+	if ctx.Bool("remove-cover") {
+		if ctx.IsSet("cover") {
+			return nil, errors.New("cover could not be replaced and removed at the same time")
+		}
+		meta.CoverImage = "remove cover"
+	}
+	if len(meta.CoverImage) > 0 && meta.CoverImage != "remove cover" {
+		// relative to current directory rather than configuration
+		fname, err := filepath.Abs(meta.CoverImage)
+		if err != nil {
+			return nil, errors.New("normalizing cover path failed")
+		}
+		meta.CoverImage = fname
+	}
+	if reflect.DeepEqual(meta, &config.MetaInfo{}) {
+		return nil, errors.New("nothing to change, no meta information has been specified")
+	}
+	return meta, nil
+}
+
+// MetaSet is "meta set" command body.
+func MetaSet(ctx *cli.Context) error {
+
+	const (
+		errPrefix = "meta set: "
+		errCode   = 1
+	)
+
+	env := ctx.Generic(state.FlagName).(*state.LocalEnv)
+
+	src, err := metaSourceArg(ctx, env)
+	if err != nil {
+		return cli.Exit(fmt.Errorf("%s%w", errPrefix, err), errCode)
+	}
+	meta, err := metaFromFlags(ctx)
+	if err != nil {
+		return cli.Exit(fmt.Errorf("%s%w", errPrefix, err), errCode)
+	}
+
+	data, err := src.read()
+	if err != nil {
+		return cli.Exit(fmt.Errorf("%sunable to read book: %w", errPrefix, err), errCode)
+	}
+	if data, err = processor.SetMeta(data, meta, env); err != nil {
+		return cli.Exit(fmt.Errorf("%sunable to update description (%s): %w", errPrefix, src, err), errCode)
+	}
+	if err := src.write(data); err != nil {
+		return cli.Exit(fmt.Errorf("%sunable to write book (%s): %w", errPrefix, src, err), errCode)
+	}
+	env.Log.Info("Book description updated", zap.Stringer("book", src))
+	return nil
+}
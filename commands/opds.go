@@ -0,0 +1,204 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/google/uuid"
+	"github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+
+	"fb2converter/opds"
+	"fb2converter/processor"
+	"fb2converter/state"
+)
+
+// catalogHref returns link to the file relative to catalog directory.
+func catalogHref(dir, fname string) (string, error) {
+	rel, err := filepath.Rel(dir, fname)
+	if err != nil {
+		return "", err
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	for i := range parts {
+		parts[i] = url.PathEscape(parts[i])
+	}
+	return strings.Join(parts, "/"), nil
+}
+
+// saveCovers stores cover image and its thumbnail produced the same way synccovers does. Both are always JPEG.
+func saveCovers(data []byte, dir, name string, w, h int) (string, string, error) {
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", "", fmt.Errorf("unable to decode cover: %w", err)
+	}
+
+	cover, thumb := filepath.Join("covers", name+".jpg"), filepath.Join("covers", name+"_thumb.jpg")
+	if err := os.MkdirAll(filepath.Join(dir, "covers"), 0755); err != nil {
+		return "", "", err
+	}
+	if err := imaging.Save(img, filepath.Join(dir, cover), imaging.JPEGQuality(75)); err != nil {
+		return "", "", fmt.Errorf("unable to save cover: %w", err)
+	}
+	if err := imaging.Save(imaging.Thumbnail(img, w, h, imaging.Lanczos), filepath.Join(dir, thumb), imaging.JPEGQuality(75)); err != nil {
+		return "", "", fmt.Errorf("unable to save thumbnail: %w", err)
+	}
+	return filepath.ToSlash(cover), filepath.ToSlash(thumb), nil
+}
+
+// catalogBook finds conversion results for the book and prepares catalog entry, books without results are not
+// included in catalog.
+func catalogBook(b *processor.CatalogBook, path, library, dir string, w, h int, env *state.LocalEnv) (*opds.Book, error) {
+
+	id := b.ID
+	if len(id) == 0 {
+		// stable between runs
+		id = uuid.NewSHA1(uuid.NameSpaceURL, []byte(b.Source)).String()
+	}
+
+	book := &opds.Book{
+		ID:         id,
+		Title:      b.Title,
+		Authors:    b.Authors,
+		AuthorSort: b.AuthorSort,
+		Series:     b.Sequence,
+		SeriesNum:  b.SequenceNumber,
+		Genres:     b.Genres,
+		Lang:       b.Lang,
+		Issued:     b.Date,
+		Summary:    b.Annotation,
+	}
+
+	add := func(fname, ct string) error {
+		fi, err := os.Stat(fname)
+		if err != nil || !fi.Mode().IsRegular() {
+			return nil
+		}
+		href, err := catalogHref(dir, fname)
+		if err != nil {
+			return err
+		}
+		for _, l := range book.Files {
+			if l.Href == href {
+				return nil
+			}
+		}
+		book.Files = append(book.Files, opds.Link{Rel: opds.RelAcquisition, Href: href, Type: ct})
+		if fi.ModTime().After(book.Updated) {
+			book.Updated = fi.ModTime()
+		}
+		return nil
+	}
+	for f := processor.OEpub; f < processor.UnsupportedOutputFmt; f++ {
+		if err := add(filepath.Join(library, b.Outputs[f]), contentTypes[f]); err != nil {
+			return nil, err
+		}
+	}
+	if len(path) > 0 && strings.HasPrefix(path, library+string(filepath.Separator)) {
+		// source itself is part of the library
+		if err := add(path, contentTypes[processor.OFb2]); err != nil {
+			return nil, err
+		}
+	}
+	if len(book.Files) == 0 {
+		env.Log.Debug("No conversion results found, skipping book", zap.String("book", b.Source))
+		return nil, nil
+	}
+
+	if len(b.Cover) > 0 {
+		var err error
+		// book IDs are not always unique, source paths are
+		name := uuid.NewSHA1(uuid.NameSpaceURL, []byte(b.Source)).String()
+		if book.Cover, book.Thumbnail, err = saveCovers(b.Cover, dir, name, w, h); err != nil {
+			env.Log.Warn("Unable to extract cover", zap.String("book", b.Source), zap.Error(err))
+		}
+	}
+	return book, nil
+}
+
+// Opds is "opds" command body.
+func Opds(ctx *cli.Context) error {
+
+	const (
+		errPrefix = "opds: "
+		errCode   = 1
+	)
+
+	env := ctx.Generic(state.FlagName).(*state.LocalEnv)
+
+	src, err := sourcePath(ctx)
+	if err != nil {
+		return cli.Exit(fmt.Errorf("%s%w", errPrefix, err), errCode)
+	}
+	if src == processor.StdStream {
+		return cli.Exit(fmt.Errorf("%scatalog could not be built from STDIN", errPrefix), errCode)
+	}
+
+	library := ctx.Args().Get(1)
+	if len(library) == 0 {
+		return cli.Exit(fmt.Errorf("%slibrary directory has not been specified", errPrefix), errCode)
+	}
+	if library, err = filepath.Abs(library); err != nil {
+		return cli.Exit(fmt.Errorf("%snormalizing library path failed", errPrefix), errCode)
+	}
+	if fi, err := os.Stat(library); err != nil || !fi.IsDir() {
+		return cli.Exit(fmt.Errorf("%slibrary must be an existing directory (%s)", errPrefix, library), errCode)
+	}
+	if ctx.Args().Len() > 2 {
+		env.Log.Warn("Mailformed command line, too many destinations", zap.Strings("ignoring", ctx.Args().Slice()[2:]))
+	}
+
+	dir := filepath.Join(library, ctx.String("catalog"))
+	nodirs := ctx.Bool("nodirs")
+	width, height := ctx.Int("width"), ctx.Int("height")
+	cpage, depth := archiveOptions(ctx, env)
+
+	cat := &opds.Catalog{Title: ctx.String("title"), New: ctx.Int("new")}
+
+	env.Log.Info("Catalog creation starting", zap.String("source", src), zap.String("library", library), zap.String("catalog", dir))
+	defer func(start time.Time) {
+		env.Log.Info("Catalog creation completed", zap.Duration("elapsed", time.Since(start)), zap.Int("books", len(cat.Books)))
+	}(time.Now())
+
+	var mu sync.Mutex
+	bp := newBookPool(ctx.Context, 1, func(_ context.Context, r io.Reader, t *bookTask, env *state.LocalEnv) error {
+
+		if t.kind != processor.InFb2 {
+			env.Log.Debug("Skipping file, only FB2 could be cataloged", zap.String("file", t.src))
+			return nil
+		}
+
+		b, err := processor.ReadCatalogBook(processor.UnicodeReader(r, t.enc), t.enc == processor.EncUnknown, t.src, nodirs, env)
+		if err != nil {
+			return err
+		}
+		book, err := catalogBook(b, t.path, library, dir, width, height, env)
+		if err != nil || book == nil {
+			return err
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		cat.Books = append(cat.Books, book)
+		return nil
+	}, env)
+
+	if err := processSource(src, false, cpage, depth, bp, env); err != nil {
+		return cli.Exit(fmt.Errorf("%s%w", errPrefix, err), errCode)
+	}
+	if err := cat.Write(dir); err != nil {
+		return cli.Exit(fmt.Errorf("%sunable to write catalog: %w", errPrefix, err), errCode)
+	}
+	return nil
+}
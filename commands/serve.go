@@ -0,0 +1,656 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+
+	"fb2converter/config"
+	"fb2converter/misc"
+	"fb2converter/processor"
+	"fb2converter/state"
+)
+
+// Conversion job states.
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// convertJob is a single book submitted for conversion.
+type convertJob struct {
+	ID       string     `json:"id"`
+	Status   string     `json:"status"`
+	Source   string     `json:"source"`
+	Format   string     `json:"format"`
+	Result   string     `json:"result,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	Created  time.Time  `json:"created"`
+	Finished *time.Time `json:"finished,omitempty"`
+
+	format processor.OutputFmt
+	cfg    *config.Config // configuration adjusted by request, nil if server configuration is used
+	dir    string         // temporary directory with uploaded book and conversion results
+	input  string
+	output string
+	// cancels asynchronous conversion
+	cancel  context.CancelFunc
+	removed bool
+}
+
+// contentTypes are used for conversion results.
+var contentTypes = map[processor.OutputFmt]string{
+	processor.OEpub:   "application/epub+zip",
+	processor.OKepub:  "application/epub+zip",
+	processor.OEpub3:  "application/epub+zip",
+	processor.OAzw3:   "application/vnd.amazon.ebook",
+	processor.OMobi:   "application/x-mobipocket-ebook",
+	processor.OFb2:    "application/x-fictionbook+xml",
+	processor.OFb2Zip: "application/zip",
+	processor.OTxt:    "text/plain; charset=utf-8",
+	processor.OMd:     "text/markdown; charset=utf-8",
+	processor.OHtml:   "text/html; charset=utf-8",
+}
+
+// server keeps state of conversion server.
+type server struct {
+	env     *state.LocalEnv
+	depth   int
+	maxSize int64
+	keep    time.Duration
+	// limits conversion time of a single book
+	timeout time.Duration
+
+	// limits number of conversions running at the same time
+	sem chan struct{}
+	// asynchronous conversions are canceled when server is stopping
+	ctx context.Context
+	// running asynchronous conversions
+	wg sync.WaitGroup
+
+	mu   sync.Mutex
+	jobs map[string]*convertJob
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	// nothing could be done on error at this point, client will see broken response
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// newJob creates job and saves uploaded book into its temporary directory. Book is either sent as "file" field of
+// multipart form or as request body, in which case "name" query parameter could be used to give it proper name.
+// Configuration fragment (JSON) could be sent as "config" query parameter or form field, it is merged with server
+// configuration the same way additional --config file would be. Only options from requestOptions are accepted.
+func (s *server) newJob(w http.ResponseWriter, r *http.Request) (*convertJob, int, error) {
+
+	to := r.URL.Query().Get("to")
+	if len(to) == 0 {
+		to = processor.OEpub.String()
+	}
+	format := processor.ParseFmtString(to)
+	if format == processor.UnsupportedOutputFmt {
+		return nil, http.StatusBadRequest, fmt.Errorf("unsupported output format %q", to)
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.maxSize)
+
+	var (
+		name, opts string
+		in         io.Reader
+	)
+	if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct == "multipart/form-data" {
+		f, hdr, err := r.FormFile("file")
+		if err != nil {
+			return nil, uploadStatus(err), fmt.Errorf("unable to read uploaded file: %w", err)
+		}
+		defer f.Close()
+		name, in = hdr.Filename, f
+		if v := r.MultipartForm.Value["config"]; len(v) > 0 {
+			opts = v[0]
+		}
+	} else {
+		name, in = r.URL.Query().Get("name"), r.Body
+	}
+	if len(opts) == 0 {
+		opts = r.URL.Query().Get("config")
+	}
+
+	if len(name) > 0 {
+		base := filepath.Base(filepath.FromSlash(name))
+		if len(base) == 0 || base == "." || base == ".." || base == string(filepath.Separator) {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid book name %q", name)
+		}
+		name = base
+	}
+
+	var cfg *config.Config
+	if len(opts) > 0 {
+		err := checkRequestOptions([]byte(opts))
+		if err == nil {
+			var base []byte
+			if base, err = s.env.Cfg.GetBytes(); err == nil {
+				cfg, err = config.BuildConfigData(s.env.Cfg.Path, base, []byte(opts))
+			}
+		}
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("bad configuration: %w", err)
+		}
+	}
+
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return nil, uploadStatus(err), fmt.Errorf("unable to read uploaded file: %w", err)
+	}
+	if len(name) == 0 {
+		// without name only FB2 could be recognized by content, anything else is treated as archive
+		name = "book.zip"
+		if ok, kind, _ := detectBook(data); ok && kind == processor.InFb2 {
+			name = "book.fb2"
+		}
+	}
+
+	u, err := uuid.NewRandom()
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("unable to generate UUID: %w", err)
+	}
+	dir, err := os.MkdirTemp("", "fb2c-serve-")
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("unable to create temporary directory: %w", err)
+	}
+
+	job := &convertJob{
+		ID:      u.String(),
+		Status:  jobQueued,
+		Source:  name,
+		Format:  format.String(),
+		Created: time.Now(),
+		format:  format,
+		cfg:     cfg,
+		dir:     dir,
+		input:   filepath.Join(dir, "in", name),
+	}
+	if err := os.MkdirAll(filepath.Dir(job.input), 0700); err == nil {
+		err = os.WriteFile(job.input, data, 0600)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, http.StatusInternalServerError, fmt.Errorf("unable to store uploaded file: %w", err)
+	}
+	return job, 0, nil
+}
+
+// requestOptions lists configuration options client is allowed to set per request, with all their content. Options naming
+// files (stylesheet, cover and vignette images, fonts, kindlegen, logs, output names) are never accepted, otherwise
+// client could have any file readable by server embedded into converted book.
+var requestOptions = map[string]bool{
+	"document.title_format":                    true,
+	"document.author_format":                   true,
+	"document.author_format_meta":              true,
+	"document.author_format_file_name":         true,
+	"document.transliterate_meta":              true,
+	"document.open_from_cover":                 true,
+	"document.chapter_per_file":                true,
+	"document.chapter_level":                   true,
+	"document.series_number_positions":         true,
+	"document.series_first_word_length":        true,
+	"document.remove_png_transparency":         true,
+	"document.optimize_images":                 true,
+	"document.jpeq_quality_level":              true,
+	"document.images_scale_factor":             true,
+	"document.characters_per_page":             true,
+	"document.pages_per_file":                  true,
+	"document.chapter_subtitle_dividers":       true,
+	"document.insert_soft_hyphen":              true,
+	"document.ignore_nonbreakable_space":       true,
+	"document.use_broken_images":               true,
+	"document.fix_zip_format":                  true,
+	"document.dropcaps":                        true,
+	"document.notes":                           true,
+	"document.annotation":                      true,
+	"document.toc":                             true,
+	"document.cover.always_convert":            true,
+	"document.cover.default":                   true,
+	"document.cover.width":                     true,
+	"document.cover.height":                    true,
+	"document.cover.resize":                    true,
+	"document.cover.stamp_placement":           true,
+	"document.vignettes.create":                true,
+	"document.transform":                       true,
+	"document.tags":                            true,
+	"document.kindlegen.use_kindlegen":         true,
+	"document.kindlegen.compression_level":     true,
+	"document.kindlegen.no_mobi_optimization":  true,
+	"document.kindlegen.remove_personal_label": true,
+	"document.kindlegen.generate_apnx":         true,
+	"document.kindlegen.force_asin_on_azw3":    true,
+	"overwrites[].name":                        true,
+	"overwrites[].meta.id":                     true,
+	"overwrites[].meta.asin":                   true,
+	"overwrites[].meta.title":                  true,
+	"overwrites[].meta.language":               true,
+	"overwrites[].meta.genres":                 true,
+	"overwrites[].meta.authors":                true,
+	"overwrites[].meta.sequence":               true,
+	"overwrites[].meta.sequence_number":        true,
+	"overwrites[].meta.date":                   true,
+	"overwrites[].meta.annotation":             true,
+}
+
+// checkRequestOptions makes sure configuration fragment sent by client only has options from requestOptions.
+func checkRequestOptions(data []byte) error {
+
+	var opts map[string]any
+	if err := json.Unmarshal(data, &opts); err != nil {
+		return err
+	}
+	return checkOption("", opts)
+}
+
+func checkOption(path string, v any) error {
+
+	if requestOptions[path] {
+		return nil
+	}
+	switch v := v.(type) {
+	case map[string]any:
+		for _, k := range slices.Sorted(maps.Keys(v)) {
+			name := k
+			if len(path) > 0 {
+				name = path + "." + k
+			}
+			if err := checkOption(name, v[k]); err != nil {
+				return err
+			}
+		}
+		return nil
+	case []any:
+		for _, e := range v {
+			if err := checkOption(path+"[]", e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("option %q could not be set per request", path)
+}
+
+func uploadStatus(err error) int {
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// convert converts uploaded book, only single book is expected even when archive was uploaded. Conversion is abandoned
+// when context is canceled (client of synchronous request went away).
+func (s *server) convert(ctx context.Context, job *convertJob) error {
+
+	env := *s.env
+	env.Log = s.env.Log.With(zap.String("job", job.ID))
+	if job.cfg != nil {
+		env.Cfg = job.cfg
+	}
+
+	out := filepath.Join(job.dir, "out")
+	bp := newBookPool(ctx, 1, func(ctx context.Context, r io.Reader, t *bookTask, env *state.LocalEnv) error {
+		if len(job.output) > 0 {
+			return errors.New("only single book could be converted per request")
+		}
+		fname, err := processBook(ctx, r, t.kind, t.enc, t.src, out, true, false, true, job.format, env)
+		if err != nil {
+			return err
+		}
+		job.output = fname
+		return nil
+	}, &env)
+	bp.timeout = s.timeout
+
+	if err := processSource(job.input, false, nil, s.depth, bp, &env); err != nil {
+		return err
+	}
+	for _, r := range bp.results {
+		if r.err != nil {
+			return fmt.Errorf("%s: %w", r.src, r.err)
+		}
+	}
+	if len(job.output) == 0 {
+		return errors.New("no books found")
+	}
+	return nil
+}
+
+// run waits for its turn and converts book.
+func (s *server) run(ctx context.Context, job *convertJob) error {
+
+	select {
+	case s.sem <- struct{}{}:
+	case <-ctx.Done():
+		return s.finish(job, ctx.Err())
+	}
+	defer func() { <-s.sem }()
+
+	s.mu.Lock()
+	job.Status = jobRunning
+	s.mu.Unlock()
+
+	return s.finish(job, s.convert(ctx, job))
+}
+
+// finish records outcome of the job.
+func (s *server) finish(job *convertJob, err error) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	job.Finished = &now
+	if err != nil {
+		job.Status, job.Error = jobFailed, err.Error()
+	} else {
+		job.Status, job.Result = jobDone, filepath.Base(job.output)
+	}
+	return err
+}
+
+// sendResult writes converted book to the client.
+func sendResult(w http.ResponseWriter, job *convertJob) {
+
+	f, err := os.Open(job.output)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer f.Close()
+
+	ct := contentTypes[job.format]
+	if len(ct) == 0 {
+		ct = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", ct)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filepath.Base(job.output)}))
+	if fi, err := f.Stat(); err == nil {
+		w.Header().Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+	}
+	w.WriteHeader(http.StatusOK)
+	// error here means client went away
+	_, _ = io.Copy(w, f)
+}
+
+func (s *server) handleConvert(w http.ResponseWriter, r *http.Request) {
+
+	job, code, err := s.newJob(w, r)
+	if err != nil {
+		writeError(w, code, err)
+		return
+	}
+
+	if async, _ := strconv.ParseBool(r.URL.Query().Get("async")); async {
+		ctx, cancel := context.WithCancel(s.ctx)
+		job.cancel = cancel
+
+		s.mu.Lock()
+		s.jobs[job.ID] = job
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer cancel()
+			if err := s.run(ctx, job); err != nil {
+				s.env.Log.Warn("Conversion failed", zap.String("job", job.ID), zap.Error(err))
+			}
+			// job could be deleted while it was running, nobody else would clean after it
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if job.removed {
+				os.RemoveAll(job.dir)
+			}
+		}()
+
+		w.Header().Set("Location", "/api/jobs/"+job.ID)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		writeJSON(w, http.StatusAccepted, job)
+		return
+	}
+
+	defer os.RemoveAll(job.dir)
+	if err := s.run(r.Context(), job); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	sendResult(w, job)
+}
+
+// job finds asynchronous job by request path.
+func (s *server) job(w http.ResponseWriter, r *http.Request) *convertJob {
+
+	s.mu.Lock()
+	job, ok := s.jobs[r.PathValue("id")]
+	s.mu.Unlock()
+
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("job not found"))
+		return nil
+	}
+	return job
+}
+
+func (s *server) handleJob(w http.ResponseWriter, r *http.Request) {
+	if job := s.job(w, r); job != nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		writeJSON(w, http.StatusOK, job)
+	}
+}
+
+func (s *server) handleResult(w http.ResponseWriter, r *http.Request) {
+
+	job := s.job(w, r)
+	if job == nil {
+		return
+	}
+
+	s.mu.Lock()
+	status, msg := job.Status, job.Error
+	s.mu.Unlock()
+
+	switch status {
+	case jobDone:
+		sendResult(w, job)
+	case jobFailed:
+		writeError(w, http.StatusUnprocessableEntity, errors.New(msg))
+	default:
+		writeError(w, http.StatusConflict, fmt.Errorf("job is %s", status))
+	}
+}
+
+func (s *server) handleDelete(w http.ResponseWriter, r *http.Request) {
+
+	job := s.job(w, r)
+	if job == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.jobs, job.ID)
+	if job.Status == jobQueued || job.Status == jobRunning {
+		// conversion is abandoned, its goroutine removes results when done
+		job.removed = true
+		job.cancel()
+	} else {
+		os.RemoveAll(job.dir)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) handleHealth(w http.ResponseWriter, r *http.Request) {
+
+	s.mu.Lock()
+	count := len(s.jobs)
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"status":  "ok",
+		"version": misc.GetVersion(),
+		"running": len(s.sem),
+		"jobs":    count,
+	})
+}
+
+func (s *server) handleFormats(w http.ResponseWriter, r *http.Request) {
+
+	var formats []string
+	for f := processor.OEpub; f < processor.UnsupportedOutputFmt; f++ {
+		formats = append(formats, f.String())
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"formats": formats,
+		// EPUB input could only be converted to these
+		"epub": []string{processor.OKepub.String(), processor.OAzw3.String(), processor.OMobi.String()},
+	})
+}
+
+// expire removes finished asynchronous jobs which results were not collected in time.
+func (s *server) expire(now time.Time) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, job := range s.jobs {
+		if job.Finished != nil && now.Sub(*job.Finished) > s.keep {
+			s.env.Log.Debug("Removing expired job", zap.String("job", id))
+			delete(s.jobs, id)
+			os.RemoveAll(job.dir)
+		}
+	}
+}
+
+// Serve is "serve" command body.
+func Serve(ctx *cli.Context) error {
+
+	const (
+		errPrefix = "serve: "
+		errCode   = 1
+	)
+
+	env := ctx.Generic(state.FlagName).(*state.LocalEnv)
+
+	if ctx.Args().Len() > 0 {
+		env.Log.Warn("Mailformed command line, too many arguments", zap.Strings("ignoring", ctx.Args().Slice()))
+	}
+
+	jobs := ctx.Int("jobs")
+	if jobs < 1 {
+		env.Log.Warn("Number of parallel jobs should be positive, converting books one by one", zap.Int("jobs", jobs))
+		jobs = 1
+	}
+	_, depth := archiveOptions(ctx, env)
+
+	sctx, cancel := signal.NotifyContext(ctx.Context, os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	s := &server{
+		env:     env,
+		depth:   depth,
+		maxSize: int64(ctx.Int("max-size")) << 20,
+		keep:    ctx.Duration("keep"),
+		timeout: ctx.Duration("timeout"),
+		sem:     make(chan struct{}, jobs),
+		ctx:     sctx,
+		jobs:    make(map[string]*convertJob),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/health", s.handleHealth)
+	mux.HandleFunc("GET /api/formats", s.handleFormats)
+	mux.HandleFunc("POST /api/convert", s.handleConvert)
+	mux.HandleFunc("GET /api/jobs/{id}", s.handleJob)
+	mux.HandleFunc("GET /api/jobs/{id}/result", s.handleResult)
+	mux.HandleFunc("DELETE /api/jobs/{id}", s.handleDelete)
+
+	srv := &http.Server{
+		Addr:              ctx.String("listen"),
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		ErrorLog:          zap.NewStdLog(env.Log),
+		// synchronous conversions are abandoned when server is stopping
+		BaseContext: func(net.Listener) context.Context { return sctx },
+	}
+
+	env.Log.Info("Server starting", zap.String("listen", srv.Addr), zap.Int("jobs", jobs))
+	defer func(start time.Time) {
+		env.Log.Info("Server stopped", zap.Duration("elapsed", time.Since(start)))
+	}(time.Now())
+
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-sctx.Done():
+				return
+			case now := <-ticker.C:
+				s.expire(now)
+			}
+		}
+	}()
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.ListenAndServe()
+	}()
+
+	var err error
+	select {
+	case err = <-errs:
+	case <-sctx.Done():
+		tctx, tcancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer tcancel()
+		err = srv.Shutdown(tctx)
+	}
+
+	// wait for canceled asynchronous conversions and clean after all jobs
+	cancel()
+	s.wg.Wait()
+	s.mu.Lock()
+	for id, job := range s.jobs {
+		delete(s.jobs, id)
+		os.RemoveAll(job.dir)
+	}
+	s.mu.Unlock()
+
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return cli.Exit(fmt.Errorf("%s%w", errPrefix, err), errCode)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"fb2converter/config"
+	"fb2converter/state"
+)
+
+func TestServe(t *testing.T) {
+
+	cfg, err := config.BuildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := &server{
+		env:     &state.LocalEnv{Cfg: cfg, Log: zap.NewNop()},
+		maxSize: 1 << 20,
+		keep:    time.Hour,
+		sem:     make(chan struct{}, 1),
+		ctx:     ctx,
+		jobs:    make(map[string]*convertJob),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/convert", s.handleConvert)
+	mux.HandleFunc("GET /api/jobs/{id}", s.handleJob)
+	mux.HandleFunc("DELETE /api/jobs/{id}", s.handleDelete)
+
+	post := func(query url.Values) *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/convert?"+query.Encode(), strings.NewReader("<FictionBook/>")))
+		return w
+	}
+
+	for _, name := range []string{".", "..", "/", "books/.."} {
+		if w := post(url.Values{"name": {name}}); w.Code != http.StatusBadRequest {
+			t.Errorf("name %q: status %d, expected bad request", name, w.Code)
+		}
+	}
+	if w := post(url.Values{"config": {"{broken"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("broken configuration: status %d, expected bad request", w.Code)
+	}
+
+	// client should not be able to read server files
+	secret := filepath.Join(t.TempDir(), "secret.css")
+	if err := os.WriteFile(secret, []byte("body { color: red; }"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, opts := range []string{
+		`{"document": {"style": "` + filepath.ToSlash(secret) + `"}}`,
+		`{"document": {"cover": {"width": 600, "image_path": "` + filepath.ToSlash(secret) + `"}}}`,
+		`{"document": {"kindlegen": {"path": "/bin/false"}}}`,
+		`{"document": {"vignettes": {"images": {"default": {"chapter_end": "` + filepath.ToSlash(secret) + `"}}}}}`,
+		`{"overwrites": [{"name": "*", "meta": {"title": "T", "cover_image": "` + filepath.ToSlash(secret) + `"}}]}`,
+		`{"logger": {"file": {"destination": "/tmp/log"}}}`,
+	} {
+		if w := post(url.Values{"config": {opts}}); w.Code != http.StatusBadRequest {
+			t.Errorf("configuration %s: status %d, expected bad request", opts, w.Code)
+		}
+	}
+
+	// conversion slot is taken, so job stays queued until it is deleted
+	s.sem <- struct{}{}
+
+	w := post(url.Values{
+		"name":   {"../book.fb2"},
+		"async":  {"true"},
+		"config": {`{"document": {"title_format": "{/b/}", "cover": {"width": 600}}, "overwrites": [{"name": "*", "meta": {"language": "de"}}]}`},
+	})
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+	var res convertJob
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Source != "book.fb2" {
+		t.Errorf("book name %q was not cleaned", res.Source)
+	}
+
+	s.mu.Lock()
+	job := s.jobs[res.ID]
+	s.mu.Unlock()
+	if job.cfg == nil || job.cfg.Doc.TitleFormat != "{/b/}" || job.cfg.Doc.Cover.Width != 600 || job.cfg.Overwrites["*"].Lang != "de" {
+		t.Error("request configuration was not applied")
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/api/jobs/"+res.ID, nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("delete of queued job: status %d", w.Code)
+	}
+
+	s.wg.Wait()
+	if job.Status != jobFailed {
+		t.Errorf("deleted job is %s", job.Status)
+	}
+	if _, err := os.Stat(job.dir); !os.IsNotExist(err) {
+		t.Error("deleted job directory was not removed")
+	}
+}
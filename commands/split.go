@@ -0,0 +1,169 @@
+package commands
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+
+	"fb2converter/processor"
+	"fb2converter/state"
+)
+
+// readFB2Document reads book from fb2 file or zip archive, see locateMetaSource for possible names.
+func readFB2Document(name string, env *state.LocalEnv) (*processor.FB2Document, *metaSource, error) {
+
+	src, err := filepath.Abs(name)
+	if err != nil {
+		return nil, nil, errors.New("normalizing source path failed")
+	}
+	ms, err := locateMetaSource(src)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := ms.read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to read book (%s): %w", ms, err)
+	}
+	enc := processor.DetectEncoding(data)
+	book, err := processor.ReadFB2Document(processor.UnicodeReader(bytes.NewReader(data), enc), enc == processor.EncUnknown, ms.String(), env)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to parse book (%s): %w", ms, err)
+	}
+	return book, ms, nil
+}
+
+// writeFB2Document writes book to file, existing file is only replaced when overwrite is requested.
+func writeFB2Document(book *processor.FB2Document, fname string, overwrite bool) error {
+
+	if _, err := os.Stat(fname); err == nil && !overwrite {
+		return fmt.Errorf("output file already exists (%s)", fname)
+	}
+	f, err := os.Create(fname)
+	if err != nil {
+		return fmt.Errorf("unable to create output file (%s): %w", fname, err)
+	}
+	if _, err := book.WriteTo(f); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to write output file (%s): %w", fname, err)
+	}
+	return f.Close()
+}
+
+// Split is "split" command body.
+func Split(ctx *cli.Context) error {
+
+	const (
+		errPrefix = "split: "
+		errCode   = 1
+	)
+
+	env := ctx.Generic(state.FlagName).(*state.LocalEnv)
+
+	if ctx.Args().Len() == 0 {
+		return cli.Exit(fmt.Errorf("%sno input source has been specified", errPrefix), errCode)
+	}
+	if ctx.Args().Len() > 2 {
+		env.Log.Warn("Mailformed command line, too many destinations", zap.Strings("ignoring", ctx.Args().Slice()[2:]))
+	}
+
+	book, src, err := readFB2Document(ctx.Args().Get(0), env)
+	if err != nil {
+		return cli.Exit(fmt.Errorf("%s%w", errPrefix, err), errCode)
+	}
+
+	dst := ctx.Args().Get(1)
+	if len(dst) == 0 {
+		dst = filepath.Dir(src.path)
+	}
+	if dst, err = watchDir(dst, "destination directory", false); err != nil {
+		return cli.Exit(fmt.Errorf("%s%w", errPrefix, err), errCode)
+	}
+
+	parts, err := book.Split()
+	if err != nil {
+		return cli.Exit(fmt.Errorf("%sunable to split book (%s): %w", errPrefix, src, err), errCode)
+	}
+
+	name := filepath.Base(src.path)
+	if len(src.entry) > 0 {
+		name = filepath.Base(filepath.FromSlash(src.entry))
+	}
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	width := len(fmt.Sprint(len(parts)))
+	for i, part := range parts {
+		fname := filepath.Join(dst, fmt.Sprintf("%s - %0*d.fb2", name, width, i+1))
+		if err := writeFB2Document(part, fname, ctx.Bool("overwrite")); err != nil {
+			return cli.Exit(fmt.Errorf("%s%w", errPrefix, err), errCode)
+		}
+		env.Log.Info("Book part written", zap.String("title", part.Title), zap.String("to", fname))
+	}
+	return nil
+}
+
+// Merge is "merge" command body.
+func Merge(ctx *cli.Context) error {
+
+	const (
+		errPrefix = "merge: "
+		errCode   = 1
+	)
+
+	env := ctx.Generic(state.FlagName).(*state.LocalEnv)
+
+	if ctx.Args().Len() < 3 {
+		return cli.Exit(fmt.Errorf("%sat least two sources and destination have to be specified", errPrefix), errCode)
+	}
+	args := ctx.Args().Slice()
+
+	dst, err := filepath.Abs(args[len(args)-1])
+	if err != nil {
+		return cli.Exit(fmt.Errorf("%snormalizing destination path failed", errPrefix), errCode)
+	}
+
+	books := make([]*processor.FB2Document, 0, len(args)-1)
+	for _, name := range args[:len(args)-1] {
+		book, _, err := readFB2Document(name, env)
+		if err != nil {
+			return cli.Exit(fmt.Errorf("%s%w", errPrefix, err), errCode)
+		}
+		books = append(books, book)
+	}
+	if ctx.Bool("by-sequence") {
+		sort.SliceStable(books, func(i, j int) bool { return books[i].SeqNum < books[j].SeqNum })
+	}
+
+	title := ctx.String("title")
+	if len(title) == 0 {
+		// series is named after the sequence
+		title = books[0].SeqName
+		for _, b := range books[1:] {
+			if b.SeqName != title {
+				title = ""
+				break
+			}
+		}
+	}
+	if len(title) == 0 {
+		return cli.Exit(fmt.Errorf("%sbooks do not belong to the same sequence, specify title of the merged book", errPrefix), errCode)
+	}
+
+	merged, err := processor.MergeFB2Documents(books, title)
+	if err != nil {
+		return cli.Exit(fmt.Errorf("%sunable to merge books: %w", errPrefix, err), errCode)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return cli.Exit(fmt.Errorf("%sunable to create destination directory: %w", errPrefix, err), errCode)
+	}
+	if err := writeFB2Document(merged, dst, ctx.Bool("overwrite")); err != nil {
+		return cli.Exit(fmt.Errorf("%s%w", errPrefix, err), errCode)
+	}
+	env.Log.Info("Merged book written", zap.String("title", title), zap.Int("books", len(books)), zap.String("to", dst))
+	return nil
+}
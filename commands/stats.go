@@ -0,0 +1,212 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+
+	"fb2converter/processor"
+	"fb2converter/state"
+)
+
+// statsTotals is library-wide summary of book metrics.
+type statsTotals struct {
+	Books        int            `json:"books"`
+	Failed       int            `json:"failed"`
+	Characters   int            `json:"characters"`
+	Words        int            `json:"words"`
+	Pages        int            `json:"pages"`
+	Notes        int            `json:"notes"`
+	Images       int            `json:"images"`
+	ImageBytes   int            `json:"image_bytes"`
+	BrokenImages int            `json:"broken_images"`
+	Languages    map[string]int `json:"languages"`
+	Encodings    map[string]int `json:"encodings_without_bom"`
+	WithBOM      int            `json:"with_bom"`
+	DefaultCover []string       `json:"default_cover"`
+}
+
+type statsReport struct {
+	Books  []*processor.BookStats `json:"books"`
+	Totals statsTotals            `json:"totals"`
+}
+
+func (r *statsReport) add(s *processor.BookStats) {
+
+	t := &r.Totals
+	r.Books = append(r.Books, s)
+	t.Books++
+	t.Characters += s.Characters
+	t.Words += s.Words
+	t.Pages += s.Pages
+	for _, n := range s.Notes {
+		t.Notes += n
+	}
+	t.Images += s.Images
+	t.ImageBytes += s.ImageBytes
+	t.BrokenImages += s.BrokenImages
+	t.Languages[s.Lang]++
+	if s.BOM {
+		t.WithBOM++
+	} else {
+		t.Encodings[s.Encoding]++
+	}
+	if s.DefaultCover {
+		t.DefaultCover = append(t.DefaultCover, s.Source)
+	}
+}
+
+// sortedCounts formats counters as "key (count)" list ordered by count.
+func sortedCounts(m map[string]int) string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if m[keys[i]] != m[keys[j]] {
+			return m[keys[i]] > m[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	list := make([]string, 0, len(keys))
+	for _, k := range keys {
+		list = append(list, fmt.Sprintf("%s (%d)", k, m[k]))
+	}
+	return strings.Join(list, ", ")
+}
+
+// writeTable prints report as text table followed by totals.
+func (r *statsReport) writeTable(out io.Writer) error {
+
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "Source\tLang\tEncoding\tCharacters\tWords\tPages\tNotes\tImages\tImage KB\tBroken\tCover\t")
+	for _, s := range r.Books {
+		notes := 0
+		for _, n := range s.Notes {
+			notes += n
+		}
+		enc := s.Encoding
+		if s.BOM {
+			enc = "BOM"
+		}
+		cover := "yes"
+		if s.DefaultCover {
+			cover = "default"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%s\t\n",
+			s.Source, s.Lang, enc, s.Characters, s.Words, s.Pages, notes, s.Images, (s.ImageBytes+1023)/1024, s.BrokenImages, cover)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	t := &r.Totals
+	fmt.Fprintln(out)
+	tw = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	for _, line := range [][2]string{
+		{"Books", fmt.Sprintf("%d (failed %d)", t.Books, t.Failed)},
+		{"Characters", strconv.Itoa(t.Characters)},
+		{"Words", strconv.Itoa(t.Words)},
+		{"Pages", strconv.Itoa(t.Pages)},
+		{"Notes", strconv.Itoa(t.Notes)},
+		{"Images", fmt.Sprintf("%d (%d KB, broken %d)", t.Images, (t.ImageBytes+1023)/1024, t.BrokenImages)},
+		{"Languages", sortedCounts(t.Languages)},
+		{"Encodings without BOM", sortedCounts(t.Encodings)},
+		{"Books with BOM", strconv.Itoa(t.WithBOM)},
+		{"Default cover", strconv.Itoa(len(t.DefaultCover))},
+	} {
+		fmt.Fprintf(tw, "%s:\t%s\n", line[0], line[1])
+	}
+	return tw.Flush()
+}
+
+// Stats is "stats" command body.
+func Stats(ctx *cli.Context) error {
+
+	const (
+		errPrefix = "stats: "
+		errCode   = 1
+	)
+
+	env := ctx.Generic(state.FlagName).(*state.LocalEnv)
+
+	src, err := sourcePath(ctx)
+	if err != nil {
+		return cli.Exit(fmt.Errorf("%s%w", errPrefix, err), errCode)
+	}
+	if ctx.Args().Len() > 1 {
+		env.Log.Warn("Mailformed command line, too many sources", zap.Strings("ignoring", ctx.Args().Slice()[1:]))
+	}
+
+	cpage, depth := archiveOptions(ctx, env)
+
+	env.Log.Info("Stats starting", zap.String("source", src))
+	defer func(start time.Time) {
+		env.Log.Info("Stats completed", zap.Duration("elapsed", time.Since(start)))
+	}(time.Now())
+
+	var (
+		mu     sync.Mutex
+		report = &statsReport{
+			Books: []*processor.BookStats{},
+			Totals: statsTotals{
+				Languages:    make(map[string]int),
+				Encodings:    make(map[string]int),
+				DefaultCover: []string{},
+			},
+		}
+	)
+
+	bp := newBookPool(ctx.Context, ctx.Int("jobs"), func(_ context.Context, r io.Reader, t *bookTask, env *state.LocalEnv) error {
+
+		if t.kind != processor.InFb2 {
+			env.Log.Debug("Skipping file, only FB2 statistics could be collected", zap.String("file", t.src))
+			return nil
+		}
+
+		s, err := processor.ReadStats(processor.UnicodeReader(r, t.enc), t.enc == processor.EncUnknown, t.src, env)
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		report.add(s)
+		return nil
+	}, env)
+
+	if err := processSource(src, false, cpage, depth, bp, env); err != nil {
+		return cli.Exit(fmt.Errorf("%s%w", errPrefix, err), errCode)
+	}
+	report.Totals.Failed = bp.failures()
+
+	// parallel processing makes order random
+	sort.Slice(report.Books, func(i, j int) bool { return report.Books[i].Source < report.Books[j].Source })
+	sort.Strings(report.Totals.DefaultCover)
+
+	if ctx.Bool("json") {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return cli.Exit(fmt.Errorf("%s%w", errPrefix, err), errCode)
+		}
+		fmt.Fprintf(os.Stdout, "%s\n", data)
+	} else if err := report.writeTable(os.Stdout); err != nil {
+		return cli.Exit(fmt.Errorf("%sunable to write results: %w", errPrefix, err), errCode)
+	}
+
+	if report.Totals.Failed > 0 {
+		return cli.Exit(fmt.Errorf("%sunable to collect statistics for %d book(s)", errPrefix, report.Totals.Failed), errCode)
+	}
+	return nil
+}
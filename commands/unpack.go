@@ -0,0 +1,80 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+
+	"fb2converter/processor"
+	"fb2converter/state"
+)
+
+// unpackNames are files and directories unpack creates in destination directory.
+var unpackNames = []string{"book.json", "records", "resources", "mobi7", "kf8"}
+
+// Unpack is "unpack" command body - dumps Kindle book structure for debugging.
+func Unpack(ctx *cli.Context) error {
+
+	const (
+		errPrefix = "unpack: "
+		errCode   = 1
+	)
+
+	env := ctx.Generic(state.FlagName).(*state.LocalEnv)
+
+	if ctx.Args().Len() < 2 {
+		return cli.Exit(fmt.Errorf("%sboth source book and destination directory must be specified", errPrefix), errCode)
+	}
+	if ctx.Args().Len() > 2 {
+		env.Log.Warn("Mailformed command line, too many destinations", zap.Strings("ignoring", ctx.Args().Slice()[2:]))
+	}
+
+	src, err := filepath.Abs(ctx.Args().Get(0))
+	if err != nil {
+		return cli.Exit(fmt.Errorf("%snormalizing source path failed", errPrefix), errCode)
+	}
+	if info, err := os.Stat(src); err != nil {
+		return cli.Exit(fmt.Errorf("%swrong book source has been specified: %w", errPrefix, err), errCode)
+	} else if !info.Mode().IsRegular() {
+		return cli.Exit(fmt.Errorf("%sbook source must be a file (%s)", errPrefix, src), errCode)
+	}
+
+	dst, err := filepath.Abs(ctx.Args().Get(1))
+	if err != nil {
+		return cli.Exit(fmt.Errorf("%snormalizing destination path failed", errPrefix), errCode)
+	}
+	if info, err := os.Stat(dst); err == nil && !info.IsDir() {
+		return cli.Exit(fmt.Errorf("%sdestination path must be a directory (%s)", errPrefix, dst), errCode)
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return cli.Exit(fmt.Errorf("%swrong destination path has been specified: %w", errPrefix, err), errCode)
+	}
+
+	// previous results would be confusing when mixed with new ones
+	for _, name := range unpackNames {
+		path := filepath.Join(dst, name)
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		if !ctx.Bool("overwrite") {
+			return cli.Exit(fmt.Errorf("%sdestination directory already has unpacked book, use --ow to replace it (%s)", errPrefix, dst), errCode)
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return cli.Exit(fmt.Errorf("%sunable to remove previous results: %w", errPrefix, err), errCode)
+		}
+	}
+
+	env.Log.Info("Unpacking starting", zap.String("file", src), zap.String("destination", dst))
+	defer func(start time.Time) {
+		env.Log.Info("Unpacking completed", zap.Duration("elapsed", time.Since(start)))
+	}(time.Now())
+
+	if err := processor.UnpackKindle(src, dst, env.Log); err != nil {
+		return cli.Exit(fmt.Errorf("%sunable to unpack book (%s): %w", errPrefix, src, err), errCode)
+	}
+	return nil
+}
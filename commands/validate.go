@@ -0,0 +1,132 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+
+	"fb2converter/processor"
+	"fb2converter/state"
+)
+
+// validationReport is produced for every validated book.
+type validationReport struct {
+	Source   string                      `json:"source"`
+	Valid    bool                        `json:"valid"`
+	Errors   int                         `json:"errors"`
+	Warnings int                         `json:"warnings"`
+	Issues   []processor.ValidationIssue `json:"issues,omitempty"`
+}
+
+func (r *validationReport) write(out io.Writer, asJSON bool) error {
+
+	if asJSON {
+		data, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(out, "%s\n", data)
+		return err
+	}
+
+	if len(r.Issues) == 0 {
+		_, err := fmt.Fprintf(out, "%s: ok\n", r.Source)
+		return err
+	}
+	if _, err := fmt.Fprintf(out, "%s: %d error(s), %d warning(s)\n", r.Source, r.Errors, r.Warnings); err != nil {
+		return err
+	}
+	for _, i := range r.Issues {
+		var err error
+		if len(i.Path) > 0 {
+			_, err = fmt.Fprintf(out, "    %-7s %s: %s\n", i.Level, i.Path, i.Message)
+		} else {
+			_, err = fmt.Fprintf(out, "    %-7s %s\n", i.Level, i.Message)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate is "validate" command body.
+func Validate(ctx *cli.Context) error {
+
+	const (
+		errPrefix = "validate: "
+		errCode   = 1
+	)
+
+	env := ctx.Generic(state.FlagName).(*state.LocalEnv)
+
+	src, err := sourcePath(ctx)
+	if err != nil {
+		return cli.Exit(fmt.Errorf("%s%w", errPrefix, err), errCode)
+	}
+	if ctx.Args().Len() > 1 {
+		env.Log.Warn("Mailformed command line, too many sources", zap.Strings("ignoring", ctx.Args().Slice()[1:]))
+	}
+
+	asJSON := ctx.Bool("json")
+	cpage, depth := archiveOptions(ctx, env)
+
+	env.Log.Info("Validation starting", zap.String("source", src))
+	defer func(start time.Time) {
+		env.Log.Info("Validation completed", zap.Duration("elapsed", time.Since(start)))
+	}(time.Now())
+
+	var (
+		mu             sync.Mutex
+		books, invalid int
+	)
+	bp := newBookPool(ctx.Context, 1, func(_ context.Context, r io.Reader, t *bookTask, env *state.LocalEnv) error {
+
+		if t.kind != processor.InFb2 {
+			env.Log.Debug("Skipping file, only FB2 could be validated", zap.String("file", t.src))
+			return nil
+		}
+
+		issues, err := processor.ValidateFB2(processor.UnicodeReader(r, t.enc), t.enc == processor.EncUnknown)
+		if err != nil {
+			return err
+		}
+
+		rpt := &validationReport{Source: t.src, Issues: issues}
+		for _, i := range issues {
+			if i.Level == processor.IssueError {
+				rpt.Errors++
+			} else {
+				rpt.Warnings++
+			}
+		}
+		rpt.Valid = rpt.Errors == 0
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		books++
+		if !rpt.Valid {
+			invalid++
+		}
+		return rpt.write(os.Stdout, asJSON)
+	}, env)
+
+	if err := processSource(src, false, cpage, depth, bp, env); err != nil {
+		return cli.Exit(fmt.Errorf("%s%w", errPrefix, err), errCode)
+	}
+	if failed := bp.failures(); failed > 0 {
+		return cli.Exit(fmt.Errorf("%s%d book(s) could not be validated", errPrefix, failed), errCode)
+	}
+	if invalid > 0 {
+		return cli.Exit(fmt.Errorf("%s%d of %d book(s) have errors", errPrefix, invalid, books), errCode)
+	}
+	return nil
+}
@@ -0,0 +1,435 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+	"golang.org/x/text/encoding"
+
+	"fb2converter/archive"
+	"fb2converter/processor"
+	"fb2converter/state"
+)
+
+// isWatchedFile checks if file arriving to hot folder should be converted. Archives are recognized the same way
+// "convert" does it.
+func isWatchedFile(fname string) bool {
+	if isBookName(fname) {
+		return true
+	}
+	format, _ := archive.Detect(fname)
+	return format != archive.Unknown
+}
+
+// readyFile is file which was not changed for a while and could be converted.
+type readyFile struct {
+	path string
+	// file existed before it was changed, previous conversion results should be replaced
+	modified bool
+}
+
+// hotFolder converts books as they appear in source directory.
+type hotFolder struct {
+	src, dst     string
+	done, failed string
+	delay        time.Duration
+
+	jobs    int
+	timeout time.Duration
+	cpage   encoding.Encoding
+	depth   int
+	action  func(overwrite bool) bookFunc
+	env     *state.LocalEnv
+
+	fsw *fsnotify.Watcher
+
+	mu       sync.Mutex
+	timers   map[string]*time.Timer
+	modified map[string]bool
+	ready    chan readyFile
+	// canceled when watching stops, interrupts conversion in progress
+	ctx context.Context
+}
+
+// ignored checks if path belongs to one of the directories program writes to, which could be inside source directory.
+func (h *hotFolder) ignored(path string) bool {
+	for _, dir := range []string{h.dst, h.done, h.failed} {
+		if len(dir) > 0 && (path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))) {
+			return true
+		}
+	}
+	return false
+}
+
+// add starts watching directory tree, books already present in newly created directories are scheduled for conversion
+// since they could arrive before watch was established.
+func (h *hotFolder) add(dir string, schedule bool) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			h.env.Log.Warn("Skipping path", zap.String("path", path), zap.Error(err))
+			return nil
+		}
+		if h.ignored(path) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			if err := h.fsw.Add(path); err != nil {
+				return fmt.Errorf("unable to watch directory (%s): %w", path, err)
+			}
+			h.env.Log.Debug("Watching directory", zap.String("dir", path))
+			return nil
+		}
+		if schedule && info.Mode().IsRegular() && isWatchedFile(path) {
+			h.schedule(path, false)
+		}
+		return nil
+	})
+}
+
+// schedule (re)starts debounce timer for the file, conversion starts when file was not changed for a while. File is
+// considered modified unless it was created while timer was running.
+func (h *hotFolder) schedule(path string, modified bool) {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if t, ok := h.timers[path]; ok {
+		h.modified[path] = h.modified[path] && modified
+		t.Reset(h.delay)
+		return
+	}
+	h.modified[path] = modified
+	h.timers[path] = time.AfterFunc(h.delay, func() {
+		h.mu.Lock()
+		f := readyFile{path: path, modified: h.modified[path]}
+		delete(h.timers, path)
+		delete(h.modified, path)
+		h.mu.Unlock()
+		select {
+		case h.ready <- f:
+		case <-h.ctx.Done():
+		}
+	})
+}
+
+// stop cancels all pending conversions.
+func (h *hotFolder) stop() {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for path, t := range h.timers {
+		t.Stop()
+		delete(h.timers, path)
+		delete(h.modified, path)
+	}
+}
+
+// handle reacts on file system event.
+func (h *hotFolder) handle(ev fsnotify.Event) {
+
+	if h.ignored(ev.Name) || !ev.Has(fsnotify.Create) && !ev.Has(fsnotify.Write) {
+		return
+	}
+	fi, err := os.Stat(ev.Name)
+	if err != nil {
+		// already gone
+		return
+	}
+	switch {
+	case fi.IsDir():
+		if ev.Has(fsnotify.Create) {
+			if err := h.add(ev.Name, true); err != nil {
+				h.env.Log.Error("Unable to watch directory", zap.String("dir", ev.Name), zap.Error(err))
+			}
+		}
+	case fi.Mode().IsRegular() && isWatchedFile(ev.Name):
+		h.schedule(ev.Name, !ev.Has(fsnotify.Create))
+	}
+}
+
+// convert processes single file from source directory, returns false if any of the books could not be converted.
+// Existing results are replaced when file was modified.
+func (h *hotFolder) convert(path string, modified bool) bool {
+
+	rel, err := filepath.Rel(h.src, path)
+	if err != nil {
+		h.env.Log.Error("Unable to process file", zap.String("file", path), zap.Error(err))
+		return false
+	}
+
+	bp := newBookPool(h.ctx, h.jobs, h.action(modified), h.env)
+	bp.timeout = h.timeout
+	if ok, err := isArchiveFile(path); err != nil {
+		h.env.Log.Error("Unable to check archive type", zap.String("file", path), zap.Error(err))
+		return false
+	} else if ok {
+		err = processArchive(path, "", filepath.Dir(rel), h.cpage, h.depth, bp, h.env)
+		bp.wait()
+		if err != nil {
+			h.env.Log.Error("Unable to process archive", zap.String("file", path), zap.Error(err))
+			return false
+		}
+	} else {
+		kind := processor.InFb2
+		ok, enc, err := isBookFile(path)
+		if err == nil && !ok {
+			if ok, err = isEpubFile(path); ok {
+				kind = processor.InEpub
+			}
+		}
+		if err != nil || !ok {
+			h.env.Log.Error("Unable to process file, not recognized as FB2 or EPUB book", zap.String("file", path), zap.Error(err))
+			return false
+		}
+		bp.submit(&bookTask{
+			kind:   kind,
+			enc:    enc,
+			src:    rel,
+			path:   path,
+			msg:    "Unable to process file",
+			fields: []zap.Field{zap.String("file", path)},
+		})
+		bp.wait()
+	}
+
+	if len(bp.results) == 0 {
+		h.env.Log.Error("Nothing to process, no books found", zap.String("file", path))
+		return false
+	}
+	return bp.failures() == 0
+}
+
+// move puts processed file into done or failed directory keeping its path relative to source directory.
+func (h *hotFolder) move(path string, ok bool) {
+
+	dir := h.done
+	if !ok {
+		dir = h.failed
+	}
+	if len(dir) == 0 {
+		return
+	}
+
+	rel, err := filepath.Rel(h.src, path)
+	if err != nil {
+		h.env.Log.Error("Unable to move file", zap.String("file", path), zap.Error(err))
+		return
+	}
+	to := filepath.Join(dir, rel)
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		h.env.Log.Error("Unable to move file", zap.String("file", path), zap.String("to", to), zap.Error(err))
+		return
+	}
+	if err := moveFile(path, to); err != nil {
+		h.env.Log.Error("Unable to move file", zap.String("file", path), zap.String("to", to), zap.Error(err))
+		return
+	}
+	h.env.Log.Debug("File moved", zap.String("file", path), zap.String("to", to))
+}
+
+// moveFile renames file, falling back to copy when destination is on a different device.
+func moveFile(from, to string) error {
+
+	if err := os.Rename(from, to); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(from)
+}
+
+// watchDir returns absolute path to the directory specified on command line.
+func watchDir(name, what string, mustExist bool) (string, error) {
+
+	if len(name) == 0 {
+		return "", nil
+	}
+	dir, err := filepath.Abs(name)
+	if err != nil {
+		return "", fmt.Errorf("normalizing %s path failed", what)
+	}
+	fi, err := os.Stat(dir)
+	switch {
+	case err == nil && !fi.IsDir():
+		return "", fmt.Errorf("%s is not a directory (%s)", what, dir)
+	case err == nil:
+		return dir, nil
+	case mustExist || !errors.Is(err, os.ErrNotExist):
+		return "", fmt.Errorf("%s is not accessible (%s): %w", what, dir, err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("unable to create %s (%s): %w", what, dir, err)
+	}
+	return dir, nil
+}
+
+// Watch is "watch" command body.
+func Watch(ctx *cli.Context) error {
+
+	const (
+		errPrefix = "watch: "
+		errCode   = 1
+	)
+
+	env := ctx.Generic(state.FlagName).(*state.LocalEnv)
+
+	if ctx.Args().Len() < 2 {
+		return cli.Exit(fmt.Errorf("%sboth source and destination directories must be specified", errPrefix), errCode)
+	}
+	if ctx.Args().Len() > 2 {
+		env.Log.Warn("Mailformed command line, too many destinations", zap.Strings("ignoring", ctx.Args().Slice()[2:]))
+	}
+
+	h := &hotFolder{
+		delay:    ctx.Duration("delay"),
+		jobs:     ctx.Int("jobs"),
+		timeout:  ctx.Duration("timeout"),
+		env:      env,
+		timers:   make(map[string]*time.Timer),
+		modified: make(map[string]bool),
+		ready:    make(chan readyFile),
+	}
+
+	var err error
+	for _, d := range []struct {
+		dir       *string
+		name      string
+		what      string
+		mustExist bool
+	}{
+		{&h.src, ctx.Args().Get(0), "source directory", true},
+		{&h.dst, ctx.Args().Get(1), "destination directory", false},
+		{&h.done, ctx.String("done"), "done directory", false},
+		{&h.failed, ctx.String("failed"), "failed directory", false},
+	} {
+		if *d.dir, err = watchDir(d.name, d.what, d.mustExist); err != nil {
+			return cli.Exit(fmt.Errorf("%s%w", errPrefix, err), errCode)
+		}
+	}
+	if h.ignored(h.src) {
+		return cli.Exit(fmt.Errorf("%ssource directory could not be inside destination, done or failed directories", errPrefix), errCode)
+	}
+
+	format := processor.ParseFmtString(ctx.String("to"))
+	if format == processor.UnsupportedOutputFmt {
+		env.Log.Warn("Unknown output format requested, switching to epub", zap.String("format", ctx.String("to")))
+		format = processor.OEpub
+	}
+	nodirs := ctx.Bool("nodirs")
+	overwrite := ctx.Bool("ow")
+
+	if h.delay <= 0 {
+		env.Log.Warn("Delay should be positive, using default", zap.Duration("delay", h.delay))
+		h.delay = 2 * time.Second
+	}
+	if h.jobs < 1 {
+		env.Log.Warn("Number of parallel jobs should be positive, converting books one by one", zap.Int("jobs", h.jobs))
+		h.jobs = 1
+	}
+	h.cpage, h.depth = archiveOptions(ctx, env)
+	h.action = func(modified bool) bookFunc {
+		return func(ctx context.Context, r io.Reader, t *bookTask, env *state.LocalEnv) error {
+			_, err := processBook(ctx, r, t.kind, t.enc, t.src, h.dst, nodirs, false, overwrite || modified, format, env)
+			return err
+		}
+	}
+
+	if h.fsw, err = fsnotify.NewWatcher(); err != nil {
+		return cli.Exit(fmt.Errorf("%sunable to start watcher: %w", errPrefix, err), errCode)
+	}
+	defer h.fsw.Close()
+
+	sctx, cancel := signal.NotifyContext(ctx.Context, os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	h.ctx = sctx
+
+	if err := h.add(h.src, ctx.Bool("existing")); err != nil {
+		return cli.Exit(fmt.Errorf("%s%w", errPrefix, err), errCode)
+	}
+
+	env.Log.Info("Watching starting", zap.String("source", h.src), zap.String("destination", h.dst), zap.Stringer("format", format))
+	defer func(start time.Time) {
+		env.Log.Info("Watching completed", zap.Duration("elapsed", time.Since(start)))
+	}(time.Now())
+
+	// books are converted one file at a time, events keep coming meanwhile
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-sctx.Done():
+				return
+			case f := <-h.ready:
+				if _, err := os.Stat(f.path); err != nil {
+					// removed or renamed while waiting
+					continue
+				}
+				ok := h.convert(f.path, f.modified)
+				if sctx.Err() != nil {
+					// conversion was interrupted, file stays where it was
+					return
+				}
+				h.move(f.path, ok)
+			}
+		}
+	}()
+
+	for done := false; !done; {
+		select {
+		case <-sctx.Done():
+			done = true
+		case ev, ok := <-h.fsw.Events:
+			if !ok {
+				done = true
+				break
+			}
+			h.handle(ev)
+		case err, ok := <-h.fsw.Errors:
+			if !ok {
+				done = true
+				break
+			}
+			env.Log.Warn("Watcher problem", zap.Error(err))
+		}
+	}
+	cancel()
+	h.stop()
+
+	// wait for interrupted conversion to clean up
+	wg.Wait()
+	return nil
+}
@@ -0,0 +1,184 @@
+package commands
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+
+	"fb2converter/config"
+	"fb2converter/state"
+)
+
+func TestHotFolderDebounce(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := &hotFolder{
+		delay:    100 * time.Millisecond,
+		env:      &state.LocalEnv{Log: zap.NewNop()},
+		timers:   make(map[string]*time.Timer),
+		modified: make(map[string]bool),
+		ready:    make(chan readyFile),
+		ctx:      ctx,
+	}
+
+	// file being written keeps postponing conversion, it stays new when created while timer was running
+	start := time.Now()
+	h.schedule("book.fb2", false)
+	for i := 0; i < 5; i++ {
+		time.Sleep(30 * time.Millisecond)
+		h.schedule("book.fb2", true)
+	}
+	last := time.Now()
+	select {
+	case f := <-h.ready:
+		if time.Since(last) < h.delay {
+			t.Errorf("file was ready %s after last change", time.Since(last))
+		}
+		if f.path != "book.fb2" || f.modified {
+			t.Errorf("unexpected ready file %+v", f)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("file was never ready")
+	}
+	if time.Since(start) < 250*time.Millisecond {
+		t.Error("changes did not postpone conversion")
+	}
+	select {
+	case f := <-h.ready:
+		t.Errorf("file was ready twice: %+v", f)
+	case <-time.After(3 * h.delay):
+	}
+
+	// changed existing file replaces previous results
+	h.schedule("book.fb2", true)
+	if f := <-h.ready; !f.modified {
+		t.Error("changed file is not marked as modified")
+	}
+
+	// pending conversions are dropped on stop
+	h.schedule("other.fb2", false)
+	h.stop()
+	select {
+	case f := <-h.ready:
+		t.Errorf("stopped file was ready: %+v", f)
+	case <-time.After(3 * h.delay):
+	}
+}
+
+func TestWatch(t *testing.T) {
+
+	root := t.TempDir()
+	src, dst := filepath.Join(root, "in"), filepath.Join(root, "out")
+	done, failed := filepath.Join(root, "done"), filepath.Join(root, "failed")
+	if err := os.MkdirAll(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// already present book is only converted when requested
+	if err := os.WriteFile(filepath.Join(src, "first.fb2"), []byte(convertTestBook), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := config.BuildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := &state.LocalEnv{Cfg: cfg, Log: zap.NewNop()}
+	app := &cli.App{
+		Flags:          []cli.Flag{&cli.GenericFlag{Name: state.FlagName, Hidden: true, Value: env}},
+		ExitErrHandler: func(*cli.Context, error) {},
+		Commands: []*cli.Command{{
+			Name:   "watch",
+			Action: Watch,
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "to", Value: "epub"},
+				&cli.BoolFlag{Name: "nodirs"},
+				&cli.BoolFlag{Name: "ow"},
+				&cli.StringFlag{Name: "force-zip-cp"},
+				&cli.IntFlag{Name: "jobs", Value: 1},
+				&cli.DurationFlag{Name: "timeout"},
+				&cli.IntFlag{Name: "archive-depth", Value: 2},
+				&cli.DurationFlag{Name: "delay"},
+				&cli.StringFlag{Name: "done"},
+				&cli.StringFlag{Name: "failed"},
+				&cli.BoolFlag{Name: "existing"},
+			},
+		}},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	result := make(chan error, 1)
+	go func() {
+		result <- app.RunContext(ctx, []string{"fb2c", "watch", "--delay", "200ms", "--existing", "--done", done, "--failed", failed, src, dst})
+	}()
+
+	exists := func(path string) bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+	waitFor := func(path string) {
+		t.Helper()
+		for deadline := time.Now().Add(10 * time.Second); !exists(path); time.Sleep(20 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s did not appear", path)
+			}
+		}
+	}
+
+	waitFor(filepath.Join(done, "first.fb2"))
+	if !exists(filepath.Join(dst, "first.epub")) || exists(filepath.Join(src, "first.fb2")) {
+		t.Error("existing book was not converted and moved")
+	}
+
+	// book is written in parts, conversion waits until file stops changing
+	book := filepath.Join(src, "sub", "second.fb2")
+	if err := os.MkdirAll(filepath.Dir(book), 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(book)
+	if err != nil {
+		t.Fatal(err)
+	}
+	half := len(convertTestBook) / 2
+	if _, err := f.WriteString(convertTestBook[:half]); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err := f.WriteString(convertTestBook[half:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// not a book goes to failed directory
+	if err := os.WriteFile(filepath.Join(src, "bad.fb2"), []byte("not a book"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(filepath.Join(done, "sub", "second.fb2"))
+	if !exists(filepath.Join(dst, "sub", "second.epub")) {
+		t.Error("book from new directory was not converted keeping its path")
+	}
+	waitFor(filepath.Join(failed, "bad.fb2"))
+	if exists(filepath.Join(dst, "bad.epub")) {
+		t.Error("result of failed conversion is present")
+	}
+
+	cancel()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("watch ended with error: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("watch did not stop")
+	}
+}
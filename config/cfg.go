@@ -9,6 +9,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/asaskevich/govalidator"
@@ -96,6 +97,7 @@ type MetaInfo struct {
 	SeqName    string        `json:"sequence"`
 	SeqNum     int           `json:"sequence_number"`
 	Date       string        `json:"date"`
+	Annotation string        `json:"annotation"`
 	CoverImage string        `json:"cover_image"`
 }
 
@@ -114,6 +116,17 @@ func (c *SMTPConfig) IsValid() bool {
 		len(c.To) > 0 && govalidator.IsEmail(c.To)
 }
 
+// TagMapping replaces built-in transfer of FB2 tag to XHTML. When Attr is specified only elements having this attribute
+// (with value Value, if it is not empty) are affected. Content of the element is transferred to XHTML tag To with CSS
+// class Class.
+type TagMapping struct {
+	Tag   string `json:"tag"`
+	Attr  string `json:"attr"`
+	Value string `json:"value"`
+	To    string `json:"to"`
+	Class string `json:"class"`
+}
+
 // Doc format configuration for book processor.
 type Doc struct {
 	TitleFormat           string   `json:"title_format"`
@@ -180,9 +193,11 @@ type Doc struct {
 	} `json:"vignettes"`
 	//
 	Transformations map[string]map[string]string `json:"transform"`
+	Tags            []TagMapping                 `json:"tags"`
 	//
 	Kindlegen struct {
 		Path             string `json:"path"`
+		UseKindlegen     bool   `json:"use_kindlegen"`
 		CompressionLevel int    `json:"compression_level"`
 		Verbose          bool   `json:"verbose"`
 		NoOptimization   bool   `json:"no_mobi_optimization"`
@@ -340,10 +355,30 @@ func BuildConfig(fnames ...string) (*Config, error) {
 		}
 	}
 
+	return buildConfig(configSources, base, fmt.Sprint(fnames))
+}
+
+// BuildConfigData loads configuration from JSON documents in memory rather than from files, later documents take
+// precedence. Relative paths found in configuration are resolved against base directory.
+func BuildConfigData(base string, docs ...[]byte) (*Config, error) {
+
+	var configSources = []source.Source{
+		memory.NewSource(memory.WithJSON(defaultConfig)),
+	}
+	for _, doc := range docs {
+		if len(doc) > 0 {
+			configSources = append(configSources, memory.NewSource(memory.WithJSON(doc)))
+		}
+	}
+	return buildConfig(configSources, base, "data")
+}
+
+func buildConfig(configSources []source.Source, base, name string) (*Config, error) {
+
 	c := config.NewConfig()
 
-	if err = c.Load(configSources...); err != nil {
-		return nil, fmt.Errorf("unable to parse configuration %v", fnames)
+	if err := c.Load(configSources...); err != nil {
+		return nil, fmt.Errorf("unable to parse configuration %s", name)
 	}
 
 	conf := Config{cfg: c, Path: base, Overwrites: make(map[string]MetaInfo)}
@@ -444,7 +479,7 @@ func (conf *Config) GetOverwrite(name string) *MetaInfo {
 		if i, ok := conf.Overwrites[name]; ok {
 			return &i
 		}
-		parts := strings.SplitN(name, "/", 1)
+		parts := strings.SplitN(name, "/", 2)
 		if len(parts) <= 1 {
 			break
 		}
@@ -516,6 +551,10 @@ func (conf *Config) GetActualBytes() ([]byte, error) {
 		}{Name: filepath.FromSlash(k), Meta: v}
 		a.H = append(a.H, s)
 	}
+	// keep output stable, so it could be compared
+	sort.Slice(a.H, func(i, j int) bool {
+		return a.H[i].Name < a.H[j].Name
+	})
 
 	// Marshall it to json
 	b, err := json.Marshal(a)
@@ -529,14 +568,20 @@ func (conf *Config) GetActualBytes() ([]byte, error) {
 	return out.Bytes(), err
 }
 
-// PrepareLog returns our standard logger. It prepares zap logger for use by the program.
-func (conf *Config) PrepareLog(rpt *reporter.Report) (*zap.Logger, error) {
+// PrepareLog returns our standard logger. It prepares zap logger for use by the program. When stdoutBusy is set program
+// output goes to STDOUT and all console logging is sent to STDERR.
+func (conf *Config) PrepareLog(rpt *reporter.Report, stdoutBusy bool) (*zap.Logger, error) {
 
 	// Console - split stdout and stderr, handle colors and redirection
 
+	lpOut := os.Stdout
+	if stdoutBusy {
+		lpOut = os.Stderr
+	}
+
 	ec := zap.NewDevelopmentEncoderConfig()
 	ec.EncodeCaller = nil
-	if EnableColorOutput(os.Stdout) {
+	if EnableColorOutput(lpOut) {
 		ec.EncodeLevel = zapcore.CapitalColorLevelEncoder
 	} else {
 		ec.EncodeLevel = zapcore.CapitalLevelEncoder
@@ -559,13 +604,13 @@ func (conf *Config) PrepareLog(rpt *reporter.Report) (*zap.Logger, error) {
 	var consoleCoreHP, consoleCoreLP zapcore.Core
 	switch conf.ConsoleLogger.Level {
 	case "normal":
-		consoleCoreLP = zapcore.NewCore(consoleEncoderLP, zapcore.Lock(os.Stdout),
+		consoleCoreLP = zapcore.NewCore(consoleEncoderLP, zapcore.Lock(lpOut),
 			zap.LevelEnablerFunc(func(lvl zapcore.Level) bool {
 				return zapcore.InfoLevel <= lvl && lvl < zapcore.ErrorLevel
 			}))
 		consoleCoreHP = zapcore.NewCore(consoleEncoderHP, zapcore.Lock(os.Stderr), highPriority)
 	case "debug":
-		consoleCoreLP = zapcore.NewCore(consoleEncoderLP, zapcore.Lock(os.Stdout),
+		consoleCoreLP = zapcore.NewCore(consoleEncoderLP, zapcore.Lock(lpOut),
 			zap.LevelEnablerFunc(func(lvl zapcore.Level) bool {
 				return zapcore.DebugLevel <= lvl && lvl < zapcore.ErrorLevel
 			}))
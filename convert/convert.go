@@ -0,0 +1,224 @@
+// Package convert is library interface to the converter: single book is read from io.Reader and result is written to
+// io.Writer. No command line, configuration files or logging setup is required.
+package convert
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"runtime/debug"
+
+	"go.uber.org/zap"
+
+	"fb2converter/config"
+	"fb2converter/processor"
+	"fb2converter/state"
+)
+
+// Format is output format.
+type Format string
+
+// Supported output formats, names are the same as for "--to" option of fb2c.
+const (
+	Epub   Format = "epub"
+	Epub3  Format = "epub3"
+	Kepub  Format = "kepub"
+	Azw3   Format = "azw3"
+	Mobi   Format = "mobi"
+	Fb2    Format = "fb2"
+	Fb2Zip Format = "fb2.zip"
+	Txt    Format = "txt"
+	Md     Format = "md"
+	HTML   Format = "html"
+)
+
+// Options controls conversion. Zero value converts FB2 to EPUB with default configuration.
+type Options struct {
+	// Format of the result, Epub when empty.
+	Format Format
+	// Name of the source book. It is used to find meta overwrites in configuration and as a book title when book does
+	// not have one, "book.fb2" when empty. Zip archives and names ending with ".epub" are treated as EPUB.
+	Name string
+	// Config is configuration in JSON, the same fb2c reads from file. Default configuration is used when empty.
+	Config []byte
+	// ConfigDir is directory relative paths in configuration (stylesheets, fonts, kindlegen) are resolved against.
+	ConfigDir string
+	// Meta overwrites book description, its non-empty fields take precedence over overwrites from configuration.
+	Meta *config.MetaInfo
+	// Logger receives conversion log, nothing is logged when nil.
+	Logger *zap.Logger
+}
+
+// Result describes converted book.
+type Result struct {
+	// ID is book identifier as written into result.
+	ID string
+	// Title is book title after meta overwrites.
+	Title string
+	// FileName is name of the result produced by file name template from configuration.
+	FileName string
+	// Size is number of bytes written.
+	Size int64
+}
+
+// Convert converts single FB2 or EPUB book. Context is checked between conversion stages and kills kindlegen, canceled
+// conversion returns context error.
+func Convert(ctx context.Context, r io.Reader, w io.Writer, opts *Options) (res *Result, err error) {
+
+	if opts == nil {
+		opts = &Options{}
+	}
+	env, format, name, err := prepare(opts)
+	if err != nil {
+		return nil, &Error{Kind: KindOptions, Err: err}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			env.Log.Error("Conversion ended with panic", zap.Any("panic", r), zap.ByteString("stack", debug.Stack()))
+			res, err = nil, &Error{Kind: KindOther, Err: fmt.Errorf("conversion ended with panic: %v", r)}
+		}
+	}()
+
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(4)
+
+	var p *processor.Processor
+	if bytes.HasPrefix(head, []byte("PK\x03\x04")) || filepath.Ext(name) == ".epub" {
+		data, err := io.ReadAll(br)
+		if err != nil {
+			return nil, &Error{Kind: KindOther, Err: fmt.Errorf("unable to read source: %w", err)}
+		}
+		if !isEpub(data) {
+			return nil, &Error{Kind: KindInput, Err: errors.New("source is neither FB2 nor EPUB book")}
+		}
+		p, err = processor.NewEPUB(bytes.NewReader(data), name, processor.StdStream, true, false, true, format, env)
+		if err != nil {
+			return nil, wrapError(err)
+		}
+	} else {
+		enc := processor.DetectEncoding(head)
+		if p, err = processor.NewFB2(processor.UnicodeReader(br, enc), enc == processor.EncUnknown, name, processor.StdStream, true, false, true, format, env); err != nil {
+			return nil, wrapError(err)
+		}
+	}
+	defer p.Clean()
+
+	if err := p.Process(ctx); err != nil {
+		return nil, wrapError(err)
+	}
+	cw := &countingWriter{w: w}
+	fname, err := p.SaveTo(ctx, cw)
+	if err != nil {
+		if cw.err != nil {
+			return nil, &Error{Kind: KindOutput, Err: fmt.Errorf("unable to write result: %w", cw.err)}
+		}
+		return nil, wrapError(err)
+	}
+	return &Result{ID: p.Book.ID.String(), Title: p.Book.Title, FileName: fname, Size: cw.n}, nil
+}
+
+// countingWriter counts bytes written and remembers write error, so it could be told apart from conversion errors.
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	if err != nil && c.err == nil {
+		c.err = err
+	}
+	return n, err
+}
+
+// prepare builds environment processor expects from options.
+func prepare(opts *Options) (*state.LocalEnv, processor.OutputFmt, string, error) {
+
+	to := opts.Format
+	if len(to) == 0 {
+		to = Epub
+	}
+	format := processor.ParseFmtString(string(to))
+	if format == processor.UnsupportedOutputFmt {
+		return nil, format, "", fmt.Errorf("unsupported output format %q", to)
+	}
+
+	cfg, err := config.BuildConfigData(opts.ConfigDir, opts.Config)
+	if err != nil {
+		return nil, format, "", err
+	}
+
+	name := opts.Name
+	if len(name) == 0 {
+		name = "book.fb2"
+	}
+	if opts.Meta != nil {
+		var meta config.MetaInfo
+		if m := cfg.GetOverwrite(name); m != nil {
+			meta = *m
+		}
+		cfg.Overwrites[filepath.ToSlash(name)] = mergeMeta(meta, opts.Meta)
+	}
+
+	log := opts.Logger
+	if log == nil {
+		log = zap.NewNop()
+	}
+	return &state.LocalEnv{Cfg: cfg, Log: log}, format, name, nil
+}
+
+// mergeMeta replaces fields of configured overwrite with fields set in options.
+func mergeMeta(meta config.MetaInfo, m *config.MetaInfo) config.MetaInfo {
+	for _, f := range []struct {
+		to   *string
+		from string
+	}{
+		{&meta.ID, m.ID},
+		{&meta.ASIN, m.ASIN},
+		{&meta.Title, m.Title},
+		{&meta.Lang, m.Lang},
+		{&meta.SeqName, m.SeqName},
+		{&meta.Date, m.Date},
+		{&meta.Annotation, m.Annotation},
+		{&meta.CoverImage, m.CoverImage},
+	} {
+		if len(f.from) > 0 {
+			*f.to = f.from
+		}
+	}
+	if m.SeqNum != 0 {
+		meta.SeqNum = m.SeqNum
+	}
+	if len(m.Genres) > 0 {
+		meta.Genres = m.Genres
+	}
+	if len(m.Authors) > 0 {
+		meta.Authors = m.Authors
+	}
+	return meta
+}
+
+// isEpub checks if zip archive looks like EPUB book, either mimetype or container has to be present.
+func isEpub(data []byte) bool {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return false
+	}
+	for _, f := range zr.File {
+		if f.Name == "mimetype" || f.Name == "META-INF/container.xml" {
+			return true
+		}
+	}
+	return false
+}
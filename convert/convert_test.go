@@ -0,0 +1,112 @@
+package convert
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"fb2converter/config"
+)
+
+const book = `<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+<description>
+  <title-info><genre>sf</genre><author><first-name>First</first-name><last-name>Author</last-name></author><book-title>Title</book-title><lang>en</lang></title-info>
+  <document-info><id>7f9f5a2e-3b8c-4d3e-9a49-9c1f2b3d4e5f</id></document-info>
+</description>
+<body><section><title><p>Chapter</p></title><p>Some text.</p></section></body>
+</FictionBook>`
+
+func TestConvert(t *testing.T) {
+
+	// kindlegen is not involved, so no temporary files should be necessary
+	t.Setenv("TMPDIR", filepath.Join(t.TempDir(), "missing"))
+
+	var buf bytes.Buffer
+	res, err := Convert(context.Background(), strings.NewReader(book), &buf, &Options{Meta: &config.MetaInfo{Title: "Changed"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ID != "7f9f5a2e-3b8c-4d3e-9a49-9c1f2b3d4e5f" || res.Title != "Changed" || !strings.HasSuffix(res.FileName, ".epub") {
+		t.Errorf("unexpected result %+v", res)
+	}
+	if res.Size != int64(buf.Len()) {
+		t.Errorf("size %d, written %d", res.Size, buf.Len())
+	}
+	if _, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len())); err != nil {
+		t.Errorf("result is not EPUB: %v", err)
+	}
+
+	// options are merged with configured overwrite field by field
+	buf.Reset()
+	res, err = Convert(context.Background(), strings.NewReader(book), &buf, &Options{
+		Config: []byte(`{"overwrites": [{"name": "*", "meta": {"id": "0c4b5bb8-0d36-4f5e-8f5a-6f3c1c1e2a7b", "title": "Configured"}}]}`),
+		Meta:   &config.MetaInfo{Title: "Changed"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ID != "0c4b5bb8-0d36-4f5e-8f5a-6f3c1c1e2a7b" || res.Title != "Changed" {
+		t.Errorf("overwrites were not merged %+v", res)
+	}
+
+	buf.Reset()
+	if _, err := Convert(context.Background(), strings.NewReader(book), &buf, &Options{Format: Txt}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "Some text.") {
+		t.Errorf("unexpected text output %q", buf.String())
+	}
+}
+
+func TestConvertErrors(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	if w, err := zw.Create("book.fb2"); err != nil {
+		t.Fatal(err)
+	} else if _, err := w.Write([]byte(book)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name string
+		ctx  context.Context
+		src  string
+		opts *Options
+		kind ErrorKind
+	}{
+		{"format", context.Background(), book, &Options{Format: "pdf"}, KindOptions},
+		{"config", context.Background(), book, &Options{Config: []byte("{")}, KindOptions},
+		{"parse", context.Background(), "<html><body/></html>", nil, KindParse},
+		{"zip", context.Background(), archive.String(), &Options{Format: Kepub}, KindInput},
+		{"epub name", context.Background(), book, &Options{Format: Kepub, Name: "book.epub"}, KindInput},
+		{"kindlegen", context.Background(), book, &Options{Format: Mobi, Config: []byte(`{"document":{"kindlegen":{"path":"/nonexistent/kindlegen"}}}`)}, KindKindlegen},
+		{"canceled", ctx, book, nil, -1},
+	} {
+		_, err := Convert(c.ctx, strings.NewReader(c.src), &bytes.Buffer{}, c.opts)
+		if err == nil {
+			t.Errorf("%s: error expected", c.name)
+			continue
+		}
+		var e *Error
+		switch {
+		case c.kind < 0 && !errors.Is(err, context.Canceled):
+			t.Errorf("%s: context error expected, got %v", c.name, err)
+		case c.kind >= 0 && !errors.As(err, &e):
+			t.Errorf("%s: typed error expected, got %v", c.name, err)
+		case c.kind >= 0 && e.Kind != c.kind:
+			t.Errorf("%s: %s error expected, got %v", c.name, c.kind, err)
+		}
+	}
+}
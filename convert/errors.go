@@ -0,0 +1,79 @@
+package convert
+
+import (
+	"context"
+	"errors"
+
+	"fb2converter/processor"
+)
+
+// ErrorKind tells which part of conversion failed.
+type ErrorKind int
+
+// Kinds of conversion errors.
+const (
+	// KindOther is any failure not covered by other kinds.
+	KindOther ErrorKind = iota
+	// KindOptions means options or configuration are invalid.
+	KindOptions
+	// KindParse means source book could not be parsed.
+	KindParse
+	// KindImage means book images could not be processed.
+	KindImage
+	// KindKindlegen means kindlegen was not found or failed.
+	KindKindlegen
+	// KindOutput means result could not be written.
+	KindOutput
+	// KindInput means source is neither FB2 nor EPUB book.
+	KindInput
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case KindOptions:
+		return "options"
+	case KindParse:
+		return "parse"
+	case KindImage:
+		return "image"
+	case KindKindlegen:
+		return "kindlegen"
+	case KindOutput:
+		return "output"
+	case KindInput:
+		return "input"
+	default:
+		return "other"
+	}
+}
+
+// Error is returned by Convert for all failures except context cancellation.
+type Error struct {
+	Kind ErrorKind
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Kind.String() + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// wrapError classifies processor error, context errors are returned as is.
+func wrapError(err error) error {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	kind := KindOther
+	switch {
+	case errors.Is(err, processor.ErrParse):
+		kind = KindParse
+	case errors.Is(err, processor.ErrImage):
+		kind = KindImage
+	case errors.Is(err, processor.ErrKindlegen):
+		kind = KindKindlegen
+	}
+	return &Error{Kind: kind, Err: err}
+}
@@ -19,6 +19,7 @@ require (
 	github.com/hashicorp/hcl v1.0.0
 	github.com/hidez8891/zip v1.11.0
 	github.com/neurosnap/sentences v1.1.2
+	github.com/nwaples/rardecode v1.1.3
 	github.com/pkg/profile v1.7.0
 	github.com/urfave/cli/v2 v2.27.4
 	go.uber.org/zap v1.27.0
@@ -0,0 +1,339 @@
+// Package opds produces static OPDS 1.2 catalog: set of Atom feeds which could be served by any web server.
+package opds
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gosimple/slug"
+)
+
+// Feed types and link relations defined by OPDS.
+const (
+	NavigationType  = "application/atom+xml;profile=opds-catalog;kind=navigation"
+	AcquisitionType = "application/atom+xml;profile=opds-catalog;kind=acquisition"
+
+	RelAcquisition = "http://opds-spec.org/acquisition"
+	RelImage       = "http://opds-spec.org/image"
+	RelThumbnail   = "http://opds-spec.org/image/thumbnail"
+	RelSortNew     = "http://opds-spec.org/sort/new"
+)
+
+// Root feed of the catalog, all other feeds are in the same directory.
+const IndexName = "index.xml"
+
+// Link is Atom link.
+type Link struct {
+	Rel   string `xml:"rel,attr,omitempty"`
+	Href  string `xml:"href,attr"`
+	Type  string `xml:"type,attr,omitempty"`
+	Title string `xml:"title,attr,omitempty"`
+}
+
+// Author is Atom person construct.
+type Author struct {
+	Name string `xml:"name"`
+}
+
+// Category is Atom category.
+type Category struct {
+	Term  string `xml:"term,attr"`
+	Label string `xml:"label,attr,omitempty"`
+}
+
+// Text is Atom text construct.
+type Text struct {
+	Type string `xml:"type,attr,omitempty"`
+	Body string `xml:",chardata"`
+}
+
+// Entry is Atom entry describing either book or navigation target.
+type Entry struct {
+	Title      string     `xml:"title"`
+	ID         string     `xml:"id"`
+	Updated    string     `xml:"updated"`
+	Authors    []Author   `xml:"author"`
+	Language   string     `xml:"dc:language,omitempty"`
+	Issued     string     `xml:"dc:issued,omitempty"`
+	Categories []Category `xml:"category"`
+	Summary    *Text      `xml:"summary,omitempty"`
+	Content    *Text      `xml:"content,omitempty"`
+	Links      []Link     `xml:"link"`
+}
+
+// Feed is Atom feed.
+type Feed struct {
+	XMLName   xml.Name `xml:"feed"`
+	Xmlns     string   `xml:"xmlns,attr"`
+	XmlnsDC   string   `xml:"xmlns:dc,attr"`
+	XmlnsOPDS string   `xml:"xmlns:opds,attr"`
+	ID        string   `xml:"id"`
+	Title     string   `xml:"title"`
+	Updated   string   `xml:"updated"`
+	Links     []Link   `xml:"link"`
+	Entries   []Entry  `xml:"entry"`
+}
+
+// Book is a single catalog entry. All references are relative to the catalog directory.
+type Book struct {
+	ID         string
+	Title      string
+	Authors    []string
+	AuthorSort []string
+	Series     string
+	SeriesNum  int
+	Genres     []string
+	Lang       string
+	Issued     string
+	Summary    string
+	Updated    time.Time
+	Files      []Link
+	Cover      string
+	Thumbnail  string
+}
+
+// Catalog collects books and writes feeds: by author, by series, by genre and newest books.
+type Catalog struct {
+	Title   string
+	New     int // number of books in newest books feed
+	Books   []*Book
+	updated string
+}
+
+func (c *Catalog) feed(id, title, self, kind string) *Feed {
+	return &Feed{
+		Xmlns:     "http://www.w3.org/2005/Atom",
+		XmlnsDC:   "http://purl.org/dc/terms/",
+		XmlnsOPDS: "http://opds-spec.org/2010/catalog",
+		ID:        "urn:fb2c:" + id,
+		Title:     title,
+		Updated:   c.updated,
+		Links: []Link{
+			{Rel: "self", Href: self, Type: kind},
+			{Rel: "start", Href: IndexName, Type: NavigationType, Title: c.Title},
+		},
+	}
+}
+
+func (c *Catalog) navEntry(id, title, href, kind, content string) Entry {
+	return Entry{
+		Title:   title,
+		ID:      "urn:fb2c:" + id,
+		Updated: c.updated,
+		Content: &Text{Type: "text", Body: content},
+		Links:   []Link{{Rel: "subsection", Href: href, Type: kind}},
+	}
+}
+
+func bookEntry(b *Book) Entry {
+
+	e := Entry{
+		Title:    b.Title,
+		ID:       "urn:uuid:" + b.ID,
+		Updated:  b.Updated.UTC().Format(time.RFC3339),
+		Language: b.Lang,
+		Issued:   b.Issued,
+		Links:    append([]Link{}, b.Files...),
+	}
+	for _, a := range b.Authors {
+		e.Authors = append(e.Authors, Author{Name: a})
+	}
+	for _, g := range b.Genres {
+		e.Categories = append(e.Categories, Category{Term: g, Label: g})
+	}
+	summary := b.Summary
+	if len(b.Series) > 0 {
+		series := b.Series
+		if b.SeriesNum > 0 {
+			series += " #" + strconv.Itoa(b.SeriesNum)
+		}
+		summary = strings.TrimSpace(series + "\n" + summary)
+	}
+	if len(summary) > 0 {
+		e.Summary = &Text{Type: "text", Body: summary}
+	}
+	if len(b.Cover) > 0 {
+		e.Links = append(e.Links, Link{Rel: RelImage, Href: b.Cover, Type: "image/jpeg"})
+	}
+	if len(b.Thumbnail) > 0 {
+		e.Links = append(e.Links, Link{Rel: RelThumbnail, Href: b.Thumbnail, Type: "image/jpeg"})
+	}
+	return e
+}
+
+// group is a set of books sharing author, series or genre.
+type group struct {
+	name, sort, file string
+	books            []*Book
+}
+
+// groups splits books by keys, every group gets unique feed file name derived from its name.
+func groups(books []*Book, prefix string, keys func(b *Book) (names, sorts []string)) []*group {
+
+	index := make(map[string]*group)
+	for _, b := range books {
+		names, sorts := keys(b)
+		for i, n := range names {
+			if len(n) == 0 {
+				continue
+			}
+			g, ok := index[n]
+			if !ok {
+				g = &group{name: n, sort: strings.ToLower(sorts[i])}
+				index[n] = g
+			}
+			g.books = append(g.books, b)
+		}
+	}
+
+	list := make([]*group, 0, len(index))
+	for _, g := range index {
+		list = append(list, g)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].sort != list[j].sort {
+			return list[i].sort < list[j].sort
+		}
+		return list[i].name < list[j].name
+	})
+
+	used := make(map[string]bool)
+	for i, g := range list {
+		s := slug.Make(g.name)
+		if len(s) == 0 {
+			s = strconv.Itoa(i + 1)
+		}
+		name := s
+		for n := 2; used[name]; n++ {
+			name = fmt.Sprintf("%s-%d", s, n)
+		}
+		used[name] = true
+		g.file = prefix + "-" + name + ".xml"
+	}
+	return list
+}
+
+func byTitle(books []*Book) {
+	sort.SliceStable(books, func(i, j int) bool {
+		return strings.ToLower(books[i].Title) < strings.ToLower(books[j].Title)
+	})
+}
+
+func bySeries(books []*Book) {
+	sort.SliceStable(books, func(i, j int) bool {
+		if books[i].Series != books[j].Series {
+			return strings.ToLower(books[i].Series) < strings.ToLower(books[j].Series)
+		}
+		if books[i].SeriesNum != books[j].SeriesNum {
+			return books[i].SeriesNum < books[j].SeriesNum
+		}
+		return strings.ToLower(books[i].Title) < strings.ToLower(books[j].Title)
+	})
+}
+
+func (c *Catalog) writeGroups(dir, id, title, prefix string, list []*group, order func([]*Book)) error {
+
+	nav := c.feed(id, title, prefix+".xml", NavigationType)
+	nav.Links = append(nav.Links, Link{Rel: "up", Href: IndexName, Type: NavigationType})
+	for _, g := range list {
+		books := append([]*Book{}, g.books...)
+		order(books)
+
+		f := c.feed(id+":"+strings.TrimSuffix(g.file, ".xml"), g.name, g.file, AcquisitionType)
+		f.Links = append(f.Links, Link{Rel: "up", Href: prefix + ".xml", Type: NavigationType})
+		for _, b := range books {
+			f.Entries = append(f.Entries, bookEntry(b))
+		}
+		if err := f.write(filepath.Join(dir, g.file)); err != nil {
+			return err
+		}
+		nav.Entries = append(nav.Entries, c.navEntry(id+":"+strings.TrimSuffix(g.file, ".xml"), g.name, g.file, AcquisitionType, fmt.Sprintf("%d book(s)", len(books))))
+	}
+	return nav.write(filepath.Join(dir, prefix+".xml"))
+}
+
+// Write writes all catalog feeds into directory.
+func (c *Catalog) Write(dir string) error {
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	// groups could disappear since previous run
+	for _, prefix := range []string{"author", "series", "genre"} {
+		old, err := filepath.Glob(filepath.Join(dir, prefix+"-*.xml"))
+		if err != nil {
+			return err
+		}
+		for _, fname := range old {
+			if err := os.Remove(fname); err != nil {
+				return err
+			}
+		}
+	}
+
+	var last time.Time
+	for _, b := range c.Books {
+		if b.Updated.After(last) {
+			last = b.Updated
+		}
+	}
+	if last.IsZero() {
+		last = time.Now()
+	}
+	c.updated = last.UTC().Format(time.RFC3339)
+
+	authors := groups(c.Books, "author", func(b *Book) ([]string, []string) { return b.Authors, b.AuthorSort })
+	if err := c.writeGroups(dir, "authors", "By author", "authors", authors, bySeries); err != nil {
+		return err
+	}
+	series := groups(c.Books, "series", func(b *Book) ([]string, []string) { return []string{b.Series}, []string{b.Series} })
+	if err := c.writeGroups(dir, "series", "By series", "series", series, bySeries); err != nil {
+		return err
+	}
+	genres := groups(c.Books, "genre", func(b *Book) ([]string, []string) { return b.Genres, b.Genres })
+	if err := c.writeGroups(dir, "genres", "By genre", "genres", genres, byTitle); err != nil {
+		return err
+	}
+
+	books := append([]*Book{}, c.Books...)
+	sort.SliceStable(books, func(i, j int) bool { return books[i].Updated.After(books[j].Updated) })
+	if c.New > 0 && len(books) > c.New {
+		books = books[:c.New]
+	}
+	newest := c.feed("new", "New books", "new.xml", AcquisitionType)
+	newest.Links = append(newest.Links, Link{Rel: "up", Href: IndexName, Type: NavigationType})
+	for _, b := range books {
+		newest.Entries = append(newest.Entries, bookEntry(b))
+	}
+	if err := newest.write(filepath.Join(dir, "new.xml")); err != nil {
+		return err
+	}
+
+	index := c.feed("root", c.Title, IndexName, NavigationType)
+	index.Links = append(index.Links, Link{Rel: RelSortNew, Href: "new.xml", Type: AcquisitionType, Title: "New books"})
+	index.Entries = []Entry{
+		c.navEntry("authors", "By author", "authors.xml", NavigationType, fmt.Sprintf("%d author(s)", len(authors))),
+		c.navEntry("series", "By series", "series.xml", NavigationType, fmt.Sprintf("%d series", len(series))),
+		c.navEntry("genres", "By genre", "genres.xml", NavigationType, fmt.Sprintf("%d genre(s)", len(genres))),
+		c.navEntry("new", "New books", "new.xml", AcquisitionType, fmt.Sprintf("%d book(s)", len(books))),
+	}
+	return index.write(filepath.Join(dir, IndexName))
+}
+
+func (f *Feed) write(fname string) error {
+
+	data, err := xml.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to prepare feed (%s): %w", fname, err)
+	}
+	if err := os.WriteFile(fname, append([]byte(xml.Header), append(data, '\n')...), 0644); err != nil {
+		return fmt.Errorf("unable to write feed (%s): %w", fname, err)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package opds
+
+import (
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCatalogWrite(t *testing.T) {
+
+	now := time.Now()
+	cat := &Catalog{Title: "Test", New: 2, Books: []*Book{
+		{ID: "3", Title: "Third", Authors: []string{"Author"}, AuthorSort: []string{"Author"}, Series: "Saga", SeriesNum: 3, Updated: now},
+		{ID: "1", Title: "First", Authors: []string{"Author"}, AuthorSort: []string{"Author"}, Series: "Saga", SeriesNum: 1, Updated: now.Add(-time.Hour)},
+		{ID: "2", Title: "Second", Genres: []string{"sf"}, Series: "Saga", SeriesNum: 2, Updated: now.Add(-2 * time.Hour)},
+	}}
+
+	dir := t.TempDir()
+	// left from previous run
+	if err := os.WriteFile(filepath.Join(dir, "genre-old.xml"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := cat.Write(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	read := func(name string) *Feed {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := &Feed{}
+		if err := xml.Unmarshal(data, f); err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+
+	if f := read("series-saga.xml"); len(f.Entries) != 3 || f.Entries[0].Title != "First" || f.Entries[2].Title != "Third" {
+		t.Errorf("series feed is not ordered by number: %+v", f.Entries)
+	}
+	if f := read("new.xml"); len(f.Entries) != 2 || f.Entries[0].Title != "Third" {
+		t.Errorf("unexpected new books feed: %+v", f.Entries)
+	}
+	if f := read("authors.xml"); len(f.Entries) != 1 || f.Entries[0].Links[0].Href != "author-author.xml" {
+		t.Errorf("unexpected authors feed: %+v", f.Entries)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "genre-old.xml")); !os.IsNotExist(err) {
+		t.Errorf("stale feed was not removed")
+	}
+}
@@ -1,6 +1,7 @@
 package processor
 
 import (
+	gocontext "context"
 	"runtime"
 	"strings"
 	"sync"
@@ -105,9 +106,9 @@ func (b *Book) BookAuthors(format string, short bool) string {
 }
 
 // flushMeta saves all container meta files.
-func (b *Book) flushMeta(path string) error {
+func (b *Book) flushMeta(out bookFS) error {
 	for _, f := range b.Meta {
-		if err := f.flush(path); err != nil {
+		if err := f.flush(out); err != nil {
 			return err // no point continuing
 		}
 	}
@@ -115,12 +116,15 @@ func (b *Book) flushMeta(path string) error {
 }
 
 // flushData saves all "data" files.
-func (b *Book) flushData(path string) error {
+func (b *Book) flushData(ctx gocontext.Context, out bookFS) error {
 
 	if len(b.Data) == 0 {
 		return nil
 	} else if len(b.Data) == 1 {
-		if err := b.Data[0].flush(path); err != nil {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := b.Data[0].flush(out); err != nil {
 			return err // no point continuing
 		}
 		return nil
@@ -140,10 +144,10 @@ func (b *Book) flushData(path string) error {
 		go func(job <-chan *dataFile, res chan<- error) {
 			defer wg.Done()
 			for f := range job {
-				if f == nil || atomic.LoadInt32(&haveError) != 0 {
+				if f == nil || atomic.LoadInt32(&haveError) != 0 || ctx.Err() != nil {
 					break
 				}
-				err := f.flush(path)
+				err := f.flush(out)
 				if err != nil {
 					atomic.AddInt32(&haveError, 1)
 					res <- err
@@ -155,7 +159,7 @@ func (b *Book) flushData(path string) error {
 
 	// supply work
 	for _, f := range b.Data {
-		if atomic.LoadInt32(&haveError) != 0 {
+		if atomic.LoadInt32(&haveError) != 0 || ctx.Err() != nil {
 			break
 		}
 		job <- f
@@ -167,16 +171,19 @@ func (b *Book) flushData(path string) error {
 		// return first error
 		return <-res
 	}
-	return nil
+	return ctx.Err()
 }
 
 // flushXHTML saves all content files generated by transforming fb2.
-func (b *Book) flushXHTML(path string) error {
+func (b *Book) flushXHTML(ctx gocontext.Context, out bookFS) error {
 
 	if len(b.Files) == 0 {
 		return nil
 	} else if len(b.Files) == 1 {
-		if err := b.Files[0].flush(path); err != nil {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := b.Files[0].flush(out); err != nil {
 			return err // no point continuing
 		}
 		return nil
@@ -196,10 +203,10 @@ func (b *Book) flushXHTML(path string) error {
 		go func(job <-chan *dataFile, res chan<- error) {
 			defer wg.Done()
 			for f := range job {
-				if f == nil || atomic.LoadInt32(&haveError) != 0 {
+				if f == nil || atomic.LoadInt32(&haveError) != 0 || ctx.Err() != nil {
 					break
 				}
-				err := f.flush(path)
+				err := f.flush(out)
 				if err != nil {
 					atomic.AddInt32(&haveError, 1)
 					res <- err
@@ -211,7 +218,7 @@ func (b *Book) flushXHTML(path string) error {
 
 	// supply work
 	for _, f := range b.Files {
-		if atomic.LoadInt32(&haveError) != 0 {
+		if atomic.LoadInt32(&haveError) != 0 || ctx.Err() != nil {
 			break
 		}
 		job <- f
@@ -223,18 +230,29 @@ func (b *Book) flushXHTML(path string) error {
 		// return first error
 		return <-res
 	}
-	return nil
+	return ctx.Err()
 }
 
 // flushImages saves all images - coming from fb2 binary tags.
-func (b *Book) flushImages(path string) error {
+func (b *Book) flushImages(ctx gocontext.Context, out bookFS) error {
+	return b.eachImage(ctx, func(f *binImage) error {
+		return f.flush(out)
+	})
+}
+
+// eachImage runs fn on all images coming from fb2 binary tags using processing pool, stops on first error or when context
+// is canceled.
+func (b *Book) eachImage(ctx gocontext.Context, fn func(f *binImage) error) error {
 
 	if len(b.Images) == 0 {
 		return nil
 	}
 
 	if len(b.Images) == 1 {
-		if err := b.Images[0].flush(path); err != nil {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(b.Images[0]); err != nil {
 			return err // no point continuing
 		}
 		return nil
@@ -254,10 +272,10 @@ func (b *Book) flushImages(path string) error {
 		go func(job <-chan *binImage, res chan<- error) {
 			defer wg.Done()
 			for f := range job {
-				if f == nil || atomic.LoadInt32(&haveError) != 0 {
+				if f == nil || atomic.LoadInt32(&haveError) != 0 || ctx.Err() != nil {
 					break
 				}
-				err := f.flush(path)
+				err := fn(f)
 				if err != nil {
 					atomic.AddInt32(&haveError, 1)
 					res <- err
@@ -269,7 +287,7 @@ func (b *Book) flushImages(path string) error {
 
 	// supply work
 	for _, f := range b.Images {
-		if atomic.LoadInt32(&haveError) != 0 {
+		if atomic.LoadInt32(&haveError) != 0 || ctx.Err() != nil {
 			break
 		}
 		job <- f
@@ -281,18 +299,18 @@ func (b *Book) flushImages(path string) error {
 		// return first error
 		return <-res
 	}
-	return nil
+	return ctx.Err()
 }
 
 // flushVignettes saves all vignettes used for content.
-func (b *Book) flushVignettes(path string) error {
+func (b *Book) flushVignettes(out bookFS) error {
 
 	if len(b.Vignettes) == 0 {
 		return nil
 	}
 
 	for _, f := range b.Vignettes {
-		if err := f.flush(path); err != nil {
+		if err := f.flush(out); err != nil {
 			return err // no point continuing
 		}
 	}
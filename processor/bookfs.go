@@ -0,0 +1,157 @@
+package processor
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Book output tree is everything which ends up in resulting EPUB or is fed to KF8 writer and kindlegen. It is assembled
+// in memory - working directory on disk is only necessary when kindlegen is invoked or debug report is requested.
+
+// bookFS is book output tree. Names are slash separated paths relative to the tree root.
+type bookFS interface {
+	fs.ReadFileFS
+	// WriteFile creates or replaces file, creating directories when necessary.
+	WriteFile(name string, data []byte) error
+	// Files returns names of all files in the tree in lexical order.
+	Files() ([]string, error)
+}
+
+// memFS keeps output tree in memory, it is safe for concurrent use. Directories are implied by file names and could not
+// be opened.
+type memFS struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+func newMemFS() *memFS {
+	return &memFS{files: make(map[string][]byte)}
+}
+
+func (m *memFS) Open(name string) (fs.File, error) {
+	data, err := m.ReadFile(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return &memFile{info: memFileInfo{name: path.Base(name), size: int64(len(data))}, Reader: bytes.NewReader(data)}, nil
+}
+
+func (m *memFS) ReadFile(name string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data, ok := m.files[name]
+	if !ok || !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrNotExist}
+	}
+	return data, nil
+}
+
+func (m *memFS) WriteFile(name string, data []byte) error {
+	if !fs.ValidPath(name) || name == "." {
+		return &fs.PathError{Op: "write", Path: name, Err: fs.ErrInvalid}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.files[name] = data
+	return nil
+}
+
+func (m *memFS) Files() ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.files))
+	for name := range m.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+type memFile struct {
+	info memFileInfo
+	*bytes.Reader
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *memFile) Close() error               { return nil }
+
+type memFileInfo struct {
+	name string
+	size int64
+}
+
+func (i memFileInfo) Name() string       { return i.name }
+func (i memFileInfo) Size() int64        { return i.size }
+func (i memFileInfo) Mode() fs.FileMode  { return 0644 }
+func (i memFileInfo) ModTime() time.Time { return time.Time{} }
+func (i memFileInfo) IsDir() bool        { return false }
+func (i memFileInfo) Sys() any           { return nil }
+
+// dirFS keeps output tree in the directory.
+type dirFS string
+
+func (d dirFS) Open(name string) (fs.File, error) {
+	return os.DirFS(string(d)).Open(name)
+}
+
+func (d dirFS) ReadFile(name string) ([]byte, error) {
+	return fs.ReadFile(os.DirFS(string(d)), name)
+}
+
+func (d dirFS) WriteFile(name string, data []byte) error {
+	if !fs.ValidPath(name) || name == "." {
+		return &fs.PathError{Op: "write", Path: name, Err: fs.ErrInvalid}
+	}
+	fname := filepath.Join(string(d), filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(fname), 0700); err != nil {
+		return fmt.Errorf("unable to create content directory: %w", err)
+	}
+	return os.WriteFile(fname, data, 0644)
+}
+
+func (d dirFS) Files() ([]string, error) {
+	var names []string
+	err := fs.WalkDir(os.DirFS(string(d)), ".", func(name string, e fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if e.Type().IsRegular() {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// copyBookFS copies all files of the output tree to another one.
+func copyBookFS(to, from bookFS) error {
+
+	names, err := from.Files()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		data, err := from.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		if err := to.WriteFile(name, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package processor
+
+import (
+	"errors"
+	"io/fs"
+	"slices"
+	"testing"
+)
+
+func TestBookFS(t *testing.T) {
+
+	for _, out := range []bookFS{newMemFS(), dirFS(t.TempDir())} {
+
+		files := map[string]string{
+			"mimetype":                   "application/epub+zip",
+			"OEBPS/content.opf":          "<package/>",
+			"OEBPS/images/cover.jpg":     "jpeg",
+			"META-INF/container.xml":     "<container/>",
+			"OEBPS/text/index0.xhtml":    "<html/>",
+			"OEBPS/text/index0.xhtml.gz": "",
+		}
+		for name, data := range files {
+			if err := out.WriteFile(name, []byte(data)); err != nil {
+				t.Fatalf("%T: unable to write %s: %v", out, name, err)
+			}
+		}
+		if err := out.WriteFile("../escape", nil); err == nil {
+			t.Errorf("%T: file outside of the tree was written", out)
+		}
+
+		names, err := out.Files()
+		if err != nil {
+			t.Fatalf("%T: unable to list files: %v", out, err)
+		}
+		if !slices.IsSorted(names) || len(names) != len(files) {
+			t.Errorf("%T: unexpected file list: %v", out, names)
+		}
+		for _, name := range names {
+			// through fs.FS interface as KF8 writer does
+			data, err := fs.ReadFile(out, name)
+			if err != nil || string(data) != files[name] {
+				t.Errorf("%T: %s has unexpected content %q: %v", out, name, data, err)
+			}
+		}
+		if _, err := out.ReadFile("OEBPS/missing.css"); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%T: unexpected error for missing file: %v", out, err)
+		}
+	}
+}
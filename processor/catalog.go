@@ -0,0 +1,62 @@
+package processor
+
+import (
+	"encoding/base64"
+	"io"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"fb2converter/state"
+)
+
+// CatalogBook is book information necessary to build library catalog.
+type CatalogBook struct {
+	*BookInfo
+	// sequence and author names could be used for sorting
+	AuthorSort []string
+	// cover image as it is stored in the book, could be empty
+	Cover []byte
+	// names of the files conversion would produce for every output format, relative to destination directory
+	Outputs map[OutputFmt]string
+}
+
+// ReadCatalogBook processes FB2 document description the same way ReadInfo does and collects information catalog
+// needs: cover image and names of conversion results.
+func ReadCatalogBook(r io.Reader, unknownEncoding bool, src string, nodirs bool, env *state.LocalEnv) (*CatalogBook, error) {
+
+	p, u, err := readDescription(r, unknownEncoding, src, env)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &CatalogBook{BookInfo: p.bookInfo(u), Outputs: make(map[OutputFmt]string)}
+	for _, an := range p.Book.Authors {
+		b.AuthorSort = append(b.AuthorSort, strings.TrimSpace(strings.Join([]string{an.Last, an.First, an.Middle}, " ")))
+	}
+
+	if len(p.Book.Cover) > 0 {
+		for _, el := range p.doc.FindElements("./FictionBook/binary[@id]") {
+			if getAttrValue(el, "id") != p.Book.Cover {
+				continue
+			}
+			// same leniency as when binaries are processed for conversion
+			s := strings.Replace(el.Text(), " ", "", -1)
+			data := make([]byte, base64.StdEncoding.DecodedLen(len(s)))
+			n, err := base64.StdEncoding.Decode(data, []byte(s))
+			if err != nil {
+				env.Log.Warn("Unable to decode cover image, ignoring", zap.String("id", p.Book.Cover), zap.Error(err))
+				break
+			}
+			b.Cover = data[:n]
+			break
+		}
+	}
+
+	p.nodirs = nodirs
+	for f := OEpub; f < UnsupportedOutputFmt; f++ {
+		p.format = f
+		b.Outputs[f] = p.prepareOutputName()
+	}
+	return b, nil
+}
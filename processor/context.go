@@ -140,7 +140,7 @@ func (ctx *context) createPM(name string) (*etree.Element, *dataFile) {
 	return pm, f
 }
 
-func (ctx *context) createOPF(name string) (*etree.Element, *dataFile) {
+func (ctx *context) createOPF(name, version string) (*etree.Element, *dataFile) {
 
 	ctx.fname = name + ".opf"
 	ctx.pageLength = 0
@@ -161,7 +161,7 @@ func (ctx *context) createOPF(name string) (*etree.Element, *dataFile) {
 	}
 
 	pkg := ctx.out.Element.AddNext("package",
-		attr("version", "2.0"),
+		attr("version", version),
 		attr("xmlns", `http://www.idpf.org/2007/opf`),
 		attr("unique-identifier", "BookId"),
 	)
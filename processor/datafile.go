@@ -2,7 +2,7 @@ package processor
 
 import (
 	"fmt"
-	"os"
+	"path"
 	"path/filepath"
 
 	"fb2converter/etree"
@@ -35,26 +35,30 @@ func (f *dataFile) String() string {
 	)
 }
 
-func (f *dataFile) flush(path string) error {
+// name returns file location in the output tree.
+func (f *dataFile) name() string {
+	return path.Join(filepath.ToSlash(f.relpath), f.fname)
+}
+
+func (f *dataFile) flush(out bookFS) error {
 
 	if len(f.fname) == 0 || (len(f.data) == 0 && f.doc == nil) {
 		return nil
 	}
 
-	newdir := filepath.Join(path, f.relpath)
-	if err := os.MkdirAll(newdir, 0700); err != nil {
-		return fmt.Errorf("unable to create content directory: %w", err)
-	}
-
 	if f.doc != nil {
-		if err := f.doc.WriteToFile(filepath.Join(newdir, f.fname)); err != nil {
-			return fmt.Errorf("unable to flush XML content to %s: %w", filepath.Join(newdir, f.fname), err)
+		data, err := f.doc.WriteToBytes()
+		if err == nil {
+			err = out.WriteFile(f.name(), data)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to flush XML content to %s: %w", f.name(), err)
 		}
 		return nil
 	}
 
-	if err := os.WriteFile(filepath.Join(newdir, f.fname), f.data, 0644); err != nil {
-		return fmt.Errorf("unable to save data to %s: %w", filepath.Join(newdir, f.fname), err)
+	if err := out.WriteFile(f.name(), f.data); err != nil {
+		return fmt.Errorf("unable to save data to %s: %w", f.name(), err)
 	}
 	return nil
 }
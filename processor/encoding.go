@@ -0,0 +1,66 @@
+package processor
+
+import (
+	"bytes"
+	"io"
+
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/encoding/unicode/utf32"
+	"golang.org/x/text/transform"
+)
+
+// SrcEncoding is Unicode encoding of FB2 document recognized by its BOM.
+type SrcEncoding int
+
+// Source encodings, document without BOM has unknown encoding and is decoded according to its XML declaration.
+const (
+	EncUnknown SrcEncoding = iota
+	EncUTF8
+	EncUTF16BigEndian
+	EncUTF16LittleEndian
+	EncUTF32BigEndian
+	EncUTF32LittleEndian
+)
+
+// Order is important - UTF-32 little endian BOM starts with UTF-16 one.
+var boms = []struct {
+	bom []byte
+	enc SrcEncoding
+}{
+	{[]byte{0x00, 0x00, 0xFE, 0xFF}, EncUTF32BigEndian},
+	{[]byte{0xFF, 0xFE, 0x00, 0x00}, EncUTF32LittleEndian},
+	{[]byte{0xEF, 0xBB, 0xBF}, EncUTF8},
+	{[]byte{0xFE, 0xFF}, EncUTF16BigEndian},
+	{[]byte{0xFF, 0xFE}, EncUTF16LittleEndian},
+}
+
+// DetectEncoding checks BOM at the start of the document, head should have at least 4 bytes for detection to be reliable.
+func DetectEncoding(head []byte) SrcEncoding {
+	for _, b := range boms {
+		if bytes.HasPrefix(head, b.bom) {
+			return b.enc
+		}
+	}
+	return EncUnknown
+}
+
+// UnicodeReader returns reader decoding document in specified encoding to UTF-8, document of unknown encoding is read
+// as is.
+func UnicodeReader(r io.Reader, enc SrcEncoding) io.Reader {
+	switch enc {
+	case EncUnknown:
+		return r
+	case EncUTF8:
+		return transform.NewReader(r, unicode.BOMOverride(unicode.UTF8.NewDecoder()))
+	case EncUTF16BigEndian:
+		return transform.NewReader(r, unicode.UTF16(unicode.BigEndian, unicode.ExpectBOM).NewDecoder())
+	case EncUTF16LittleEndian:
+		return transform.NewReader(r, unicode.UTF16(unicode.LittleEndian, unicode.ExpectBOM).NewDecoder())
+	case EncUTF32BigEndian:
+		return transform.NewReader(r, utf32.UTF32(utf32.BigEndian, utf32.ExpectBOM).NewDecoder())
+	case EncUTF32LittleEndian:
+		return transform.NewReader(r, utf32.UTF32(utf32.LittleEndian, utf32.ExpectBOM).NewDecoder())
+	default:
+		panic("unsupported encoding - should never happen")
+	}
+}
@@ -0,0 +1,49 @@
+package processor
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/encoding/unicode/utf32"
+)
+
+func TestUnicodeReader(t *testing.T) {
+
+	const text = `<?xml version="1.0"?><FictionBook>Книга</FictionBook>`
+
+	for _, c := range []struct {
+		name string
+		enc  encoding.Encoding
+		want SrcEncoding
+	}{
+		{"utf-8", unicode.UTF8BOM, EncUTF8},
+		{"utf-16be", unicode.UTF16(unicode.BigEndian, unicode.UseBOM), EncUTF16BigEndian},
+		{"utf-16le", unicode.UTF16(unicode.LittleEndian, unicode.UseBOM), EncUTF16LittleEndian},
+		{"utf-32be", utf32.UTF32(utf32.BigEndian, utf32.UseBOM), EncUTF32BigEndian},
+		{"utf-32le", utf32.UTF32(utf32.LittleEndian, utf32.UseBOM), EncUTF32LittleEndian},
+		{"no bom", unicode.UTF8, EncUnknown},
+	} {
+		data, err := c.enc.NewEncoder().Bytes([]byte(text))
+		if err != nil {
+			t.Fatal(err)
+		}
+		enc := DetectEncoding(data)
+		if enc != c.want {
+			t.Errorf("%s: detected %d, expected %d", c.name, enc, c.want)
+			continue
+		}
+		out, err := io.ReadAll(UnicodeReader(bytes.NewReader(data), enc))
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		} else if string(out) != text {
+			t.Errorf("%s: unexpected result %q", c.name, out)
+		}
+	}
+
+	if enc := DetectEncoding([]byte{0xFF}); enc != EncUnknown {
+		t.Errorf("short head: detected %d", enc)
+	}
+}
@@ -13,6 +13,12 @@ const (
 	OKepub                                // kepub
 	OAzw3                                 // azw3
 	OMobi                                 // mobi
+	OEpub3                                // epub3
+	OFb2                                  // fb2
+	OFb2Zip                               // fb2.zip
+	OTxt                                  // txt
+	OMd                                   // md
+	OHtml                                 // html
 	UnsupportedOutputFmt                  //
 )
 
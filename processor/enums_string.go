@@ -12,12 +12,18 @@ func _() {
 	_ = x[OKepub-1]
 	_ = x[OAzw3-2]
 	_ = x[OMobi-3]
-	_ = x[UnsupportedOutputFmt-4]
+	_ = x[OEpub3-4]
+	_ = x[OFb2-5]
+	_ = x[OFb2Zip-6]
+	_ = x[OTxt-7]
+	_ = x[OMd-8]
+	_ = x[OHtml-9]
+	_ = x[UnsupportedOutputFmt-10]
 }
 
-const _OutputFmt_name = "epubkepubazw3mobi"
+const _OutputFmt_name = "epubkepubazw3mobiepub3fb2fb2.ziptxtmdhtml"
 
-var _OutputFmt_index = [...]uint8{0, 4, 9, 13, 17, 17}
+var _OutputFmt_index = [...]uint8{0, 4, 9, 13, 17, 22, 25, 32, 35, 37, 41, 41}
 
 func (i OutputFmt) String() string {
 	if i < 0 || i >= OutputFmt(len(_OutputFmt_index)-1) {
@@ -2,133 +2,125 @@ package processor
 
 import (
 	"archive/zip"
+	"bytes"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	fixzip "github.com/hidez8891/zip"
 	"go.uber.org/zap"
 )
 
-func zipRemoveDataDescriptors(from, to string) error {
+// zipRemoveDataDescriptors rewrites zip archive without data descriptors.
+func zipRemoveDataDescriptors(data []byte, to io.Writer) error {
 
-	out, err := os.Create(to)
+	r, err := fixzip.NewReader(bytes.NewReader(data), int64(len(data)))
 	if err != nil {
-		return fmt.Errorf("unable to create EPUB (%s): %w", to, err)
+		return fmt.Errorf("unable to read EPUB: %w", err)
 	}
-	defer out.Close()
-
-	r, err := fixzip.OpenReader(from)
-	if err != nil {
-		return fmt.Errorf("unable to read EPUB (%s): %w", from, err)
-	}
-	defer r.Close()
-
-	w := fixzip.NewWriter(out)
-	defer w.Close()
 
+	w := fixzip.NewWriter(to)
 	for _, file := range r.File {
 		// unset data descriptor flag.
 		file.Flags &= ^fixzip.FlagDataDescriptor
 
 		// copy zip entry
 		if err := w.CopyFile(file); err != nil {
-			return fmt.Errorf("unable to write EPUB (%s): %w", to, err)
+			return fmt.Errorf("unable to write EPUB: %w", err)
 		}
 	}
-	return nil
+	return w.Close()
 }
 
-func (p *Processor) writeEPUB(fname string) error {
+// packEPUB packs output tree into zip archive.
+func (p *Processor) packEPUB(w io.Writer) error {
 
-	f, err := os.Create(fname)
+	names, err := p.out.Files()
 	if err != nil {
-		return fmt.Errorf("unable to create EPUB (%s): %w", fname, err)
+		return fmt.Errorf("unable to list EPUB content: %w", err)
 	}
-	defer f.Close()
 
-	epub := zip.NewWriter(f)
-	defer epub.Close()
+	epub := zip.NewWriter(w)
 
-	var content bool
-	t := time.Now()
+	// mimetype should be the first entry in epub
+	mt, err := p.out.ReadFile("mimetype")
+	if err != nil {
+		return fmt.Errorf("unable to find mimetype file: %w", err)
+	}
+	f, err := epub.CreateHeader(&zip.FileHeader{
+		Name:   "mimetype",
+		Method: zip.Store,
+		// do not set time for mimetype, it spoils epubcheck magic
+	})
+	if err == nil {
+		_, err = f.Write(mt)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to add mimetype to EPUB: %w", err)
+	}
 
-	saveFile := func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if !info.Mode().IsRegular() {
-			return nil
+	t := time.Now()
+	for _, name := range names {
+		if !strings.Contains(name, "/") && (p.kind == InFb2 || name == "mimetype") {
+			// ignore everything in the root directory, but unpacked epub may keep its content there
+			continue
 		}
-		if filepath.ToSlash(path) == filepath.ToSlash(fname) {
-			// ignore itself
-			return nil
+		data, err := p.out.ReadFile(name)
+		if err != nil {
+			return fmt.Errorf("unable to add file to EPUB: %w", err)
 		}
-		if content && filepath.ToSlash(filepath.Dir(path)) == filepath.ToSlash(p.tmpDir) {
-			// ignore everything in the root directory
-			return nil
+		f, err := epub.CreateHeader(&zip.FileHeader{
+			Name:     name,
+			Method:   zip.Deflate,
+			Modified: t,
+		})
+		if err == nil {
+			_, err = f.Write(data)
 		}
-
-		// Get the path of the file relative to the source folder
-		rel, err := filepath.Rel(p.tmpDir, path)
 		if err != nil {
-			return err
-		}
-		rel = filepath.ToSlash(rel)
-
-		var w io.Writer
-		if !content {
-			if w, err = epub.CreateHeader(&zip.FileHeader{
-				Name:   info.Name(),
-				Method: zip.Store,
-				// do not set time for mimetype, it spoils epubcheck magic
-			}); err != nil {
-				return err
-			}
-		} else {
-			if w, err = epub.CreateHeader(&zip.FileHeader{
-				Name:     rel,
-				Method:   zip.Deflate,
-				Modified: t,
-			}); err != nil {
-				return err
-			}
+			return fmt.Errorf("unable to add file to EPUB: %w", err)
 		}
+	}
+	return epub.Close()
+}
 
-		var r io.ReadCloser
-		if r, err = os.Open(path); err != nil {
-			return err
-		}
-		defer r.Close()
+// writeEPUB writes epub assembled from output tree.
+func (p *Processor) writeEPUB(w io.Writer) error {
 
-		if _, err = io.Copy(w, r); err != nil {
-			return err
-		}
-		return nil
+	if !p.env.Cfg.Doc.FixZip {
+		return p.packEPUB(w)
 	}
 
-	// mimetype should be the first entry in epub
-	mt := filepath.Join(p.tmpDir, "mimetype")
-	info, err := os.Stat(mt)
-	if err != nil {
-		return fmt.Errorf("unable to find mimetype file: %w", err)
-	}
-	if err = saveFile(mt, info, nil); err != nil {
-		return fmt.Errorf("unable to add mimetype to EPUB: %w", err)
+	var buf bytes.Buffer
+	if err := p.packEPUB(&buf); err != nil {
+		return err
 	}
+	return zipRemoveDataDescriptors(buf.Bytes(), w)
+}
 
-	content = true
+// FinalizeEPUB produces epub file out of previously saved output tree.
+func (p *Processor) FinalizeEPUB(fname string) error {
 
-	if err = filepath.Walk(p.tmpDir, saveFile); err != nil {
-		return fmt.Errorf("unable to add file to EPUB: %w", err)
+	if err := p.prepareOutput(fname); err != nil {
+		return err
 	}
-	return nil
+
+	f, err := os.Create(fname)
+	if err != nil {
+		return fmt.Errorf("unable to create EPUB (%s): %w", fname, err)
+	}
+	if err := p.writeEPUB(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
 }
 
-// FinalizeEPUB produces epub file out of previously saved temporary files.
-func (p *Processor) FinalizeEPUB(fname string) error {
+// prepareOutput makes sure that resulting file could be written, removing old one when overwriting is allowed.
+func (p *Processor) prepareOutput(fname string) error {
 
 	if _, err := os.Stat(fname); err == nil {
 		if !p.overwrite {
@@ -143,25 +135,10 @@ func (p *Processor) FinalizeEPUB(fname string) error {
 	} else if err := os.MkdirAll(filepath.Dir(fname), 0700); err != nil {
 		return fmt.Errorf("unable to create output directory: %w", err)
 	}
-
-	if p.env.Cfg.Doc.FixZip {
-		_, tmp := filepath.Split(fname)
-		tmp = filepath.Join(p.tmpDir, tmp)
-
-		if err := p.writeEPUB(tmp); err != nil {
-			return err
-		}
-		if err := zipRemoveDataDescriptors(tmp, fname); err != nil {
-			return err
-		}
-		return os.Remove(tmp)
-	} else if err := p.writeEPUB(fname); err != nil {
-		return err
-	}
 	return nil
 }
 
-// FinalizeKEPUB produces kepub.epub file out of previously saved temporary files.
+// FinalizeKEPUB produces kepub.epub file out of previously saved output tree.
 func (p *Processor) FinalizeKEPUB(fname string) error {
 	return p.FinalizeEPUB(fname)
 }
@@ -0,0 +1,31 @@
+package processor
+
+import "errors"
+
+// Conversion errors are marked with one of these, so callers could tell what went wrong using errors.Is.
+var (
+	ErrParse     = errors.New("book could not be parsed")
+	ErrImage     = errors.New("image processing failed")
+	ErrKindlegen = errors.New("kindlegen failed")
+)
+
+// markedError adds kind to the error keeping its message intact.
+type markedError struct {
+	kind, err error
+}
+
+func (e *markedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *markedError) Unwrap() []error {
+	return []error{e.kind, e.err}
+}
+
+// markError marks error with kind, nil stays nil.
+func markError(kind, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &markedError{kind: kind, err: err}
+}
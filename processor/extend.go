@@ -0,0 +1,152 @@
+package processor
+
+import (
+	"sync"
+
+	"go.uber.org/zap"
+
+	"fb2converter/config"
+	"fb2converter/etree"
+)
+
+// Conversion could be extended by programs embedding processor: transfer of particular FB2 tags to XHTML could be
+// replaced and additional processing could be hooked into fixed points of book processing. Registrations are global and
+// affect all conversions started after them, so they are normally done from init. Simple tag renaming does not require
+// any code - see "tags" in document configuration.
+
+// TransferFunc transfers FB2 element "from" (with all its content) into XHTML element "to".
+type TransferFunc func(p *Processor, from, to *etree.Element) error
+
+// HookFunc is called at its processing stage, returned error stops conversion.
+type HookFunc func(p *Processor) error
+
+// Stage is a point in book processing where hooks are called.
+type Stage int
+
+// Stages with hooks. Hooks are only called for conversions producing XHTML, not for FB2 output or EPUB input.
+const (
+	// book description was parsed, bodies are not processed yet
+	AfterDescription Stage = iota
+	// all bodies and notes were transferred to XHTML
+	AfterBodies
+	// content is ready, OPF is about to be generated (EPUB and Kindle output only)
+	BeforeOPF
+)
+
+var registry = struct {
+	sync.RWMutex
+	transfers map[string]TransferFunc
+	hooks     map[Stage][]HookFunc
+}{
+	transfers: make(map[string]TransferFunc),
+	hooks:     make(map[Stage][]HookFunc),
+}
+
+// RegisterTransfer sets transfer function for FB2 tag replacing built-in one. Nil function restores built-in transfer.
+func RegisterTransfer(tag string, fn TransferFunc) {
+
+	registry.Lock()
+	defer registry.Unlock()
+
+	if fn == nil {
+		delete(registry.transfers, tag)
+		return
+	}
+	registry.transfers[tag] = fn
+}
+
+// RegisterHook adds function to be called at processing stage, hooks are called in order of registration.
+func RegisterHook(stage Stage, fn HookFunc) {
+
+	registry.Lock()
+	defer registry.Unlock()
+
+	registry.hooks[stage] = append(registry.hooks[stage], fn)
+}
+
+// Transfer transfers FB2 element to XHTML the usual way: optional decorations are XHTML tag, its CSS class and href.
+// Without tag element content is added directly to "to". It is intended to be used by custom transfer functions.
+func (p *Processor) Transfer(from, to *etree.Element, decorations ...string) error {
+	return p.transfer(from, to, decorations...)
+}
+
+// Document returns source FB2 document.
+func (p *Processor) Document() *etree.Document {
+	return p.doc
+}
+
+// EachXHTML calls fn for every XHTML file produced so far, name is file location in the resulting book.
+func (p *Processor) EachXHTML(fn func(name string, doc *etree.Document) error) error {
+	for _, f := range p.Book.Files {
+		if f.doc == nil {
+			continue
+		}
+		if err := fn(f.name(), f.doc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// transferFunc selects transfer function for FB2 element: configured tag mappings go first, then registered transfer
+// functions and built-in ones.
+func (p *Processor) transferFunc(el *etree.Element) (TransferFunc, bool) {
+
+	for _, m := range p.tagMappings {
+		if m.Tag != el.Tag {
+			continue
+		}
+		if len(m.Attr) > 0 {
+			if a := el.SelectAttr(m.Attr); a == nil || len(m.Value) > 0 && a.Value != m.Value {
+				continue
+			}
+		}
+		return func(p *Processor, from, to *etree.Element) error {
+			return p.transfer(from, to, m.To, m.Class)
+		}, true
+	}
+
+	registry.RLock()
+	fn, ok := registry.transfers[el.Tag]
+	registry.RUnlock()
+	if ok {
+		return fn, true
+	}
+
+	fn, ok = supportedTransfers[el.Tag]
+	return fn, ok
+}
+
+// runHooks returns processing stage calling all hooks registered for the stage.
+func (p *Processor) runHooks(stage Stage) func() error {
+	return func() error {
+		registry.RLock()
+		hooks := registry.hooks[stage]
+		registry.RUnlock()
+
+		for _, fn := range hooks {
+			if err := fn(p); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// validTagMappings returns usable tag mappings from configuration.
+func validTagMappings(tags []config.TagMapping, log *zap.Logger) []config.TagMapping {
+
+	var res []config.TagMapping
+	for _, m := range tags {
+		if len(m.Tag) == 0 || len(m.To) == 0 {
+			log.Warn("Invalid tag mapping, both tag and to must be specified, ignoring", zap.Any("mapping", m))
+			continue
+		}
+		if len(m.Attr) == 0 && len(m.Value) > 0 {
+			log.Warn("Invalid tag mapping, value requires attr, ignoring", zap.Any("mapping", m))
+			continue
+		}
+		res = append(res, m)
+	}
+	return res
+}
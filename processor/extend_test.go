@@ -0,0 +1,102 @@
+package processor
+
+import (
+	gocontext "context"
+	"errors"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"fb2converter/config"
+	"fb2converter/etree"
+	"fb2converter/state"
+)
+
+func TestExtend(t *testing.T) {
+
+	const doc = `<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+<description>
+  <title-info><book-title>Extended</book-title><lang>en</lang></title-info>
+  <document-info><id>1</id></document-info>
+</description>
+<body><section>
+  <p><style name="smallcaps">caps</style> <style name="other">plain</style> <strong>bold</strong></p>
+  <publisher-note>note</publisher-note>
+</section></body>
+</FictionBook>`
+
+	cfg, err := config.BuildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Doc.Tags = []config.TagMapping{
+		{Tag: "style", Attr: "name", Value: "smallcaps", To: "span", Class: "smallcaps"},
+		{Tag: "strong", To: "b"},
+		{Tag: "broken"},
+	}
+	env := &state.LocalEnv{Cfg: cfg, Log: zap.NewNop()}
+
+	RegisterTransfer("publisher-note", func(p *Processor, from, to *etree.Element) error {
+		return p.Transfer(from, to, "aside", "publisher")
+	})
+	defer RegisterTransfer("publisher-note", nil)
+
+	defer func() { registry.hooks = make(map[Stage][]HookFunc) }()
+
+	var stages []Stage
+	for _, s := range []Stage{AfterDescription, AfterBodies, BeforeOPF} {
+		RegisterHook(s, func(p *Processor) error {
+			if p.Book.Title == "Extended" {
+				stages = append(stages, s)
+			}
+			return nil
+		})
+	}
+
+	p, err := NewFB2(strings.NewReader(doc), false, "book.fb2", t.TempDir(), true, false, true, OEpub, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.tagMappings) != 2 {
+		t.Errorf("invalid mapping was not dropped: %v", p.tagMappings)
+	}
+	if err := p.Process(gocontext.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(stages) != 3 || stages[0] != AfterDescription || stages[1] != AfterBodies || stages[2] != BeforeOPF {
+		t.Errorf("unexpected hook calls: %v", stages)
+	}
+
+	var text strings.Builder
+	if err := p.EachXHTML(func(_ string, doc *etree.Document) error {
+		s, err := doc.WriteToString()
+		text.WriteString(s)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		`<span class="smallcaps">caps</span>`,
+		`<span>plain</span>`,
+		`<b>bold</b>`,
+		`<aside class="publisher">note</aside>`,
+	} {
+		if !strings.Contains(text.String(), s) {
+			t.Errorf("%s is missing from the content", s)
+		}
+	}
+
+	// hook error stops conversion
+	failure := errors.New("failure")
+	RegisterHook(AfterBodies, func(p *Processor) error { return failure })
+
+	p, err = NewFB2(strings.NewReader(doc), false, "book.fb2", t.TempDir(), true, false, true, OEpub, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Process(gocontext.Background()); !errors.Is(err, failure) {
+		t.Errorf("hook error expected, got %v", err)
+	}
+}
@@ -0,0 +1,276 @@
+package processor
+
+import (
+	"archive/zip"
+	gocontext "context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"fb2converter/etree"
+)
+
+// Order of description elements as required by FB2 schema, used when new elements have to be inserted.
+var (
+	fb2TitleInfoOrder    = []string{"genre", "author", "book-title", "annotation", "keywords", "date", "coverpage", "lang", "src-lang", "translator", "sequence"}
+	fb2DocumentInfoOrder = []string{"author", "program-used", "date", "src-url", "src-ocr", "id", "version", "history", "publisher"}
+	fb2AuthorOrder       = []string{"first-name", "middle-name", "last-name", "nickname", "home-page", "email", "id"}
+)
+
+// base64 encoded binary content is split into lines of this size.
+const fb2BinaryLineSize = 76
+
+// fb2Output checks if book is being repaired rather than converted.
+func (p *Processor) fb2Output() bool {
+	return p.format == OFb2 || p.format == OFb2Zip
+}
+
+// processFB2 repairs source document: binaries are decoded and checked, cover duplicates are removed and meta
+// information is corrected, book bodies are left intact.
+func (p *Processor) processFB2(ctx gocontext.Context) error {
+	return runStages(ctx, p.processBinaries, p.processDescription, p.processImages, p.updateDescription)
+}
+
+// updateDescription writes meta information changed by overwrites back to the document.
+func (p *Processor) updateDescription() error {
+
+	if p.metaOverwrite == nil {
+		return nil
+	}
+
+	desc := p.doc.FindElement("./FictionBook/description")
+	if desc == nil {
+		p.env.Log.Warn("Book has no description, unable to apply meta overwrites")
+		return nil
+	}
+
+	info := desc.SelectElement("title-info")
+	if info == nil {
+		info = insertFB2Element(desc, "title-info", []string{"title-info", "src-title-info", "document-info", "publish-info", "custom-info"})
+	}
+
+	if len(p.metaOverwrite.Genres) > 0 && len(p.Book.Genres) > 0 {
+		removeFB2Elements(info, "genre")
+		for _, g := range p.Book.Genres {
+			insertFB2Element(info, "genre", fb2TitleInfoOrder).SetText(g)
+		}
+	}
+	if len(p.metaOverwrite.Authors) > 0 {
+		removeFB2Elements(info, "author")
+		for _, an := range p.Book.Authors {
+			e := insertFB2Element(info, "author", fb2TitleInfoOrder)
+			for _, n := range []struct{ tag, value string }{{"first-name", an.First}, {"middle-name", an.Middle}, {"last-name", an.Last}} {
+				if len(n.value) > 0 {
+					insertFB2Element(e, n.tag, fb2AuthorOrder).SetText(n.value)
+				}
+			}
+		}
+	}
+	if len(strings.TrimSpace(p.metaOverwrite.Title)) > 0 {
+		selectFB2Element(info, "book-title", fb2TitleInfoOrder).SetText(p.Book.Title)
+	}
+	if len(strings.TrimSpace(p.metaOverwrite.Date)) > 0 {
+		e := selectFB2Element(info, "date", fb2TitleInfoOrder)
+		e.RemoveAttr("value")
+		e.SetText(p.Book.Date)
+	}
+	if len(strings.TrimSpace(p.metaOverwrite.Annotation)) > 0 {
+		e := selectFB2Element(info, "annotation", fb2TitleInfoOrder)
+		for _, t := range append([]etree.Token{}, e.Child...) {
+			e.RemoveChild(t)
+		}
+		for _, l := range strings.Split(p.Book.Annotation, "\n") {
+			if l = strings.TrimSpace(l); len(l) > 0 {
+				e.AddNext("p").SetText(l)
+			}
+		}
+	}
+	if p.metaOverwrite.CoverImage == "remove cover" {
+		removeFB2Elements(info, "coverpage")
+	}
+	if len(strings.TrimSpace(p.metaOverwrite.Lang)) > 0 {
+		selectFB2Element(info, "lang", fb2TitleInfoOrder).SetText(p.Book.Lang.String())
+	}
+	if len(strings.TrimSpace(p.metaOverwrite.SeqName)) > 0 || p.metaOverwrite.SeqNum > 0 {
+		e := selectFB2Element(info, "sequence", fb2TitleInfoOrder)
+		e.CreateAttr("name", p.Book.SeqName)
+		if p.Book.SeqNum > 0 {
+			e.CreateAttr("number", strconv.Itoa(p.Book.SeqNum))
+		}
+	}
+	if _, err := uuid.Parse(strings.TrimSpace(p.metaOverwrite.ID)); err == nil {
+		if info := desc.SelectElement("document-info"); info != nil {
+			selectFB2Element(info, "id", fb2DocumentInfoOrder).SetText(p.Book.ID.String())
+		}
+	}
+	return nil
+}
+
+// updateBinaries processes images the same way as for other formats and replaces document binaries with results.
+func (p *Processor) updateBinaries(ctx gocontext.Context) error {
+
+	if err := p.Book.eachImage(ctx, func(b *binImage) error {
+		if b.empty() {
+			return nil
+		}
+		return b.process()
+	}); err != nil {
+		return err
+	}
+
+	root := p.doc.FindElement("./FictionBook")
+	if root == nil {
+		return fmt.Errorf("unable to find FictionBook element")
+	}
+	removeFB2Elements(root, "binary")
+
+	for _, b := range p.Book.Images {
+		if len(b.data) == 0 {
+			p.env.Log.Warn("Dropping empty binary", zap.String("id", b.id))
+			continue
+		}
+		enc := base64.StdEncoding.EncodeToString(b.data)
+		var text strings.Builder
+		for len(enc) > fb2BinaryLineSize {
+			text.WriteString(enc[:fb2BinaryLineSize])
+			text.WriteByte('\n')
+			enc = enc[fb2BinaryLineSize:]
+		}
+		text.WriteString(enc)
+		root.AddNext("binary", attr("id", b.id), attr("content-type", b.ct)).SetText(text.String()).SetTail("\n")
+	}
+	return nil
+}
+
+// FinalizeFB2 writes repaired document, packing it into zip archive when requested.
+func (p *Processor) FinalizeFB2(fname string) error {
+
+	if err := p.prepareOutput(fname); err != nil {
+		return err
+	}
+
+	f, err := os.Create(fname)
+	if err != nil {
+		return fmt.Errorf("unable to create FB2 (%s): %w", fname, err)
+	}
+	if err := p.writeFB2(f, filepath.Base(fname)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeFB2 writes repaired document to w, name is used for the archive entry.
+func (p *Processor) writeFB2(w io.Writer, name string) error {
+
+	addXMLDeclaration(p.doc)
+
+	if p.format != OFb2Zip {
+		if _, err := p.doc.WriteTo(w); err != nil {
+			return fmt.Errorf("unable to write FB2 (%s): %w", name, err)
+		}
+		return nil
+	}
+
+	z := zip.NewWriter(w)
+	f, err := z.CreateHeader(&zip.FileHeader{
+		Name:     strings.TrimSuffix(name, filepath.Ext(name)),
+		Method:   zip.Deflate,
+		Modified: time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to create FB2 archive (%s): %w", name, err)
+	}
+	if _, err := p.doc.WriteTo(f); err != nil {
+		return fmt.Errorf("unable to write FB2 (%s): %w", name, err)
+	}
+	return z.Close()
+}
+
+// addXMLDeclaration makes sure document starts with XML declaration.
+func addXMLDeclaration(doc *etree.Document) {
+
+	for _, t := range doc.Child {
+		if pi, ok := t.(*etree.ProcInst); ok && pi.Target == "xml" {
+			// encoding is always replaced with UTF-8 when written
+			return
+		}
+	}
+	pi := etree.NewProcInst("xml", `version="1.0" encoding="UTF-8"`)
+	pi.TailData = "\n"
+	var first etree.Token
+	if len(doc.Child) > 0 {
+		first = doc.Child[0]
+	}
+	doc.InsertChild(first, pi)
+}
+
+// selectFB2Element returns first child element with the tag, creating it if necessary.
+func selectFB2Element(parent *etree.Element, tag string, order []string) *etree.Element {
+	if e := parent.SelectElement(tag); e != nil {
+		return e
+	}
+	return insertFB2Element(parent, tag, order)
+}
+
+// insertFB2Element creates new child element keeping schema order and document formatting.
+func insertFB2Element(parent *etree.Element, tag string, order []string) *etree.Element {
+
+	var ex etree.Token
+	pos := slices.Index(order, tag)
+	for _, c := range parent.ChildElements() {
+		if slices.Index(order, c.Tag) > pos {
+			ex = c
+			break
+		}
+	}
+
+	e := etree.NewElement(tag)
+	parent.InsertChild(ex, e)
+
+	// reuse indentation of the preceding token
+	i := slices.Index(parent.Child, etree.Token(e))
+	if i <= 0 {
+		return e
+	}
+	ws, ok := fb2Indent(parent.Child[i-1])
+	if !ok {
+		return e
+	}
+	e.TailData = ws
+	if prev, ok := parent.Child[i-1].(*etree.Element); ok && ex == nil && i > 1 {
+		// when appended, preceding element tail indents closing tag of parent, so new element takes it over
+		if indent, ok := fb2Indent(parent.Child[i-2]); ok {
+			prev.TailData = indent
+		}
+	}
+	return e
+}
+
+// fb2Indent returns whitespace following the token, if any.
+func fb2Indent(t etree.Token) (string, bool) {
+	var ws string
+	switch t := t.(type) {
+	case *etree.Element:
+		ws = t.TailData
+	case *etree.CharData:
+		ws = t.Data
+	}
+	return ws, len(ws) > 0 && len(strings.TrimSpace(ws)) == 0
+}
+
+// removeFB2Elements removes all child elements with the tag.
+func removeFB2Elements(parent *etree.Element, tag string) {
+	for _, e := range parent.SelectElements(tag) {
+		parent.RemoveChild(e)
+	}
+}
@@ -0,0 +1,142 @@
+package processor
+
+import (
+	"archive/zip"
+	"bytes"
+	gocontext "context"
+	"io"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+	"golang.org/x/text/encoding/charmap"
+
+	"fb2converter/config"
+	"fb2converter/state"
+)
+
+func TestRepairFB2(t *testing.T) {
+
+	const doc = `<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+ <description>
+  <title-info>
+   <genre>sf</genre>
+   <author><first-name>Анна</first-name><last-name>Писатель</last-name></author>
+   <book-title>Книга</book-title>
+   <coverpage><image l:href="#pic.png"/></coverpage>
+   <lang>ru</lang>
+  </title-info>
+  <document-info><id>1</id></document-info>
+ </description>
+ <body><section><title><p>Глава</p></title><p>Текст.</p></section></body>
+ <binary id="pic.png" content-type="image/png">` + htmlTestImage + `</binary>
+</FictionBook>`
+
+	cfg, err := config.BuildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Overwrites = map[string]config.MetaInfo{"*": {
+		Title:   "Новая",
+		SeqName: "Цикл",
+		SeqNum:  2,
+		Authors: []*config.AuthorName{{First: "Борис", Last: "Автор"}},
+	}}
+	env := &state.LocalEnv{Cfg: cfg, Log: zap.NewNop()}
+
+	convert := func(src string, unknownEncoding bool, format OutputFmt) (string, []byte) {
+		t.Helper()
+		p, err := NewFB2(strings.NewReader(src), unknownEncoding, "book.fb2", t.TempDir(), true, false, true, format, env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.Clean()
+		if err := p.Process(gocontext.Background()); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		name, err := p.SaveTo(gocontext.Background(), &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return name, buf.Bytes()
+	}
+
+	check := func(out string) {
+		t.Helper()
+		if !utf8.ValidString(out) {
+			t.Fatal("result is not in UTF-8")
+		}
+		if !strings.HasPrefix(out, `<?xml version="1.0" encoding="UTF-8"?>`+"\n<FictionBook") {
+			t.Errorf("unexpected XML declaration: %.60q", out)
+		}
+		for _, s := range []string{
+			// repaired description keeps schema order and formatting
+			"   <author><first-name>Борис</first-name><last-name>Автор</last-name></author>\n   <book-title>Новая</book-title>",
+			"   <lang>ru</lang>\n   <sequence name=\"Цикл\" number=\"2\"/>\n  </title-info>",
+			// bodies are left intact
+			" <body><section><title><p>Глава</p></title><p>Текст.</p></section></body>",
+		} {
+			if !strings.Contains(out, s) {
+				t.Errorf("%q is missing from result", s)
+			}
+		}
+		if strings.Contains(out, "Писатель") || strings.Contains(out, "Книга") {
+			t.Error("overwritten description is left in result")
+		}
+		// binaries are rewritten in lines of limited size
+		b := out[strings.Index(out, `<binary id="pic.png" content-type="image/png">`):]
+		b = b[strings.Index(b, ">")+1 : strings.Index(b, "</binary>")]
+		if lines := strings.Split(b, "\n"); len(lines) != 2 || len(lines[0]) != fb2BinaryLineSize || strings.Join(lines, "") != htmlTestImage {
+			t.Errorf("unexpected binary content %q", b)
+		}
+
+		// result could be read back
+		p, err := NewFB2(strings.NewReader(out), false, "book.fb2", t.TempDir(), true, false, true, OEpub, &state.LocalEnv{Cfg: cfg, Log: zap.NewNop()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.Clean()
+		if err := p.processDescription(); err != nil {
+			t.Fatal(err)
+		}
+		if p.Book.Title != "Новая" || p.Book.SeqName != "Цикл" || p.Book.SeqNum != 2 || p.Book.Lang.String() != "ru" {
+			t.Errorf("unexpected description read back: %q %q %d %s", p.Book.Title, p.Book.SeqName, p.Book.SeqNum, p.Book.Lang)
+		}
+	}
+
+	// source in single byte code page with its own declaration
+	src, err := charmap.Windows1251.NewEncoder().String(`<?xml version="1.0" encoding="windows-1251"?>` + "\n" + doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, out := convert(src, true, OFb2)
+	if name != "book.fb2" {
+		t.Errorf("unexpected name %q", name)
+	}
+	check(string(out))
+
+	// source without declaration packed into archive
+	name, out = convert(doc, false, OFb2Zip)
+	if name != "book.fb2.zip" {
+		t.Errorf("unexpected name %q", name)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(out), int64(len(out)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != 1 || zr.File[0].Name != "book.fb2" || zr.File[0].Method != zip.Deflate {
+		t.Fatalf("unexpected archive content %v", zr.File)
+	}
+	f, err := zr.File[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(string(data))
+}
@@ -0,0 +1,164 @@
+package processor
+
+import (
+	"hash/fnv"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"fb2converter/state"
+)
+
+// Content fingerprint is MinHash of word shingles: books with slightly edited text share most of the shingles and
+// so most of the minimal hashes. See https://en.wikipedia.org/wiki/MinHash.
+const (
+	shingleWords = 4
+	// FingerprintLen is number of hashes in content fingerprint.
+	FingerprintLen = 64
+)
+
+// BookFingerprint is what is necessary to recognize duplicate books.
+type BookFingerprint struct {
+	Source  string   `json:"source"`
+	ID      string   `json:"id,omitempty"`
+	Title   string   `json:"title"`
+	Authors []string `json:"authors"`
+	Version string   `json:"version,omitempty"`
+	Size    int64    `json:"size"`
+	// normalized authors, title and sequence, empty when book has no title
+	Key string `json:"-"`
+	// content MinHash, empty when book text is too short
+	Content []uint64 `json:"-"`
+}
+
+// VersionNumber returns document-info version as number, 0 when it is missing or could not be parsed.
+func (f *BookFingerprint) VersionNumber() float64 {
+	v, err := strconv.ParseFloat(strings.Replace(f.Version, ",", ".", 1), 64)
+	if err != nil {
+		return 0
+	}
+	return v
+}
+
+// Similarity estimates how much texts of two books have in common, from 0 to 1.
+func (f *BookFingerprint) Similarity(o *BookFingerprint) float64 {
+	if len(f.Content) != FingerprintLen || len(o.Content) != FingerprintLen {
+		return 0
+	}
+	same := 0
+	for i := range f.Content {
+		if f.Content[i] == o.Content[i] {
+			same++
+		}
+	}
+	return float64(same) / FingerprintLen
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// normalizeWords lowercases text and drops everything but letters and digits.
+func normalizeWords(s string) []string {
+	return strings.FieldsFunc(strings.ReplaceAll(strings.ToLower(s), "ё", "е"), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// mix64 is splitmix64 finalizer, good enough to produce independent hash functions out of one.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// minHash calculates content fingerprint, nil if there are not enough words.
+func minHash(words []string) []uint64 {
+
+	if len(words) < shingleWords {
+		return nil
+	}
+
+	res := make([]uint64, FingerprintLen)
+	for i := range res {
+		res[i] = ^uint64(0)
+	}
+	h := fnv.New64a()
+	for i := 0; i+shingleWords <= len(words); i++ {
+		h.Reset()
+		for _, w := range words[i : i+shingleWords] {
+			h.Write([]byte(w))
+			h.Write([]byte{0})
+		}
+		base := h.Sum64()
+		for j := range res {
+			if v := mix64(base + uint64(j)*0x9e3779b97f4a7c15); v < res[j] {
+				res[j] = v
+			}
+		}
+	}
+	return res
+}
+
+// ReadFingerprint parses FB2 document and prepares its fingerprint. Book ID is the one conversion would use (including
+// one derived from non UUID document-info/id), empty when document does not have any.
+func ReadFingerprint(r io.Reader, unknownEncoding bool, src string, env *state.LocalEnv) (*BookFingerprint, error) {
+
+	cr := &countingReader{r: r}
+	p, u, err := readDescription(cr, unknownEncoding, src, env)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &BookFingerprint{
+		Source:  src,
+		Title:   p.Book.Title,
+		Authors: make([]string, 0, len(p.Book.Authors)),
+		Size:    cr.n,
+	}
+	if p.Book.ID != u {
+		f.ID = p.Book.ID.String()
+	}
+	if e := p.doc.FindElement("./FictionBook/description/document-info/version"); e != nil {
+		f.Version = strings.TrimSpace(e.Text())
+	}
+
+	authors := make([]string, 0, len(p.Book.Authors))
+	for _, an := range p.Book.Authors {
+		f.Authors = append(f.Authors, ReplaceKeywords(p.env.Cfg.Doc.AuthorFormat, CreateAuthorKeywordsMap(an)))
+		authors = append(authors, strings.Join(normalizeWords(an.Last+" "+an.First+" "+an.Middle), " "))
+	}
+	// without title book is named after file, which means nothing here
+	if title := strings.Join(normalizeWords(p.Book.Title), " "); len(title) > 0 && p.Book.Title != filepath.Base(src) {
+		sort.Strings(authors)
+		f.Key = strings.Join([]string{
+			strings.Join(authors, ";"),
+			title,
+			strings.Join(normalizeWords(p.Book.SeqName), " "),
+			strconv.Itoa(p.Book.SeqNum),
+		}, "|")
+	}
+
+	var b strings.Builder
+	for i, body := range p.doc.FindElements("./FictionBook/body") {
+		if i != 0 && IsOneOf(getAttrValue(body, "name"), env.Cfg.Doc.Notes.BodyNames) {
+			continue
+		}
+		collectText(body, &b)
+	}
+	f.Content = minHash(normalizeWords(b.String()))
+	return f, nil
+}
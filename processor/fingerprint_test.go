@@ -0,0 +1,26 @@
+package processor
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFingerprintSimilarity(t *testing.T) {
+
+	text := strings.Repeat("Жил-был у бабушки серенький козлик, вот как, вот как, серенький козлик. ", 3) +
+		"Бабушка козлика очень любила, вот как, вот как, очень любила. Вздумалось козлику в лес погуляти, вот как, вот как, " +
+		"в лес погуляти. Напали на козлика серые волки, вот как, вот как, серые волки. Остались от козлика рожки да ножки."
+	edited := strings.Replace(text, "рожки да ножки", "только рожки", 1)
+	other := "Мороз и солнце; день чудесный! Еще ты дремлешь, друг прелестный - пора, красавица, проснись: открой сомкнуты негой взоры."
+
+	f := &BookFingerprint{Content: minHash(normalizeWords(text))}
+	if s := f.Similarity(&BookFingerprint{Content: minHash(normalizeWords(edited))}); s < 0.8 {
+		t.Errorf("edited text similarity is too low: %f", s)
+	}
+	if s := f.Similarity(&BookFingerprint{Content: minHash(normalizeWords(other))}); s > 0.2 {
+		t.Errorf("different text similarity is too high: %f", s)
+	}
+	if s := f.Similarity(&BookFingerprint{Content: minHash(normalizeWords("три слова только"))}); s != 0 {
+		t.Errorf("short text must not have fingerprint: %f", s)
+	}
+}
@@ -244,6 +244,84 @@ func (p *Processor) generateNCX() error {
 	to, f := p.ctx().createNCX("toc", p.Book.ID.String())
 	p.Book.Files = append(p.Book.Files, f)
 
+	p.buildTOC(to, addNavPoint)
+	return nil
+}
+
+// generateNav creates EPUB3 navigation document with table of contents, page list and landmarks.
+func (p *Processor) generateNav() error {
+
+	if p.format != OEpub3 {
+		return nil
+	}
+
+	p.env.Log.Debug("Generating navigation document - start")
+	defer func(start time.Time) {
+		p.env.Log.Debug("Generating navigation document - done", zap.Duration("elapsed", time.Since(start)))
+	}(time.Now())
+
+	// nested navigation points are kept in ordered lists inside of list items
+	addNavItem := func(to *etree.Element, _ int, title, link string) *etree.Element {
+		if to.Tag == "li" {
+			if ol := to.SelectElement("ol"); ol != nil {
+				to = ol
+			} else {
+				to = to.AddNext("ol")
+			}
+		}
+		li := to.AddNext("li")
+		li.AddNext("a", attr("href", link)).SetText(title)
+		return li
+	}
+
+	to, f := p.ctx().createXHTML("nav",
+		attr("xmlns", `http://www.w3.org/1999/xhtml`),
+		attr("xmlns:epub", `http://www.idpf.org/2007/ops`),
+	)
+	f.id = "nav"
+	f.transient = dataNotForSpline
+	p.Book.Files = append(p.Book.Files, f)
+
+	toc := to.AddNext("nav", attr("epub:type", "toc"), attr("id", "toc"))
+	toc.AddNext("h1").SetText(p.env.Cfg.Doc.TOC.Title)
+	ol := toc.AddNext("ol")
+	p.buildTOC(ol, addNavItem)
+	if len(ol.ChildElements()) == 0 {
+		// navigation document requires non-empty table of contents
+		for _, f := range p.Book.Files {
+			if strings.HasPrefix(f.fname, "index") {
+				addNavItem(ol, 0, p.Book.Title, f.fname)
+				break
+			}
+		}
+	}
+
+	if pages := p.collectPages(); len(pages) > 0 {
+		pl := to.AddNext("nav", attr("epub:type", "page-list"), attr("hidden", "hidden")).AddNext("ol")
+		for i, href := range pages {
+			pl.AddNext("li").AddNext("a", attr("href", href)).SetText(strconv.Itoa(i + 1))
+		}
+	}
+
+	lm := to.AddNext("nav", attr("epub:type", "landmarks"), attr("hidden", "hidden")).AddNext("ol")
+	if len(p.Book.Cover) > 0 {
+		lm.AddNext("li").AddNext("a", attr("epub:type", "cover"), attr("href", "cover.xhtml")).SetText("Cover")
+	}
+	if p.tocPlacement != TOCNone && len(p.Book.TOC) > 0 {
+		lm.AddNext("li").AddNext("a", attr("epub:type", "toc"), attr("href", "toc.xhtml")).SetText(p.env.Cfg.Doc.TOC.Title)
+	}
+	for _, f := range p.Book.Files {
+		if strings.HasPrefix(f.fname, "index") {
+			lm.AddNext("li").AddNext("a", attr("epub:type", "bodymatter"), attr("href", f.fname)).SetText("Start")
+			break
+		}
+	}
+	return nil
+}
+
+// buildTOC creates hierarchy of navigation points from collected TOC entries using supplied function to add single point.
+func (p *Processor) buildTOC(to *etree.Element, addNavPoint func(to *etree.Element, index int, title, link string) *etree.Element) {
+
 	index := 1
 
 	if p.tocPlacement == TOCBefore && len(p.Book.TOC) > 0 {
@@ -302,7 +380,6 @@ func (p *Processor) generateNCX() error {
 	if p.tocPlacement == TOCAfter && len(p.Book.TOC) > 0 {
 		addNavPoint(to, index, p.env.Cfg.Doc.TOC.Title, "toc.xhtml")
 	}
-	return nil
 }
 
 // process stylesheet and files it references.
@@ -395,6 +472,11 @@ func (p *Processor) prepareStylesheet() error {
 // generatePagemap creates epub page map.
 func (p *Processor) generatePagemap() error {
 
+	if p.format == OEpub3 {
+		// page list is part of navigation document
+		return nil
+	}
+
 	p.env.Log.Debug("Generating page map - start")
 	defer func(start time.Time) {
 		p.env.Log.Debug("Generating page map - done", zap.Duration("elapsed", time.Since(start)))
@@ -403,14 +485,22 @@ func (p *Processor) generatePagemap() error {
 	to, f := p.ctx().createPM("page-map")
 	p.Book.Files = append(p.Book.Files, f)
 
-	page := 1
+	for i, href := range p.collectPages() {
+		to.AddNext("page", attr("name", fmt.Sprintf("%d", i+1)), attr("href", href))
+	}
+	return nil
+}
+
+// collectPages returns references to all book pages in reading order.
+func (p *Processor) collectPages() []string {
+
+	var pages []string
 	for _, f := range p.Book.Files {
 		if f.transient&dataNotForSpline != 0 {
 			continue
 		}
 
-		to.AddNext("page", attr("name", fmt.Sprintf("%d", page)), attr("href", f.fname))
-		page++
+		pages = append(pages, f.fname)
 
 		additionalPages, ok := p.Book.Pages[f.fname]
 		if !ok {
@@ -418,11 +508,10 @@ func (p *Processor) generatePagemap() error {
 		}
 
 		for i := 0; i < additionalPages; i++ {
-			to.AddNext("page", attr("name", fmt.Sprintf("%d", page)), attr("href", fmt.Sprintf("%s#page_%d", f.fname, i)))
-			page++
+			pages = append(pages, fmt.Sprintf("%s#page_%d", f.fname, i))
 		}
 	}
-	return nil
+	return pages
 }
 
 // generateOPF creates epub Open Package format file.
@@ -433,17 +522,27 @@ func (p *Processor) generateOPF() error {
 		p.env.Log.Debug("Generating OPF - done", zap.Duration("elapsed", time.Since(start)))
 	}(time.Now())
 
-	to, f := p.ctx().createOPF("content")
-	p.Book.Files = append(p.Book.Files, f)
-
 	kindle := p.format == OMobi || p.format == OAzw3
+	epub3 := p.format == OEpub3
+
+	version := "2.0"
+	if epub3 {
+		version = "3.0"
+	}
+	to, f := p.ctx().createOPF("content", version)
+	p.Book.Files = append(p.Book.Files, f)
 
 	// Metadata generation
 
-	meta := to.AddNext("metadata",
-		attr("xmlns:dc", `http://purl.org/dc/elements/1.1/`),
-		attr("xmlns:opf", `http://www.idpf.org/2007/opf`),
-	)
+	var meta *etree.Element
+	if epub3 {
+		meta = to.AddNext("metadata", attr("xmlns:dc", `http://purl.org/dc/elements/1.1/`))
+	} else {
+		meta = to.AddNext("metadata",
+			attr("xmlns:dc", `http://purl.org/dc/elements/1.1/`),
+			attr("xmlns:opf", `http://www.idpf.org/2007/opf`),
+		)
+	}
 
 	var title string
 	if len(p.env.Cfg.Doc.TitleFormat) > 0 {
@@ -457,17 +556,31 @@ func (p *Processor) generateOPF() error {
 	}
 	meta.AddNext("dc:title").SetText(title)
 	meta.AddNext("dc:language").SetText(p.Book.Lang.String())
-	meta.AddNext("dc:identifier", attr("id", "BookId"), attr("opf:scheme", "uuid")).SetText(fmt.Sprintf("urn:uuid:%s", p.Book.ID))
+	if epub3 {
+		meta.AddNext("dc:identifier", attr("id", "BookId")).SetText(fmt.Sprintf("urn:uuid:%s", p.Book.ID))
+		meta.AddNext("meta", attr("property", "dcterms:modified")).SetText(time.Now().UTC().Format("2006-01-02T15:04:05Z"))
+	} else {
+		meta.AddNext("dc:identifier", attr("id", "BookId"), attr("opf:scheme", "uuid")).SetText(fmt.Sprintf("urn:uuid:%s", p.Book.ID))
+	}
 
-	for _, an := range p.Book.Authors {
+	for i, an := range p.Book.Authors {
 		a := ReplaceKeywords(p.env.Cfg.Doc.AuthorFormatMeta, CreateAuthorKeywordsMap(an))
 		if p.env.Cfg.Doc.TransliterateMeta {
 			a = slug.Make(a)
 		}
-		meta.AddNext("dc:creator", attr("opf:role", "aut")).SetText(a)
+		if epub3 {
+			id := fmt.Sprintf("creator%d", i+1)
+			meta.AddNext("dc:creator", attr("id", id)).SetText(a)
+			meta.AddNext("meta", attr("refines", "#"+id), attr("property", "role"), attr("scheme", "marc:relators")).SetText("aut")
+		} else {
+			meta.AddNext("dc:creator", attr("opf:role", "aut")).SetText(a)
+		}
 	}
 
-	meta.AddNext("dc:publisher")
+	if !epub3 {
+		// EPUB3 does not allow empty elements
+		meta.AddNext("dc:publisher")
+	}
 
 	for _, g := range p.Book.Genres {
 		meta.AddNext("dc:subject").SetText(g)
@@ -481,11 +594,19 @@ func (p *Processor) generateOPF() error {
 	if len(p.Book.Cover) > 0 {
 		meta.AddNext("meta", attr("name", "cover"), attr("content", "book-cover-image"))
 	}
-	// Do not let series metadata to disappear, use calibre meta tags
+	// Do not let series metadata to disappear, use calibre meta tags or EPUB3 collections
 	if len(p.Book.SeqName) > 0 {
-		meta.AddNext("meta", attr("name", "calibre:series"), attr("content", p.Book.SeqName))
-		if p.Book.SeqNum > 0 {
-			meta.AddNext("meta", attr("name", "calibre:series_index"), attr("content", strconv.Itoa(p.Book.SeqNum)))
+		if epub3 {
+			meta.AddNext("meta", attr("property", "belongs-to-collection"), attr("id", "collection")).SetText(p.Book.SeqName)
+			meta.AddNext("meta", attr("refines", "#collection"), attr("property", "collection-type")).SetText("series")
+			if p.Book.SeqNum > 0 {
+				meta.AddNext("meta", attr("refines", "#collection"), attr("property", "group-position")).SetText(strconv.Itoa(p.Book.SeqNum))
+			}
+		} else {
+			meta.AddNext("meta", attr("name", "calibre:series"), attr("content", p.Book.SeqName))
+			if p.Book.SeqNum > 0 {
+				meta.AddNext("meta", attr("name", "calibre:series_index"), attr("content", strconv.Itoa(p.Book.SeqNum)))
+			}
 		}
 	}
 
@@ -497,7 +618,17 @@ func (p *Processor) generateOPF() error {
 		if f.transient&dataNotForManifest != 0 {
 			continue
 		}
-		man.AddSame("item", attr("id", f.id), attr("media-type", f.ct), attr("href", f.fname))
+		var props *etree.Attr
+		if epub3 {
+			switch f.id {
+			case "nav":
+				props = attr("properties", "nav")
+			case "cover-page":
+				// has inline svg
+				props = attr("properties", "svg")
+			}
+		}
+		man.AddSame("item", attr("id", f.id), attr("media-type", f.ct), attr("href", f.fname), props)
 	}
 
 	for i, f := range p.Book.Images {
@@ -534,7 +665,13 @@ func (p *Processor) generateOPF() error {
 
 	// Spine generation
 
-	spine := to.AddNext("spine", attr("toc", "ncx"), attr("page-map", "page-map"))
+	var spine *etree.Element
+	if epub3 {
+		// keep NCX for older readers, page map is replaced by page list in navigation document
+		spine = to.AddNext("spine", attr("toc", "ncx"))
+	} else {
+		spine = to.AddNext("spine", attr("toc", "ncx"), attr("page-map", "page-map"))
+	}
 
 	for _, f := range p.Book.Files {
 		id := f.id
@@ -551,6 +688,11 @@ func (p *Processor) generateOPF() error {
 		spine.AddSame("itemref", attrs...)
 	}
 
+	if epub3 {
+		// guide is replaced by landmarks in navigation document
+		return nil
+	}
+
 	// Guide generation
 
 	guide := to.AddNext("guide")
@@ -617,16 +759,21 @@ func (p *Processor) KepubifyXHTML() error {
 	for _, f := range p.Book.Files {
 		if f.ct == "application/xhtml+xml" && filepath.Ext(f.fname) == ".xhtml" && f.doc != nil {
 			if body := f.doc.FindElement("./html/body"); body != nil {
-				to := etree.NewElement("div")
-				to.CreateAttr("id", "book-columns")
-				inner := to.AddNext("div", attr("id", "book-inner"))
-				children := body.ChildElements()
-				for i := 0; i < len(children); i++ {
-					inner.AddChild(body.RemoveChild(children[i]))
-				}
-				body.AddChild(to)
+				wrapKoboBody(body)
 			}
 		}
 	}
 	return nil
 }
+
+// wrapKoboBody moves body content inside of divs expected by Kobo readers.
+func wrapKoboBody(body *etree.Element) {
+	to := etree.NewElement("div")
+	to.CreateAttr("id", "book-columns")
+	inner := to.AddNext("div", attr("id", "book-inner"))
+	children := body.ChildElements()
+	for i := 0; i < len(children); i++ {
+		inner.AddChild(body.RemoveChild(children[i]))
+	}
+	body.AddChild(to)
+}
@@ -0,0 +1,167 @@
+package processor
+
+import (
+	"archive/zip"
+	"bytes"
+	gocontext "context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"fb2converter/config"
+	"fb2converter/etree"
+	"fb2converter/state"
+)
+
+func TestGenerateEPUB3(t *testing.T) {
+
+	const doc = `<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+<description>
+  <title-info><author><first-name>Ann</first-name><last-name>Writer</last-name></author><book-title>Book</book-title><lang>en</lang>
+  <coverpage><image l:href="#pic.png"/></coverpage><sequence name="Saga" number="2"/></title-info>
+  <document-info><id>1</id></document-info>
+</description>
+<body>
+  <section><title><p>One</p></title><section><title><p>One A</p></title><p>Text.</p></section></section>
+  <section><title><p>Two</p></title><p>More.</p></section>
+</body>
+<binary id="pic.png" content-type="image/png">` + htmlTestImage + `</binary>
+</FictionBook>`
+
+	cfg, err := config.BuildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := &state.LocalEnv{Cfg: cfg, Log: zap.NewNop()}
+
+	p, err := NewFB2(strings.NewReader(doc), false, "book.fb2", t.TempDir(), true, false, true, OEpub3, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Process(gocontext.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := p.SaveTo(gocontext.Background(), &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := func(name string) *etree.Element {
+		t.Helper()
+		f, err := zr.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		data, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := etree.NewDocument()
+		if err := d.ReadFromBytes(data); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		return d.Root()
+	}
+
+	// package document
+	opf := read("OEBPS/content.opf")
+	if v := opf.SelectAttrValue("version", ""); v != "3.0" {
+		t.Errorf("package version %q", v)
+	}
+	meta := opf.SelectElement("metadata")
+	if meta == nil {
+		t.Fatal("no metadata")
+	}
+	metaProp := func(prop string) *etree.Element {
+		for _, m := range meta.SelectElements("meta") {
+			if m.SelectAttrValue("property", "") == prop {
+				return m
+			}
+		}
+		return nil
+	}
+	if m := metaProp("dcterms:modified"); m == nil {
+		t.Error("dcterms:modified is missing")
+	} else if _, err := time.Parse("2006-01-02T15:04:05Z", m.Text()); err != nil {
+		t.Errorf("dcterms:modified: %v", err)
+	}
+	if m := metaProp("belongs-to-collection"); m == nil || m.Text() != "Saga" {
+		t.Errorf("unexpected collection %v", m)
+	} else {
+		id := "#" + m.SelectAttrValue("id", "")
+		refines := make(map[string]string)
+		for _, r := range meta.SelectElements("meta") {
+			if r.SelectAttrValue("refines", "") == id {
+				refines[r.SelectAttrValue("property", "")] = r.Text()
+			}
+		}
+		if refines["collection-type"] != "series" || refines["group-position"] != "2" {
+			t.Errorf("unexpected collection refinements %v", refines)
+		}
+	}
+	if opf.SelectElement("guide") != nil {
+		t.Error("guide is present in EPUB3 package")
+	}
+
+	props := make(map[string]string)
+	for _, item := range opf.FindElements("./manifest/item[@properties]") {
+		props[item.SelectAttrValue("properties", "")] = item.SelectAttrValue("href", "")
+	}
+	for prop, href := range map[string]string{
+		"nav":         "nav.xhtml",
+		"cover-image": "images/bin00000000.png",
+		"svg":         "cover.xhtml",
+	} {
+		if props[prop] != href {
+			t.Errorf("manifest item with %q property: expected %q, got %q", prop, href, props[prop])
+		}
+	}
+
+	// navigation document
+	nav := read("OEBPS/nav.xhtml")
+	navs := make(map[string]*etree.Element)
+	for _, n := range nav.FindElements("./body/nav") {
+		navs[n.SelectAttrValue("epub:type", "")] = n
+	}
+	titles := func(ol *etree.Element) (res []string) {
+		for _, li := range ol.SelectElements("li") {
+			res = append(res, li.SelectElement("a").Text())
+		}
+		return
+	}
+
+	toc := navs["toc"]
+	if toc == nil || toc.SelectElement("ol") == nil {
+		t.Fatal("table of contents is missing")
+	}
+	top := toc.SelectElement("ol")
+	if got := strings.Join(titles(top), "|"); got != "Writer Ann Book|One|Two|Content" {
+		t.Errorf("unexpected table of contents %q", got)
+	}
+	if sub := top.FindElement("./li[2]/ol"); sub == nil || strings.Join(titles(sub), "|") != "One A" {
+		t.Error("nested section is not in nested list")
+	}
+	if pl := navs["page-list"]; pl == nil || pl.SelectAttrValue("hidden", "") != "hidden" || len(pl.FindElements("./ol/li")) != 6 {
+		t.Error("unexpected page list")
+	}
+	lm := navs["landmarks"]
+	if lm == nil {
+		t.Fatal("landmarks are missing")
+	}
+	landmarks := make(map[string]string)
+	for _, a := range lm.FindElements("./ol/li/a") {
+		landmarks[a.SelectAttrValue("epub:type", "")] = a.SelectAttrValue("href", "")
+	}
+	if landmarks["cover"] != "cover.xhtml" || landmarks["toc"] != "toc.xhtml" || landmarks["bodymatter"] != "index1.xhtml" {
+		t.Errorf("unexpected landmarks %v", landmarks)
+	}
+}
@@ -0,0 +1,208 @@
+package processor
+
+import (
+	"bytes"
+	gocontext "context"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"os"
+	"path"
+	"strings"
+
+	"fb2converter/etree"
+)
+
+// htmlVoidElements could not have content and are always written self-closed.
+var htmlVoidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true, "hr": true, "img": true,
+	"input": true, "link": true, "meta": true, "source": true, "track": true, "wbr": true,
+}
+
+// htmlNoteButtonStyle makes buttons opening popover notes look like links, book stylesheet takes precedence.
+const htmlNoteButtonStyle = ":where(button[popovertarget]) {\n    all: unset;\n    cursor: pointer;\n    color: LinkText;\n    text-decoration: underline\n}\n\n"
+
+// htmlOutput checks if book is being rendered as a single HTML page.
+func (p *Processor) htmlOutput() bool {
+	return p.format == OHtml
+}
+
+// processHTML transfers book to XHTML the usual way, everything will be put into a single page later.
+func (p *Processor) processHTML(ctx gocontext.Context) error {
+	return runStages(ctx,
+		p.processBinaries,
+		p.processNotes,
+		p.processDescription,
+		p.runHooks(AfterDescription),
+		p.processBodies,
+		p.runHooks(AfterBodies),
+		p.processLinks,
+		p.processImages,
+		p.generateCover,
+		// TOC page goes to the very top, even before cover
+		p.generateTOCPage,
+		p.prepareStylesheet,
+	)
+}
+
+// FinalizeHTML produces self-contained HTML page out of previously generated XHTML files, all resources are inlined as
+// data URIs.
+func (p *Processor) FinalizeHTML(ctx gocontext.Context, fname string) error {
+
+	if err := p.prepareOutput(fname); err != nil {
+		return err
+	}
+	data, err := p.renderHTML(ctx)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(fname, data, 0644); err != nil {
+		return fmt.Errorf("unable to write HTML (%s): %w", fname, err)
+	}
+	return nil
+}
+
+// renderHTML produces self-contained HTML page.
+func (p *Processor) renderHTML(ctx gocontext.Context) ([]byte, error) {
+
+	// resources by references used in content
+	resources := make(map[string]string)
+	if err := p.Book.eachImage(ctx, func(b *binImage) error {
+		if b.empty() {
+			return nil
+		}
+		return b.process()
+	}); err != nil {
+		return nil, err
+	}
+	for _, b := range p.Book.Images {
+		if len(b.data) > 0 {
+			resources[path.Join(DirImages, b.fname)] = dataURI(b.ct, b.data)
+		}
+	}
+	for _, b := range p.Book.Vignettes {
+		if b.empty() {
+			continue
+		}
+		if err := b.process(); err != nil {
+			return nil, err
+		}
+		resources[path.Join(DirVignettes, b.fname)] = dataURI(b.ct, b.data)
+	}
+
+	var css string
+	for _, d := range p.Book.Data {
+		if d.id == "style" {
+			css = string(d.data)
+		}
+	}
+	for _, d := range p.Book.Data {
+		if d.id != "style" {
+			// see prepareStylesheet
+			css = strings.ReplaceAll(css, path.Join(DirFonts, d.fname), dataURI(d.ct, d.data))
+		}
+	}
+
+	// move content of all pages into single body
+	doc := etree.NewDocument()
+	doc.WriteSettings = etree.WriteSettings{CanonicalText: true, CanonicalAttrVal: true}
+	body := doc.CreateElement("body")
+	pages := make(map[string]bool)
+	for _, f := range p.Book.Files {
+		if f.doc == nil || f.transient&dataNotForSpline != 0 {
+			continue
+		}
+		from := f.doc.FindElement("./html/body")
+		if from == nil {
+			continue
+		}
+		pages[f.fname] = true
+		to := body.AddNext("section", attr("id", f.fname))
+		for _, t := range append([]etree.Token{}, from.Child...) {
+			to.AddChild(t)
+		}
+		to.SetTail("\n")
+	}
+
+	// popover notes for modes where notes are marked semantically
+	notes := make(map[string]bool)
+	for _, e := range body.FindElements(".//aside") {
+		if getAttrValue(e, "epub:type") == "footnote" {
+			e.CreateAttr("popover", "auto")
+			notes[getAttrValue(e, "id")] = true
+		}
+	}
+
+	fixHTMLElement(body, resources, pages, notes)
+
+	var buf bytes.Buffer
+	buf.WriteString("<!DOCTYPE html>\n")
+	buf.WriteString(fmt.Sprintf("<html lang=\"%s\">\n<head>\n", p.Book.Lang))
+	buf.WriteString("<meta charset=\"utf-8\"/>\n")
+	buf.WriteString(fmt.Sprintf("<title>%s</title>\n", html.EscapeString(p.Book.Title)))
+	buf.WriteString("<style>\n" + htmlNoteButtonStyle + css + "\n</style>\n</head>\n")
+	if _, err := doc.WriteTo(&buf); err != nil {
+		return nil, fmt.Errorf("unable to write HTML: %w", err)
+	}
+	buf.WriteString("\n</html>\n")
+	return buf.Bytes(), nil
+}
+
+// fixHTMLElement makes page references local, inlines resources and makes sure that element would be properly parsed
+// by HTML parser.
+func fixHTMLElement(e *etree.Element, resources map[string]string, pages, notes map[string]bool) {
+
+	switch e.Tag {
+	case "a":
+		if href := getAttrValue(e, "href"); len(href) > 0 && !strings.Contains(href, ":") {
+			page, frag, _ := strings.Cut(href, "#")
+			switch {
+			case notes[frag]:
+				// only buttons could open popovers
+				e.Tag = "button"
+				e.RemoveAttr("href")
+				e.CreateAttr("type", "button")
+				e.CreateAttr("popovertarget", frag)
+			case len(frag) > 0:
+				e.CreateAttr("href", "#"+frag)
+			case pages[page]:
+				e.CreateAttr("href", "#"+page)
+			}
+		}
+		if getAttrValue(e, "class") == "pagemarker" {
+			// page markers are numbered per file
+			e.RemoveAttr("id")
+		}
+	case "img":
+		if uri, ok := resources[getAttrValue(e, "src")]; ok {
+			e.CreateAttr("src", uri)
+		}
+	case "image":
+		// svg cover
+		for _, key := range []string{"xlink:href", "href"} {
+			if uri, ok := resources[e.SelectAttrValue(key, "")]; ok {
+				e.CreateAttr(key, uri)
+			}
+		}
+	case "svg":
+		// foreign content allows self-closed elements
+		for _, c := range e.FindElements(".//image") {
+			fixHTMLElement(c, resources, pages, notes)
+		}
+		return
+	}
+
+	children := e.ChildElements()
+	if len(e.Child) == 0 && !htmlVoidElements[e.Tag] {
+		// HTML parser does not understand self-closed tags
+		e.CreateCharData("")
+	}
+	for _, c := range children {
+		fixHTMLElement(c, resources, pages, notes)
+	}
+}
+
+// dataURI returns resource as base64 encoded data URI.
+func dataURI(ct string, data []byte) string {
+	return "data:" + ct + ";base64," + base64.StdEncoding.EncodeToString(data)
+}
@@ -0,0 +1,118 @@
+package processor
+
+import (
+	gocontext "context"
+	"regexp"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"fb2converter/config"
+	"fb2converter/etree"
+	"fb2converter/state"
+)
+
+// 1x1 PNG
+const htmlTestImage = "iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAIAAACQd1PeAAAADElEQVR4nGP4z8AAAAMBAQDJ/pLvAAAAAElFTkSuQmCC"
+
+func TestRenderHTML(t *testing.T) {
+
+	const doc = `<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+<description>
+  <title-info><book-title>Page</book-title><lang>en</lang><coverpage><image l:href="#pic.png"/></coverpage></title-info>
+  <document-info><id>1</id></document-info>
+</description>
+<body>
+  <section id="s1"><title><p>One</p></title><p>Text<a l:href="#n1" type="note">[1]</a> see <a l:href="#s2">two</a> and <a l:href="https://example.com">web</a>.</p><empty-line/><image l:href="#pic.png"/></section>
+  <section id="s2"><title><p>Two</p></title><p>More.</p></section>
+</body>
+<body name="notes"><section id="n1"><title><p>1</p></title><p>Note.</p></section></body>
+<binary id="pic.png" content-type="image/png">` + htmlTestImage + `</binary>
+</FictionBook>`
+
+	cfg, err := config.BuildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// popover notes require notes marked as footnotes
+	cfg.Doc.Notes.Mode = "float-new"
+	env := &state.LocalEnv{Cfg: cfg, Log: zap.NewNop()}
+
+	p, err := NewFB2(strings.NewReader(doc), false, "book.fb2", t.TempDir(), true, false, true, OHtml, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Process(gocontext.Background()); err != nil {
+		t.Fatal(err)
+	}
+	data, err := p.renderHTML(gocontext.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(data)
+
+	for _, s := range []string{
+		`<img src="data:image/png;base64,` + htmlTestImage + `" alt="bin00000000.png"/>`,
+		`xlink:href="data:image/png;base64,` + htmlTestImage + `"></image>`,
+		`<button id="back_n1" class="anchor" epub:type="noteref" type="button" popovertarget="n1">[1]</button>`,
+		`<aside id="n1" epub:type="footnote" popover="auto">`,
+		`<a class="linkanchor" href="#s2">two</a>`,
+		`<a class="linkanchor" href="https://example.com">web</a>`,
+		`<a href="#tocref2">One</a>`,
+		`<div class="section" id="s1"></div>`,
+	} {
+		if !strings.Contains(out, s) {
+			t.Errorf("%s is missing from the page", s)
+		}
+	}
+	if strings.Contains(out, `.xhtml#`) {
+		t.Error("page references were not made local")
+	}
+	if m := regexp.MustCompile(`<(div|p|a|span|section|aside)\b[^>]*/>`).FindString(out); len(m) > 0 {
+		t.Errorf("non-void element is self-closed: %s", m)
+	}
+}
+
+func TestFixHTMLElement(t *testing.T) {
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromString(`<body>` +
+		`<a href="index2.xhtml">page</a>` +
+		`<a href="index2.xhtml#sec">section</a>` +
+		`<a href="index9.xhtml">unknown</a>` +
+		`<a href="notes.xhtml#n1">note</a>` +
+		`<a href="mailto:someone@example.com">mail</a>` +
+		`<a class="pagemarker" id="page_1"/>` +
+		`<img src="images/pic.png"/><br/><p/>` +
+		`<svg xmlns:xlink="http://www.w3.org/1999/xlink"><image xlink:href="images/pic.png"/></svg>` +
+		`</body>`); err != nil {
+		t.Fatal(err)
+	}
+	body := doc.Root()
+
+	fixHTMLElement(body,
+		map[string]string{"images/pic.png": "data:image/png;base64,AAAA"},
+		map[string]bool{"index2.xhtml": true},
+		map[string]bool{"n1": true})
+
+	out, err := doc.WriteToString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		`<a href="#index2.xhtml">page</a>`,
+		`<a href="#sec">section</a>`,
+		`<a href="index9.xhtml">unknown</a>`,
+		`<button type="button" popovertarget="n1">note</button>`,
+		`<a href="mailto:someone@example.com">mail</a>`,
+		`<a class="pagemarker"></a>`,
+		`<img src="data:image/png;base64,AAAA"/><br/><p></p>`,
+		`<image xlink:href="data:image/png;base64,AAAA"></image>`,
+	} {
+		if !strings.Contains(out, s) {
+			t.Errorf("%s is missing from %s", s, out)
+		}
+	}
+}
@@ -7,7 +7,7 @@ import (
 	"image/color"
 	"image/draw"
 	"image/png"
-	"os"
+	"path"
 	"path/filepath"
 
 	// additional supported image formats
@@ -48,22 +48,36 @@ type binImage struct {
 	data        []byte
 }
 
-// flush is storing image to file
-func (b *binImage) flush(path string) error {
+// flush is storing image to the output tree
+func (b *binImage) flush(out bookFS) error {
 
 	// Sanity
-	if len(b.fname) == 0 || (len(b.data) == 0 && b.img == nil) {
+	if b.empty() {
 		return nil
 	}
 
-	newdir := filepath.Join(path, b.relpath)
-	if err := os.MkdirAll(newdir, 0700); err != nil {
-		return fmt.Errorf("unable to create directory %s: %w", newdir, err)
+	name := path.Join(filepath.ToSlash(b.relpath), b.fname)
+	if err := b.process(); err != nil {
+		return fmt.Errorf("%w (%s)", err, name)
 	}
 
+	if err := out.WriteFile(name, b.data); err != nil {
+		return markError(ErrImage, fmt.Errorf("unable to save image %s: %w", name, err))
+	}
+	return nil
+}
+
+// empty checks if there is anything to store.
+func (b *binImage) empty() bool {
+	return len(b.fname) == 0 || (len(b.data) == 0 && b.img == nil)
+}
+
+// process performs requested image transformations leaving results in data, ct and imgType.
+func (b *binImage) process() error {
+
 	// Do not touch svg images
 	if b.imgType == "svg" {
-		goto Storing
+		return nil
 	}
 
 	// See if processing is needed - imageChanged
@@ -75,10 +89,7 @@ func (b *binImage) flush(path string) error {
 			var err error
 			b.img, b.imgType, err = image.Decode(bytes.NewReader(b.data))
 			if err != nil {
-				b.log.Warn("Unable to decode image for processing, storing as is",
-					zap.String("id", b.id),
-					zap.Error(err))
-				goto Storing
+				return markError(ErrImage, fmt.Errorf("unable to decode image %s: %w", b.id, err))
 			}
 		}
 
@@ -92,7 +103,7 @@ func (b *binImage) flush(path string) error {
 			} else {
 				b.log.Warn("Unable to resize image, storing as is",
 					zap.String("id", b.id))
-				goto Storing
+				return nil
 			}
 		}
 
@@ -137,7 +148,7 @@ func (b *binImage) flush(path string) error {
 				b.log.Error("Unable to encode processed PNG, skipping",
 					zap.String("id", b.id),
 					zap.Error(err))
-				goto Storing
+				return nil
 			}
 			b.imgType = "png"
 			b.ct = "image/png"
@@ -159,7 +170,7 @@ func (b *binImage) flush(path string) error {
 				b.log.Error("Unable to encode processed image, skipping",
 					zap.String("id", b.id),
 					zap.Error(err))
-				goto Storing
+				return nil
 			}
 			b.imgType = "jpeg"
 			b.ct = "image/jpeg"
@@ -177,18 +188,13 @@ func (b *binImage) flush(path string) error {
 			b.log.Warn("Unable to process image - unsupported format, skipping",
 				zap.String("id", b.id),
 				zap.String("type", b.imgType))
-			goto Storing
+			return nil
 		}
 	}
 
 	// Sanity - should never happen
 	if len(b.data) == 0 {
-		return fmt.Errorf("no image to save %s (%s)", b.id, filepath.Join(newdir, b.fname))
-	}
-
-Storing:
-	if err := os.WriteFile(filepath.Join(newdir, b.fname), b.data, 0644); err != nil {
-		return fmt.Errorf("unable to save image %s: %w", filepath.Join(newdir, b.fname), err)
+		return markError(ErrImage, fmt.Errorf("no image to save %s", b.id))
 	}
 	return nil
 }
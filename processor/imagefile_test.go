@@ -0,0 +1,16 @@
+package processor
+
+import (
+	"errors"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestImageProcessingErrors(t *testing.T) {
+
+	b := &binImage{log: zap.NewNop(), id: "broken", data: []byte("not an image"), flags: imageScale, scaleFactor: 0.5}
+	if err := b.process(); !errors.Is(err, ErrImage) {
+		t.Errorf("image error expected, got %v", err)
+	}
+}
@@ -0,0 +1,419 @@
+package processor
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"golang.org/x/text/language"
+
+	"fb2converter/config"
+	"fb2converter/etree"
+)
+
+// unpackEPUB extracts epub content into output tree, making sure nothing escapes it.
+func unpackEPUB(r io.Reader, out bookFS) error {
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("unable to read EPUB: %w", err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return fmt.Errorf("unable to open EPUB: %w", err)
+	}
+
+	extract := func(f *zip.File, name string) error {
+		in, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+
+		data, err := io.ReadAll(in)
+		if err != nil {
+			return err
+		}
+		return out.WriteFile(name, data)
+	}
+
+	for _, f := range zr.File {
+		name := path.Clean("/" + f.Name)[1:]
+		if len(name) == 0 || f.FileInfo().IsDir() {
+			continue
+		}
+		if err := extract(f, name); err != nil {
+			return fmt.Errorf("unable to extract %s from EPUB: %w", f.Name, err)
+		}
+	}
+
+	// some books are packed carelessly
+	if _, err := out.ReadFile("mimetype"); errors.Is(err, fs.ErrNotExist) {
+		if err := out.WriteFile("mimetype", []byte("application/epub+zip")); err != nil {
+			return fmt.Errorf("unable to save mimetype: %w", err)
+		}
+	}
+	return nil
+}
+
+// readDocument parses XML document from output tree.
+func (p *Processor) readDocument(doc *etree.Document, name string) error {
+	data, err := p.out.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	return doc.ReadFromBytes(data)
+}
+
+// opfPath returns location of package document relative to epub root (in slash separated form).
+func (p *Processor) opfPath() (string, error) {
+
+	doc := etree.NewDocument()
+	if err := p.readDocument(doc, DirMata+"/container.xml"); err != nil {
+		return "", fmt.Errorf("unable to read EPUB container: %w", err)
+	}
+	for _, rf := range doc.FindElements("./container/rootfiles/rootfile") {
+		if getAttrValue(rf, "media-type") == "application/oebps-package+xml" {
+			if name := getAttrValue(rf, "full-path"); len(name) > 0 {
+				return path.Clean(name), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("unable to find package document in EPUB container")
+}
+
+// readOPF reads EPUB package document and collects book description from it.
+func (p *Processor) readOPF() error {
+
+	p.env.Log.Debug("Parsing package document - start")
+	defer func(start time.Time) {
+		p.env.Log.Debug("Parsing package document - done",
+			zap.Duration("elapsed", time.Since(start)),
+			zap.Stringer("id", p.Book.ID),
+			zap.String("title", p.Book.Title),
+			zap.Stringer("lang", p.Book.Lang),
+			zap.Strings("genres", p.Book.Genres),
+			zap.String("authors", p.Book.BookAuthors(p.env.Cfg.Doc.AuthorFormat, false)),
+			zap.String("sequence", p.Book.SeqName),
+			zap.Int("sequence number", p.Book.SeqNum),
+			zap.String("date", p.Book.Date),
+		)
+	}(time.Now())
+
+	name, err := p.opfPath()
+	if err != nil {
+		return err
+	}
+	if err := p.readDocument(p.doc, name); err != nil {
+		return fmt.Errorf("unable to parse package document: %w", err)
+	}
+	p.Book.Files = append(p.Book.Files, &dataFile{
+		id:        "content",
+		fname:     path.Base(name),
+		relpath:   filepath.FromSlash(path.Dir(name)),
+		ct:        "application/oebps-package+xml",
+		transient: dataNotForSpline | dataNotForManifest,
+		doc:       p.doc,
+	})
+
+	pkg := p.doc.SelectElement("package")
+	if pkg == nil {
+		return fmt.Errorf("unable to find package in %s", name)
+	}
+	meta := pkg.SelectElement("metadata")
+	if meta == nil {
+		return nil
+	}
+
+	if e := opfIdentifier(pkg, meta); e != nil {
+		text := strings.TrimSpace(e.Text())
+		if u, err := uuid.Parse(strings.TrimPrefix(strings.ToLower(text), "urn:uuid:")); err == nil {
+			p.Book.ID = u
+		} else if len(text) > 0 {
+			p.env.Log.Debug("Unable to parse book id, deriving new", zap.String("id", text), zap.Error(err))
+			p.Book.ID = uuid.NewSHA1(nameSpaceFB2, []byte(text))
+		}
+	}
+	for _, e := range meta.SelectElements("identifier") {
+		scheme := strings.ToUpper(getAttrValue(e, "scheme"))
+		if scheme == "ASIN" || scheme == "MOBI-ASIN" {
+			p.Book.ASIN = strings.TrimSpace(e.Text())
+		}
+	}
+	if e := meta.SelectElement("title"); e != nil {
+		if t := strings.TrimSpace(e.Text()); len(t) > 0 {
+			p.Book.Title = t
+		}
+	}
+	if e := meta.SelectElement("language"); e != nil {
+		if l := strings.TrimSpace(e.Text()); len(l) > 0 {
+			if t, err := language.Parse(l); err != nil {
+				p.env.Log.Warn("Unable to parse book language, ignoring", zap.String("lang", l), zap.Error(err))
+			} else {
+				p.Book.Lang = t
+			}
+		}
+	}
+	for _, e := range meta.SelectElements("subject") {
+		if g := strings.TrimSpace(e.Text()); len(g) > 0 {
+			p.Book.Genres = append(p.Book.Genres, g)
+		}
+	}
+	for _, e := range meta.SelectElements("creator") {
+		if role := getAttrValue(e, "role"); len(role) > 0 && role != "aut" {
+			continue
+		}
+		if a := strings.TrimSpace(e.Text()); len(a) > 0 {
+			// there is no reliable way to split name into parts
+			p.Book.Authors = append(p.Book.Authors, &config.AuthorName{Last: a})
+		}
+	}
+	for _, e := range meta.SelectElements("meta") {
+		switch getAttrValue(e, "name") {
+		case "calibre:series":
+			p.Book.SeqName = strings.TrimSpace(getAttrValue(e, "content"))
+		case "calibre:series_index":
+			// calibre keeps it as float
+			if f, err := strconv.ParseFloat(strings.TrimSpace(getAttrValue(e, "content")), 64); err == nil {
+				p.Book.SeqNum = int(f)
+			}
+		}
+	}
+	if e := meta.SelectElement("description"); e != nil {
+		p.Book.Annotation = strings.TrimSpace(e.Text())
+	}
+	if e := meta.SelectElement("date"); e != nil {
+		p.Book.Date = strings.TrimSpace(e.Text())
+	}
+	return nil
+}
+
+// opfIdentifier returns book unique identifier element.
+func opfIdentifier(pkg, meta *etree.Element) *etree.Element {
+	id := getAttrValue(pkg, "unique-identifier")
+	for _, e := range meta.SelectElements("identifier") {
+		if len(id) == 0 || getAttrValue(e, "id") == id {
+			return e
+		}
+	}
+	return meta.SelectElement("identifier")
+}
+
+// processOPF applies requested meta information changes to EPUB package document.
+func (p *Processor) processOPF() error {
+
+	p.env.Log.Debug("Processing package document - start")
+	defer func(start time.Time) {
+		p.env.Log.Debug("Processing package document - done", zap.Duration("elapsed", time.Since(start)))
+	}(time.Now())
+
+	if p.format == OKepub {
+		p.Book.tokenizer = newTokenizer(p.Book.Lang, p.env.Log)
+	}
+
+	if p.metaOverwrite == nil {
+		return nil
+	}
+	if len(p.metaOverwrite.CoverImage) > 0 {
+		p.env.Log.Warn("Cover overwrite is not supported for EPUB, ignoring", zap.String("cover", p.metaOverwrite.CoverImage))
+	}
+
+	// book is a copy of original description
+	book := *p.Book
+	p.overwriteMeta()
+
+	pkg := p.doc.SelectElement("package")
+	meta := pkg.SelectElement("metadata")
+	if meta == nil {
+		meta = etree.NewElement("metadata")
+		pkg.InsertChild(pkg.SelectElement("manifest"), meta)
+	}
+
+	// setText replaces text of the first element with specified tag creating new one if necessary
+	setText := func(tag, text string) {
+		e := meta.SelectElement(tag)
+		if e == nil {
+			e = meta.AddNext("dc:" + tag)
+		}
+		e.SetText(text)
+	}
+	// setList removes all elements with specified tag and creates new ones
+	setList := func(tag string, texts []string) {
+		for _, e := range meta.SelectElements(tag) {
+			meta.RemoveChild(e)
+		}
+		for _, t := range texts {
+			meta.AddNext("dc:" + tag).SetText(t)
+		}
+	}
+	// setMeta replaces content of named meta element
+	setMeta := func(name, content string) {
+		for _, e := range meta.SelectElements("meta") {
+			if getAttrValue(e, "name") == name {
+				meta.RemoveChild(e)
+			}
+		}
+		meta.AddNext("meta", attr("name", name), attr("content", content))
+	}
+
+	if book.ID != p.Book.ID {
+		if e := opfIdentifier(pkg, meta); e != nil {
+			e.SetText(fmt.Sprintf("urn:uuid:%s", p.Book.ID))
+		}
+	}
+	if book.Title != p.Book.Title {
+		setText("title", p.Book.Title)
+	}
+	if book.Lang != p.Book.Lang {
+		setText("language", p.Book.Lang.String())
+	}
+	if !slices.Equal(book.Authors, p.Book.Authors) {
+		authors := make([]string, 0, len(p.Book.Authors))
+		for _, an := range p.Book.Authors {
+			authors = append(authors, ReplaceKeywords(p.env.Cfg.Doc.AuthorFormatMeta, CreateAuthorKeywordsMap(an)))
+		}
+		setList("creator", authors)
+	}
+	if !slices.Equal(book.Genres, p.Book.Genres) {
+		setList("subject", p.Book.Genres)
+	}
+	if book.SeqName != p.Book.SeqName {
+		setMeta("calibre:series", p.Book.SeqName)
+	}
+	if book.SeqNum != p.Book.SeqNum {
+		setMeta("calibre:series_index", strconv.Itoa(p.Book.SeqNum))
+	}
+	if book.Date != p.Book.Date {
+		setText("date", p.Book.Date)
+	}
+	return nil
+}
+
+// kepubifyEPUB inserts Kobo spans into all EPUB content documents.
+func (p *Processor) kepubifyEPUB() error {
+
+	if p.format != OKepub {
+		return nil
+	}
+
+	p.env.Log.Debug("Inserting Kobo spans - start")
+	defer func(start time.Time) {
+		p.env.Log.Debug("Inserting Kobo spans - done", zap.Duration("elapsed", time.Since(start)))
+	}(time.Now())
+
+	entities, err := prepareHTMLNamedEntities()
+	if err != nil {
+		return fmt.Errorf("unable to write prepare HTML named entities: %w", err)
+	}
+
+	opf := p.Book.Files[0]
+	base := filepath.ToSlash(opf.relpath)
+
+	for _, item := range p.doc.FindElements("./package/manifest/item") {
+		if getAttrValue(item, "media-type") != "application/xhtml+xml" {
+			continue
+		}
+		href, err := url.PathUnescape(getAttrValue(item, "href"))
+		if err != nil || len(href) == 0 {
+			p.env.Log.Warn("Unable to parse manifest item href, skipping", zap.String("href", getAttrValue(item, "href")), zap.Error(err))
+			continue
+		}
+		name := path.Join(base, href)
+
+		doc := etree.NewDocument()
+		doc.ReadSettings = etree.ReadSettings{Entity: entities}
+		doc.WriteSettings = etree.WriteSettings{CanonicalText: true, CanonicalAttrVal: true}
+		if err := p.readDocument(doc, name); err != nil {
+			p.env.Log.Warn("Unable to parse content document, skipping", zap.String("file", name), zap.Error(err))
+			continue
+		}
+
+		body := doc.FindElement("./html/body")
+		if body == nil || body.FindElement(".//span[@class='koboSpan']") != nil {
+			// nothing to do or already done
+			continue
+		}
+
+		p.ctx().paragraph, p.ctx().sentence = 0, 0
+		p.insertKoboSpans(body)
+		wrapKoboBody(body)
+
+		p.Book.Files = append(p.Book.Files, &dataFile{
+			id:      getAttrValue(item, "id"),
+			fname:   path.Base(name),
+			relpath: filepath.FromSlash(path.Dir(name)),
+			ct:      "application/xhtml+xml",
+			doc:     doc,
+		})
+	}
+	return nil
+}
+
+var (
+	// elements, content of which should be left alone
+	koboSkipTags = map[string]bool{
+		"script": true, "style": true, "svg": true, "math": true, "pre": true, "code": true, "textarea": true, "noscript": true,
+	}
+	// elements starting new Kobo paragraph
+	koboBlockTags = map[string]bool{
+		"p": true, "div": true, "li": true, "dt": true, "dd": true, "td": true, "th": true, "blockquote": true, "caption": true,
+		"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	}
+)
+
+// insertKoboSpans wraps every sentence of element text (recursively) into Kobo span.
+func (p *Processor) insertKoboSpans(e *etree.Element) {
+
+	if koboSkipTags[e.Tag] {
+		return
+	}
+	if koboBlockTags[e.Tag] {
+		p.ctx().paragraph++
+		p.ctx().sentence = 0
+	}
+
+	addText := func(text string) {
+		if len(strings.TrimSpace(text)) == 0 {
+			if len(text) > 0 {
+				e.CreateCharData(text)
+			}
+			return
+		}
+		for _, s := range splitSentences(p.Book.tokenizer, text) {
+			p.ctx().sentence++
+			e.AddNext("span",
+				attr("class", "koboSpan"),
+				attr("id", fmt.Sprintf("kobo.%d.%d", p.ctx().paragraph, p.ctx().sentence)),
+			).SetText(s)
+		}
+	}
+
+	children := e.Child
+	e.Child = make([]etree.Token, 0, len(children))
+	for _, c := range children {
+		switch t := c.(type) {
+		case *etree.CharData:
+			addText(t.Data)
+		case *etree.Element:
+			tail := t.Tail()
+			t.SetTail("")
+			e.AddChild(t)
+			p.insertKoboSpans(t)
+			addText(tail)
+		default:
+			e.AddChild(t)
+		}
+	}
+}
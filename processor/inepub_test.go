@@ -0,0 +1,171 @@
+package processor
+
+import (
+	"archive/zip"
+	"bytes"
+	gocontext "context"
+	"io"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"fb2converter/config"
+	"fb2converter/etree"
+	"fb2converter/state"
+)
+
+// makeEPUB packs files into in-memory EPUB, mimetype goes first.
+func makeEPUB(t *testing.T, files [][2]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range append([][2]string{{"mimetype", "application/epub+zip"}}, files...) {
+		w, err := zw.Create(f[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, f[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestConvertEPUB(t *testing.T) {
+
+	book := makeEPUB(t, [][2]string{
+		{"META-INF/container.xml", `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+<rootfiles><rootfile full-path="OPS/package.opf" media-type="application/oebps-package+xml"/></rootfiles>
+</container>`},
+		{"OPS/package.opf", `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="2.0" unique-identifier="uid">
+<metadata xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:opf="http://www.idpf.org/2007/opf">
+  <dc:title>Original</dc:title>
+  <dc:language>en</dc:language>
+  <dc:identifier opf:scheme="ISBN">978-0000000000</dc:identifier>
+  <dc:identifier id="uid">urn:uuid:5b3b5fd2-8f3d-4a5e-9b7e-2b1f1d3c4a5e</dc:identifier>
+  <dc:creator opf:role="aut">Ann Writer</dc:creator>
+  <dc:creator opf:role="edt">Ed Itor</dc:creator>
+  <meta name="calibre:series" content="Saga"/>
+  <meta name="calibre:series_index" content="3.0"/>
+</metadata>
+<manifest>
+  <item id="ncx" href="toc.ncx" media-type="application/x-dtbncx+xml"/>
+  <item id="ch1" href="text/ch%201.xhtml" media-type="application/xhtml+xml"/>
+</manifest>
+<spine toc="ncx"><itemref idref="ch1"/></spine>
+</package>`},
+		{"OPS/toc.ncx", `<?xml version="1.0" encoding="UTF-8"?>
+<ncx xmlns="http://www.daisy.org/z3986/2005/ncx/" version="2005-1">
+<head><meta name="dtb:uid" content="urn:uuid:5b3b5fd2-8f3d-4a5e-9b7e-2b1f1d3c4a5e"/></head>
+<docTitle><text>Original</text></docTitle>
+<navMap><navPoint id="n1" playOrder="1"><navLabel><text>One</text></navLabel><content src="text/ch%201.xhtml"/></navPoint></navMap>
+</ncx>`},
+		{"OPS/text/ch 1.xhtml", `<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml"><head><title>One</title></head>
+<body><h1>One</h1><p>First sentence. Second sentence.</p></body></html>`},
+	})
+
+	cfg, err := config.BuildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Overwrites = map[string]config.MetaInfo{"*": {Title: "Changed", SeqNum: 4}}
+	env := &state.LocalEnv{Cfg: cfg, Log: zap.NewNop()}
+
+	if _, err := NewEPUB(bytes.NewReader(book), "book.epub", t.TempDir(), true, false, true, OEpub, env); err == nil {
+		t.Error("EPUB to EPUB conversion was accepted")
+	}
+
+	convert := func(format OutputFmt) (*Processor, []byte) {
+		t.Helper()
+		p, err := NewEPUB(bytes.NewReader(book), "book.epub", t.TempDir(), true, false, true, format, env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.Clean()
+		if err := p.Process(gocontext.Background()); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if _, err := p.SaveTo(gocontext.Background(), &buf); err != nil {
+			t.Fatal(err)
+		}
+		return p, buf.Bytes()
+	}
+
+	p, data := convert(OKepub)
+
+	// description comes from package document
+	if p.Book.ID.String() != "5b3b5fd2-8f3d-4a5e-9b7e-2b1f1d3c4a5e" || p.Book.Lang.String() != "en" ||
+		p.Book.SeqName != "Saga" || p.Book.SeqNum != 4 || p.Book.Title != "Changed" {
+		t.Errorf("unexpected book description: %s %s %q %d %q", p.Book.ID, p.Book.Lang, p.Book.SeqName, p.Book.SeqNum, p.Book.Title)
+	}
+	if len(p.Book.Authors) != 1 || p.Book.Authors[0].Last != "Ann Writer" {
+		t.Errorf("unexpected authors %v", p.Book.Authors)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if zr.File[0].Name != "mimetype" || zr.File[0].Method != zip.Store {
+		t.Error("mimetype is not the first stored entry")
+	}
+	read := func(name string) string {
+		t.Helper()
+		f, err := zr.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		data, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	// overwritten meta information is stored in package document, the rest is kept as is
+	opf := etree.NewDocument()
+	if err := opf.ReadFromString(read("OPS/package.opf")); err != nil {
+		t.Fatal(err)
+	}
+	meta := opf.FindElement("./package/metadata")
+	if e := meta.SelectElement("title"); e == nil || e.Text() != "Changed" {
+		t.Error("title was not overwritten")
+	}
+	if e := meta.SelectElement("creator"); e == nil || e.Text() != "Ann Writer" || len(meta.SelectElements("creator")) != 2 {
+		t.Error("creators were changed")
+	}
+	series := make(map[string]string)
+	for _, e := range meta.SelectElements("meta") {
+		series[e.SelectAttrValue("name", "")] = e.SelectAttrValue("content", "")
+	}
+	if series["calibre:series"] != "Saga" || series["calibre:series_index"] != "4" {
+		t.Errorf("unexpected series %v", series)
+	}
+
+	// content documents get Kobo spans
+	ch := read("OPS/text/ch 1.xhtml")
+	if n := strings.Count(ch, `class="koboSpan"`); n < 2 {
+		t.Errorf("content was not kepubified: %s", ch)
+	}
+	if read("OPS/toc.ncx") == "" {
+		t.Error("navigation was lost")
+	}
+
+	// azw3 is produced by built-in writer from the same tree
+	_, data = convert(OAzw3)
+	if len(data) < 68 || string(data[60:68]) != "BOOKMOBI" {
+		t.Error("result is not a Kindle book")
+	}
+	if !bytes.Contains(data, []byte("Changed")) {
+		t.Error("overwritten title is missing from Kindle book")
+	}
+}
@@ -0,0 +1,110 @@
+package processor
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+
+	"fb2converter/etree"
+	"fb2converter/state"
+)
+
+// BookInfo is book metainformation as conversion would see it, including overwrites from configuration.
+type BookInfo struct {
+	Source         string   `json:"source"`
+	ID             string   `json:"id"`
+	ASIN           string   `json:"asin,omitempty"`
+	Title          string   `json:"title"`
+	Authors        []string `json:"authors"`
+	Sequence       string   `json:"sequence,omitempty"`
+	SequenceNumber int      `json:"sequence_number,omitempty"`
+	Genres         []string `json:"genres"`
+	Lang           string   `json:"lang"`
+	Date           string   `json:"date,omitempty"`
+	Annotation     string   `json:"annotation,omitempty"`
+	Cover          bool     `json:"cover"`
+	Images         int      `json:"images"`
+}
+
+// ReadInfo parses FB2 document and processes its description only. Nothing is written to disk and no external programs
+// are called, so it is cheap enough to be used on large collections. Book ID is left empty when document does not have
+// one (conversion would generate random ID in this case).
+func ReadInfo(r io.Reader, unknownEncoding bool, src string, env *state.LocalEnv) (*BookInfo, error) {
+
+	p, u, err := readDescription(r, unknownEncoding, src, env)
+	if err != nil {
+		return nil, err
+	}
+	return p.bookInfo(u), nil
+}
+
+// readDescription prepares processor with parsed document and processed description, random UUID book was given is
+// returned as well.
+func readDescription(r io.Reader, unknownEncoding bool, src string, env *state.LocalEnv) (*Processor, uuid.UUID, error) {
+
+	u, err := uuid.NewRandom()
+	if err != nil {
+		return nil, u, fmt.Errorf("unable to generate UUID: %w", err)
+	}
+
+	p := &Processor{
+		kind: InFb2,
+		src:  src,
+		// pretend we are producing fb2 so no content is generated for annotation
+		format:        OFb2,
+		infoOnly:      true,
+		doc:           etree.NewDocument(),
+		Book:          NewBook(u, filepath.Base(src)),
+		env:           env,
+		metaOverwrite: env.Cfg.GetOverwrite(src),
+	}
+
+	if p.doc.ReadSettings, err = fb2ReadSettings(unknownEncoding); err != nil {
+		return nil, u, err
+	}
+	if _, err := p.doc.ReadFrom(r); err != nil {
+		return nil, u, markError(ErrParse, fmt.Errorf("unable to parse FB2: %w", err))
+	}
+	if err := p.processDescription(); err != nil {
+		return nil, u, err
+	}
+	return p, u, nil
+}
+
+// bookInfo collects book information after description was processed.
+func (p *Processor) bookInfo(u uuid.UUID) *BookInfo {
+
+	info := &BookInfo{
+		Source:         p.src,
+		ASIN:           p.Book.ASIN,
+		Title:          p.Book.Title,
+		Authors:        make([]string, 0, len(p.Book.Authors)),
+		Sequence:       p.Book.SeqName,
+		SequenceNumber: p.Book.SeqNum,
+		Genres:         p.Book.Genres,
+		Lang:           p.Book.Lang.String(),
+		Date:           p.Book.Date,
+		Annotation:     p.Book.Annotation,
+	}
+	if p.Book.ID != u {
+		info.ID = p.Book.ID.String()
+	}
+	for _, an := range p.Book.Authors {
+		info.Authors = append(info.Authors, ReplaceKeywords(p.env.Cfg.Doc.AuthorFormat, CreateAuthorKeywordsMap(an)))
+	}
+	if info.Genres == nil {
+		info.Genres = []string{}
+	}
+	for _, el := range p.doc.FindElements("./FictionBook/binary[@id]") {
+		if id := getAttrValue(el, "id"); len(p.Book.Cover) > 0 && id == p.Book.Cover {
+			info.Cover = true
+		}
+		if strings.HasPrefix(strings.ToLower(getAttrValue(el, "content-type")), "image/") {
+			info.Images++
+		}
+	}
+	return info
+}
@@ -0,0 +1,56 @@
+package processor
+
+import (
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"fb2converter/config"
+	"fb2converter/state"
+)
+
+func TestReadInfo(t *testing.T) {
+
+	const doc = `<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+<description>
+  <title-info>
+    <genre>sf</genre><genre>adventure</genre>
+    <author><first-name>Ivan</first-name><last-name>Petrov</last-name></author>
+    <book-title>Title</book-title>
+    <annotation><p>Short annotation.</p></annotation>
+    <coverpage><image l:href="#cover.jpg"/></coverpage>
+    <lang>en</lang>
+    <sequence name="Saga" number="2"/>
+  </title-info>
+</description>
+<body><section><p>Text</p></section></body>
+<binary id="cover.jpg" content-type="image/jpeg">/9j/4AAQ</binary>
+<binary id="other.png" content-type="image/png">iVBORw0KGgo=</binary>
+</FictionBook>`
+
+	cfg, err := config.BuildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Overwrites = map[string]config.MetaInfo{"books/book.fb2": {Title: "New Title"}}
+	env := &state.LocalEnv{Cfg: cfg, Log: zap.NewNop()}
+
+	info, err := ReadInfo(strings.NewReader(doc), false, "books/book.fb2", env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Title != "New Title" {
+		t.Errorf("title overwrite was not applied: %q", info.Title)
+	}
+	if len(info.ID) != 0 {
+		t.Errorf("book without id got id %q", info.ID)
+	}
+	if info.Sequence != "Saga" || info.SequenceNumber != 2 || info.Lang != "en" || info.Annotation != "Short annotation." {
+		t.Errorf("unexpected info %+v", info)
+	}
+	if len(info.Authors) != 1 || len(info.Genres) != 2 || !info.Cover || info.Images != 2 {
+		t.Errorf("unexpected info %+v", info)
+	}
+}
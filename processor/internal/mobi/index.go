@@ -0,0 +1,239 @@
+package mobi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/bits"
+)
+
+// Index records (INDX) layout follows KindleUnpack and calibre descriptions.
+
+const (
+	indxHeaderLength = 192
+	indxRecordLimit  = 0x10000 - indxHeaderLength - 1048 // kindlegen leaves some margin
+	cncxRecordLimit  = 0x10000 - 1024
+	cncxMaxString    = 500
+)
+
+// tagMeta describes single tag of the index TAGX section.
+type tagMeta struct {
+	name           string
+	number         byte
+	valuesPerEntry byte
+	bitmask        byte
+	endFlag        byte
+}
+
+var endTagTable = tagMeta{name: "eof", endFlag: 1}
+
+var (
+	skelTags = []tagMeta{
+		{"chunk_count", 1, 1, 3, 0},
+		{"geometry", 6, 2, 12, 0},
+		endTagTable,
+	}
+	fragTags = []tagMeta{
+		{"cncx_offset", 2, 1, 1, 0},
+		{"file_number", 3, 1, 2, 0},
+		{"sequence_number", 4, 1, 4, 0},
+		{"geometry", 6, 2, 8, 0},
+		endTagTable,
+	}
+	ncxTags = []tagMeta{
+		{"offset", 1, 1, 1, 0},
+		{"length", 2, 1, 2, 0},
+		{"label", 3, 1, 4, 0},
+		{"depth", 4, 1, 8, 0},
+		{"parent", 21, 1, 16, 0},
+		{"first_child", 22, 1, 32, 0},
+		{"last_child", 23, 1, 64, 0},
+		{"pos_fid", 6, 2, 128, 0},
+		endTagTable,
+	}
+	guideTags = []tagMeta{
+		{"title", 1, 1, 1, 0},
+		{"pos_fid", 6, 2, 2, 0},
+		endTagTable,
+	}
+)
+
+// indexEntry is a single index entry - key and tag values.
+type indexEntry struct {
+	key  string
+	tags map[string][]int
+}
+
+// cncx keeps strings referenced from index entries.
+type cncx struct {
+	offsets map[string]int
+	records [][]byte
+}
+
+func newCNCX(strs []string) *cncx {
+
+	c := &cncx{offsets: make(map[string]int)}
+
+	var buf bytes.Buffer
+	offset := 0
+	for _, s := range strs {
+		if _, ok := c.offsets[s]; ok {
+			continue
+		}
+		data := []byte(s)
+		if len(data) > cncxMaxString {
+			data = data[:cncxMaxString]
+		}
+		raw := append(encodeVarInt(len(data)), data...)
+		if buf.Len()+len(raw) > cncxRecordLimit {
+			c.records = append(c.records, alignBlock(bytes.Clone(buf.Bytes())))
+			buf.Reset()
+			offset = len(c.records) * 0x10000
+		}
+		buf.Write(raw)
+		c.offsets[s] = offset
+		offset += len(raw)
+	}
+	if buf.Len() > 0 {
+		c.records = append(c.records, alignBlock(bytes.Clone(buf.Bytes())))
+	}
+	return c
+}
+
+// buildIndex produces full set of records for the index: header, index records and CNCX records.
+func buildIndex(tags []tagMeta, entries []indexEntry, strs *cncx) [][]byte {
+
+	var (
+		blocks, idxts [][]byte
+		counts        []int
+		lastKeys      []string
+		block, idxt   bytes.Buffer
+		count         int
+		lastKey       string
+	)
+
+	flush := func() {
+		blocks = append(blocks, bytes.Clone(block.Bytes()))
+		idxts = append(idxts, bytes.Clone(idxt.Bytes()))
+		counts = append(counts, count)
+		lastKeys = append(lastKeys, lastKey)
+		block.Reset()
+		idxt.Reset()
+		count = 0
+	}
+
+	for _, e := range entries {
+		var raw bytes.Buffer
+		raw.WriteByte(byte(len(e.key)))
+		raw.WriteString(e.key)
+		raw.WriteByte(controlByte(tags, e))
+		for _, t := range tags {
+			for _, v := range e.tags[t.name] {
+				raw.Write(encodeVarInt(v))
+			}
+		}
+		if block.Len()+idxt.Len()+raw.Len()+2 > indxRecordLimit {
+			flush()
+		}
+		binary.Write(&idxt, binary.BigEndian, uint16(indxHeaderLength+block.Len()))
+		block.Write(raw.Bytes())
+		count++
+		lastKey = e.key
+	}
+	if count > 0 || len(blocks) == 0 {
+		flush()
+	}
+
+	records := make([][]byte, 0, len(blocks)+1)
+
+	// placeholder for index header
+	records = append(records, nil)
+
+	for i := range blocks {
+		data := alignBlock(blocks[i])
+		table := alignBlock(append([]byte("IDXT"), idxts[i]...))
+
+		var rec bytes.Buffer
+		rec.WriteString("INDX")
+		binary.Write(&rec, binary.BigEndian, uint32(indxHeaderLength))
+		rec.Write(make([]byte, 4))
+		binary.Write(&rec, binary.BigEndian, uint32(1)) // index record
+		rec.Write(make([]byte, 4))
+		binary.Write(&rec, binary.BigEndian, uint32(indxHeaderLength+len(data)))
+		binary.Write(&rec, binary.BigEndian, uint32(counts[i]))
+		rec.Write(bytes.Repeat([]byte{0xFF}, 8))
+		rec.Write(make([]byte, 156))
+		rec.Write(data)
+		rec.Write(table)
+		records = append(records, rec.Bytes())
+	}
+
+	// TAGX
+	var tagx bytes.Buffer
+	tagx.WriteString("TAGX")
+	binary.Write(&tagx, binary.BigEndian, uint32(12+4*len(tags)))
+	binary.Write(&tagx, binary.BigEndian, uint32(1)) // control byte count
+	for _, t := range tags {
+		tagx.Write([]byte{t.number, t.valuesPerEntry, t.bitmask, t.endFlag})
+	}
+	tagxData := alignBlock(tagx.Bytes())
+
+	// geometry of index records, pointed to by header IDXT
+	var geom, hidxt bytes.Buffer
+	hidxt.WriteString("IDXT")
+	pos := indxHeaderLength + len(tagxData)
+	for i := range lastKeys {
+		binary.Write(&hidxt, binary.BigEndian, uint16(pos+geom.Len()))
+		geom.WriteByte(byte(len(lastKeys[i])))
+		geom.WriteString(lastKeys[i])
+		binary.Write(&geom, binary.BigEndian, uint16(counts[i]))
+	}
+	geomData := alignBlock(geom.Bytes())
+	hidxtData := alignBlock(hidxt.Bytes())
+
+	total := 0
+	for _, c := range counts {
+		total += c
+	}
+	ncncx := 0
+	if strs != nil {
+		ncncx = len(strs.records)
+	}
+
+	var hdr bytes.Buffer
+	hdr.WriteString("INDX")
+	binary.Write(&hdr, binary.BigEndian, uint32(indxHeaderLength))
+	hdr.Write(make([]byte, 8))
+	binary.Write(&hdr, binary.BigEndian, uint32(2))
+	binary.Write(&hdr, binary.BigEndian, uint32(indxHeaderLength+len(tagxData)+len(geomData)))
+	binary.Write(&hdr, binary.BigEndian, uint32(len(blocks)))
+	binary.Write(&hdr, binary.BigEndian, uint32(65001)) // utf-8
+	binary.Write(&hdr, binary.BigEndian, uint32(0xFFFFFFFF))
+	binary.Write(&hdr, binary.BigEndian, uint32(total))
+	hdr.Write(make([]byte, 12)) // ORDT, LIGT, number of ORDT/LIGT entries
+	binary.Write(&hdr, binary.BigEndian, uint32(ncncx))
+	hdr.Write(make([]byte, 124))
+	binary.Write(&hdr, binary.BigEndian, uint32(indxHeaderLength)) // TAGX offset
+	hdr.Write(make([]byte, 8))
+	hdr.Write(tagxData)
+	hdr.Write(geomData)
+	hdr.Write(hidxtData)
+	records[0] = hdr.Bytes()
+
+	if strs != nil {
+		records = append(records, strs.records...)
+	}
+	return records
+}
+
+// controlByte calculates index entry control byte - which tags are present and how many values they have.
+func controlByte(tags []tagMeta, e indexEntry) byte {
+	var cb byte
+	for _, t := range tags {
+		if t.endFlag == 1 {
+			break
+		}
+		n := len(e.tags[t.name]) / int(t.valuesPerEntry)
+		cb |= t.bitmask & byte(n<<bits.TrailingZeros8(t.bitmask))
+	}
+	return cb
+}
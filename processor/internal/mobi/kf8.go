@@ -0,0 +1,604 @@
+package mobi
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"fb2converter/etree"
+)
+
+// KF8 text is a set of "skeletons" (one per xhtml file) each followed by "chunks" (fragments of the file body).
+// Reader reassembles every file by inserting chunks into skeleton at the positions kept in FRAG index. Internal
+// links are "kindle:pos:fid:XXXX:off:YYYYYYYYYY" pointers - fragment number and offset in the reassembled file.
+// See calibre.ebooks.mobi.writer8 for the original description of the format.
+
+const (
+	chunkSize       = 8192
+	linkPlaceholder = "kindle:pos:fid:0000:off:"
+)
+
+var (
+	reLinkPlaceholder = regexp.MustCompile(linkPlaceholder + `([0-9A-V]{10})`)
+	reElementID       = regexp.MustCompile(`<[^>]*?\sid="([^"]+)"`)
+	reCSSURL          = regexp.MustCompile(`url\(\s*['"]?([^'")]+?)['"]?\s*\)`)
+)
+
+type kf8Chunk struct {
+	data      []byte
+	insertPos int // absolute position in the reassembled text
+	startPos  int // position relative to the end of skeleton
+	seq       int
+	selector  string
+}
+
+type kf8Skeleton struct {
+	href   string
+	data   []byte
+	start  int // absolute position in the text
+	insert int // position of chunks in the skeleton
+	chunks []*kf8Chunk
+}
+
+// kf8Resource is an image or font stored in separate PDB record.
+type kf8Resource struct {
+	mediaType string
+	data      []byte
+}
+
+// ncxRecord is a flattened TOC entry.
+type ncxRecord struct {
+	label    string
+	depth    int
+	offset   int
+	fid, off int
+	parent   int
+	children []int
+}
+
+type kf8Builder struct {
+	log *zap.Logger
+	pkg *opfPackage
+	//
+	resources []kf8Resource
+	resIndex  map[string]int // 1 based
+	hasFonts  bool
+	flows     [][]byte
+	flowIndex map[string]int
+	skeletons []*kf8Skeleton
+	files     map[string]*kf8Skeleton
+	chunks    []*kf8Chunk
+	links     []string
+	ids       map[string]int
+	//
+	text []byte
+}
+
+func newKF8Builder(pkg *opfPackage, log *zap.Logger) *kf8Builder {
+	return &kf8Builder{
+		log:       log,
+		pkg:       pkg,
+		resIndex:  make(map[string]int),
+		flows:     [][]byte{nil},
+		flowIndex: make(map[string]int),
+		files:     make(map[string]*kf8Skeleton),
+		ids:       make(map[string]int),
+	}
+}
+
+// build produces KF8 text and resources.
+func (b *kf8Builder) build() error {
+
+	if err := b.collectResources(); err != nil {
+		return err
+	}
+	for _, item := range b.pkg.spine {
+		b.files[item.href] = nil
+	}
+	for i, item := range b.pkg.spine {
+		s, err := b.processFile(i, item)
+		if err != nil {
+			return err
+		}
+		b.skeletons = append(b.skeletons, s)
+		b.files[item.href] = s
+	}
+
+	// assemble main flow
+	var text bytes.Buffer
+	for _, s := range b.skeletons {
+		s.start = text.Len()
+		text.Write(s.data)
+		pos, cp := s.start+s.insert, 0
+		for _, c := range s.chunks {
+			c.insertPos, c.startPos, c.seq = pos, cp, len(b.chunks)
+			b.chunks = append(b.chunks, c)
+			pos += len(c.data)
+			cp += len(c.data)
+			text.Write(c.data)
+		}
+		b.collectIDs(s)
+	}
+	flow := text.Bytes()
+
+	// now when positions are known - resolve internal links, placeholders have the same length as final links
+	for _, m := range reLinkPlaceholder.FindAllSubmatchIndex(flow, -1) {
+		target := b.links[fromBase32(flow[m[2]:m[3]])]
+		fid, off := b.posFid(b.offsetOf(target))
+		copy(flow[m[0]:m[1]], "kindle:pos:fid:"+toBase32(fid, 4)+":off:"+toBase32(off, 10))
+	}
+	b.flows[0] = flow
+	b.text = bytes.Join(b.flows, nil)
+	return nil
+}
+
+// collectResources gathers images and fonts from the manifest.
+func (b *kf8Builder) collectResources() error {
+	for _, item := range b.pkg.items {
+		isFont := strings.Contains(item.mediaType, "font") ||
+			strings.HasSuffix(strings.ToLower(item.href), ".ttf") || strings.HasSuffix(strings.ToLower(item.href), ".otf")
+		switch {
+		case item.mediaType == "image/jpeg" || item.mediaType == "image/png" || item.mediaType == "image/gif":
+		case isFont:
+		default:
+			continue
+		}
+		data, err := b.pkg.read(item)
+		if err != nil {
+			return fmt.Errorf("unable to read resource (%s): %w", item.href, err)
+		}
+		if isFont {
+			if data, err = fontRecord(data); err != nil {
+				return fmt.Errorf("unable to store font (%s): %w", item.href, err)
+			}
+			b.hasFonts = true
+		}
+		b.resources = append(b.resources, kf8Resource{mediaType: item.mediaType, data: data})
+		b.resIndex[item.href] = len(b.resources)
+	}
+	return nil
+}
+
+// processFile splits xhtml file into skeleton and chunks.
+func (b *kf8Builder) processFile(num int, item *opfItem) (*kf8Skeleton, error) {
+
+	src, err := b.pkg.read(item)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read content (%s): %w", item.href, err)
+	}
+	doc := etree.NewDocument()
+	doc.ReadSettings.Entity = xml.HTMLEntity
+	doc.WriteSettings = etree.WriteSettings{CanonicalText: true, CanonicalAttrVal: true}
+	if err := doc.ReadFromBytes(src); err != nil {
+		return nil, fmt.Errorf("unable to read content (%s): %w", item.href, err)
+	}
+	body := doc.FindElement("./html/body")
+	if body == nil {
+		return nil, fmt.Errorf("content does not have body (%s)", item.href)
+	}
+	if err := b.rewriteLinks(item.href, doc.Root()); err != nil {
+		return nil, err
+	}
+
+	aid := toBase32(num, 1)
+	body.CreateAttr("aid", aid)
+
+	content := body.Child
+	body.Child = nil
+	// make sure body is not written as empty element
+	body.AddChild(etree.NewCharData(""))
+
+	data, err := doc.WriteToBytes()
+	if err != nil {
+		return nil, fmt.Errorf("unable to serialize content (%s): %w", item.href, err)
+	}
+	closing := "</body>"
+	if len(body.Space) > 0 {
+		closing = "</" + body.Space + ":body>"
+	}
+	s := &kf8Skeleton{href: item.href, data: data, insert: bytes.LastIndex(data, []byte(closing))}
+
+	selector := "P-//*[@aid='" + aid + "']"
+	var buf bytes.Buffer
+	for _, t := range content {
+		frag := etree.NewDocument()
+		frag.WriteSettings = doc.WriteSettings
+		frag.AddChild(t)
+		data, err := frag.WriteToBytes()
+		if err != nil {
+			return nil, fmt.Errorf("unable to serialize content (%s): %w", item.href, err)
+		}
+		if buf.Len() > 0 && buf.Len()+len(data) > chunkSize {
+			s.chunks = append(s.chunks, &kf8Chunk{data: bytes.Clone(buf.Bytes()), selector: selector})
+			buf.Reset()
+		}
+		buf.Write(data)
+	}
+	if buf.Len() == 0 {
+		// reader does not like skeletons without chunks
+		buf.WriteString("<div></div>")
+	}
+	s.chunks = append(s.chunks, &kf8Chunk{data: bytes.Clone(buf.Bytes()), selector: selector})
+	return s, nil
+}
+
+// rewriteLinks replaces references to resources, stylesheets and other book files with kindle specific ones.
+func (b *kf8Builder) rewriteLinks(href string, e *etree.Element) error {
+
+	for i := range e.Attr {
+		a := &e.Attr[i]
+		switch {
+		case (e.Tag == "img" && a.Key == "src") || (e.Tag == "image" && a.Key == "href"):
+			if isExternal(a.Value) {
+				continue
+			}
+			link, err := b.embedLink(resolveHref(href, a.Value))
+			if err != nil {
+				return err
+			}
+			if len(link) > 0 {
+				a.Value = link
+			}
+		case e.Tag == "link" && a.Key == "href":
+			if isExternal(a.Value) || !strings.Contains(getAttr(e, "rel"), "stylesheet") {
+				continue
+			}
+			link, err := b.flowLink(resolveHref(href, a.Value))
+			if err != nil {
+				return err
+			}
+			if len(link) > 0 {
+				a.Value = link
+			}
+		case a.Key == "href":
+			if isExternal(a.Value) {
+				continue
+			}
+			target := resolveHref(href, a.Value)
+			doc, _, _ := strings.Cut(target, "#")
+			if _, ok := b.files[doc]; ok {
+				a.Value = linkPlaceholder + toBase32(len(b.links), 10)
+				b.links = append(b.links, target)
+			}
+		}
+	}
+	if e.Tag == "style" {
+		css, err := b.rewriteCSS(href, []byte(e.Text()))
+		if err != nil {
+			return err
+		}
+		e.SetText(string(css))
+	}
+	for _, c := range e.ChildElements() {
+		if err := b.rewriteLinks(href, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// embedLink returns kindle link to the resource.
+func (b *kf8Builder) embedLink(href string) (string, error) {
+	href, _, _ = strings.Cut(href, "#")
+	if idx, ok := b.resIndex[href]; ok {
+		link := "kindle:embed:" + toBase32(idx, 4)
+		if r := b.resources[idx-1]; strings.HasPrefix(r.mediaType, "image/") {
+			link += "?mime=" + r.mediaType
+		}
+		return link, nil
+	}
+	if item, ok := b.pkg.byHref[href]; ok && item.mediaType == "image/svg+xml" {
+		return b.flowLink(href)
+	}
+	b.log.Debug("Unable to find resource, leaving link intact", zap.String("href", href))
+	return "", nil
+}
+
+// flowLink returns kindle link to the flow, adding it if necessary.
+func (b *kf8Builder) flowLink(href string) (string, error) {
+	item, ok := b.pkg.byHref[href]
+	if !ok {
+		b.log.Debug("Unable to find flow, leaving link intact", zap.String("href", href))
+		return "", nil
+	}
+	idx, ok := b.flowIndex[href]
+	if !ok {
+		data, err := b.pkg.read(item)
+		if err != nil {
+			return "", fmt.Errorf("unable to read flow (%s): %w", href, err)
+		}
+		if item.mediaType == "text/css" {
+			if data, err = b.rewriteCSS(href, data); err != nil {
+				return "", err
+			}
+		}
+		b.flows = append(b.flows, data)
+		idx = len(b.flows) - 1
+		b.flowIndex[href] = idx
+	}
+	return "kindle:flow:" + toBase32(idx, 4) + "?mime=" + item.mediaType, nil
+}
+
+// rewriteCSS replaces urls in stylesheet with kindle links.
+func (b *kf8Builder) rewriteCSS(href string, css []byte) ([]byte, error) {
+	var err error
+	res := reCSSURL.ReplaceAllFunc(css, func(m []byte) []byte {
+		ref := string(reCSSURL.FindSubmatch(m)[1])
+		if err != nil || isExternal(ref) {
+			return m
+		}
+		var link string
+		if link, err = b.embedLink(resolveHref(href, ref)); err != nil || len(link) == 0 {
+			return m
+		}
+		return []byte("url(" + link + ")")
+	})
+	return res, err
+}
+
+// collectIDs remembers positions of all elements with ids in the reassembled file.
+func (b *kf8Builder) collectIDs(s *kf8Skeleton) {
+
+	var file bytes.Buffer
+	file.Write(s.data[:s.insert])
+	for _, c := range s.chunks {
+		file.Write(c.data)
+	}
+	file.Write(s.data[s.insert:])
+
+	for _, m := range reElementID.FindAllSubmatchIndex(file.Bytes(), -1) {
+		key := s.href + "#" + string(file.Bytes()[m[2]:m[3]])
+		if _, ok := b.ids[key]; !ok {
+			b.ids[key] = s.start + m[0]
+		}
+	}
+}
+
+// offsetOf returns position of the link target in the reassembled text.
+func (b *kf8Builder) offsetOf(href string) int {
+	if ofs, ok := b.ids[href]; ok {
+		return ofs
+	}
+	doc, _, _ := strings.Cut(href, "#")
+	if s, ok := b.files[doc]; ok && s != nil {
+		return s.start
+	}
+	return 0
+}
+
+// posFid converts position in the reassembled text into chunk number and offset in it.
+func (b *kf8Builder) posFid(offset int) (int, int) {
+	for i, c := range b.chunks {
+		if c.insertPos <= offset && offset < c.insertPos+len(c.data) {
+			return c.seq, offset - c.insertPos
+		}
+		if c.insertPos > offset {
+			// position is in the skeleton, use the next chunk
+			return c.seq, 0
+		}
+		if i == len(b.chunks)-1 {
+			return c.seq, offset - c.insertPos
+		}
+	}
+	return 0, 0
+}
+
+// fdst describes flows boundaries.
+func (b *kf8Builder) fdst() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("FDST")
+	binary.Write(&buf, binary.BigEndian, uint32(12))
+	binary.Write(&buf, binary.BigEndian, uint32(len(b.flows)))
+	start := 0
+	for _, f := range b.flows {
+		binary.Write(&buf, binary.BigEndian, uint32(start))
+		binary.Write(&buf, binary.BigEndian, uint32(start+len(f)))
+		start += len(f)
+	}
+	return buf.Bytes()
+}
+
+// skelIndex produces SKEL index records.
+func (b *kf8Builder) skelIndex() [][]byte {
+	entries := make([]indexEntry, 0, len(b.skeletons))
+	for i, s := range b.skeletons {
+		entries = append(entries, indexEntry{
+			key: fmt.Sprintf("SKEL%010d", i),
+			tags: map[string][]int{
+				// values have to be repeated twice
+				"chunk_count": {len(s.chunks), len(s.chunks)},
+				"geometry":    {s.start, len(s.data), s.start, len(s.data)},
+			},
+		})
+	}
+	return buildIndex(skelTags, entries, nil)
+}
+
+// fragIndex produces FRAG (chunk) index records.
+func (b *kf8Builder) fragIndex() [][]byte {
+	selectors := make([]string, 0, len(b.chunks))
+	for _, c := range b.chunks {
+		selectors = append(selectors, c.selector)
+	}
+	strs := newCNCX(selectors)
+
+	var entries []indexEntry
+	for i, s := range b.skeletons {
+		for _, c := range s.chunks {
+			entries = append(entries, indexEntry{
+				key: fmt.Sprintf("%010d", c.insertPos),
+				tags: map[string][]int{
+					"cncx_offset":     {strs.offsets[c.selector]},
+					"file_number":     {i},
+					"sequence_number": {c.seq},
+					"geometry":        {c.startPos, len(c.data)},
+				},
+			})
+		}
+	}
+	return buildIndex(fragTags, entries, strs)
+}
+
+// ncxIndex produces NCX index records, nil if book does not have TOC.
+func (b *kf8Builder) ncxIndex() [][]byte {
+
+	// flatten TOC depth first
+	var recs []*ncxRecord
+	var walk func(points []*opfNavPoint, depth, parent int)
+	walk = func(points []*opfNavPoint, depth, parent int) {
+		for _, p := range points {
+			r := &ncxRecord{label: p.label, depth: depth, parent: parent}
+			if len(r.label) == 0 {
+				r.label = "Unknown"
+			}
+			r.offset = b.offsetOf(p.href)
+			r.fid, r.off = b.posFid(r.offset)
+			recs = append(recs, r)
+			idx := len(recs) - 1
+			if parent >= 0 {
+				recs[parent].children = append(recs[parent].children, idx)
+			}
+			walk(p.children, depth+1, idx)
+		}
+	}
+	walk(b.pkg.toc, 0, -1)
+	if len(recs) == 0 {
+		return nil
+	}
+
+	// Kindle requires entries to be sorted by depth and play order
+	order := make([]int, len(recs))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortStableFunc(order, func(i, j int) int {
+		return recs[i].depth - recs[j].depth
+	})
+	index := make([]int, len(recs))
+	for n, i := range order {
+		index[i] = n
+	}
+
+	labels := make([]string, 0, len(recs))
+	for _, i := range order {
+		labels = append(labels, recs[i].label)
+	}
+	strs := newCNCX(labels)
+
+	end := len(b.flows[0])
+	format := fmt.Sprintf("%%0%dX", max(2, len(fmt.Sprintf("%X", len(recs)-1))))
+
+	entries := make([]indexEntry, 0, len(recs))
+	for _, i := range order {
+		r := recs[i]
+		next := end
+		for _, o := range recs {
+			if o.depth <= r.depth && o.offset > r.offset && o.offset < next {
+				next = o.offset
+			}
+		}
+		tags := map[string][]int{
+			"offset":  {r.offset},
+			"length":  {next - r.offset},
+			"label":   {strs.offsets[r.label]},
+			"depth":   {r.depth},
+			"pos_fid": {r.fid, r.off},
+		}
+		if r.parent >= 0 {
+			tags["parent"] = []int{index[r.parent]}
+		}
+		if len(r.children) > 0 {
+			tags["first_child"] = []int{index[r.children[0]]}
+			tags["last_child"] = []int{index[r.children[len(r.children)-1]]}
+		}
+		entries = append(entries, indexEntry{key: fmt.Sprintf(format, index[i]), tags: tags})
+	}
+	return buildIndex(ncxTags, entries, strs)
+}
+
+// guideIndex produces guide index records, nil if book does not have guide. Returns start reading position if known.
+func (b *kf8Builder) guideIndex() ([][]byte, int) {
+
+	start := -1
+	refs := slices.Clone(b.pkg.guide)
+	refs = slices.DeleteFunc(refs, func(r opfGuideRef) bool {
+		doc, _, _ := strings.Cut(r.href, "#")
+		_, ok := b.files[doc]
+		return len(r.kind) == 0 || !ok
+	})
+	if len(refs) == 0 {
+		return nil, start
+	}
+	slices.SortStableFunc(refs, func(a, b opfGuideRef) int {
+		return strings.Compare(a.kind, b.kind)
+	})
+
+	titles := make([]string, 0, len(refs))
+	for _, r := range refs {
+		titles = append(titles, r.title)
+	}
+	strs := newCNCX(titles)
+
+	entries := make([]indexEntry, 0, len(refs))
+	for _, r := range refs {
+		offset := b.offsetOf(r.href)
+		if r.kind == "text" || r.kind == "bodymatter" {
+			start = offset
+		}
+		fid, off := b.posFid(offset)
+		entries = append(entries, indexEntry{
+			key: r.kind,
+			tags: map[string][]int{
+				"title":   {strs.offsets[r.title]},
+				"pos_fid": {fid, off},
+			},
+		})
+	}
+	return buildIndex(guideTags, entries, strs), start
+}
+
+// pageOffsets returns positions of page map entries in the reassembled text.
+func (b *kf8Builder) pageOffsets() []int {
+	offsets := make([]int, 0, len(b.pkg.pages))
+	for _, p := range b.pkg.pages {
+		offsets = append(offsets, b.offsetOf(p))
+	}
+	return offsets
+}
+
+// fontRecord packs font into FONT record (zlib compressed, not obfuscated).
+func fontRecord(data []byte) ([]byte, error) {
+
+	var z bytes.Buffer
+	w, err := zlib.NewWriterLevel(&z, zlib.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	if z.Len() == 0 {
+		return nil, errors.New("empty font")
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("FONT")
+	binary.Write(&buf, binary.BigEndian, uint32(len(data))) // uncompressed size
+	binary.Write(&buf, binary.BigEndian, uint32(1))         // flags: compressed
+	binary.Write(&buf, binary.BigEndian, uint32(24))        // data start
+	binary.Write(&buf, binary.BigEndian, uint32(0))         // xor key length
+	binary.Write(&buf, binary.BigEndian, uint32(24))        // xor key start
+	buf.Write(z.Bytes())
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,270 @@
+package mobi
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"path"
+	"strings"
+
+	"fb2converter/etree"
+)
+
+// opfItem is a single manifest entry.
+type opfItem struct {
+	id        string
+	href      string // path relative to OPF directory, slash separated
+	mediaType string
+	props     string
+}
+
+// opfGuideRef is a single guide reference.
+type opfGuideRef struct {
+	kind  string
+	title string
+	href  string
+}
+
+// opfNavPoint is a single NCX TOC entry.
+type opfNavPoint struct {
+	label    string
+	href     string
+	children []*opfNavPoint
+}
+
+// opfPackage keeps everything we need from the book OPF tree to produce KF8.
+type opfPackage struct {
+	fsys fs.FS
+	dir  string // OPF directory in fsys
+	//
+	title       string
+	lang        string
+	authors     []string
+	publisher   string
+	description string
+	date        string
+	subjects    []string
+	//
+	items  []*opfItem
+	byID   map[string]*opfItem
+	byHref map[string]*opfItem
+	spine  []*opfItem
+	cover  *opfItem
+	guide  []opfGuideRef
+	toc    []*opfNavPoint
+	pages  []string
+}
+
+// readPackage parses OPF file and everything it refers to which is necessary to build KF8 indexes. Book files are read
+// from fsys, name is slash separated OPF path in it.
+func readPackage(fsys fs.FS, name string) (*opfPackage, error) {
+
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read OPF (%s): %w", name, err)
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(data); err != nil {
+		return nil, fmt.Errorf("unable to read OPF (%s): %w", name, err)
+	}
+	pkg := doc.FindElement("./package")
+	if pkg == nil {
+		return nil, errors.New("OPF does not have package element")
+	}
+
+	o := &opfPackage{
+		fsys:   fsys,
+		dir:    path.Dir(name),
+		byID:   make(map[string]*opfItem),
+		byHref: make(map[string]*opfItem),
+	}
+
+	var coverID string
+	if meta := pkg.FindElement("./metadata"); meta != nil {
+		text := func(tag string) string {
+			if e := meta.FindElement("./" + tag); e != nil {
+				return strings.TrimSpace(e.Text())
+			}
+			return ""
+		}
+		o.title = text("title")
+		o.lang = text("language")
+		o.publisher = text("publisher")
+		o.description = text("description")
+		o.date = text("date")
+		for _, e := range meta.FindElements("./creator") {
+			if role := getAttr(e, "role"); len(role) == 0 || role == "aut" {
+				if a := strings.TrimSpace(e.Text()); len(a) > 0 {
+					o.authors = append(o.authors, a)
+				}
+			}
+		}
+		for _, e := range meta.FindElements("./subject") {
+			if s := strings.TrimSpace(e.Text()); len(s) > 0 {
+				o.subjects = append(o.subjects, s)
+			}
+		}
+		for _, e := range meta.FindElements("./meta[@name='cover']") {
+			coverID = getAttr(e, "content")
+		}
+	}
+
+	if manifest := pkg.FindElement("./manifest"); manifest != nil {
+		for _, e := range manifest.FindElements("./item") {
+			item := &opfItem{
+				id:        getAttr(e, "id"),
+				href:      resolveHref("", getAttr(e, "href")),
+				mediaType: getAttr(e, "media-type"),
+				props:     getAttr(e, "properties"),
+			}
+			o.items = append(o.items, item)
+			o.byID[item.id] = item
+			o.byHref[item.href] = item
+			if strings.Contains(item.props, "cover-image") {
+				coverID = item.id
+			}
+		}
+	}
+	if item, ok := o.byID[coverID]; ok && strings.HasPrefix(item.mediaType, "image/") {
+		o.cover = item
+	}
+
+	var ncx, pageMap *opfItem
+	if spine := pkg.FindElement("./spine"); spine != nil {
+		for _, e := range spine.FindElements("./itemref") {
+			if item, ok := o.byID[getAttr(e, "idref")]; ok {
+				o.spine = append(o.spine, item)
+			}
+		}
+		ncx = o.byID[getAttr(spine, "toc")]
+		pageMap = o.byID[getAttr(spine, "page-map")]
+	}
+	if len(o.spine) == 0 {
+		return nil, errors.New("OPF spine is empty")
+	}
+	for _, item := range o.items {
+		switch {
+		case ncx == nil && item.mediaType == "application/x-dtbncx+xml":
+			ncx = item
+		case pageMap == nil && item.mediaType == "application/oebps-page-map+xml":
+			pageMap = item
+		}
+	}
+
+	if guide := pkg.FindElement("./guide"); guide != nil {
+		for _, e := range guide.FindElements("./reference") {
+			o.guide = append(o.guide, opfGuideRef{
+				kind:  getAttr(e, "type"),
+				title: getAttr(e, "title"),
+				href:  resolveHref("", getAttr(e, "href")),
+			})
+		}
+	}
+
+	if ncx != nil {
+		if err := o.readNCX(ncx); err != nil {
+			return nil, err
+		}
+	}
+	if pageMap != nil {
+		if err := o.readPageMap(pageMap); err != nil {
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+// readNCX reads navigation map from NCX.
+func (o *opfPackage) readNCX(item *opfItem) error {
+
+	data, err := o.read(item)
+	if err != nil {
+		return fmt.Errorf("unable to read NCX (%s): %w", item.href, err)
+	}
+	doc := etree.NewDocument()
+	doc.ReadSettings.Entity = xml.HTMLEntity
+	if err := doc.ReadFromBytes(data); err != nil {
+		return fmt.Errorf("unable to read NCX (%s): %w", item.href, err)
+	}
+	navMap := doc.FindElement("./ncx/navMap")
+	if navMap == nil {
+		return nil
+	}
+
+	var walk func(e *etree.Element) []*opfNavPoint
+	walk = func(e *etree.Element) []*opfNavPoint {
+		var points []*opfNavPoint
+		for _, np := range e.SelectElements("navPoint") {
+			point := &opfNavPoint{}
+			if label := np.FindElement("./navLabel/text"); label != nil {
+				point.label = strings.TrimSpace(label.Text())
+			}
+			if content := np.SelectElement("content"); content != nil {
+				point.href = resolveHref(item.href, getAttr(content, "src"))
+			}
+			point.children = walk(np)
+			points = append(points, point)
+		}
+		return points
+	}
+	o.toc = walk(navMap)
+	return nil
+}
+
+// readPageMap reads list of pages from page map.
+func (o *opfPackage) readPageMap(item *opfItem) error {
+
+	data, err := o.read(item)
+	if err != nil {
+		return fmt.Errorf("unable to read page map (%s): %w", item.href, err)
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(data); err != nil {
+		return fmt.Errorf("unable to read page map (%s): %w", item.href, err)
+	}
+	for _, e := range doc.FindElements("./page-map/page") {
+		o.pages = append(o.pages, resolveHref(item.href, getAttr(e, "href")))
+	}
+	return nil
+}
+
+// read returns content of the manifest item.
+func (o *opfPackage) read(item *opfItem) ([]byte, error) {
+	return fs.ReadFile(o.fsys, path.Join(o.dir, item.href))
+}
+
+// getAttr returns value of the attribute with the given key (namespace prefix is ignored).
+func getAttr(e *etree.Element, key string) string {
+	for _, a := range e.Attr {
+		if a.Key == key {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// resolveHref converts reference found in the document into the path relative to the OPF directory,
+// keeping fragment if present.
+func resolveHref(doc, href string) string {
+	href, frag, _ := strings.Cut(href, "#")
+	if p, err := url.PathUnescape(href); err == nil {
+		href = p
+	}
+	// empty reference points to the document itself
+	res := doc
+	if len(href) > 0 {
+		res = strings.TrimPrefix(path.Clean(path.Join("/", path.Dir(doc), href)), "/")
+	}
+	if len(frag) > 0 {
+		res += "#" + frag
+	}
+	return res
+}
+
+// isExternal checks if reference points outside of the book.
+func isExternal(href string) bool {
+	u, err := url.Parse(href)
+	return err != nil || len(u.Scheme) > 0
+}
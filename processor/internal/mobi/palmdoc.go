@@ -0,0 +1,209 @@
+package mobi
+
+import (
+	"bytes"
+	"errors"
+	"unicode/utf8"
+)
+
+var errCorruptedPalmDoc = errors.New("corrupted PalmDoc record")
+
+const (
+	textRecordSize = 4096
+	base32Alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUV"
+)
+
+// compressPalmDoc implements PalmDOC (LZ77 variant) compression of a single text record.
+func compressPalmDoc(data []byte) []byte {
+
+	var out bytes.Buffer
+
+	ldata := len(data)
+	for i := 0; i < ldata; {
+		if i > 10 && ldata-i > 10 {
+			// look for the longest match in the sliding window
+			found := false
+			for n := 10; n > 2; n-- {
+				start := max(0, i-2047)
+				if m := bytes.LastIndex(data[start:i], data[i:i+n]); m >= 0 {
+					dist := i - (start + m)
+					code := 0x8000 + ((dist << 3) & 0x3ff8) + (n - 3)
+					out.WriteByte(byte(code >> 8))
+					out.WriteByte(byte(code))
+					i += n
+					found = true
+					break
+				}
+			}
+			if found {
+				continue
+			}
+		}
+
+		ch := data[i]
+		i++
+		if ch == ' ' && i+1 < ldata {
+			// space followed by printable character
+			if next := data[i]; next >= 0x40 && next < 0x80 {
+				out.WriteByte(next ^ 0x80)
+				i++
+				continue
+			}
+		}
+		if ch == 0 || (ch > 8 && ch < 0x80) {
+			out.WriteByte(ch)
+			continue
+		}
+
+		// sequence of binary bytes, up to 8 at a time
+		j := i
+		seq := []byte{ch}
+		for j < ldata && len(seq) < 8 {
+			ch = data[j]
+			if ch == 0 || (ch > 8 && ch < 0x80) {
+				break
+			}
+			seq = append(seq, ch)
+			j++
+		}
+		out.WriteByte(byte(len(seq)))
+		out.Write(seq)
+		i += len(seq) - 1
+	}
+	return out.Bytes()
+}
+
+// splitTextRecords breaks text into record size chunks. Each chunk is returned together with the
+// bytes needed to complete its last (truncated) multibyte UTF-8 character.
+func splitTextRecords(text []byte) (records, overlaps [][]byte) {
+
+	for pos := 0; pos < len(text); pos += textRecordSize {
+		end := min(pos+textRecordSize, len(text))
+
+		var overlap []byte
+		if end < len(text) {
+			// find beginning of the last character in the record
+			start := end - 1
+			for start > pos && end-start < utf8.UTFMax && !utf8.RuneStart(text[start]) {
+				start--
+			}
+			if need := utf8SeqLen(text[start]); start+need > end {
+				overlap = text[end:min(start+need, len(text))]
+			}
+		}
+		records = append(records, text[pos:end])
+		overlaps = append(overlaps, overlap)
+	}
+	return
+}
+
+// uncompressPalmDoc decodes single PalmDOC compressed text record (as in KindleUnpack). Record comes from untrusted
+// book, so literal lengths and back reference distances are checked.
+func uncompressPalmDoc(data []byte) ([]byte, error) {
+	var out []byte
+	for i := 0; i < len(data); {
+		c := data[i]
+		i++
+		switch {
+		case c >= 1 && c <= 8:
+			if i+int(c) > len(data) {
+				return nil, errCorruptedPalmDoc
+			}
+			out = append(out, data[i:i+int(c)]...)
+			i += int(c)
+		case c < 0x80:
+			out = append(out, c)
+		case c >= 0xC0:
+			out = append(out, ' ', c^0x80)
+		default:
+			if i >= len(data) {
+				return nil, errCorruptedPalmDoc
+			}
+			code := int(c)<<8 | int(data[i])
+			i++
+			dist, n := (code>>3)&0x7FF, (code&7)+3
+			if dist == 0 || dist > len(out) {
+				return nil, errCorruptedPalmDoc
+			}
+			for ; n > 0; n-- {
+				out = append(out, out[len(out)-dist])
+			}
+		}
+	}
+	return out, nil
+}
+
+// utf8SeqLen returns expected length of UTF-8 sequence by its first byte.
+func utf8SeqLen(b byte) int {
+	switch {
+	case b&0xE0 == 0xC0:
+		return 2
+	case b&0xF0 == 0xE0:
+		return 3
+	case b&0xF8 == 0xF0:
+		return 4
+	default:
+		return 1
+	}
+}
+
+// encodeVarInt encodes value as forward variable width integer (7 bits per byte, last byte has high bit set).
+func encodeVarInt(value int) []byte {
+	var buf []byte
+	for {
+		buf = append([]byte{byte(value & 0x7F)}, buf...)
+		value >>= 7
+		if value == 0 {
+			break
+		}
+	}
+	buf[len(buf)-1] |= 0x80
+	return buf
+}
+
+// decodeVarInt decodes forward variable width integer, returns value and number of bytes consumed.
+func decodeVarInt(data []byte) (int, int) {
+	var value, n int
+	for n < len(data) {
+		b := data[n]
+		n++
+		value = value<<7 | int(b&0x7F)
+		if b&0x80 != 0 {
+			break
+		}
+	}
+	return value, n
+}
+
+// toBase32 encodes number the way Kindle expects it in "kindle:" links, padding result to requested number of digits.
+func toBase32(n, digits int) string {
+	var buf []byte
+	for {
+		buf = append([]byte{base32Alphabet[n%32]}, buf...)
+		n /= 32
+		if n == 0 {
+			break
+		}
+	}
+	for len(buf) < digits {
+		buf = append([]byte{'0'}, buf...)
+	}
+	return string(buf)
+}
+
+// fromBase32 decodes number produced by toBase32.
+func fromBase32(s []byte) int {
+	var n int
+	for _, c := range s {
+		n = n*32 + bytes.IndexByte([]byte(base32Alphabet), c)
+	}
+	return n
+}
+
+// alignBlock pads data with zeroes to the 4 bytes boundary.
+func alignBlock(data []byte) []byte {
+	if extra := len(data) % 4; extra != 0 {
+		return append(data, make([]byte, 4-extra)...)
+	}
+	return data
+}
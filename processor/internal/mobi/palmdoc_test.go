@@ -0,0 +1,60 @@
+package mobi
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestPalmDocRoundTrip(t *testing.T) {
+
+	text := []byte(strings.Repeat("<p>Съешь же ещё этих мягких французских булок, да выпей чаю. The quick brown fox jumps.</p>\x01\x02\n", 200))
+
+	records, overlaps := splitTextRecords(text)
+	if len(records) != (len(text)+textRecordSize-1)/textRecordSize {
+		t.Fatalf("unexpected number of records: %d", len(records))
+	}
+
+	var res []byte
+	for i, rec := range records {
+		data, err := uncompressPalmDoc(compressPalmDoc(rec))
+		if err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+		if !bytes.Equal(data, rec) {
+			t.Fatalf("record %d does not survive compression", i)
+		}
+		if !utf8.Valid(append(bytes.Clone(rec[bytes.LastIndexByte(rec, '<'):]), overlaps[i]...)) {
+			t.Fatalf("record %d overlap does not complete last character", i)
+		}
+		res = append(res, data...)
+	}
+	if !bytes.Equal(res, text) {
+		t.Fatal("text does not survive compression")
+	}
+}
+
+func TestEncoding(t *testing.T) {
+
+	for _, c := range []struct {
+		in  int
+		out []byte
+	}{
+		{0, []byte{0x80}},
+		{0x7F, []byte{0xFF}},
+		{0x80, []byte{0x01, 0x80}},
+		{0x3FFF, []byte{0x7F, 0xFF}},
+	} {
+		if res := encodeVarInt(c.in); !bytes.Equal(res, c.out) {
+			t.Errorf("encodeVarInt(%d) = % x, expected % x", c.in, res, c.out)
+		}
+	}
+
+	for _, n := range []int{0, 31, 32, 1000, 0x7FFFFFF} {
+		s := toBase32(n, 10)
+		if len(s) != 10 || fromBase32([]byte(s)) != n {
+			t.Errorf("toBase32(%d) = %s does not decode back", n, s)
+		}
+	}
+}
@@ -483,36 +483,5 @@ func (s *Splitter) processPageData(data []byte) {
 		asin = s.asin
 	}
 
-	var contentHeader string
-	if s.combo {
-		contentHeader = fmt.Sprintf(`{"contentGuid":"%s","asin":"%s","cdeType":"%s","fileRevisionId":"1"}`,
-			s.contentGUID,
-			string(asin),
-			string(s.cdetype),
-		)
-	} else {
-		contentHeader = fmt.Sprintf(`{"contentGuid":"%s","asin":"%s","cdeType":"%s","format":"MOBI_8","fileRevisionId":"1","acr":"%s"}`,
-			s.contentGUID,
-			string(asin),
-			string(s.cdetype),
-			string(s.acr),
-		)
-	}
-	pageHeader := fmt.Sprintf(`{"asin":"%s","pageMap":"%s"}`, string(asin), pm.Pagemap)
-
-	var apnx bytes.Buffer
-	binary.Write(&apnx, binary.BigEndian, uint16(1))
-	binary.Write(&apnx, binary.BigEndian, uint16(1))
-	binary.Write(&apnx, binary.BigEndian, uint32(12+len(contentHeader)))
-	binary.Write(&apnx, binary.BigEndian, uint32(len(contentHeader)))
-	apnx.WriteString(contentHeader)
-	binary.Write(&apnx, binary.BigEndian, uint16(1))
-	binary.Write(&apnx, binary.BigEndian, uint16(len(pageHeader)))
-	binary.Write(&apnx, binary.BigEndian, uint16(pmnn))
-	binary.Write(&apnx, binary.BigEndian, uint16(32))
-	apnx.WriteString(pageHeader)
-	for _, ofs := range pageOffsets {
-		binary.Write(&apnx, binary.BigEndian, uint32(ofs))
-	}
-	s.pagedata = apnx.Bytes()
+	s.pagedata = buildAPNX(s.contentGUID, asin, s.cdetype, s.acr, s.combo, pm.Pagemap, pageOffsets)
 }
@@ -0,0 +1,577 @@
+package mobi
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"strconv"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+)
+
+// Unpacker is a debugging aid, it does what KindleUnpack does for us most of the time: dumps headers, EXTH, records,
+// resources and text of the book. Output directory layout:
+//
+//	book.json            - PDB records list and headers of every book part (mobi7 and/or KF8), all EXTH records
+//	records/             - raw PDB records
+//	resources/           - images and fonts, numbered the same way "kindle:embed" links are (1 based)
+//	mobi7/book.html      - text of mobi7 part
+//	kf8/text/, kf8/flows - KF8 text reassembled into parts out of skeletons and fragments, and flows (CSS, SVG)
+
+// rec0 offsets used only when unpacking.
+const (
+	compressionType = 0
+	textEncoding    = 28
+	exthFlagsOffset = 128
+	fdstCount       = 196
+	extraDataFlags  = 242
+	fragmentIndex   = 248
+	skeletonIndex   = 252
+
+	compressionHuffCdic = 17480
+)
+
+var exthNames = map[int]string{
+	100: "author", 101: "publisher", 103: "description", 104: "isbn", 105: "subject", 106: "publishing_date",
+	108: "contributor", 109: "rights", 112: "source", 113: "asin", 114: "version_number", 115: "sample",
+	116: "start_reading", 117: "adult", 118: "retail_price", 119: "retail_price_currency", 121: "kf8_boundary_offset",
+	125: "resource_count", 129: "kf8_cover_uri", 131: "unknown_131", 201: "cover_offset", 202: "thumb_offset",
+	203: "has_fake_cover", 204: "creator_software", 205: "creator_major", 206: "creator_minor", 207: "creator_build",
+	208: "watermark", 300: "font_signature", 401: "clipping_limit", 404: "tts_flag", 501: "cdetype",
+	502: "last_update_time", 503: "updated_title", 504: "cde_content_key", 524: "language",
+	525: "primary_writing_mode", 527: "page_progression_direction", 535: "kindlegen_build",
+}
+
+// exth records with numeric values.
+var exthNumbers = map[int]bool{
+	115: true, 116: true, 121: true, 125: true, 131: true, 201: true, 202: true, 203: true, 204: true, 205: true,
+	206: true, 207: true, 401: true, 404: true,
+}
+
+type exthRecord struct {
+	ID    int    `json:"id"`
+	Name  string `json:"name,omitempty"`
+	Value any    `json:"value"`
+}
+
+type bookPart struct {
+	Format        string       `json:"format"`
+	Record0       int          `json:"record0"`
+	Version       int          `json:"version"`
+	Encoding      int          `json:"encoding"`
+	Compression   int          `json:"compression"`
+	Encrypted     bool         `json:"encrypted"`
+	TextLength    int          `json:"text_length"`
+	TextRecords   int          `json:"text_records"`
+	FirstResource int          `json:"first_resource"`
+	ASIN          string       `json:"asin,omitempty"`
+	CDEKey        string       `json:"cde_content_key,omitempty"`
+	CDEType       string       `json:"cdetype,omitempty"`
+	CoverOffset   *int         `json:"cover_offset,omitempty"`
+	ThumbOffset   *int         `json:"thumb_offset,omitempty"`
+	KF8Offset     *int         `json:"kf8_offset,omitempty"`
+	EXTH          []exthRecord `json:"exth"`
+	rec0          []byte
+}
+
+type recordInfo struct {
+	Index  int    `json:"index"`
+	Offset int    `json:"offset"`
+	Length int    `json:"length"`
+	Magic  string `json:"magic,omitempty"`
+}
+
+type unpackInfo struct {
+	Name    string        `json:"name"`
+	Type    string        `json:"type"`
+	Records []*recordInfo `json:"records"`
+	Parts   []*bookPart   `json:"parts"`
+}
+
+// Unpacker - mobi and azw3 structure dumper.
+type Unpacker struct {
+	log   *zap.Logger
+	fname string
+	data  []byte
+	info  unpackInfo
+}
+
+// NewUnpacker returns pointer to Unpacker with parsed mobi or azw3 file.
+func NewUnpacker(fname string, log *zap.Logger) (*Unpacker, error) {
+
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < firstPdbRecord+8 || string(data[60:68]) != "BOOKMOBI" {
+		return nil, errors.New("not a mobi book")
+	}
+
+	u := &Unpacker{
+		log:   log,
+		fname: fname,
+		data:  data,
+		info: unpackInfo{
+			Name: string(bytes.TrimRight(data[:32], "\x00")),
+			Type: string(data[60:68]),
+		},
+	}
+
+	nsec := getUInt16(data, numberOfPdbRecords)
+	for i := 0; i < nsec; i++ {
+		start, end := getSectionAddr(data, i)
+		if start > end || end > len(data) {
+			return nil, fmt.Errorf("record %d is out of file bounds", i)
+		}
+		u.info.Records = append(u.info.Records, &recordInfo{Index: i, Offset: start, Length: end - start, Magic: recordMagic(data[start:end])})
+	}
+
+	first := u.readPart(0)
+	u.info.Parts = append(u.info.Parts, first)
+	if first.Version != 8 && first.KF8Offset != nil && *first.KF8Offset > 0 && *first.KF8Offset < nsec {
+		// combo mobi, KF8 part follows BOUNDARY record
+		u.info.Parts = append(u.info.Parts, u.readPart(*first.KF8Offset))
+	}
+	return u, nil
+}
+
+// signatures of known non-text records.
+var recordMagics = []string{"INDX", "FDST", "FLIS", "FCIS", "SRCS", "CMET", "PAGE", "RESC", "DATP", "HUFF", "CDIC", "FONT", "CRES", "CONT"}
+
+// recordMagic returns record signature if record starts with one.
+func recordMagic(rec []byte) string {
+	switch {
+	case bytes.HasPrefix(rec, []byte("BOUNDARY")):
+		return "BOUNDARY"
+	case bytes.HasPrefix(rec, []byte{0xFF, 0xD8, 0xFF}):
+		return "JPEG"
+	case bytes.HasPrefix(rec, []byte("\x89PNG")):
+		return "PNG"
+	case bytes.HasPrefix(rec, []byte("GIF8")):
+		return "GIF"
+	case bytes.Equal(rec, recordEOF):
+		return "EOF"
+	}
+	for _, m := range recordMagics {
+		if bytes.HasPrefix(rec, []byte(m)) {
+			return m
+		}
+	}
+	return ""
+}
+
+func (u *Unpacker) readPart(base int) *bookPart {
+
+	rec0 := readSection(u.data, base)
+
+	p := &bookPart{
+		Format:        "mobi7",
+		Record0:       base,
+		Version:       getInt32(rec0, mobiVersion),
+		Encoding:      getInt32(rec0, textEncoding),
+		Compression:   getUInt16(rec0, compressionType),
+		Encrypted:     getUInt16(rec0, cryptoType) != 0,
+		TextLength:    getInt32(rec0, lengthOfBook),
+		TextRecords:   getUInt16(rec0, bookRecordCount),
+		FirstResource: getInt32(rec0, firstRescRecord),
+		rec0:          rec0,
+	}
+	if p.Version == 8 {
+		p.Format = "kf8"
+	}
+	if p.FirstResource >= 0 {
+		p.FirstResource += base
+	}
+	if getInt32(rec0, exthFlagsOffset)&0x40 == 0 {
+		return p
+	}
+
+	value := func(id int) []byte {
+		if v := readExth(rec0, id); len(v) > 0 {
+			return v[0]
+		}
+		return nil
+	}
+	number := func(id int) *int {
+		if v := value(id); len(v) >= 4 {
+			n := getInt32(v, 0)
+			return &n
+		}
+		return nil
+	}
+	p.ASIN, p.CDEKey, p.CDEType = string(value(exthASIN)), string(value(exthCDEContentKey)), string(value(exthCDEType))
+	p.CoverOffset, p.ThumbOffset, p.KF8Offset = number(exthCoverOffset), number(exthThumbOffset), number(exthKF8Offset)
+
+	ebase, _, enum := getExthParams(rec0)
+	for ebase += 12; enum > 0; enum-- {
+		id, size := getInt32(rec0, ebase), getInt32(rec0, ebase+4)
+		data := rec0[ebase+8 : ebase+size]
+		r := exthRecord{ID: id, Name: exthNames[id]}
+		switch {
+		case exthNumbers[id] && len(data) == 4:
+			r.Value = getInt32(data, 0)
+		case utf8.Valid(data):
+			r.Value = string(data)
+		default:
+			r.Value = hex.EncodeToString(data)
+		}
+		p.EXTH = append(p.EXTH, r)
+		ebase += size
+	}
+	return p
+}
+
+// trailingSize calculates size of trailing entries of the text record as indicated by extra data flags.
+func trailingSize(rec []byte, flags int) int {
+
+	num := 0
+	for f := flags >> 1; f != 0; f >>= 1 {
+		if f&1 == 0 {
+			continue
+		}
+		// backward encoded variable width integer
+		size, shift := 0, 0
+		for end := len(rec) - num; end > 0 && shift < 28; end-- {
+			b := rec[end-1]
+			size |= int(b&0x7F) << shift
+			shift += 7
+			if b&0x80 != 0 {
+				break
+			}
+		}
+		num += size
+	}
+	if flags&1 != 0 && len(rec) > num {
+		// multibyte overlap
+		num += int(rec[len(rec)-num-1]&0x3) + 1
+	}
+	return num
+}
+
+// text decompresses text records of the book part.
+func (u *Unpacker) text(p *bookPart) ([]byte, error) {
+
+	if p.Encrypted {
+		return nil, errors.New("book is encrypted")
+	}
+	if p.Compression != compressionNone && p.Compression != compressionPalmDoc {
+		if p.Compression == compressionHuffCdic {
+			return nil, errors.New("HUFF/CDIC compression is not supported")
+		}
+		return nil, fmt.Errorf("unknown compression %d", p.Compression)
+	}
+
+	flags := 0
+	if getInt32(p.rec0, mobiHeaderLength) >= 0xE4 && p.Version >= 5 {
+		flags = getUInt16(p.rec0, extraDataFlags)
+	}
+
+	var text bytes.Buffer
+	for i := 1; i <= p.TextRecords; i++ {
+		rec := readSection(u.data, p.Record0+i)
+		rec = rec[:len(rec)-trailingSize(rec, flags)]
+		if p.Compression == compressionPalmDoc {
+			var err error
+			if rec, err = uncompressPalmDoc(rec); err != nil {
+				return nil, fmt.Errorf("text record %d: %w", i, err)
+			}
+		}
+		text.Write(rec)
+	}
+	if text.Len() > p.TextLength {
+		text.Truncate(p.TextLength)
+	}
+	return text.Bytes(), nil
+}
+
+// readTags decodes tag values of the index entry according to TAGX table.
+func readTags(data []byte, cbCount int, table []tagMeta) map[string][]int {
+
+	type tagValues struct {
+		name           string
+		count, size    int
+		valuesPerEntry int
+	}
+
+	var list []tagValues
+	cb, ofs := 0, cbCount
+	for _, t := range table {
+		if t.endFlag == 1 {
+			cb++
+			continue
+		}
+		v := data[cb] & t.bitmask
+		if v == 0 {
+			continue
+		}
+		tv := tagValues{name: t.name, valuesPerEntry: int(t.valuesPerEntry)}
+		if v == t.bitmask && bits.OnesCount8(t.bitmask) > 1 {
+			// size in bytes of all values follows control bytes
+			size, n := decodeVarInt(data[ofs:])
+			tv.size = size
+			ofs += n
+		} else {
+			tv.count = int(v >> bits.TrailingZeros8(t.bitmask))
+		}
+		list = append(list, tv)
+	}
+
+	tags := make(map[string][]int, len(list))
+	for _, tv := range list {
+		var values []int
+		if tv.size == 0 {
+			for i := 0; i < tv.count*tv.valuesPerEntry; i++ {
+				v, n := decodeVarInt(data[ofs:])
+				values = append(values, v)
+				ofs += n
+			}
+		} else {
+			for consumed := 0; consumed < tv.size; {
+				v, n := decodeVarInt(data[ofs:])
+				values = append(values, v)
+				consumed += n
+				ofs += n
+			}
+		}
+		tags[tv.name] = values
+	}
+	return tags
+}
+
+// readIndex parses index produced by buildIndex (or kindlegen), tags are named after known tags table.
+func readIndex(data []byte, first int, known []tagMeta) ([]indexEntry, error) {
+
+	hdr := readSection(data, first)
+	if !bytes.HasPrefix(hdr, []byte("INDX")) {
+		return nil, fmt.Errorf("record %d is not an index", first)
+	}
+	tagx, count := getInt32(hdr, 4), getInt32(hdr, 24)
+	if !bytes.HasPrefix(hdr[tagx:], []byte("TAGX")) {
+		return nil, fmt.Errorf("index %d has no TAGX section", first)
+	}
+
+	var table []tagMeta
+	cbCount := getInt32(hdr, tagx+8)
+	for ofs := tagx + 12; ofs < tagx+getInt32(hdr, tagx+4); ofs += 4 {
+		t := tagMeta{name: fmt.Sprintf("tag%d", hdr[ofs]), number: hdr[ofs], valuesPerEntry: hdr[ofs+1], bitmask: hdr[ofs+2], endFlag: hdr[ofs+3]}
+		for _, k := range known {
+			if k.number == t.number && k.endFlag == 0 {
+				t.name = k.name
+				break
+			}
+		}
+		table = append(table, t)
+	}
+
+	var entries []indexEntry
+	for i := 1; i <= count; i++ {
+		rec := readSection(data, first+i)
+		idxt, n := getInt32(rec, 20), getInt32(rec, 24)
+		for j := 0; j < n; j++ {
+			start, end := getUInt16(rec, idxt+4+2*j), idxt
+			if j < n-1 {
+				end = getUInt16(rec, idxt+4+2*(j+1))
+			}
+			entry := rec[start:end]
+			klen := int(entry[0])
+			entries = append(entries, indexEntry{
+				key:  string(entry[1 : 1+klen]),
+				tags: readTags(entry[1+klen:], cbCount, table),
+			})
+		}
+	}
+	return entries, nil
+}
+
+// kf8Parts splits KF8 text into flows and reassembles main flow into separate files.
+func (u *Unpacker) kf8Parts(p *bookPart, text []byte) (parts, flows [][]byte, err error) {
+
+	flows = [][]byte{text}
+	if idx := getInt32(p.rec0, kf8FdstIndex); idx >= 0 && getInt32(p.rec0, fdstCount) > 1 {
+		fdst := readSection(u.data, p.Record0+idx)
+		if !bytes.HasPrefix(fdst, []byte("FDST")) {
+			return nil, nil, errors.New("FDST record not found")
+		}
+		flows = flows[:0]
+		for i, ofs := 0, getInt32(fdst, 4); i < getInt32(fdst, 8); i, ofs = i+1, ofs+8 {
+			start, end := getInt32(fdst, ofs), getInt32(fdst, ofs+4)
+			if start > end || end > len(text) {
+				return nil, nil, fmt.Errorf("flow %d is out of text bounds", i)
+			}
+			flows = append(flows, text[start:end])
+		}
+	}
+
+	skelIdx, fragIdx := getInt32(p.rec0, skeletonIndex), getInt32(p.rec0, fragmentIndex)
+	if skelIdx < 0 || fragIdx < 0 {
+		return nil, flows, nil
+	}
+	skels, err := readIndex(u.data, p.Record0+skelIdx, skelTags)
+	if err != nil {
+		return nil, nil, err
+	}
+	frags, err := readIndex(u.data, p.Record0+fragIdx, fragTags)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	main, next := flows[0], 0
+	for _, s := range skels {
+		geom := s.tags["geometry"]
+		if len(geom) < 2 || len(s.tags["chunk_count"]) < 1 {
+			return nil, nil, fmt.Errorf("bad skeleton entry %s", s.key)
+		}
+		start, pos := geom[0], geom[0]+geom[1]
+		part := bytes.Clone(main[start:pos])
+		for i := 0; i < s.tags["chunk_count"][0] && next < len(frags); i, next = i+1, next+1 {
+			f := frags[next]
+			insert, err := strconv.Atoi(f.key)
+			if err != nil || len(f.tags["geometry"]) < 2 {
+				return nil, nil, fmt.Errorf("bad fragment entry %s", f.key)
+			}
+			insert -= start
+			length := f.tags["geometry"][1]
+			part = append(part[:insert], append(bytes.Clone(main[pos:pos+length]), part[insert:]...)...)
+			pos += length
+		}
+		parts = append(parts, part)
+	}
+	return parts, flows, nil
+}
+
+// unpackFont restores font out of FONT record, returns font and file extension.
+func unpackFont(rec []byte) ([]byte, string, error) {
+
+	flags, start, keyLen, keyStart := getInt32(rec, 8), getInt32(rec, 12), getInt32(rec, 16), getInt32(rec, 20)
+	font := bytes.Clone(rec[start:])
+	if flags&2 != 0 && keyLen > 0 {
+		// obfuscated, only first 1040 bytes are xored
+		key := rec[keyStart : keyStart+keyLen]
+		for i := 0; i < len(font) && i < 1040; i++ {
+			font[i] ^= key[i%keyLen]
+		}
+	}
+	if flags&1 != 0 {
+		r, err := zlib.NewReader(bytes.NewReader(font))
+		if err != nil {
+			return nil, "", err
+		}
+		if font, err = io.ReadAll(r); err != nil {
+			return nil, "", err
+		}
+	}
+	switch {
+	case bytes.HasPrefix(font, []byte("\x00\x01\x00\x00")), bytes.HasPrefix(font, []byte("true")), bytes.HasPrefix(font, []byte("ttcf")):
+		return font, ".ttf", nil
+	case bytes.HasPrefix(font, []byte("OTTO")):
+		return font, ".otf", nil
+	}
+	return font, ".dat", nil
+}
+
+// SaveResult writes book structure into the requested directory.
+func (u *Unpacker) SaveResult(dir string) error {
+
+	write := func(name string, data []byte) error {
+		fname := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+			return err
+		}
+		return os.WriteFile(fname, data, 0644)
+	}
+
+	info, err := json.MarshalIndent(&u.info, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := write("book.json", append(info, '\n')); err != nil {
+		return err
+	}
+
+	for _, r := range u.info.Records {
+		name := fmt.Sprintf("%05d.dat", r.Index)
+		if len(r.Magic) > 0 {
+			name = fmt.Sprintf("%05d_%s.dat", r.Index, r.Magic)
+		}
+		if err := write(filepath.Join("records", name), u.data[r.Offset:r.Offset+r.Length]); err != nil {
+			return err
+		}
+	}
+
+	// resources are shared by both parts of combo mobi and end at KF8 boundary
+	if first := u.info.Parts[0].FirstResource; first > 0 {
+		last := len(u.info.Records)
+		if len(u.info.Parts) > 1 {
+			last = u.info.Parts[1].Record0
+		}
+		for i := first; i < last; i++ {
+			r, num := u.info.Records[i], i-first+1
+			data := u.data[r.Offset : r.Offset+r.Length]
+			var name string
+			switch r.Magic {
+			case "JPEG":
+				name = fmt.Sprintf("image%05d.jpg", num)
+			case "PNG":
+				name = fmt.Sprintf("image%05d.png", num)
+			case "GIF":
+				name = fmt.Sprintf("image%05d.gif", num)
+			case "FONT":
+				font, ext, err := unpackFont(data)
+				if err != nil {
+					u.log.Warn("Unable to unpack font, skipping", zap.Int("record", i), zap.Error(err))
+					continue
+				}
+				name, data = fmt.Sprintf("font%05d%s", num, ext), font
+			default:
+				continue
+			}
+			if err := write(filepath.Join("resources", name), data); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, p := range u.info.Parts {
+		text, err := u.text(p)
+		if err != nil {
+			u.log.Warn("Unable to extract text", zap.String("part", p.Format), zap.Error(err))
+			continue
+		}
+		if p.Format != "kf8" {
+			if err := write(filepath.Join(p.Format, "book.html"), text); err != nil {
+				return err
+			}
+			continue
+		}
+		parts, flows, err := u.kf8Parts(p, text)
+		if err != nil {
+			u.log.Warn("Unable to split KF8 text, saving it as is", zap.Error(err))
+			parts, flows = [][]byte{text}, nil
+		}
+		for i, part := range parts {
+			if err := write(filepath.Join(p.Format, "text", fmt.Sprintf("part%04d.html", i)), part); err != nil {
+				return err
+			}
+		}
+		for i := 1; i < len(flows); i++ {
+			ext := ".css"
+			if bytes.HasPrefix(flows[i], []byte("<?xml")) || bytes.HasPrefix(flows[i], []byte("<svg")) {
+				ext = ".svg"
+			}
+			if err := write(filepath.Join(p.Format, "flows", fmt.Sprintf("flow%04d%s", i, ext)), flows[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	u.log.Debug("Book unpacked", zap.String("file", u.fname), zap.String("dir", dir))
+	return nil
+}
@@ -0,0 +1,79 @@
+package mobi
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestIndexRoundTrip(t *testing.T) {
+
+	var entries []indexEntry
+	for i := 0; i < 3000; i++ {
+		entries = append(entries, indexEntry{
+			key: fmt.Sprintf("%010d", i*100),
+			tags: map[string][]int{
+				"cncx_offset":     {i * 7},
+				"file_number":     {i / 10},
+				"sequence_number": {i},
+				"geometry":        {i * 3, 100},
+			},
+		})
+	}
+	records := buildIndex(fragTags, entries, nil)
+	if len(records) < 3 {
+		t.Fatalf("expected index to span several records, got %d", len(records))
+	}
+
+	res, err := readIndex(buildPDB([]byte("test"), records), 0, fragTags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != len(entries) {
+		t.Fatalf("read %d entries, expected %d", len(res), len(entries))
+	}
+	for i, e := range res {
+		if e.key != entries[i].key {
+			t.Fatalf("entry %d: key %s, expected %s", i, e.key, entries[i].key)
+		}
+		for name, values := range entries[i].tags {
+			if !slices.Equal(e.tags[name], values) {
+				t.Fatalf("entry %d: tag %s = %v, expected %v", i, name, e.tags[name], values)
+			}
+		}
+	}
+}
+
+func TestDecoding(t *testing.T) {
+
+	for _, c := range []struct {
+		in  []byte
+		out int
+	}{
+		{[]byte{0x80}, 0},
+		{[]byte{0xFF}, 0x7F},
+		{[]byte{0x01, 0x80}, 0x80},
+		{[]byte{0x7F, 0xFF}, 0x3FFF},
+	} {
+		if res, n := decodeVarInt(c.in); res != c.out || n != len(c.in) {
+			t.Errorf("decodeVarInt(% x) = %d (%d bytes), expected %d", c.in, res, n, c.out)
+		}
+	}
+
+	if res, err := uncompressPalmDoc([]byte{'a', 'b', 'c', 0x80, 0x18, 0xC1, 2, 0x90, 0x91}); err != nil || !bytes.Equal(res, []byte("abcabc A\x90\x91")) {
+		t.Errorf("uncompressPalmDoc = %q (%v)", res, err)
+	}
+
+	for _, data := range [][]byte{
+		{3, 'a'},          // literal run past the end of record
+		{'a', 0x80},       // missing second byte of back reference
+		{'a', 0x80, 0x50}, // back reference before start of output
+		{0x80, 0x03},      // zero distance
+	} {
+		if _, err := uncompressPalmDoc(data); !errors.Is(err, errCorruptedPalmDoc) {
+			t.Errorf("uncompressPalmDoc(% x) = %v, expected corrupted record", data, err)
+		}
+	}
+}
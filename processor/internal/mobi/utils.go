@@ -39,14 +39,23 @@ const (
 	huffTableOffset   = 120
 
 	// exth records of interest
+	exthAuthor        = 100
+	exthPublisher     = 101
+	exthDescription   = 103
+	exthSubject       = 105
+	exthPubDate       = 106
 	exthASIN          = 113
 	exthStartReading  = 116
 	exthKF8Offset     = 121
+	exthResourceCount = 125
 	exthCoverOffset   = 201
 	exthThumbOffset   = 202
+	exthFakeCover     = 203
 	exthThumbnailURI  = 129
 	exthCDEType       = 501
+	exthUpdatedTitle  = 503
 	exthCDEContentKey = 504
+	exthLanguage      = 524
 )
 
 // NOTE: Since I decided to convert verbatim - this is old to_base() implementation originally
@@ -421,3 +430,40 @@ func SetJpegDPI(buf *bytes.Buffer, dpit JpegDPIType, xdensity, ydensity int16) (
 
 	return newbuf, true
 }
+
+// buildAPNX produces APNX page map file content.
+func buildAPNX(contentGUID string, asin, cdetype, acr []byte, combo bool, pageMap string, offsets []int) []byte {
+
+	var contentHeader string
+	if combo {
+		contentHeader = fmt.Sprintf(`{"contentGuid":"%s","asin":"%s","cdeType":"%s","fileRevisionId":"1"}`,
+			contentGUID,
+			string(asin),
+			string(cdetype),
+		)
+	} else {
+		contentHeader = fmt.Sprintf(`{"contentGuid":"%s","asin":"%s","cdeType":"%s","format":"MOBI_8","fileRevisionId":"1","acr":"%s"}`,
+			contentGUID,
+			string(asin),
+			string(cdetype),
+			string(acr),
+		)
+	}
+	pageHeader := fmt.Sprintf(`{"asin":"%s","pageMap":"%s"}`, string(asin), pageMap)
+
+	var apnx bytes.Buffer
+	binary.Write(&apnx, binary.BigEndian, uint16(1))
+	binary.Write(&apnx, binary.BigEndian, uint16(1))
+	binary.Write(&apnx, binary.BigEndian, uint32(12+len(contentHeader)))
+	binary.Write(&apnx, binary.BigEndian, uint32(len(contentHeader)))
+	apnx.WriteString(contentHeader)
+	binary.Write(&apnx, binary.BigEndian, uint16(1))
+	binary.Write(&apnx, binary.BigEndian, uint16(len(pageHeader)))
+	binary.Write(&apnx, binary.BigEndian, uint16(len(offsets)))
+	binary.Write(&apnx, binary.BigEndian, uint16(32))
+	apnx.WriteString(pageHeader)
+	for _, ofs := range offsets {
+		binary.Write(&apnx, binary.BigEndian, uint32(ofs))
+	}
+	return apnx.Bytes()
+}
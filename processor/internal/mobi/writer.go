@@ -0,0 +1,446 @@
+package mobi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// Record 0 layout and indexes are following calibre KF8 writer (calibre.ebooks.mobi.writer8.mobi), which in turn
+// mimics kindlegen 2.x output for standalone azw3 books.
+
+const (
+	nullIndex = 0xFFFFFFFF
+
+	compressionNone    = 1
+	compressionPalmDoc = 2
+
+	mobiHeaderSize = 264
+	exthFlags      = 0x50
+	exthFlagFonts  = 0x1000
+)
+
+var (
+	recordFLIS = []byte("FLIS\x00\x00\x00\x08\x00\x41\x00\x00\x00\x00\x00\x00\xff\xff\xff\xff\x00\x01\x00\x03\x00\x00\x00\x03\x00\x00\x00\x01\xff\xff\xff\xff")
+	recordEOF  = []byte{0xe9, 0x8e, 0x0d, 0x0a}
+)
+
+// Writer - produces KF8 (azw3) book directly from OPF tree, without kindlegen.
+type Writer struct {
+	log *zap.Logger
+	//
+	contentGUID string
+	acr         []byte
+	cdetype     []byte
+	cdekey      []byte
+	pagedata    []byte
+	result      []byte
+}
+
+// NewWriter returns pointer to Writer with KF8 book built out of OPF file and content it refers to. Book files are read
+// from fsys, opf is slash separated path in it.
+func NewWriter(fsys fs.FS, opf string, u uuid.UUID, asin string, compress, nonPersonal, forceASIN bool, log *zap.Logger) (*Writer, error) {
+
+	pkg, err := readPackage(fsys, opf)
+	if err != nil {
+		return nil, err
+	}
+
+	b := newKF8Builder(pkg, log)
+	if err := b.build(); err != nil {
+		return nil, err
+	}
+
+	w := &Writer{
+		log:         log,
+		contentGUID: strings.Replace(u.String(), "-", "", -1)[:8],
+		acr:         pdbName(pkg.title),
+	}
+	if len(asin) == 0 {
+		w.cdekey = convertToRadix32(strings.Replace(u.String(), "-", "", -1), 10)
+	} else {
+		w.cdekey = []byte(asin)
+	}
+	if nonPersonal {
+		w.cdetype = []byte("EBOK")
+	} else {
+		w.cdetype = []byte("PDOC")
+	}
+
+	// cover and thumbnail
+	coverOffset, thumbOffset := -1, -1
+	if pkg.cover != nil {
+		if idx, ok := b.resIndex[pkg.cover.href]; ok {
+			coverOffset = idx - 1
+			if thumb := w.makeThumbnail(b.resources[coverOffset].data); len(thumb) > 0 {
+				b.resources = append(b.resources, kf8Resource{mediaType: "image/jpeg", data: thumb})
+				thumbOffset = len(b.resources) - 1
+			}
+		}
+	}
+
+	records := [][]byte{nil}
+
+	// text
+	textRecords, overlaps := splitTextRecords(b.text)
+	size := 0
+	for i, rec := range textRecords {
+		if compress {
+			rec = compressPalmDoc(rec)
+		} else {
+			rec = bytes.Clone(rec)
+		}
+		// multibyte trailing entry
+		rec = append(rec, overlaps[i]...)
+		rec = append(rec, byte(len(overlaps[i])))
+		records = append(records, rec)
+		size += len(rec)
+	}
+	lastText := len(records) - 1
+	if size%4 != 0 {
+		// kindlegen pads text so next record starts at 4 bytes boundary
+		records = append(records, make([]byte, size%4))
+	}
+	firstNonText := len(records)
+
+	// indexes
+	fragIndex := len(records)
+	records = append(records, b.fragIndex()...)
+	skelIndex := len(records)
+	records = append(records, b.skelIndex()...)
+
+	guideIndex := nullIndex
+	guide, start := b.guideIndex()
+	if len(guide) > 0 {
+		guideIndex = len(records)
+		records = append(records, guide...)
+	}
+	ncxIndex := nullIndex
+	if ncx := b.ncxIndex(); len(ncx) > 0 {
+		ncxIndex = len(records)
+		records = append(records, ncx...)
+	} else {
+		log.Warn("Book has no TOC, KF8 will have no NCX index")
+	}
+
+	// resources
+	firstResource := nullIndex
+	if len(b.resources) > 0 {
+		firstResource = len(records)
+		for _, r := range b.resources {
+			records = append(records, r.data)
+		}
+	}
+
+	fdstRecord := len(records)
+	records = append(records, b.fdst())
+	flisRecord := len(records)
+	records = append(records, recordFLIS)
+	fcisRecord := len(records)
+	records = append(records, recordFCIS(len(b.text)))
+	records = append(records, recordEOF)
+
+	// EXTH
+	exth := newExthBuilder()
+	for _, a := range pkg.authors {
+		exth.add(exthAuthor, []byte(a))
+	}
+	if len(pkg.publisher) > 0 {
+		exth.add(exthPublisher, []byte(pkg.publisher))
+	}
+	if len(pkg.description) > 0 {
+		exth.add(exthDescription, []byte(pkg.description))
+	}
+	for _, s := range pkg.subjects {
+		exth.add(exthSubject, []byte(s))
+	}
+	if len(pkg.date) > 0 {
+		exth.add(exthPubDate, []byte(pkg.date))
+	}
+	if forceASIN {
+		exth.add(exthASIN, w.cdekey)
+	}
+	if start >= 0 {
+		exth.addInt(exthStartReading, start)
+	}
+	exth.addInt(exthResourceCount, len(b.resources))
+	if coverOffset >= 0 {
+		exth.addInt(exthCoverOffset, coverOffset)
+		exth.addInt(exthFakeCover, 0)
+	}
+	if thumbOffset >= 0 {
+		exth.addInt(exthThumbOffset, thumbOffset)
+		exth.add(exthThumbnailURI, []byte("kindle:embed:"+toBase32(thumbOffset, 4)))
+	}
+	exth.add(exthCDEType, w.cdetype)
+	exth.add(exthUpdatedTitle, []byte(pkg.title))
+	exth.add(exthCDEContentKey, w.cdekey)
+	if len(pkg.lang) > 0 {
+		exth.add(exthLanguage, []byte(pkg.lang))
+	}
+
+	flags := exthFlags
+	if b.hasFonts {
+		flags |= exthFlagFonts
+	}
+	compression := compressionNone
+	if compress {
+		compression = compressionPalmDoc
+	}
+
+	var rec0 bytes.Buffer
+	put16 := func(v int) { binary.Write(&rec0, binary.BigEndian, uint16(v)) }
+	put32 := func(v int) { binary.Write(&rec0, binary.BigEndian, uint32(v)) }
+	fill := func(b byte, n int) { rec0.Write(bytes.Repeat([]byte{b}, n)) }
+
+	// PalmDOC header
+	put16(compression)
+	put16(0)
+	put32(len(b.text))
+	put16(lastText)
+	put16(textRecordSize)
+	put16(0) // encryption
+	put16(0)
+	// MOBI header
+	rec0.WriteString("MOBI")
+	put32(mobiHeaderSize)
+	put32(2) // book
+	put32(65001)
+	put32(int(rand.Uint32()))
+	put32(8) // file version
+	fill(0xFF, 40)
+	put32(firstNonText)
+	put32(0) // title offset, set later
+	put32(len(pkg.title))
+	put32(langCode(pkg.lang))
+	put32(0)
+	put32(0)
+	put32(8) // min version
+	put32(firstResource)
+	fill(0, 16) // huffman
+	put32(flags)
+	fill(0, 32)
+	put32(nullIndex)
+	put32(nullIndex) // DRM
+	fill(0, 12)
+	fill(0, 8)
+	put32(fdstRecord)
+	put32(len(b.flows))
+	put32(fcisRecord)
+	put32(1)
+	put32(flisRecord)
+	put32(1)
+	fill(0, 8)
+	put32(nullIndex) // SRCS
+	put32(0)
+	fill(0xFF, 8)
+	put32(1) // extra data flags: multibyte trailing entries
+	put32(ncxIndex)
+	put32(fragIndex)
+	put32(skelIndex)
+	put32(nullIndex) // DATP
+	put32(guideIndex)
+	fill(0xFF, 4)
+	fill(0, 4)
+	fill(0xFF, 4)
+	fill(0, 4)
+	rec0.Write(exth.bytes())
+	title := rec0.Len()
+	rec0.WriteString(pkg.title)
+	rec0.Write(make([]byte, 4-rec0.Len()%4))
+	// some space for Amazon's service to add its data
+	rec0.Write(make([]byte, 8192))
+
+	records[0] = rec0.Bytes()
+	putInt32(records[0], titleOffset, title)
+
+	w.result = buildPDB(w.acr, records)
+	if offsets := b.pageOffsets(); len(offsets) > 0 {
+		w.pagedata = buildAPNX(w.contentGUID, w.cdekey, w.cdetype, w.acr, false, "(1,a,1)", offsets)
+	}
+	return w, nil
+}
+
+// SaveResult saves azw3 to the requested location.
+func (w *Writer) SaveResult(fname string) error {
+	if len(w.result) == 0 {
+		return errors.New("nothing to save")
+	}
+	return os.WriteFile(fname, w.result, 0644)
+}
+
+// WriteResult writes azw3 to out.
+func (w *Writer) WriteResult(out io.Writer) error {
+	if len(w.result) == 0 {
+		return errors.New("nothing to save")
+	}
+	_, err := out.Write(w.result)
+	return err
+}
+
+// SavePageMap saves page map to the requested location.
+func (w *Writer) SavePageMap(fname string, eink bool) error {
+
+	if len(w.pagedata) == 0 {
+		w.log.Debug("Page map does not exist, ignoring")
+		return nil
+	}
+
+	dir := filepath.Dir(fname)
+	base := strings.TrimSuffix(filepath.Base(fname), filepath.Ext(fname))
+
+	if eink {
+		dir = filepath.Join(dir, base+".sdr")
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return fmt.Errorf("unable to create pagemap directory: %w", err)
+		}
+	}
+	base += ".apnx"
+	return os.WriteFile(filepath.Join(dir, base), w.pagedata, 0644)
+}
+
+// makeThumbnail produces properly sized thumbnail out of cover image.
+func (w *Writer) makeThumbnail(cover []byte) []byte {
+
+	img, _, err := image.Decode(bytes.NewReader(cover))
+	if err != nil {
+		w.log.Warn("Unable to decode cover image, no thumbnail will be produced", zap.Error(err))
+		return nil
+	}
+	thumb := imaging.Thumbnail(img, 330, 470, imaging.Lanczos)
+	if thumb == nil {
+		return nil
+	}
+	var buf = new(bytes.Buffer)
+	if err := imaging.Encode(buf, thumb, imaging.JPEG, imaging.JPEGQuality(75)); err != nil {
+		w.log.Error("Unable to encode thumbnail, skipping", zap.Error(err))
+		return nil
+	}
+	var jfifAdded bool
+	buf, jfifAdded = SetJpegDPI(buf, DpiPxPerInch, 300, 300)
+	if jfifAdded {
+		w.log.Debug("Inserting JFIF APP0 marker segment into azw3 thumbnail")
+	}
+	return buf.Bytes()
+}
+
+// exthBuilder accumulates EXTH records.
+type exthBuilder struct {
+	buf   bytes.Buffer
+	count int
+}
+
+func newExthBuilder() *exthBuilder {
+	return &exthBuilder{}
+}
+
+func (e *exthBuilder) add(id int, data []byte) {
+	binary.Write(&e.buf, binary.BigEndian, uint32(id))
+	binary.Write(&e.buf, binary.BigEndian, uint32(len(data)+8))
+	e.buf.Write(data)
+	e.count++
+}
+
+func (e *exthBuilder) addInt(id, val int) {
+	e.add(id, putInt32(nil, 0, val))
+}
+
+func (e *exthBuilder) bytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("EXTH")
+	binary.Write(&buf, binary.BigEndian, uint32(e.buf.Len()+12))
+	binary.Write(&buf, binary.BigEndian, uint32(e.count))
+	buf.Write(e.buf.Bytes())
+	// always pad with at least one byte
+	buf.Write(make([]byte, 4-e.buf.Len()%4))
+	return buf.Bytes()
+}
+
+// recordFCIS produces FCIS record for the text of given length.
+func recordFCIS(length int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("FCIS\x00\x00\x00\x14\x00\x00\x00\x10\x00\x00\x00\x02\x00\x00\x00\x00")
+	binary.Write(&buf, binary.BigEndian, uint32(length))
+	buf.WriteString("\x00\x00\x00\x00\x00\x00\x00\x28\x00\x00\x00\x00\x00\x00\x00\x28\x00\x00\x00\x08\x00\x01\x00\x01\x00\x00\x00\x00")
+	return buf.Bytes()
+}
+
+// buildPDB puts records into Palm database.
+func buildPDB(name []byte, records [][]byte) []byte {
+
+	var buf bytes.Buffer
+
+	n := len(records)
+	now := uint32(time.Now().Unix())
+
+	title := make([]byte, 32)
+	copy(title, name)
+	buf.Write(title)
+	binary.Write(&buf, binary.BigEndian, uint16(0)) // attributes
+	binary.Write(&buf, binary.BigEndian, uint16(0)) // version
+	binary.Write(&buf, binary.BigEndian, now)       // created
+	binary.Write(&buf, binary.BigEndian, now)       // modified
+	buf.Write(make([]byte, 12))                     // backup, modnum, app info
+	binary.Write(&buf, binary.BigEndian, uint32(0)) // sort info
+	buf.WriteString("BOOKMOBI")
+	binary.Write(&buf, binary.BigEndian, uint32(2*n-1))
+	binary.Write(&buf, binary.BigEndian, uint32(0))
+	binary.Write(&buf, binary.BigEndian, uint16(n))
+
+	ofs := firstPdbRecord + 8*n + 2
+	for i, r := range records {
+		binary.Write(&buf, binary.BigEndian, uint32(ofs))
+		binary.Write(&buf, binary.BigEndian, uint32(2*i))
+		ofs += len(r)
+	}
+	buf.Write([]byte{0, 0})
+	for _, r := range records {
+		buf.Write(r)
+	}
+	return buf.Bytes()
+}
+
+// pdbName produces database name out of book title.
+func pdbName(title string) []byte {
+	const alphabet = `-ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789`
+	name := make([]byte, 0, 31)
+	for _, sym := range title {
+		if len(name) == cap(name) {
+			break
+		}
+		if strings.ContainsRune(alphabet, sym) {
+			name = append(name, byte(sym))
+		} else {
+			name = append(name, '_')
+		}
+	}
+	return name
+}
+
+// langCode returns MOBI language code (windows LCID primary language) for IANA language tag.
+func langCode(lang string) int {
+	primary, _, _ := strings.Cut(strings.ToLower(lang), "-")
+	codes := map[string]int{
+		"ar": 0x01, "bg": 0x02, "ca": 0x03, "zh": 0x04, "cs": 0x05, "da": 0x06, "de": 0x07, "el": 0x08,
+		"en": 0x09, "es": 0x0a, "fi": 0x0b, "fr": 0x0c, "he": 0x0d, "hu": 0x0e, "is": 0x0f, "it": 0x10,
+		"ja": 0x11, "ko": 0x12, "nl": 0x13, "nb": 0x14, "no": 0x14, "pl": 0x15, "pt": 0x16, "ro": 0x18,
+		"ru": 0x19, "hr": 0x1a, "sr": 0x1a, "sk": 0x1b, "sq": 0x1c, "sv": 0x1d, "th": 0x1e, "tr": 0x1f,
+		"ur": 0x20, "id": 0x21, "uk": 0x22, "be": 0x23, "sl": 0x24, "et": 0x25, "lv": 0x26, "lt": 0x27,
+		"fa": 0x29, "vi": 0x2a, "hy": 0x2b, "az": 0x2c, "eu": 0x2d, "mk": 0x2f, "ka": 0x37, "hi": 0x39,
+		"kk": 0x3f, "uz": 0x43,
+	}
+	return codes[primary]
+}
@@ -0,0 +1,107 @@
+package mobi
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+const testOPF = `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="2.0" unique-identifier="BookId">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:title>Round Trip</dc:title>
+    <dc:language>en</dc:language>
+    <dc:creator>Some Author</dc:creator>
+  </metadata>
+  <manifest>
+    <item id="ncx" href="toc.ncx" media-type="application/x-dtbncx+xml"/>
+    <item id="ch1" href="ch1.xhtml" media-type="application/xhtml+xml"/>
+    <item id="ch2" href="ch2.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine toc="ncx">
+    <itemref idref="ch1"/>
+    <itemref idref="ch2"/>
+  </spine>
+</package>`
+
+const testNCX = `<?xml version="1.0" encoding="UTF-8"?>
+<ncx xmlns="http://www.daisy.org/z3986/2005/ncx/" version="2005-1">
+  <navMap>
+    <navPoint id="p1" playOrder="1"><navLabel><text>One</text></navLabel><content src="ch1.xhtml"/></navPoint>
+    <navPoint id="p2" playOrder="2"><navLabel><text>Two</text></navLabel><content src="ch2.xhtml#second"/></navPoint>
+  </navMap>
+</ncx>`
+
+func testChapter(title string, paragraphs int) string {
+	var body strings.Builder
+	for i := 0; i < paragraphs; i++ {
+		fmt.Fprintf(&body, "<p>%s paragraph %d: Съешь же ещё этих мягких французских булок.</p>\n", title, i)
+	}
+	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml"><head><title>%s</title></head>
+<body><h1 id="second">%s</h1>
+%s</body></html>`, title, title, body.String())
+}
+
+func TestWriterRoundTrip(t *testing.T) {
+
+	fsys := fstest.MapFS{
+		"OEBPS/content.opf": {Data: []byte(testOPF)},
+		"OEBPS/toc.ncx":     {Data: []byte(testNCX)},
+		"OEBPS/ch1.xhtml":   {Data: []byte(testChapter("First", 200))},
+		"OEBPS/ch2.xhtml":   {Data: []byte(testChapter("Second", 10))},
+	}
+
+	for _, compress := range []bool{false, true} {
+		w, err := NewWriter(fsys, "OEBPS/content.opf", uuid.New(), "", compress, false, false, zap.NewNop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fname := filepath.Join(t.TempDir(), "book.azw3")
+		if err := w.SaveResult(fname); err != nil {
+			t.Fatal(err)
+		}
+
+		u, err := NewUnpacker(fname, zap.NewNop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := getUInt16(w.result, numberOfPdbRecords); len(u.info.Records) != n || n < 2 {
+			t.Fatalf("compress %t: read %d records, expected %d", compress, len(u.info.Records), n)
+		}
+		if last := u.info.Records[len(u.info.Records)-1]; !bytes.Equal(w.result[last.Offset:last.Offset+last.Length], recordEOF) {
+			t.Errorf("compress %t: last record is not EOF", compress)
+		}
+		if len(u.info.Parts) != 1 || u.info.Parts[0].Format != "kf8" {
+			t.Fatalf("compress %t: single KF8 part expected", compress)
+		}
+
+		p := u.info.Parts[0]
+		text, err := u.text(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(text) != p.TextLength || p.TextRecords != (len(text)+textRecordSize-1)/textRecordSize {
+			t.Errorf("compress %t: text of %d bytes in %d records, header says %d bytes", compress, len(text), p.TextRecords, p.TextLength)
+		}
+
+		parts, _, err := u.kf8Parts(p, text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(parts) != 2 {
+			t.Fatalf("compress %t: %d parts, expected 2", compress, len(parts))
+		}
+		for i, s := range []string{"First paragraph 199: Съешь же ещё", "Second paragraph 9: Съешь же ещё"} {
+			if !bytes.Contains(parts[i], []byte(s)) {
+				t.Errorf("compress %t: part %d does not contain %q", compress, i, s)
+			}
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+
+	"fb2converter/etree"
+)
+
+// merger keeps identifiers already used in the merged book.
+type merger struct {
+	used     map[string]bool
+	binaries map[string]string // binary content to its id
+	notes    int
+}
+
+// unique returns identifier not used in the merged book yet.
+func (m *merger) unique(id string, book int) string {
+	res := id
+	for i := 1; m.used[res]; i++ {
+		res = fmt.Sprintf("%s_%d", id, book)
+		if i > 1 {
+			res = fmt.Sprintf("%s_%d_%d", id, book, i)
+		}
+	}
+	m.used[res] = true
+	return res
+}
+
+// note returns next note identifier.
+func (m *merger) note() string {
+	for {
+		m.notes++
+		if id := fmt.Sprintf("n%d", m.notes); !m.used[id] {
+			m.used[id] = true
+			return id
+		}
+	}
+}
+
+// renameRefs replaces identifiers and local links of the element and its children and makes xlink attributes use the
+// merged book namespace prefix.
+func renameRefs(e *etree.Element, ids map[string]string, from, to string) {
+	for i, a := range e.Attr {
+		switch {
+		case a.Key == "id" && len(a.Space) == 0:
+			if id, ok := ids[a.Value]; ok {
+				e.Attr[i].Value = id
+			}
+		case a.Key == "href" && strings.HasPrefix(a.Value, "#"):
+			if id, ok := ids[a.Value[1:]]; ok {
+				e.Attr[i].Value = "#" + id
+			}
+		}
+		if len(from) > 0 && a.Space == from {
+			e.Attr[i].Space = to
+		}
+	}
+	for _, c := range e.ChildElements() {
+		renameRefs(c, ids, from, to)
+	}
+}
+
+// sameText checks if element with the same text is already among elements.
+func sameText(list []*etree.Element, e *etree.Element) bool {
+	key := func(e *etree.Element) string {
+		var b strings.Builder
+		collectText(e, &b)
+		return strings.ToLower(strings.Join(strings.Fields(b.String()), " "))
+	}
+	for _, l := range list {
+		if key(l) == key(e) {
+			return true
+		}
+	}
+	return false
+}
+
+// bookSection turns main body of the book into a section with book title. Body consisting of the single section is used
+// as is, book cover opens the section unless it has an image already.
+func bookSection(book *FB2Document, body, cover *etree.Element) *etree.Element {
+
+	section := etree.NewElement("section")
+	if list := body.ChildElements(); len(list) == 1 && list[0].Tag == "section" {
+		section = list[0]
+	} else {
+		for _, e := range body.SelectElements("epigraph") {
+			section.AddChild(e)
+		}
+		if e := body.SelectElement("image"); e != nil {
+			section.AddChild(e)
+		}
+		for _, e := range body.SelectElements("section") {
+			section.AddChild(e)
+		}
+	}
+	section.TailData = "\n"
+
+	// title, epigraphs and image have to go first in this order
+	next := func(skip ...string) etree.Token {
+		for _, e := range section.ChildElements() {
+			if !IsOneOf(e.Tag, skip) {
+				return e
+			}
+		}
+		return nil
+	}
+	if section.SelectElement("title") == nil {
+		title := etree.NewElement("title")
+		title.AddNext("p").SetText(book.Title)
+		section.InsertChild(next(), title)
+	}
+	if section.SelectElement("image") == nil && cover != nil {
+		section.InsertChild(next("title", "epigraph"), cover.Copy())
+	}
+	return section
+}
+
+// MergeFB2Documents concatenates books into one. Every book becomes top level section of the main body titled after the
+// book (so merged book has combined TOC), notes go to the notes body of the same name and are renumbered,
+// binaries with the same content are stored once. Description is taken from the first book with authors and genres of
+// all books added, title replaced and sequence and annotation dropped.
+func MergeFB2Documents(books []*FB2Document, title string) (*FB2Document, error) {
+
+	if len(books) < 2 {
+		return nil, errors.New("at least two books are required to merge")
+	}
+
+	res := &FB2Document{Title: title, doc: books[0].doc.Copy(), env: books[0].env}
+	root := res.doc.FindElement("./FictionBook")
+	if root == nil {
+		return nil, errors.New("unable to find FictionBook element")
+	}
+	xlink := xlinkPrefix(root)
+	if len(xlink) == 0 {
+		xlink = "l"
+		root.CreateAttr("xmlns:"+xlink, xlinkNS)
+	}
+	// all content is added back book by book
+	for _, e := range root.ChildElements() {
+		if e.Tag == "body" || e.Tag == "binary" {
+			root.RemoveChild(e)
+		}
+	}
+
+	m := &merger{used: make(map[string]bool), binaries: make(map[string]string)}
+
+	main := etree.NewElement("body")
+	main.TailData = "\n"
+	var (
+		bodies   []*etree.Element
+		notes    = make(map[string]*etree.Element)
+		binaries []*etree.Element
+		authors  []*etree.Element
+		genres   []*etree.Element
+		added    []*etree.Element
+		ids      []string
+	)
+
+	for n, book := range books {
+
+		doc := book.doc.Copy()
+		broot := doc.FindElement("./FictionBook")
+		if broot == nil {
+			return nil, fmt.Errorf("book %d: unable to find FictionBook element", n+1)
+		}
+		ids = append(ids, book.id.String())
+
+		renames := make(map[string]string)
+		for _, b := range broot.SelectElements("binary") {
+			id := getAttrValue(b, "id")
+			key := getAttrValue(b, "content-type") + ":" + strings.Join(strings.Fields(b.Text()), "")
+			if prev, ok := m.binaries[key]; ok {
+				renames[id] = prev
+				continue
+			}
+			renames[id] = m.unique(id, n+1)
+			m.binaries[key] = renames[id]
+			b.TailData = "\n"
+			binaries = append(binaries, b)
+		}
+		for i, body := range broot.SelectElements("body") {
+			if book.isNotesBody(i, body) {
+				for _, s := range body.FindElements(".//section[@id]") {
+					renames[getAttrValue(s, "id")] = m.note()
+				}
+				continue
+			}
+			for _, e := range body.FindElements(".//*[@id]") {
+				renames[getAttrValue(e, "id")] = m.unique(getAttrValue(e, "id"), n+1)
+			}
+		}
+		renameRefs(broot, renames, xlinkPrefix(broot), xlink)
+		if n == 0 {
+			// first book description is the one being kept
+			if desc := root.SelectElement("description"); desc != nil {
+				renameRefs(desc, renames, "", xlink)
+			}
+		}
+
+		var section *etree.Element
+		for i, body := range broot.SelectElements("body") {
+			switch {
+			case i == 0:
+				section = bookSection(book, body, broot.FindElement("./description/title-info/coverpage/image"))
+			case book.isNotesBody(i, body):
+				name := getAttrValue(body, "name")
+				target, ok := notes[name]
+				if !ok {
+					notes[name] = body
+					body.TailData = "\n"
+					bodies = append(bodies, body)
+					continue
+				}
+				for _, e := range body.ChildElements() {
+					if e.Tag != "title" {
+						target.AddChild(e)
+					}
+				}
+			default:
+				body.TailData = "\n"
+				bodies = append(bodies, body)
+			}
+		}
+		main.AddChild(section)
+
+		if info := broot.FindElement("./description/title-info"); info != nil {
+			for _, e := range info.ChildElements() {
+				switch {
+				case e.Tag == "author" && !sameText(authors, e):
+					authors = append(authors, e)
+				case e.Tag == "genre" && !sameText(genres, e):
+					genres = append(genres, e)
+				default:
+					continue
+				}
+				if n > 0 {
+					added = append(added, e)
+				}
+			}
+		}
+	}
+
+	for _, e := range append(append([]*etree.Element{main}, bodies...), binaries...) {
+		root.AddChild(e)
+	}
+
+	if info := root.FindElement("./description/title-info"); info != nil {
+		for _, a := range added {
+			e := insertFB2Element(info, a.Tag, fb2TitleInfoOrder)
+			e.Attr = a.Attr
+			for _, c := range append([]etree.Token{}, a.Child...) {
+				e.AddChild(c)
+			}
+		}
+		selectFB2Element(info, "book-title", fb2TitleInfoOrder).SetText(title)
+		removeFB2Elements(info, "annotation")
+		removeFB2Elements(info, "sequence")
+	}
+	res.id = uuid.NewSHA1(books[0].id, []byte(strings.Join(ids, ",")))
+	if info := root.FindElement("./description/document-info"); info != nil {
+		selectFB2Element(info, "id", fb2DocumentInfoOrder).SetText(res.id.String())
+	}
+	return res, nil
+}
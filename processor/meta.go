@@ -0,0 +1,407 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"mime"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/unicode"
+
+	"fb2converter/config"
+	"fb2converter/etree"
+	"fb2converter/state"
+)
+
+// Editing FB2 description in place: only <description> element (and cover <binary> if it is replaced) is parsed and
+// serialized back, the rest of the document is kept byte-for-byte.
+
+var (
+	reXMLEncoding = regexp.MustCompile(`^<\?xml[^>]*encoding\s*=\s*["']([^"']+)["']`)
+	reXMLID       = regexp.MustCompile(`\sid\s*=\s*["']([^"']*)["']`)
+	reXLinkNS     = regexp.MustCompile(`xmlns:([\w.-]+)\s*=\s*["']http://www.w3.org/1999/xlink["']`)
+)
+
+// fb2Source keeps original document split into parts which are going to be edited.
+type fb2Source struct {
+	data  []byte            // document content, converted to UTF-8 for UTF-16 documents
+	utf16 encoding.Encoding // set when document has to be converted back to UTF-16
+	enc   encoding.Encoding // encoding used for edited parts
+	label string
+	// root start tag and its name
+	root     []byte
+	rootName string
+	rootEnd  int
+	// description element position
+	descStart, descEnd int
+}
+
+// xmlElement finds element with the name (ignoring namespace prefix) starting at position from. Comments, CDATA
+// sections and processing instructions are skipped. It returns element start and end positions.
+func xmlElement(data []byte, name string, from int) (int, int, bool) {
+
+	start := -1
+	depth := 0
+	for i := from; i < len(data); i++ {
+		if data[i] != '<' {
+			continue
+		}
+		rest := data[i:]
+		switch {
+		case bytes.HasPrefix(rest, []byte("<!--")):
+			if j := bytes.Index(rest, []byte("-->")); j >= 0 {
+				i += j + 2
+				continue
+			}
+			return 0, 0, false
+		case bytes.HasPrefix(rest, []byte("<![CDATA[")):
+			if j := bytes.Index(rest, []byte("]]>")); j >= 0 {
+				i += j + 2
+				continue
+			}
+			return 0, 0, false
+		case bytes.HasPrefix(rest, []byte("<?")), bytes.HasPrefix(rest, []byte("<!")):
+			if j := bytes.IndexByte(rest, '>'); j >= 0 {
+				i += j
+				continue
+			}
+			return 0, 0, false
+		}
+
+		closing := len(rest) > 1 && rest[1] == '/'
+		tag := rest[1:]
+		if closing {
+			tag = rest[2:]
+		}
+		n := bytes.IndexAny(tag, " \t\r\n/>")
+		if n < 0 {
+			return 0, 0, false
+		}
+		tagName := string(tag[:n])
+		if k := strings.IndexByte(tagName, ':'); k >= 0 {
+			tagName = tagName[k+1:]
+		}
+		end := tagEnd(rest)
+		if end < 0 {
+			return 0, 0, false
+		}
+		if tagName != name {
+			i += end - 1
+			continue
+		}
+		switch {
+		case closing:
+			if start >= 0 {
+				if depth--; depth == 0 {
+					return start, i + end, true
+				}
+			}
+		case rest[end-2] == '/':
+			if start < 0 {
+				return i, i + end, true
+			}
+		default:
+			if start < 0 {
+				start = i
+			}
+			depth++
+		}
+		i += end - 1
+	}
+	return 0, 0, false
+}
+
+// tagEnd returns length of the tag at the beginning of data, taking quoted attribute values into account.
+func tagEnd(data []byte) int {
+	var quote byte
+	for i, c := range data {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '>':
+			return i + 1
+		}
+	}
+	return -1
+}
+
+func newFB2Source(data []byte) (*fb2Source, error) {
+
+	s := &fb2Source{data: data, enc: unicode.UTF8, label: "utf-8"}
+
+	switch {
+	case bytes.HasPrefix(data, []byte{0x00, 0x00, 0xFE, 0xFF}), bytes.HasPrefix(data, []byte{0xFF, 0xFE, 0x00, 0x00}):
+		return nil, errors.New("UTF-32 documents could not be edited")
+	case bytes.HasPrefix(data, []byte{0xFE, 0xFF}):
+		s.utf16 = unicode.UTF16(unicode.BigEndian, unicode.UseBOM)
+	case bytes.HasPrefix(data, []byte{0xFF, 0xFE}):
+		s.utf16 = unicode.UTF16(unicode.LittleEndian, unicode.UseBOM)
+	}
+	if s.utf16 != nil {
+		text, err := s.utf16.NewDecoder().Bytes(data)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode UTF-16 document: %w", err)
+		}
+		s.data = text
+	}
+
+	body := bytes.TrimPrefix(s.data, []byte{0xEF, 0xBB, 0xBF})
+	if m := reXMLEncoding.FindSubmatch(body); m != nil && s.utf16 == nil {
+		enc, name := charset.Lookup(string(m[1]))
+		if enc == nil {
+			return nil, fmt.Errorf("unsupported document encoding %s", m[1])
+		}
+		s.enc, s.label = enc, name
+	}
+
+	start, end, ok := xmlElement(s.data, "FictionBook", 0)
+	if !ok {
+		return nil, errors.New("unable to find FictionBook element")
+	}
+	s.rootEnd = start + tagEnd(s.data[start:])
+	s.root = s.data[start:s.rootEnd]
+	s.rootName = string(s.root[1:bytes.IndexAny(s.root, " \t\r\n/>")])
+	if s.rootEnd == end {
+		return nil, errors.New("document is empty")
+	}
+
+	if s.descStart, s.descEnd, ok = xmlElement(s.data, "description", s.rootEnd); !ok {
+		return nil, errors.New("unable to find description element")
+	}
+	return s, nil
+}
+
+// document returns parsable document made of the root element and description.
+func (s *fb2Source) document() (*etree.Document, error) {
+
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="` + s.label + `"?>`)
+	buf.Write(s.root)
+	buf.Write(s.data[s.descStart:s.descEnd])
+	buf.WriteString("</" + s.rootName + ">")
+
+	doc := etree.NewDocument()
+	doc.WriteSettings = etree.WriteSettings{CanonicalText: true, CanonicalAttrVal: true}
+
+	var err error
+	if doc.ReadSettings, err = fb2ReadSettings(true); err != nil {
+		return nil, err
+	}
+	if _, err := doc.ReadFrom(&buf); err != nil {
+		return nil, fmt.Errorf("unable to parse description: %w", err)
+	}
+	return doc, nil
+}
+
+// encode serializes element in the document encoding, characters which could not be represented are written as
+// character references.
+func (s *fb2Source) encode(e *etree.Element) ([]byte, error) {
+
+	e.SetTail("")
+	doc := etree.NewDocument()
+	doc.WriteSettings = etree.WriteSettings{CanonicalText: true, CanonicalAttrVal: true}
+	doc.SetRoot(e)
+
+	data, err := doc.WriteToBytes()
+	if err != nil {
+		return nil, err
+	}
+	if s.utf16 != nil {
+		return data, nil
+	}
+	return encoding.HTMLEscapeUnsupported(s.enc.NewEncoder()).Bytes(data)
+}
+
+// processor returns processor prepared for description processing.
+func (s *fb2Source) processor(meta *config.MetaInfo, env *state.LocalEnv) (*Processor, error) {
+
+	u, err := uuid.NewRandom()
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate UUID: %w", err)
+	}
+	doc, err := s.document()
+	if err != nil {
+		return nil, err
+	}
+	p := &Processor{
+		kind:          InFb2,
+		format:        OFb2,
+		infoOnly:      true,
+		doc:           doc,
+		Book:          NewBook(u, ""),
+		env:           env,
+		metaOverwrite: meta,
+	}
+	if err := p.processDescription(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// GetMeta reads description of FB2 document.
+func GetMeta(data []byte, env *state.LocalEnv) (*config.MetaInfo, error) {
+
+	s, err := newFB2Source(data)
+	if err != nil {
+		return nil, err
+	}
+	p, err := s.processor(nil, env)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &config.MetaInfo{
+		Title:      p.Book.Title,
+		Genres:     p.Book.Genres,
+		Authors:    p.Book.Authors,
+		SeqName:    p.Book.SeqName,
+		SeqNum:     p.Book.SeqNum,
+		Date:       p.Book.Date,
+		Annotation: p.Book.Annotation,
+	}
+	// only proper UUIDs could be passed back, other identifiers are never changed
+	if e := p.doc.FindElement("./FictionBook/description/document-info/id"); e != nil {
+		if id, err := uuid.Parse(strings.TrimSpace(e.Text())); err == nil {
+			meta.ID = id.String()
+		}
+	}
+	if l := p.doc.FindElement("./FictionBook/description/title-info/lang"); l != nil {
+		meta.Lang = p.Book.Lang.String()
+	}
+	return meta, nil
+}
+
+// SetMeta changes description of FB2 document using the same rules as meta overwrites from configuration. Only
+// description and cover image are changed, the rest of the document is left intact.
+func SetMeta(data []byte, meta *config.MetaInfo, env *state.LocalEnv) ([]byte, error) {
+
+	s, err := newFB2Source(data)
+	if err != nil {
+		return nil, err
+	}
+	p, err := s.processor(meta, env)
+	if err != nil {
+		return nil, err
+	}
+	oldCover := p.Book.Cover
+
+	if err := p.updateDescription(); err != nil {
+		return nil, err
+	}
+
+	// cover binary is outside of description
+	var cover []byte
+	if len(meta.CoverImage) > 0 && meta.CoverImage != "remove cover" {
+		fname := meta.CoverImage
+		if !filepath.IsAbs(fname) {
+			fname = filepath.Join(env.Cfg.Path, fname)
+		}
+		id := oldCover
+		if len(id) == 0 {
+			id = "cover"
+		}
+		if cover, err = coverBinary(fname, id); err != nil {
+			return nil, err
+		}
+		if len(oldCover) == 0 {
+			m := reXLinkNS.FindSubmatch(s.root)
+			if m == nil {
+				return nil, errors.New("document does not declare xlink namespace, unable to add cover")
+			}
+			info := p.doc.FindElement("./FictionBook/description/title-info")
+			if info == nil {
+				return nil, errors.New("book has no title-info, unable to add cover")
+			}
+			selectFB2Element(info, "coverpage", fb2TitleInfoOrder).AddNext("image", attr(string(m[1])+":href", "#"+id))
+		}
+		env.Log.Info("Meta overwrite", zap.String("cover", fname))
+	}
+
+	desc, err := s.encode(p.doc.FindElement("./FictionBook/description"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to write description: %w", err)
+	}
+
+	var out bytes.Buffer
+	out.Write(s.data[:s.descStart])
+	out.Write(desc)
+	rest := s.data[s.descEnd:]
+
+	if len(cover) > 0 || (meta.CoverImage == "remove cover" && len(oldCover) > 0) {
+		var found bool
+		for pos := 0; ; {
+			start, end, ok := xmlElement(rest, "binary", pos)
+			if !ok {
+				break
+			}
+			if m := reXMLID.FindSubmatch(rest[start : start+tagEnd(rest[start:])]); m != nil && string(m[1]) == oldCover && len(oldCover) > 0 {
+				out.Write(rest[:start])
+				out.Write(cover)
+				rest = rest[end:]
+				if len(cover) == 0 {
+					// do not leave empty line behind
+					rest = bytes.TrimPrefix(bytes.TrimPrefix(rest, []byte("\r")), []byte("\n"))
+				}
+				found = true
+				break
+			}
+			pos = end
+		}
+		if !found && len(cover) > 0 {
+			// new cover goes at the very end of the document
+			closing := bytes.LastIndex(rest, []byte("</"+s.rootName))
+			if closing < 0 {
+				return nil, errors.New("unable to find end of FictionBook element")
+			}
+			out.Write(rest[:closing])
+			out.Write(cover)
+			out.WriteString("\n")
+			rest = rest[closing:]
+		}
+	}
+	out.Write(rest)
+
+	if s.utf16 != nil {
+		return s.utf16.NewEncoder().Bytes(out.Bytes())
+	}
+	return out.Bytes(), nil
+}
+
+// coverBinary prepares binary element with cover image from file.
+func coverBinary(fname, id string) ([]byte, error) {
+
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read cover image: %w", err)
+	}
+	_, kind, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode cover image: %w", err)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(`<binary id="` + id + `" content-type="` + mime.TypeByExtension("."+kind) + `">`)
+	enc := base64.StdEncoding.EncodeToString(data)
+	for len(enc) > fb2BinaryLineSize {
+		buf.WriteString(enc[:fb2BinaryLineSize])
+		buf.WriteByte('\n')
+		enc = enc[fb2BinaryLineSize:]
+	}
+	buf.WriteString(enc)
+	buf.WriteString("</binary>")
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,71 @@
+package processor
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"fb2converter/config"
+	"fb2converter/state"
+)
+
+func TestSetMeta(t *testing.T) {
+
+	const (
+		head = `<?xml version="1.0" encoding="UTF-8"?>
+<!-- <description>commented out</description> -->
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:xl="http://www.w3.org/1999/xlink">
+`
+		desc = `<description>
+  <title-info><genre>sf</genre><author><last-name>Author</last-name></author><book-title>Title</book-title><lang>en</lang></title-info>
+  <document-info><id>1</id></document-info>
+</description>`
+		tail = `
+<body><section><p>Text &amp;  <emphasis>kept</emphasis>   as is</p></section></body>
+</FictionBook>
+`
+	)
+
+	cfg, err := config.BuildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := &state.LocalEnv{Cfg: cfg, Log: zap.NewNop()}
+
+	data, err := SetMeta([]byte(head+desc+tail), &config.MetaInfo{
+		Title:      "New title",
+		Authors:    []*config.AuthorName{{First: "First", Last: "Last"}},
+		Annotation: "One\nTwo",
+	}, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.HasPrefix(data, []byte(head)) || !bytes.HasSuffix(data, []byte(tail)) {
+		t.Fatalf("document outside of description was changed:\n%s", data)
+	}
+	for _, s := range []string{
+		"<book-title>New title</book-title>",
+		"<author><first-name>First</first-name><last-name>Last</last-name></author>",
+		"<annotation><p>One</p><p>Two</p></annotation>",
+		"<lang>en</lang>",
+	} {
+		if !strings.Contains(string(data), s) {
+			t.Errorf("updated description does not have %s:\n%s", s, data)
+		}
+	}
+
+	meta, err := GetMeta(data, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Title != "New title" || meta.Annotation != "One\nTwo" || meta.Lang != "en" || len(meta.Authors) != 1 || len(meta.ID) != 0 {
+		t.Errorf("unexpected meta information: %+v", meta)
+	}
+
+	if _, err := SetMeta([]byte(head+tail), &config.MetaInfo{Title: "x"}, env); err == nil {
+		t.Error("expected error for document without description")
+	}
+}
@@ -2,9 +2,13 @@ package processor
 
 import (
 	"bufio"
+	"bytes"
+	gocontext "context"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"strings"
 	"syscall"
@@ -14,28 +18,19 @@ import (
 	"go.uber.org/zap"
 
 	"fb2converter/processor/internal/mobi"
+	"fb2converter/state"
 )
 
-// FinalizeMOBI produces final mobi file out of previously saved temporary files.
-func (p *Processor) FinalizeMOBI(fname string) error {
+// FinalizeMOBI produces final mobi file out of previously saved output tree.
+func (p *Processor) FinalizeMOBI(ctx gocontext.Context, fname string) error {
 
-	tmp, err := p.generateIntermediateContent(fname)
+	tmp, err := p.generateIntermediateContent(ctx, fname)
 	if err != nil {
 		return fmt.Errorf("unable to generate intermediate content: %w", err)
 	}
 
-	if _, err := os.Stat(fname); err == nil {
-		if !p.overwrite {
-			return fmt.Errorf("output file already exists: %s", fname)
-		}
-		p.env.Log.Warn("Overwriting existing file", zap.String("file", fname))
-		if err = os.Remove(fname); err != nil {
-			return err
-		}
-	} else if !os.IsNotExist(err) {
+	if err := p.prepareOutput(fname); err != nil {
 		return err
-	} else if err := os.MkdirAll(filepath.Dir(fname), 0700); err != nil {
-		return fmt.Errorf("unable to create output directory: %w", err)
 	}
 
 	if p.env.Cfg.Doc.Kindlegen.NoOptimization {
@@ -70,26 +65,41 @@ func (p *Processor) FinalizeMOBI(fname string) error {
 	return nil
 }
 
-// FinalizeAZW3 produces final azw3 file out of previously saved temporary files.
-func (p *Processor) FinalizeAZW3(fname string) error {
+// FinalizeAZW3 produces final azw3 file out of previously saved output tree.
+func (p *Processor) FinalizeAZW3(ctx gocontext.Context, fname string) error {
 
-	tmp, err := p.generateIntermediateContent(fname)
+	w, err := p.buildAZW3()
 	if err != nil {
-		return fmt.Errorf("unable to generate intermediate content: %w", err)
+		return err
+	}
+	if w == nil {
+		return p.kindlegenAZW3(ctx, fname)
 	}
 
-	if _, err := os.Stat(fname); err == nil {
-		if !p.overwrite {
-			return fmt.Errorf("output file already exists: %s", fname)
-		}
-		p.env.Log.Warn("Overwriting existing file", zap.String("file", fname))
-		if err = os.Remove(fname); err != nil {
-			return err
+	if err := p.prepareOutput(fname); err != nil {
+		return err
+	}
+	if err := w.SaveResult(fname); err != nil {
+		return fmt.Errorf("unable to save resulting AZW3: %w", err)
+	}
+	if p.kindlePageMap != APNXNone {
+		if err := w.SavePageMap(fname, p.kindlePageMap == APNXEInk); err != nil {
+			return fmt.Errorf("unable to save resulting pagemap: %w", err)
 		}
-	} else if !os.IsNotExist(err) {
+	}
+	return nil
+}
+
+// kindlegenAZW3 produces final azw3 file using kindlegen.
+func (p *Processor) kindlegenAZW3(ctx gocontext.Context, fname string) error {
+
+	tmp, err := p.generateIntermediateContent(ctx, fname)
+	if err != nil {
+		return fmt.Errorf("unable to generate intermediate content: %w", err)
+	}
+
+	if err := p.prepareOutput(fname); err != nil {
 		return err
-	} else if err := os.MkdirAll(filepath.Dir(fname), 0700); err != nil {
-		return fmt.Errorf("unable to create output directory: %w", err)
 	}
 
 	if p.env.Cfg.Doc.Kindlegen.NoOptimization {
@@ -124,19 +134,118 @@ func (p *Processor) FinalizeAZW3(fname string) error {
 	return nil
 }
 
+// buildAZW3 builds azw3 out of the output tree using built-in KF8 writer. When kindlegen is requested or built-in writer
+// failed and kindlegen is available as a fallback no writer is returned.
+func (p *Processor) buildAZW3() (*mobi.Writer, error) {
+
+	if p.env.Cfg.Doc.Kindlegen.UseKindlegen {
+		return nil, nil
+	}
+
+	opf := path.Join(DirContent, "content.opf")
+	if p.kind == InEpub {
+		opf = p.Book.Files[0].name()
+	}
+
+	p.env.Log.Debug("KF8 writer starting")
+	defer func(start time.Time) {
+		p.env.Log.Debug("KF8 writer done", zap.Duration("elapsed", time.Since(start)), zap.String("opf", opf))
+	}(time.Now())
+
+	w, err := mobi.NewWriter(p.out, opf, p.Book.ID, p.Book.ASIN,
+		p.env.Cfg.Doc.Kindlegen.CompressionLevel > 0,
+		p.env.Cfg.Doc.Kindlegen.RemovePersonal,
+		p.env.Cfg.Doc.Kindlegen.ForceASIN,
+		p.env.Log)
+	if err != nil {
+		if len(p.kindlegenPath) == 0 {
+			return nil, fmt.Errorf("unable to build AZW3: %w", err)
+		}
+		p.env.Log.Warn("Unable to produce AZW3 with built-in writer, falling back to kindlegen", zap.Error(err))
+		return nil, nil
+	}
+	return w, nil
+}
+
+// findKindlegen locates kindlegen for Kindle output. Legacy mobi could only be produced by kindlegen - built-in writer
+// makes KF8 (azw3) only. For azw3 kindlegen is required when requested by configuration, otherwise it is a fallback
+// used when available.
+func findKindlegen(format OutputFmt, env *state.LocalEnv) (string, error) {
+	path, err := env.Cfg.GetKindlegenPath()
+	switch {
+	case err == nil:
+		return path, nil
+	case format == OMobi:
+		return "", markError(ErrKindlegen, fmt.Errorf("mobi output requires kindlegen, built-in writer only produces azw3: %w", err))
+	case env.Cfg.Doc.Kindlegen.UseKindlegen:
+		return "", markError(ErrKindlegen, err)
+	}
+	return "", nil
+}
+
+// streamKindle writes azw3 or mobi book to w. Book produced by kindlegen is assembled in its own directory under working
+// one (so it does not clash with intermediate files) and streamed out when ready.
+func (p *Processor) streamKindle(ctx gocontext.Context, w io.Writer, name string) error {
+
+	if p.format == OAzw3 {
+		kw, err := p.buildAZW3()
+		if err != nil {
+			return err
+		}
+		if kw != nil {
+			return kw.WriteResult(w)
+		}
+	}
+
+	dir, err := p.workDir()
+	if err != nil {
+		return err
+	}
+	fname := filepath.Join(dir, "stdout", name)
+	if p.format == OMobi {
+		err = p.FinalizeMOBI(ctx, fname)
+	} else {
+		err = p.kindlegenAZW3(ctx, fname)
+	}
+	if err != nil {
+		return err
+	}
+	return p.streamResult(fname, w)
+}
+
 // generateIntermediateContent produces temporary mobi file, presently by running kindlegen and returns its full path.
-func (p *Processor) generateIntermediateContent(fname string) (string, error) {
+// Kindlegen is killed when context is canceled.
+func (p *Processor) generateIntermediateContent(ctx gocontext.Context, fname string) (string, error) {
 
-	workDir := filepath.Join(p.tmpDir, DirContent)
+	dir, err := p.workDir()
+	if err != nil {
+		return "", err
+	}
+	workDir := filepath.Join(dir, DirContent)
 	if p.kind == InEpub {
-		workDir = p.tmpDir
+		workDir = dir
 	}
 	workFile := strings.TrimSuffix(filepath.Base(fname), filepath.Ext(fname)) + ".mobi"
 
 	args := make([]string, 0, 10)
 	if p.kind == InEpub {
-		args = append(args, filepath.Join(p.tmpDir, filepath.Base(p.src)))
+		// pack processed content back, so kindlegen would see our changes
+		var buf bytes.Buffer
+		if err := p.packEPUB(&buf); err != nil {
+			return "", err
+		}
+		epub := filepath.Join(dir, filepath.Base(p.src))
+		if err := os.WriteFile(epub, buf.Bytes(), 0644); err != nil {
+			return "", fmt.Errorf("unable to save EPUB for kindlegen: %w", err)
+		}
+		args = append(args, epub)
 	} else {
+		if _, onDisk := p.out.(dirFS); !onDisk {
+			// kindlegen only sees files
+			if err := copyBookFS(dirFS(dir), p.out); err != nil {
+				return "", fmt.Errorf("unable to save content for kindlegen: %w", err)
+			}
+		}
 		args = append(args, filepath.Join(workDir, "content.opf"))
 	}
 	args = append(args, fmt.Sprintf("-c%d", p.env.Cfg.Doc.Kindlegen.CompressionLevel))
@@ -146,7 +255,9 @@ func (p *Processor) generateIntermediateContent(fname string) (string, error) {
 	}
 	args = append(args, "-o", workFile)
 
-	cmd := exec.Command(p.kindlegenPath, args...)
+	cmd := exec.CommandContext(ctx, p.kindlegenPath, args...)
+	// do not wait for output of processes kindlegen may have left behind when it was killed
+	cmd.WaitDelay = time.Second
 
 	p.env.Log.Debug("kindlegen staring")
 	defer func(start time.Time) {
@@ -157,26 +268,37 @@ func (p *Processor) generateIntermediateContent(fname string) (string, error) {
 		)
 	}(time.Now())
 
-	out, err := cmd.StdoutPipe()
-	if err != nil {
-		return "", fmt.Errorf("unable to redirect kindlegen stdout: %w", err)
-	}
+	out, in := io.Pipe()
+	cmd.Stdout = in
 
 	if err := cmd.Start(); err != nil {
-		return "", fmt.Errorf("unable to start kindlegen: %w", err)
+		return "", markError(ErrKindlegen, fmt.Errorf("unable to start kindlegen: %w", err))
 	}
 
 	// read and print kindlegen stdout
-	scanner := bufio.NewScanner(out)
-	for scanner.Scan() {
-		p.env.Log.Debug(scanner.Text())
+	scanned := make(chan error, 1)
+	go func() {
+		scanner := bufio.NewScanner(out)
+		for scanner.Scan() {
+			p.env.Log.Debug(scanner.Text())
+		}
+		// let kindlegen finish even if its output could not be read
+		io.Copy(io.Discard, out)
+		scanned <- scanner.Err()
+	}()
+
+	err = cmd.Wait()
+	in.Close()
+	if ctx.Err() != nil {
+		// kindlegen was killed
+		return "", ctx.Err()
 	}
-	if err := scanner.Err(); err != nil {
-		return "", fmt.Errorf("kindlegen stdout pipe broken: %w", err)
+	if err := <-scanned; err != nil {
+		return "", markError(ErrKindlegen, fmt.Errorf("kindlegen stdout pipe broken: %w", err))
 	}
 
 	result := filepath.Join(workDir, workFile)
-	if err := cmd.Wait(); err != nil {
+	if err != nil {
 		if ee, ok := err.(*exec.ExitError); ok {
 			if len(ee.Stderr) > 0 {
 				p.env.Log.Error("kindlegen", zap.String("stderr", string(ee.Stderr)), zap.Error(err))
@@ -191,16 +313,16 @@ func (p *Processor) generateIntermediateContent(fname string) (string, error) {
 				// success
 				if _, err := os.Stat(result); err != nil {
 					// kindlegen lied
-					return "", fmt.Errorf("kindlegen did not return an error, but there is no content %s: %w", result, err)
+					return "", markError(ErrKindlegen, fmt.Errorf("kindlegen did not return an error, but there is no content %s: %w", result, err))
 				}
 			case 2:
 				// error - unable to create mobi
 				fallthrough
 			default:
-				return "", fmt.Errorf("kindlegen returned error: %w", err)
+				return "", markError(ErrKindlegen, fmt.Errorf("kindlegen returned error: %w", err))
 			}
 		} else {
-			return "", fmt.Errorf("kindlegen returned error: %w", err)
+			return "", markError(ErrKindlegen, fmt.Errorf("kindlegen returned error: %w", err))
 		}
 	}
 	return result, nil
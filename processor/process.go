@@ -3,7 +3,9 @@ package processor
 
 import (
 	"bytes"
+	gocontext "context"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"image"
 	"io"
@@ -53,6 +55,9 @@ const (
 	DirSentences  = "sentences"
 )
 
+// StdStream used as source means STDIN, used as destination - STDOUT.
+const StdStream = "-"
+
 // will be used to derive UUIDs from non-parsable book ID
 var nameSpaceFB2 = uuid.MustParse("09aa0c17-ca72-42d3-afef-75911e5d7646")
 
@@ -74,7 +79,10 @@ type Processor struct {
 	kindlePageMap  APNXGeneration
 	stampPlacement StampPlacement
 	coverResize    CoverProcessing
-	// working directory
+	// only description is processed, nothing is produced
+	infoOnly bool
+	// book output tree and working directory, which is only created when necessary
+	out    bookFS
 	tmpDir string
 	// input document
 	doc *etree.Document
@@ -86,6 +94,7 @@ type Processor struct {
 	speechTransform *config.Transformation
 	dashTransform   *config.Transformation
 	metaOverwrite   *config.MetaInfo
+	tagMappings     []config.TagMapping
 	kindlegenPath   string
 }
 
@@ -107,6 +116,10 @@ func NewFB2(r io.Reader, unknownEncoding bool, src, dst string, nodirs, stk, ove
 	if notes != NFloat && notes != NFloatOld && notes != NFloatNew && notes != NFloatNewMore && env.Cfg.Doc.Notes.Renumber {
 		env.Log.Warn("Notes can be renumbered in floating modes only, ignoring", zap.String("mode", env.Cfg.Doc.Notes.Mode))
 	}
+	if format == OTxt || format == OMd {
+		// notes are always rendered as footnotes
+		notes = NDefault
+	}
 	toct := ParseTOCTypeString(env.Cfg.Doc.TOC.Type)
 	if toct == UnsupportedTOCType {
 		env.Log.Warn("Unknown TOC type requested, switching to normal", zap.String("type", env.Cfg.Doc.TOC.Type))
@@ -117,6 +130,10 @@ func NewFB2(r io.Reader, unknownEncoding bool, src, dst string, nodirs, stk, ove
 		env.Log.Warn("Unknown TOC page placement requested, turning off generation", zap.String("placement", env.Cfg.Doc.TOC.Placement))
 		place = TOCNone
 	}
+	if format == OHtml {
+		// single page always starts with TOC
+		place = TOCBefore
+	}
 	var apnx APNXGeneration
 	if kindle {
 		apnx = ParseAPNXGenerationSring(env.Cfg.Doc.Kindlegen.PageMap)
@@ -161,12 +178,13 @@ func NewFB2(r io.Reader, unknownEncoding bool, src, dst string, nodirs, stk, ove
 		speechTransform: env.Cfg.GetTransformation("speech"),
 		dashTransform:   env.Cfg.GetTransformation("dashes"),
 		metaOverwrite:   env.Cfg.GetOverwrite(src),
+		tagMappings:     validTagMappings(env.Cfg.Doc.Tags, env.Log),
 	}
 	p.doc.WriteSettings = etree.WriteSettings{CanonicalText: true, CanonicalAttrVal: true}
 
 	if kindle {
 		// Fail early
-		if p.kindlegenPath, err = env.Cfg.GetKindlegenPath(); err != nil {
+		if p.kindlegenPath, err = findKindlegen(format, env); err != nil {
 			return nil, err
 		}
 	}
@@ -185,29 +203,22 @@ func NewFB2(r io.Reader, unknownEncoding bool, src, dst string, nodirs, stk, ove
 		p.dashTransform.To = string(sym)
 	}
 
-	p.tmpDir, err = os.MkdirTemp("", "fb2c-")
-	if err != nil {
-		return nil, fmt.Errorf("unable to create temporary directory: %w", err)
+	if err := p.prepareOutputTree(u); err != nil {
+		return nil, err
 	}
-	env.Rpt.Store(fmt.Sprintf("fb2c-%s", u.String()), p.tmpDir)
 
-	if unknownEncoding {
-		// input file had no BOM mark - most likely was not Unicode
-		// in this mode we will try and respect as many HTML named character references as possible, since creator of the
-		// document did not have any choice
-		entities, err := prepareHTMLNamedEntities()
-		if err != nil {
-			return nil, fmt.Errorf("unable to write prepare HTML named entities: %w", err)
-		}
-		p.doc.ReadSettings = etree.ReadSettings{
-			CharsetReader: charset.NewReaderLabel,
-			Entity:        entities,
-		}
+	if p.doc.ReadSettings, err = fb2ReadSettings(unknownEncoding); err != nil {
+		return nil, err
 	}
 
 	// Read and parse fb2
 	if _, err := p.doc.ReadFrom(r); err != nil {
-		return nil, fmt.Errorf("unable to parse FB2: %w", err)
+		p.Clean()
+		return nil, markError(ErrParse, fmt.Errorf("unable to parse FB2: %w", err))
+	}
+	if p.doc.FindElement("./FictionBook") == nil {
+		p.Clean()
+		return nil, markError(ErrParse, errors.New("unable to parse FB2: no FictionBook element"))
 	}
 
 	// Save parsed document back to file for debugging
@@ -222,106 +233,299 @@ func NewFB2(r io.Reader, unknownEncoding bool, src, dst string, nodirs, stk, ove
 	return p, nil
 }
 
-// Process does all the work.
-func (p *Processor) Process() error {
+// fb2ReadSettings returns settings for parsing FB2 document.
+func fb2ReadSettings(unknownEncoding bool) (etree.ReadSettings, error) {
 
-	if p.kind == InEpub {
-		// later we may decide to clean epub, massage its stylesheet, etc.
-		return nil
+	if !unknownEncoding {
+		return etree.ReadSettings{}, nil
 	}
+	// input file had no BOM mark - most likely was not Unicode
+	// in this mode we will try and respect as many HTML named character references as possible, since creator of the
+	// document did not have any choice
+	entities, err := prepareHTMLNamedEntities()
+	if err != nil {
+		return etree.ReadSettings{}, fmt.Errorf("unable to write prepare HTML named entities: %w", err)
+	}
+	return etree.ReadSettings{
+		CharsetReader: charset.NewReaderLabel,
+		Entity:        entities,
+	}, nil
+}
 
-	// Processing - order of steps and their presence are important as information and context
-	// being built and accumulated...
+// NewEPUB creates EPUB book processor and prepares necessary temporary directories. EPUB could only be converted to kepub, mobi
+// and azw3.
+func NewEPUB(r io.Reader, src, dst string, nodirs, stk, overwrite bool, format OutputFmt, env *state.LocalEnv) (*Processor, error) {
 
-	// notes may contain images, so we need to process them first
-	if err := p.processBinaries(); err != nil {
-		return err
+	kindle := format == OAzw3 || format == OMobi
+
+	if !kindle && format != OKepub {
+		return nil, fmt.Errorf("unable to convert EPUB to %s, only kepub, mobi and azw3 are supported", format)
 	}
-	if err := p.processNotes(); err != nil {
-		return err
+
+	u, err := uuid.NewRandom()
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate UUID: %w", err)
 	}
-	if err := p.processDescription(); err != nil {
-		return err
+
+	var apnx APNXGeneration
+	if kindle {
+		apnx = ParseAPNXGenerationSring(env.Cfg.Doc.Kindlegen.PageMap)
+		if apnx == UnsupportedAPNXGeneration {
+			env.Log.Warn("Unknown APNX generation option requested, turning off", zap.String("apnx", env.Cfg.Doc.Kindlegen.PageMap))
+			apnx = APNXNone
+		}
 	}
-	if err := p.processBodies(); err != nil {
-		return err
+
+	p := &Processor{
+		kind:          InEpub,
+		src:           src,
+		dst:           dst,
+		nodirs:        nodirs,
+		stk:           stk,
+		overwrite:     overwrite,
+		format:        format,
+		kindlePageMap: apnx,
+		doc:           etree.NewDocument(),
+		Book:          NewBook(u, filepath.Base(src)),
+		env:           env,
+		metaOverwrite: env.Cfg.GetOverwrite(src),
 	}
-	if err := p.processLinks(); err != nil {
-		return err
+	p.doc.WriteSettings = etree.WriteSettings{CanonicalText: true, CanonicalAttrVal: true}
+
+	if kindle {
+		// Fail early
+		if p.kindlegenPath, err = findKindlegen(format, env); err != nil {
+			return nil, err
+		}
 	}
-	if err := p.processImages(); err != nil {
-		return err
+
+	if err := p.prepareOutputTree(u); err != nil {
+		return nil, err
 	}
-	if err := p.generateTOCPage(); err != nil {
-		return err
+
+	// Unpack epub and read its package document
+	if err := unpackEPUB(r, p.out); err != nil {
+		p.Clean()
+		return nil, markError(ErrParse, err)
 	}
-	if err := p.generateCover(); err != nil {
-		return err
+	if err := p.readOPF(); err != nil {
+		p.Clean()
+		return nil, markError(ErrParse, err)
 	}
-	if err := p.generateNCX(); err != nil {
-		return err
+
+	// we are ready to convert document
+	return p, nil
+}
+
+// Process does all the work. Context is checked before every processing stage, canceled processing returns context
+// error.
+func (p *Processor) Process(ctx gocontext.Context) error {
+
+	if p.kind == InEpub {
+		// epub content is mostly passed through, we only correct metadata and insert Kobo spans when necessary
+		return runStages(ctx, p.processOPF, p.kepubifyEPUB)
 	}
-	if err := p.prepareStylesheet(); err != nil {
-		return err
+	if p.fb2Output() {
+		return p.processFB2(ctx)
 	}
-	if err := p.generatePagemap(); err != nil {
-		return err
+	if p.textOutput() {
+		return p.processText(ctx)
 	}
-	if err := p.generateOPF(); err != nil {
-		return err
+	if p.htmlOutput() {
+		return p.processHTML(ctx)
+	}
+
+	// Processing - order of steps and their presence are important as information and context
+	// being built and accumulated...
+	return runStages(ctx,
+		// notes may contain images, so we need to process them first
+		p.processBinaries,
+		p.processNotes,
+		p.processDescription,
+		p.runHooks(AfterDescription),
+		p.processBodies,
+		p.runHooks(AfterBodies),
+		p.processLinks,
+		p.processImages,
+		p.generateTOCPage,
+		p.generateCover,
+		p.generateNCX,
+		p.generateNav,
+		p.prepareStylesheet,
+		p.generatePagemap,
+		p.runHooks(BeforeOPF),
+		p.generateOPF,
+		p.generateMeta,
+		p.KepubifyXHTML,
+	)
+}
+
+// runStages runs processing stages in order, stopping on first error or when context is canceled.
+func runStages(ctx gocontext.Context, stages ...func() error) error {
+	for _, stage := range stages {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := stage(); err != nil {
+			return err
+		}
 	}
-	if err := p.generateMeta(); err != nil {
+	return nil
+}
+
+// prepareOutputTree selects where book output tree is assembled. Debug report collects working directory, so when
+// report is requested everything is kept there, otherwise output tree is kept in memory.
+func (p *Processor) prepareOutputTree(u uuid.UUID) error {
+
+	if p.env.Rpt == nil {
+		p.out = newMemFS()
+		return nil
+	}
+	dir, err := p.workDir()
+	if err != nil {
 		return err
 	}
-	return p.KepubifyXHTML()
+	p.env.Rpt.Store(fmt.Sprintf("fb2c-%s", u.String()), dir)
+	p.out = dirFS(dir)
+	return nil
+}
+
+// workDir returns working directory, creating it on first use.
+func (p *Processor) workDir() (string, error) {
+
+	if len(p.tmpDir) == 0 {
+		dir, err := os.MkdirTemp("", "fb2c-")
+		if err != nil {
+			return "", fmt.Errorf("unable to create temporary directory: %w", err)
+		}
+		p.tmpDir = dir
+	}
+	return p.tmpDir, nil
 }
 
-// Save makes the conversion results permanent by storing everything properly and cleaning temporary artifacts.
-func (p *Processor) Save() (string, error) {
+// flushContent stores conversion results in the output tree.
+func (p *Processor) flushContent(ctx gocontext.Context) error {
 
 	p.env.Log.Debug("Saving content - starting", zap.String("tmp", p.tmpDir), zap.String("content", DirContent))
 	defer func(start time.Time) {
 		p.env.Log.Debug("Saving content - done", zap.Duration("elapsed", time.Since(start)))
 	}(time.Now())
 
-	if p.kind == InFb2 {
-		if err := p.Book.flushData(p.tmpDir); err != nil {
-			return "", err
-		}
-		if err := p.Book.flushVignettes(p.tmpDir); err != nil {
-			return "", err
+	switch {
+	case p.fb2Output():
+		// images are kept inside of the document
+		return p.updateBinaries(ctx)
+	case p.textOutput(), p.htmlOutput():
+		// content is rendered directly to the result
+		return nil
+	case p.kind == InFb2:
+		if err := p.Book.flushData(ctx, p.out); err != nil {
+			return err
 		}
-		if err := p.Book.flushImages(p.tmpDir); err != nil {
-			return "", err
+		if err := p.Book.flushVignettes(p.out); err != nil {
+			return err
 		}
-		if err := p.Book.flushXHTML(p.tmpDir); err != nil {
-			return "", err
+		if err := p.Book.flushImages(ctx, p.out); err != nil {
+			return err
 		}
-		if err := p.Book.flushMeta(p.tmpDir); err != nil {
-			return "", err
+		if err := p.Book.flushXHTML(ctx, p.out); err != nil {
+			return err
 		}
+		return p.Book.flushMeta(p.out)
+	default:
+		// only package document and changed content
+		return p.Book.flushXHTML(ctx, p.out)
+	}
+}
+
+// Save makes the conversion results permanent by storing everything properly and cleaning temporary artifacts. When
+// destination is STDOUT result is streamed there and no file name is returned.
+func (p *Processor) Save(ctx gocontext.Context) (string, error) {
+
+	if p.dst == StdStream {
+		_, err := p.SaveTo(ctx, os.Stdout)
+		return "", err
+	}
+
+	if err := p.flushContent(ctx); err != nil {
+		return "", err
 	}
 
 	fname := p.prepareOutputName()
 
 	var err error
 	switch p.format {
-	case OEpub:
+	case OEpub, OEpub3:
 		err = p.FinalizeEPUB(fname)
 	case OKepub:
 		err = p.FinalizeKEPUB(fname)
 	case OMobi:
-		err = p.FinalizeMOBI(fname)
+		err = p.FinalizeMOBI(ctx, fname)
 	case OAzw3:
-		err = p.FinalizeAZW3(fname)
+		err = p.FinalizeAZW3(ctx, fname)
+	case OFb2, OFb2Zip:
+		err = p.FinalizeFB2(fname)
+	case OTxt, OMd:
+		err = p.FinalizeText(fname)
+	case OHtml:
+		err = p.FinalizeHTML(ctx, fname)
 	}
 	return fname, err
 }
 
+// SaveTo writes conversion result to w and returns name of the file Save would produce. Nothing touches the disk unless
+// kindlegen has to be invoked.
+func (p *Processor) SaveTo(ctx gocontext.Context, w io.Writer) (string, error) {
+
+	if err := p.flushContent(ctx); err != nil {
+		return "", err
+	}
+
+	name := filepath.Base(p.prepareOutputName())
+
+	var err error
+	switch p.format {
+	case OEpub, OEpub3, OKepub:
+		err = p.writeEPUB(w)
+	case OMobi, OAzw3:
+		err = p.streamKindle(ctx, w, name)
+	case OFb2, OFb2Zip:
+		err = p.writeFB2(w, name)
+	case OTxt, OMd:
+		_, err = w.Write(p.renderText())
+	case OHtml:
+		var data []byte
+		if data, err = p.renderHTML(ctx); err == nil {
+			_, err = w.Write(data)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// streamResult copies finished book to the writer.
+func (p *Processor) streamResult(fname string, w io.Writer) error {
+
+	p.env.Log.Debug("Streaming result", zap.String("file", fname))
+
+	f, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(w, f); err != nil {
+		return fmt.Errorf("unable to stream resulting book: %w", err)
+	}
+	return nil
+}
+
 // SendToKindle will mail converted file to specified address and remove file if requested.
 func (p *Processor) SendToKindle(fname string) error {
 
-	if !p.stk || p.format != OEpub || len(fname) == 0 {
+	if !p.stk || (p.format != OEpub && p.format != OEpub3) || len(fname) == 0 {
 		return nil
 	}
 
@@ -405,8 +609,8 @@ func (p *Processor) SendToKindle(fname string) error {
 
 // Clean removes temporary files left after processing.
 func (p *Processor) Clean() error {
-	if p.env.Rpt != nil {
-		// Leave temporary files intact
+	if p.env.Rpt != nil || len(p.tmpDir) == 0 {
+		// Leave temporary files intact or nothing to clean
 		return nil
 	}
 	p.env.Log.Debug("Cleaning", zap.String("location", p.tmpDir))
@@ -426,10 +630,7 @@ func (p *Processor) prepareOutputName() string {
 	if p.env.Cfg.Doc.FileNameTransliterate {
 		name = slug.Make(name)
 	}
-	outFile := config.CleanFileName(name) + "." + p.format.String()
-	if p.format == OKepub {
-		outFile += "." + OEpub.String()
-	}
+	outFile := config.CleanFileName(name) + p.outputExt()
 
 	if p.kind == InFb2 && len(p.env.Cfg.Doc.FileNameFormat) > 0 {
 
@@ -451,10 +652,7 @@ func (p *Processor) prepareOutputName() string {
 					if p.env.Cfg.Doc.FileNameTransliterate {
 						tail = slug.Make(tail)
 					}
-					outFile = config.CleanFileName(tail) + "." + p.format.String()
-					if p.format == OKepub {
-						outFile += "." + OEpub.String()
-					}
+					outFile = config.CleanFileName(tail) + p.outputExt()
 					first = false
 				} else {
 					if p.env.Cfg.Doc.FileNameTransliterate {
@@ -473,6 +671,18 @@ func (p *Processor) prepareOutputName() string {
 	return filepath.Join(outDir, outFile)
 }
 
+// outputExt returns extension of the output file for requested format.
+func (p *Processor) outputExt() string {
+	switch p.format {
+	case OKepub:
+		return "." + OKepub.String() + "." + OEpub.String()
+	case OEpub3:
+		return "." + OEpub.String()
+	default:
+		return "." + p.format.String()
+	}
+}
+
 // processDescription processes book description element.
 func (p *Processor) processDescription() error {
 
@@ -529,7 +739,7 @@ func (p *Processor) processDescription() error {
 						}
 					}
 					p.Book.Lang = t
-					if p.env.Cfg.Doc.Hyphenate {
+					if p.env.Cfg.Doc.Hyphenate && !p.infoOnly {
 						p.Book.hyph = newHyph(t, p.env.Log)
 					}
 					if p.format == OKepub {
@@ -598,7 +808,7 @@ func (p *Processor) processDescription() error {
 			}
 			if e := info.SelectElement("annotation"); e != nil {
 				p.Book.Annotation = getTextFragment(e)
-				if p.env.Cfg.Doc.Annotation.Create {
+				if p.env.Cfg.Doc.Annotation.Create && !p.fb2Output() {
 					to, f := p.ctx().createXHTML("annotation", attr("xmlns", `http://www.w3.org/1999/xhtml`))
 					inner := to.AddNext("div", attr("class", "annotation"))
 					inner.AddNext("div", attr("class", "h1")).SetText(p.env.Cfg.Doc.Annotation.Title)
@@ -627,8 +837,15 @@ func (p *Processor) processDescription() error {
 	}
 
 	// Let's see if we need to correct any meta information - always comes last
+	p.overwriteMeta()
+	return nil
+}
+
+// overwriteMeta corrects book meta information using values from configuration.
+func (p *Processor) overwriteMeta() {
+
 	if p.metaOverwrite == nil {
-		return nil
+		return
 	}
 
 	if len(p.metaOverwrite.ID) > 0 {
@@ -651,9 +868,12 @@ func (p *Processor) processDescription() error {
 			if t, err := language.Parse(l); err == nil {
 				p.Book.Lang = t
 				p.env.Log.Info("Meta overwrite", zap.Stringer("lang", p.Book.Lang))
-				if p.env.Cfg.Doc.Hyphenate {
+				if p.env.Cfg.Doc.Hyphenate && !p.infoOnly {
 					p.Book.hyph = newHyph(t, p.env.Log)
 				}
+				if p.format == OKepub {
+					p.Book.tokenizer = newTokenizer(t, p.env.Log)
+				}
 			}
 		}
 	}
@@ -685,7 +905,11 @@ func (p *Processor) processDescription() error {
 		p.Book.Date = date
 		p.env.Log.Info("Meta overwrite", zap.String("date", p.Book.Date))
 	}
-	return nil
+	annotation := strings.TrimSpace(p.metaOverwrite.Annotation)
+	if len(annotation) > 0 {
+		p.Book.Annotation = annotation
+		p.env.Log.Info("Meta overwrite", zap.String("annotation", p.Book.Annotation))
+	}
 }
 
 // processBodies processes book bodies, including main one.
@@ -1013,7 +1237,7 @@ func (p *Processor) processImages() error {
 				}
 			}
 		}
-	} else if p.env.Cfg.Doc.Cover.Default || p.format == OMobi || p.format == OAzw3 {
+	} else if (p.env.Cfg.Doc.Cover.Default && !p.fb2Output()) || p.format == OMobi || p.format == OAzw3 {
 		// For Kindle we always supply cover image if none is present, for others - only if asked to
 		b, err := p.getDefaultCover(len(p.Book.Images))
 		if err != nil {
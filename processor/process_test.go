@@ -0,0 +1,150 @@
+package processor
+
+import (
+	gocontext "context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"fb2converter/config"
+	"fb2converter/state"
+)
+
+const processTestBook = `<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+<description>
+  <title-info><book-title>Book</book-title><lang>en</lang><coverpage><image l:href="#pic.png"/></coverpage></title-info>
+  <document-info><id>1</id></document-info>
+</description>
+<body>
+  <section><title><p>One</p></title><p>Text.</p></section>
+  <section><title><p>Two</p></title><p>Text.</p></section>
+  <section><title><p>Three</p></title><p>Text.</p></section>
+</body>
+<binary id="pic.png" content-type="image/png">` + htmlTestImage + `</binary>
+</FictionBook>`
+
+// fakeKindlegen creates script which stands for kindlegen: it announces start by creating "started" file next to itself
+// and never finishes.
+func fakeKindlegen(t *testing.T) (string, string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("shell script could not be used as kindlegen")
+	}
+	dir := t.TempDir()
+	started := filepath.Join(dir, "started")
+	script := filepath.Join(dir, "kindlegen")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\ntouch '"+started+"'\nexec sleep 30\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return script, started
+}
+
+func TestProcessCanceled(t *testing.T) {
+
+	cfg, err := config.BuildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := &state.LocalEnv{Cfg: cfg, Log: zap.NewNop()}
+
+	newProcessor := func(format OutputFmt) *Processor {
+		t.Helper()
+		p, err := NewFB2(strings.NewReader(processTestBook), false, "book.fb2", t.TempDir(), true, false, true, format, env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { p.Clean() })
+		return p
+	}
+
+	// expired timeout stops processing before any stage is run
+	ctx, cancel := gocontext.WithTimeout(gocontext.Background(), -time.Second)
+	defer cancel()
+	p := newProcessor(OEpub)
+	if err := p.Process(ctx); !errors.Is(err, gocontext.DeadlineExceeded) {
+		t.Errorf("expired timeout: unexpected error %v", err)
+	}
+	if len(p.Book.Files) != 0 {
+		t.Error("book was processed after timeout")
+	}
+
+	// flush workers stop when context is canceled
+	p = newProcessor(OEpub)
+	if err := p.Process(gocontext.Background()); err != nil {
+		t.Fatal(err)
+	}
+	canceled, cancel := gocontext.WithCancel(gocontext.Background())
+	cancel()
+	for name, flush := range map[string]func(gocontext.Context, bookFS) error{
+		"xhtml":  p.Book.flushXHTML,
+		"images": p.Book.flushImages,
+	} {
+		out := newMemFS()
+		if err := flush(canceled, out); !errors.Is(err, gocontext.Canceled) {
+			t.Errorf("%s: unexpected error %v", name, err)
+		}
+	}
+	if _, err := p.Save(canceled); !errors.Is(err, gocontext.Canceled) {
+		t.Errorf("save: unexpected error %v", err)
+	}
+	if entries, _ := os.ReadDir(p.dst); len(entries) != 0 {
+		t.Errorf("result of canceled conversion was saved: %v", entries)
+	}
+}
+
+func TestKindlegenCanceled(t *testing.T) {
+
+	kindlegen, started := fakeKindlegen(t)
+
+	cfg, err := config.BuildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Doc.Kindlegen.Path = kindlegen
+	env := &state.LocalEnv{Cfg: cfg, Log: zap.NewNop()}
+
+	dst := t.TempDir()
+	p, err := NewFB2(strings.NewReader(processTestBook), false, "book.fb2", dst, true, false, true, OMobi, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Process(gocontext.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := gocontext.WithTimeout(gocontext.Background(), 300*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = p.Save(ctx)
+	if !errors.Is(err, gocontext.DeadlineExceeded) {
+		t.Errorf("unexpected error %v", err)
+	}
+	if _, err := os.Stat(started); err != nil {
+		t.Error("kindlegen was never started")
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Error("kindlegen was not killed on timeout")
+	}
+	if entries, _ := os.ReadDir(dst); len(entries) != 0 {
+		t.Errorf("result of canceled conversion was saved: %v", entries)
+	}
+
+	// intermediate content goes away with processor
+	tmp := p.tmpDir
+	if len(tmp) == 0 {
+		t.Fatal("working directory was not created")
+	}
+	if err := p.Clean(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(tmp); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("working directory was left behind: %v", err)
+	}
+}
@@ -0,0 +1,203 @@
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+
+	"fb2converter/etree"
+	"fb2converter/state"
+)
+
+// Splitting and merging works on the whole parsed document: bodies are moved around, identifiers and links are renamed
+// and description is corrected. Nothing in the text itself is changed.
+
+const xlinkNS = "http://www.w3.org/1999/xlink"
+
+// FB2Document is parsed FB2 book to be split or merged.
+type FB2Document struct {
+	Title   string
+	SeqName string
+	SeqNum  int
+	id      uuid.UUID
+	doc     *etree.Document
+	env     *state.LocalEnv
+}
+
+// ReadFB2Document parses FB2 document. Book title, sequence and ID are the ones conversion would use.
+func ReadFB2Document(r io.Reader, unknownEncoding bool, src string, env *state.LocalEnv) (*FB2Document, error) {
+
+	p, _, err := readDescription(r, unknownEncoding, src, env)
+	if err != nil {
+		return nil, err
+	}
+	if p.doc.FindElement("./FictionBook/body") == nil {
+		return nil, errors.New("book has no body")
+	}
+	return &FB2Document{
+		Title:   p.Book.Title,
+		SeqName: p.Book.SeqName,
+		SeqNum:  p.Book.SeqNum,
+		id:      p.Book.ID,
+		doc:     p.doc,
+		env:     env,
+	}, nil
+}
+
+// WriteTo writes document in UTF-8.
+func (d *FB2Document) WriteTo(w io.Writer) (int64, error) {
+	addXMLDeclaration(d.doc)
+	return d.doc.WriteTo(w)
+}
+
+// isNotesBody checks if body with the index is one of the notes bodies.
+func (d *FB2Document) isNotesBody(i int, body *etree.Element) bool {
+	return i != 0 && IsOneOf(getAttrValue(body, "name"), d.env.Cfg.Doc.Notes.BodyNames)
+}
+
+// xlinkPrefix returns namespace prefix document uses for xlink attributes.
+func xlinkPrefix(root *etree.Element) string {
+	for _, a := range root.Attr {
+		if a.Space == "xmlns" && a.Value == xlinkNS {
+			return a.Key
+		}
+	}
+	return ""
+}
+
+// collectRefs remembers all local links and images of the element and its children.
+func collectRefs(e *etree.Element, refs map[string]bool) {
+	if href := getAttrValue(e, "href"); strings.HasPrefix(href, "#") {
+		refs[href[1:]] = true
+	}
+	for _, c := range e.ChildElements() {
+		collectRefs(c, refs)
+	}
+}
+
+// prune removes notes and binaries nobody refers to.
+func (d *FB2Document) prune() {
+
+	root := d.doc.FindElement("./FictionBook")
+
+	refs := make(map[string]bool)
+	var notesBodies []*etree.Element
+	for i, body := range root.SelectElements("body") {
+		if d.isNotesBody(i, body) {
+			notesBodies = append(notesBodies, body)
+			continue
+		}
+		collectRefs(body, refs)
+	}
+	if desc := root.SelectElement("description"); desc != nil {
+		collectRefs(desc, refs)
+	}
+
+	// notes could refer to other notes
+	notes := make(map[string]*etree.Element)
+	for _, body := range notesBodies {
+		for _, s := range body.FindElements(".//section[@id]") {
+			notes[getAttrValue(s, "id")] = s
+		}
+	}
+	for visited := make(map[string]bool); ; {
+		found := false
+		for id, s := range notes {
+			if refs[id] && !visited[id] {
+				visited[id] = true
+				collectRefs(s, refs)
+				found = true
+			}
+		}
+		if !found {
+			break
+		}
+	}
+
+	for id, s := range notes {
+		if !refs[id] {
+			s.Parent().RemoveChild(s)
+		}
+	}
+	for _, body := range notesBodies {
+		if len(body.FindElements(".//section[@id]")) == 0 {
+			root.RemoveChild(body)
+		}
+	}
+	for _, b := range root.SelectElements("binary") {
+		if !refs[getAttrValue(b, "id")] {
+			root.RemoveChild(b)
+		}
+	}
+}
+
+// Split divides book into separate books, one for every top level section of the main body. Every part keeps its notes
+// and only binaries it uses (book cover included), gets section title as book title and number in sequence named after
+// book sequence or, when book does not belong to any, after the book itself.
+func (d *FB2Document) Split() ([]*FB2Document, error) {
+
+	count := len(d.doc.FindElements("./FictionBook/body[1]/section"))
+	if count < 2 {
+		return nil, fmt.Errorf("book has %d top level section(s), nothing to split", count)
+	}
+
+	seq := d.SeqName
+	if len(seq) == 0 {
+		seq = d.Title
+	}
+
+	parts := make([]*FB2Document, 0, count)
+	for n := 0; n < count; n++ {
+
+		doc := d.doc.Copy()
+		body := doc.FindElement("./FictionBook/body")
+
+		// book title, epigraphs and image of the main body belong to the whole book rather than to any part
+		var section *etree.Element
+		i := 0
+		for _, c := range body.ChildElements() {
+			if c.Tag == "section" {
+				if i == n {
+					section = c
+				}
+				i++
+				if c == section {
+					continue
+				}
+			}
+			body.RemoveChild(c)
+		}
+
+		part := &FB2Document{
+			SeqName: seq,
+			SeqNum:  n + 1,
+			id:      uuid.NewSHA1(d.id, []byte(strconv.Itoa(n+1))),
+			doc:     doc,
+			env:     d.env,
+		}
+		if t := section.SelectElement("title"); t != nil {
+			part.Title = strings.TrimSpace(SanitizeTitle(AllLines(getTextFragment(t))))
+		}
+		if len(part.Title) == 0 {
+			part.Title = fmt.Sprintf("%s %d", d.Title, n+1)
+		}
+
+		if info := doc.FindElement("./FictionBook/description/title-info"); info != nil {
+			selectFB2Element(info, "book-title", fb2TitleInfoOrder).SetText(part.Title)
+			removeFB2Elements(info, "sequence")
+			e := insertFB2Element(info, "sequence", fb2TitleInfoOrder)
+			e.CreateAttr("name", part.SeqName)
+			e.CreateAttr("number", strconv.Itoa(part.SeqNum))
+		}
+		if info := doc.FindElement("./FictionBook/description/document-info"); info != nil {
+			selectFB2Element(info, "id", fb2DocumentInfoOrder).SetText(part.id.String())
+		}
+		part.prune()
+		parts = append(parts, part)
+	}
+	return parts, nil
+}
@@ -0,0 +1,131 @@
+package processor
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"fb2converter/config"
+	"fb2converter/etree"
+	"fb2converter/state"
+)
+
+const omnibus = `<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+<description>
+  <title-info><genre>sf</genre><author><first-name>First</first-name><last-name>Author</last-name></author><book-title>Omnibus</book-title><coverpage><image l:href="#cover"/></coverpage><lang>en</lang></title-info>
+  <document-info><id>7f9f5a2e-3b8c-4d3e-9a49-9c1f2b3d4e5f</id></document-info>
+</description>
+<body>
+  <title><p>Omnibus</p></title>
+  <section id="one"><title><p>Novel One</p></title><p>Text<a l:href="#n1" type="note">1</a></p><image l:href="#img1"/></section>
+  <section id="two"><title><p>Novel Two</p></title><p>Text<a l:href="#n2" type="note">2</a></p><image l:href="#img2"/></section>
+</body>
+<body name="notes">
+  <section id="n1"><p>Note one, see <a l:href="#n3">also</a></p></section>
+  <section id="n2"><p>Note two</p></section>
+  <section id="n3"><p>Note three</p></section>
+</body>
+<binary id="cover" content-type="image/png">Y292ZXI=</binary>
+<binary id="img1" content-type="image/png">aW1nMQ==</binary>
+<binary id="img2" content-type="image/png">aW1nMg==</binary>
+</FictionBook>`
+
+func ids(doc *etree.Document, path string) string {
+	var res []string
+	for _, e := range doc.FindElements(path) {
+		res = append(res, getAttrValue(e, "id"))
+	}
+	return strings.Join(res, ",")
+}
+
+func TestSplitMerge(t *testing.T) {
+
+	cfg, err := config.BuildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := &state.LocalEnv{Cfg: cfg, Log: zap.NewNop()}
+
+	book, err := ReadFB2Document(strings.NewReader(omnibus), false, "omnibus.fb2", env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts, err := book.Split()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != 2 {
+		t.Fatalf("expected 2 parts, got %d", len(parts))
+	}
+
+	for i, c := range []struct{ title, notes, binaries string }{
+		{"Novel One", "n1,n3", "cover,img1"},
+		{"Novel Two", "n2", "cover,img2"},
+	} {
+		p := parts[i]
+		if p.Title != c.title || p.SeqName != "Omnibus" || p.SeqNum != i+1 {
+			t.Errorf("part %d: unexpected title or sequence: %q %q %d", i+1, p.Title, p.SeqName, p.SeqNum)
+		}
+		if got := p.doc.FindElement("./FictionBook/description/title-info/book-title").Text(); got != c.title {
+			t.Errorf("part %d: book-title %q", i+1, got)
+		}
+		if got := ids(p.doc, "./FictionBook/body[@name='notes']/section"); got != c.notes {
+			t.Errorf("part %d: notes %q, expected %q", i+1, got, c.notes)
+		}
+		if got := ids(p.doc, "./FictionBook/binary"); got != c.binaries {
+			t.Errorf("part %d: binaries %q, expected %q", i+1, got, c.binaries)
+		}
+		if p.doc.FindElement("./FictionBook/body/title") != nil {
+			t.Errorf("part %d: omnibus title was not removed", i+1)
+		}
+	}
+	if parts[0].id == parts[1].id || parts[0].id == book.id {
+		t.Error("parts must have different IDs")
+	}
+
+	merged, err := MergeFB2Documents(parts, "Merged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := merged.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	// parts have single section each, it is used as is
+	if got := ids(doc, "./FictionBook/body[1]/section"); got != "one,two" {
+		t.Errorf("top level sections %q", got)
+	}
+	if got := ids(doc, "./FictionBook/body[@name='notes']/section"); got != "n1,n2,n3" {
+		t.Errorf("renumbered notes %q", got)
+	}
+	// cover is shared by both parts
+	if got := ids(doc, "./FictionBook/binary"); got != "cover,img1,img2" {
+		t.Errorf("binaries %q", got)
+	}
+	if got := len(doc.FindElements("./FictionBook/description/title-info/author")); got != 1 {
+		t.Errorf("expected 1 author, got %d", got)
+	}
+	if got := doc.FindElement("./FictionBook/description/title-info/book-title").Text(); got != "Merged" {
+		t.Errorf("book-title %q", got)
+	}
+	var links []string
+	for _, a := range doc.FindElements(".//a") {
+		links = append(links, getAttrValue(a, "href"))
+	}
+	sort.Strings(links)
+	if got := strings.Join(links, ","); got != "#n1,#n2,#n3" {
+		t.Errorf("links %q", got)
+	}
+	if n := doc.FindElement("./FictionBook/body[@name='notes']/section[@id='n2']"); n == nil || !strings.Contains(getTextFragment(n), "three") {
+		t.Error("note link was not renamed with the note")
+	}
+}
@@ -0,0 +1,131 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"io"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"fb2converter/etree"
+	"fb2converter/state"
+)
+
+// BookStats is book content metrics used to estimate library size and to spot broken books before conversion.
+type BookStats struct {
+	Source       string         `json:"source"`
+	Title        string         `json:"title"`
+	Lang         string         `json:"lang"`
+	Encoding     string         `json:"encoding"`
+	BOM          bool           `json:"bom"`
+	Characters   int            `json:"characters"`
+	Words        int            `json:"words"`
+	Pages        int            `json:"pages"`
+	Notes        map[string]int `json:"notes"`
+	Images       int            `json:"images"`
+	ImageBytes   int            `json:"image_bytes"`
+	BrokenImages int            `json:"broken_images"`
+	DefaultCover bool           `json:"default_cover"`
+}
+
+var reProcInstEncoding = regexp.MustCompile(`encoding\s*=\s*["']([^"']+)["']`)
+
+// inline FB2 elements, text around them belongs to the same word.
+var fb2Inline = []string{"strong", "emphasis", "style", "a", "strikethrough", "sub", "sup", "code", "image"}
+
+// collectText writes element text into builder separating blocks with spaces.
+func collectText(e *etree.Element, b *strings.Builder) {
+	for _, t := range e.Child {
+		switch v := t.(type) {
+		case *etree.CharData:
+			b.WriteString(v.Data)
+		case *etree.Element:
+			collectText(v, b)
+			if !IsOneOf(v.Tag, fb2Inline) {
+				b.WriteByte(' ')
+			}
+			b.WriteString(v.Tail())
+		}
+	}
+}
+
+// ReadStats parses FB2 document and collects content metrics. Like ReadInfo it does not write anything, metadata
+// overwrites from configuration are applied.
+func ReadStats(r io.Reader, unknownEncoding bool, src string, env *state.LocalEnv) (*BookStats, error) {
+
+	p, _, err := readDescription(r, unknownEncoding, src, env)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &BookStats{
+		Source:   src,
+		Title:    p.Book.Title,
+		Lang:     p.Book.Lang.String(),
+		Encoding: "utf-8",
+		BOM:      !unknownEncoding,
+		Notes:    make(map[string]int),
+	}
+	for _, t := range p.doc.Child {
+		if pi, ok := t.(*etree.ProcInst); ok && pi.Target == "xml" {
+			if m := reProcInstEncoding.FindStringSubmatch(pi.Inst); m != nil {
+				s.Encoding = strings.ToLower(m[1])
+			}
+			break
+		}
+	}
+
+	for i, body := range p.doc.FindElements("./FictionBook/body") {
+		if name := getAttrValue(body, "name"); i != 0 && IsOneOf(name, env.Cfg.Doc.Notes.BodyNames) {
+			s.Notes[name] += len(body.FindElements(".//section[@id]"))
+			continue
+		}
+		var b strings.Builder
+		collectText(body, &b)
+		for _, w := range strings.Fields(b.String()) {
+			if s.Words > 0 {
+				// count space between words the same way paging does
+				s.Characters++
+			}
+			s.Characters += utf8.RuneCountInString(w)
+			s.Words++
+		}
+	}
+	if env.Cfg.Doc.CharsPerPage > 0 {
+		s.Pages = (s.Characters + env.Cfg.Doc.CharsPerPage - 1) / env.Cfg.Doc.CharsPerPage
+	}
+
+	coverFound := false
+	for _, el := range p.doc.FindElements("./FictionBook/binary[@id]") {
+		ct := strings.ToLower(getAttrValue(el, "content-type"))
+		if !strings.HasPrefix(ct, "image/") {
+			continue
+		}
+		s.Images++
+
+		// same leniency as when binaries are processed for conversion
+		text := strings.Replace(el.Text(), " ", "", -1)
+		data := make([]byte, base64.StdEncoding.DecodedLen(len(text)))
+		n, err := base64.StdEncoding.Decode(data, []byte(text))
+		s.ImageBytes += n
+
+		ok := n > 0
+		if ok && !strings.HasSuffix(ct, "svg") {
+			_, _, err = image.DecodeConfig(bytes.NewReader(data[:n]))
+			ok = err == nil
+		}
+		if !ok {
+			s.BrokenImages++
+		}
+		if ok && len(p.Book.Cover) > 0 && getAttrValue(el, "id") == p.Book.Cover {
+			coverFound = true
+		}
+	}
+	if p.metaOverwrite != nil && p.metaOverwrite.CoverImage == "remove cover" {
+		coverFound = false
+	}
+	s.DefaultCover = !coverFound
+	return s, nil
+}
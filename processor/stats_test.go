@@ -0,0 +1,52 @@
+package processor
+
+import (
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"fb2converter/config"
+	"fb2converter/state"
+)
+
+func TestReadStats(t *testing.T) {
+
+	const doc = `<?xml version="1.0" encoding="windows-1251"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+<description>
+  <title-info>
+    <book-title>Title</book-title>
+    <coverpage><image l:href="#cover.jpg"/></coverpage>
+    <lang>ru</lang>
+  </title-info>
+</description>
+<body><title><p>Head</p></title><section><p>One <emphasis>two</emphasis>three</p><p>four</p></section></body>
+<body name="notes"><section id="n1"><p>Note</p></section><section id="n2"><p>Note</p></section></body>
+<binary id="cover.jpg" content-type="image/jpeg">/9j/4AAQ</binary>
+</FictionBook>`
+
+	cfg, err := config.BuildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Doc.CharsPerPage = 10
+	env := &state.LocalEnv{Cfg: cfg, Log: zap.NewNop()}
+
+	s, err := ReadStats(strings.NewReader(doc), true, "book.fb2", env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Words != 4 || s.Characters != len("Head One twothree four") || s.Pages != 3 {
+		t.Errorf("unexpected text metrics: words %d, characters %d, pages %d", s.Words, s.Characters, s.Pages)
+	}
+	if s.Notes["notes"] != 2 {
+		t.Errorf("unexpected notes: %v", s.Notes)
+	}
+	if s.Encoding != "windows-1251" || s.BOM || s.Lang != "ru" {
+		t.Errorf("unexpected encoding %s (BOM %t) or language %s", s.Encoding, s.BOM, s.Lang)
+	}
+	if s.Images != 1 || s.BrokenImages != 1 || !s.DefaultCover {
+		t.Errorf("truncated cover should be reported as broken: images %d, broken %d, default cover %t", s.Images, s.BrokenImages, s.DefaultCover)
+	}
+}
@@ -0,0 +1,347 @@
+package processor
+
+import (
+	gocontext "context"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"fb2converter/etree"
+)
+
+// textOutput checks if book is being rendered as plain text or Markdown.
+func (p *Processor) textOutput() bool {
+	return p.format == OTxt || p.format == OMd
+}
+
+// processText transfers book bodies to XHTML the usual way, so it could be rendered as text later. Notes bodies are
+// skipped - notes are rendered as footnotes.
+func (p *Processor) processText(ctx gocontext.Context) error {
+
+	if err := runStages(ctx, p.processBinaries, p.processNotes, p.processDescription, p.runHooks(AfterDescription)); err != nil {
+		return err
+	}
+	// soft hyphens only get in the way of diffing and speech synthesis
+	p.Book.hyph = nil
+
+	p.env.Log.Debug("Parsing bodies - start")
+	defer func(start time.Time) {
+		p.env.Log.Debug("Parsing bodies - done", zap.Duration("elapsed", time.Since(start)))
+	}(time.Now())
+
+	for i, body := range p.doc.FindElements("./FictionBook/body") {
+		if i != 0 && IsOneOf(getAttrValue(body, "name"), p.env.Cfg.Doc.Notes.BodyNames) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := p.processBody(i, body); err != nil {
+			return err
+		}
+	}
+	return p.runHooks(AfterBodies)()
+}
+
+// FinalizeText renders previously transferred content as plain text or Markdown.
+func (p *Processor) FinalizeText(fname string) error {
+
+	if err := p.prepareOutput(fname); err != nil {
+		return err
+	}
+	if err := os.WriteFile(fname, p.renderText(), 0644); err != nil {
+		return fmt.Errorf("unable to write %s (%s): %w", p.format, fname, err)
+	}
+	return nil
+}
+
+// renderText renders previously transferred content as plain text or Markdown.
+func (p *Processor) renderText() []byte {
+
+	w := &textWriter{md: p.format == OMd, notes: p.Book.Notes, labels: make(map[string]int)}
+	for _, f := range p.Book.Files {
+		if f.doc == nil {
+			continue
+		}
+		if body := f.doc.FindElement("./html/body"); body != nil {
+			w.blocks(body, "")
+		}
+	}
+	w.footnotes(p.Book.NotesOrder)
+
+	return []byte(strings.Join(w.out, "\n\n") + "\n")
+}
+
+var (
+	textSpaces    = regexp.MustCompile(`[ \t\r\n]+`)
+	mdEscaper     = strings.NewReplacer(`\`, `\\`, "*", `\*`, "_", `\_`, "`", "\\`", "[", `\[`, "]", `\]`, "<", `\<`, ">", `\>`, "#", `\#`)
+	mdListMarker  = regexp.MustCompile(`^(\d{1,9})([.)])`)
+	textInlineTag = map[string]bool{"span": true, "a": true, "code": true, "sup": true, "sub": true, "time": true, "img": true}
+)
+
+// textWriter renders XHTML produced by transfer as plain text or Markdown paragraphs.
+type textWriter struct {
+	md     bool
+	notes  map[string]*note
+	labels map[string]int // footnote labels in order of first reference
+	refs   []string
+	out    []string
+}
+
+// blocks renders block level content of the element, runs of inline content become paragraphs.
+func (w *textWriter) blocks(e *etree.Element, prefix string) {
+
+	var run strings.Builder
+	flush := func() {
+		w.paragraph(run.String(), prefix)
+		run.Reset()
+	}
+
+	for _, t := range e.Child {
+		switch v := t.(type) {
+		case *etree.CharData:
+			run.WriteString(w.text(v.Data, false))
+		case *etree.Element:
+			if textInlineTag[v.Tag] {
+				run.WriteString(w.element(v, false))
+				run.WriteString(w.text(v.Tail(), false))
+				continue
+			}
+			flush()
+			w.block(v, prefix)
+			run.WriteString(w.text(v.Tail(), false))
+		}
+	}
+	flush()
+}
+
+// block renders single block level element.
+func (w *textWriter) block(e *etree.Element, prefix string) {
+
+	class := getAttrValue(e, "class")
+	switch {
+	case e.Tag == "div" && len(class) == 2 && class[0] == 'h' && class[1] >= '0' && class[1] <= '9':
+		var parts []string
+		for _, c := range e.ChildElements() {
+			if s := w.clean(w.inline(c, false)); len(s) > 0 {
+				parts = append(parts, s)
+			}
+		}
+		if len(parts) == 0 {
+			return
+		}
+		title := strings.Join(parts, " ")
+		if w.md {
+			title = strings.Repeat("#", min(int(class[1]-'0')+1, 6)) + " " + title
+		}
+		w.paragraph(title, prefix)
+	case e.Tag == "div" && class == "stanza":
+		var lines []string
+		for _, c := range e.ChildElements() {
+			if s := w.clean(w.inline(c, false)); len(s) > 0 {
+				lines = append(lines, s)
+			}
+		}
+		sep := "\n"
+		if w.md {
+			// hard line break
+			sep = "\\\n"
+		}
+		w.paragraph(strings.Join(lines, sep), prefix)
+	case e.Tag == "div" && (class == "epigraph" || class == "cite" || class == "annotation"):
+		if w.md {
+			w.blocks(e, prefix+"> ")
+		} else {
+			w.blocks(e, prefix+"    ")
+		}
+	case e.Tag == "div" && (class == "image" || strings.HasPrefix(class, "vignette")):
+		// images are not rendered
+	case e.Tag == "table":
+		w.table(e, prefix)
+	default:
+		w.blocks(e, prefix)
+	}
+}
+
+// table renders table rows, one paragraph per table.
+func (w *textWriter) table(e *etree.Element, prefix string) {
+
+	var rows []string
+	for i, tr := range e.FindElements(".//tr") {
+		var cells []string
+		for _, td := range tr.ChildElements() {
+			cells = append(cells, w.clean(w.inline(td, false)))
+		}
+		if !w.md {
+			rows = append(rows, strings.Join(cells, "\t"))
+			continue
+		}
+		rows = append(rows, "| "+strings.Join(cells, " | ")+" |")
+		if i == 0 {
+			rows = append(rows, strings.Repeat("| --- ", len(cells))+"|")
+		}
+	}
+	w.paragraph(strings.Join(rows, "\n"), prefix)
+}
+
+// inline renders element content as a single line of text with Markdown formatting if requested.
+func (w *textWriter) inline(e *etree.Element, raw bool) string {
+
+	var b strings.Builder
+	for _, t := range e.Child {
+		switch v := t.(type) {
+		case *etree.CharData:
+			b.WriteString(w.text(v.Data, raw))
+		case *etree.Element:
+			b.WriteString(w.element(v, raw))
+			b.WriteString(w.text(v.Tail(), raw))
+		}
+	}
+	return b.String()
+}
+
+// element renders single inline element.
+func (w *textWriter) element(e *etree.Element, raw bool) string {
+
+	class := getAttrValue(e, "class")
+	switch e.Tag {
+	case "img":
+		return ""
+	case "code":
+		if w.md && !raw {
+			return wrapText(w.inline(e, true), "`")
+		}
+	case "a":
+		href := getAttrValue(e, "href")
+		if u, err := url.Parse(href); err == nil && len(u.Fragment) > 0 && len(u.Scheme) == 0 {
+			if _, ok := w.notes[u.Fragment]; ok {
+				if w.md {
+					return "[^" + w.label(u.Fragment) + "]"
+				}
+				return "[" + w.label(u.Fragment) + "]"
+			}
+		} else if err == nil && len(u.Scheme) > 0 && w.md && !raw {
+			return "[" + w.inline(e, raw) + "](" + href + ")"
+		}
+	case "span":
+		if !w.md || raw {
+			break
+		}
+		switch class {
+		case "strong":
+			return wrapText(w.inline(e, raw), "**")
+		case "emphasis":
+			return wrapText(w.inline(e, raw), "*")
+		case "strike":
+			return wrapText(w.inline(e, raw), "~~")
+		}
+	}
+	return w.inline(e, raw)
+}
+
+// text normalizes white space and escapes Markdown special characters.
+func (w *textWriter) text(s string, raw bool) string {
+	s = textSpaces.ReplaceAllLiteralString(s, " ")
+	if w.md && !raw {
+		s = mdEscaper.Replace(s)
+	}
+	return s
+}
+
+// clean removes extra spaces from rendered line.
+func (w *textWriter) clean(s string) string {
+	return strings.Join(strings.FieldsFunc(s, func(r rune) bool { return r == ' ' }), " ")
+}
+
+// paragraph adds non empty paragraph to the output.
+func (w *textWriter) paragraph(s, prefix string) {
+
+	if len(strings.TrimSpace(s)) == 0 {
+		return
+	}
+	lines := strings.Split(s, "\n")
+	for i, l := range lines {
+		l = w.clean(l)
+		if w.md && len(l) > 0 {
+			// make sure line would not be taken for a list item or setext heading underline
+			if l[0] == '-' || l[0] == '+' || l[0] == '=' {
+				l = `\` + l
+			} else if m := mdListMarker.FindStringSubmatchIndex(l); m != nil {
+				l = l[:m[4]] + `\` + l[m[4]:]
+			}
+		}
+		lines[i] = prefix + l
+	}
+	w.out = append(w.out, strings.Join(lines, "\n"))
+}
+
+// label returns footnote label for the note, assigning new one on first reference.
+func (w *textWriter) label(id string) string {
+	n, ok := w.labels[id]
+	if !ok {
+		w.refs = append(w.refs, id)
+		n = len(w.refs)
+		w.labels[id] = n
+	}
+	return strconv.Itoa(n)
+}
+
+// footnotes renders bodies of all referenced notes followed by notes which were never referenced.
+func (w *textWriter) footnotes(order []notelink) {
+
+	for _, nl := range order {
+		w.label(nl.id)
+	}
+	if len(w.refs) == 0 {
+		return
+	}
+	if !w.md {
+		w.out = append(w.out, "* * *")
+	}
+
+	// notes may refer to other notes, so list of references could grow while we are rendering
+	for i := 0; i < len(w.refs); i++ {
+		n := w.notes[w.refs[i]]
+		if n == nil || n.parsed == nil {
+			continue
+		}
+
+		main := w.out
+		w.out = nil
+		w.blocks(n.parsed, "")
+		paras := w.out
+		w.out = main
+
+		if len(paras) == 0 {
+			continue
+		}
+		label := "[" + strconv.Itoa(i+1) + "]"
+		if w.md {
+			label = "[^" + strconv.Itoa(i+1) + "]:"
+		}
+		indent := strings.Repeat(" ", 4)
+		for j := range paras {
+			paras[j] = strings.ReplaceAll(paras[j], "\n", "\n"+indent)
+			if j > 0 {
+				paras[j] = indent + paras[j]
+			}
+		}
+		w.out = append(w.out, label+" "+strings.Join(paras, "\n\n"))
+	}
+}
+
+// wrapText surrounds text with Markdown markers keeping surrounding spaces outside.
+func wrapText(s, marker string) string {
+	t := strings.TrimSpace(s)
+	if len(t) == 0 {
+		return s
+	}
+	start := strings.Index(s, t)
+	return s[:start] + marker + t + marker + s[start+len(t):]
+}
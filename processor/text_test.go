@@ -0,0 +1,154 @@
+package processor
+
+import (
+	gocontext "context"
+	"slices"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"fb2converter/config"
+	"fb2converter/state"
+)
+
+// textBook builds document with single section and optional notes body.
+func textBook(section, notes string) string {
+	doc := `<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+<description>
+  <title-info><book-title>Text</book-title><lang>en</lang></title-info>
+  <document-info><id>1</id></document-info>
+</description>
+<body><section>` + section + `</section></body>`
+	if len(notes) > 0 {
+		doc += `<body name="notes">` + notes + `</body>`
+	}
+	return doc + `</FictionBook>`
+}
+
+func TestRenderText(t *testing.T) {
+
+	const notes = `
+  <section id="n1"><title><p>1</p></title><p>First note refers<a l:href="#n3" type="note">[3]</a>.</p></section>
+  <section id="n2"><title><p>2</p></title><p>Second note.</p></section>
+  <section id="n3"><title><p>3</p></title><p>Nested note.</p></section>`
+
+	for _, c := range []struct {
+		name          string
+		section       string
+		notes         string
+		format        OutputFmt
+		paragraphs    []string
+		notParagraphs []string
+	}{
+		{
+			name:       "markdown escaping",
+			section:    "<title><p>Chapter *one*</p></title><p>Stars *and* _under_ [br] &lt;tag&gt; #hash \x60tick\x60 back\\slash</p>",
+			format:     OMd,
+			paragraphs: []string{`## Chapter \*one\*`, "Stars \\*and\\* \\_under\\_ \\[br\\] \\<tag\\> \\#hash \\\x60tick\\\x60 back\\\\slash"},
+		},
+		{
+			name:       "text is not escaped",
+			section:    "<title><p>Chapter *one*</p></title><p>Stars *and* _under_ [br] &lt;tag&gt; #hash</p>",
+			format:     OTxt,
+			paragraphs: []string{"Chapter *one*", "Stars *and* _under_ [br] <tag> #hash"},
+		},
+		{
+			name:       "list markers and setext underlines",
+			section:    "<p>- dash</p><p>+ plus</p><p>= equals</p><p>1. numbered</p><p>12) paren</p><p>2024 was a year</p>",
+			format:     OMd,
+			paragraphs: []string{`\- dash`, `\+ plus`, `\= equals`, `1\. numbered`, `12\) paren`, "2024 was a year"},
+		},
+		{
+			name:       "guards are markdown only",
+			section:    "<p>- dash</p><p>1. numbered</p>",
+			format:     OTxt,
+			paragraphs: []string{"- dash", "1. numbered"},
+		},
+		{
+			name:       "inline formatting",
+			section:    `<p><strong>bold</strong> <emphasis>em</emphasis> <strikethrough>gone</strikethrough> <code>a*b</code> <a l:href="https://example.com/x_y">link</a></p>`,
+			format:     OMd,
+			paragraphs: []string{"**bold** *em* ~~gone~~ \x60a*b\x60 [link](https://example.com/x_y)"},
+		},
+		{
+			name:       "footnotes numbered by first reference",
+			section:    `<p>Text<a l:href="#n2" type="note">[2]</a> then<a l:href="#n1" type="note">[1]</a> and again<a l:href="#n2" type="note">[2]</a>.</p>`,
+			notes:      notes,
+			format:     OMd,
+			paragraphs: []string{"Text[^1] then[^2] and again[^1].", "[^1]: Second note.", "[^2]: First note refers[^3].", "[^3]: Nested note."},
+		},
+		{
+			name:       "text footnotes, notes never referenced follow in document order",
+			section:    `<p>Text<a l:href="#n3" type="note">[3]</a>.</p>`,
+			notes:      notes,
+			format:     OTxt,
+			paragraphs: []string{"Text[1].", "* * *", "[1] Nested note.", "[2] First note refers[1].", "[3] Second note."},
+		},
+		{
+			name:          "no footnotes",
+			section:       `<p>Text.</p>`,
+			format:        OTxt,
+			paragraphs:    []string{"Text."},
+			notParagraphs: []string{"* * *"},
+		},
+		{
+			name:       "stanza",
+			section:    "<poem><stanza><v>Line one</v><v>Line two</v></stanza></poem>",
+			format:     OMd,
+			paragraphs: []string{"Line one\\\nLine two"},
+		},
+		{
+			name:       "text stanza",
+			section:    "<poem><stanza><v>Line one</v><v>Line two</v></stanza></poem>",
+			format:     OTxt,
+			paragraphs: []string{"Line one\nLine two"},
+		},
+		{
+			name:       "table",
+			section:    "<table><tr><th>H1</th><th>H2</th></tr><tr><td>a</td><td>b</td></tr></table>",
+			format:     OMd,
+			paragraphs: []string{"| H1 | H2 |\n| --- | --- |\n| a | b |"},
+		},
+		{
+			name:       "text table",
+			section:    "<table><tr><th>H1</th><th>H2</th></tr><tr><td>a</td><td>b</td></tr></table>",
+			format:     OTxt,
+			paragraphs: []string{"H1\tH2\na\tb"},
+		},
+		{
+			name:       "epigraph",
+			section:    "<epigraph><p>Quote</p><p>- dash</p></epigraph>",
+			format:     OMd,
+			paragraphs: []string{"> Quote", `> \- dash`},
+		},
+	} {
+		cfg, err := config.BuildConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		env := &state.LocalEnv{Cfg: cfg, Log: zap.NewNop()}
+
+		p, err := NewFB2(strings.NewReader(textBook(c.section, c.notes)), false, "book.fb2", t.TempDir(), true, false, true, c.format, env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Process(gocontext.Background()); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+
+		out := string(p.renderText())
+		paragraphs := strings.Split(strings.TrimSuffix(out, "\n"), "\n\n")
+		for _, s := range c.paragraphs {
+			if !slices.Contains(paragraphs, s) {
+				t.Errorf("%s: paragraph %q not found in\n%s", c.name, s, out)
+			}
+		}
+		for _, s := range c.notParagraphs {
+			if slices.Contains(paragraphs, s) {
+				t.Errorf("%s: unexpected paragraph %q in\n%s", c.name, s, out)
+			}
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package processor
+
+import (
+	"fmt"
+	"runtime/debug"
+
+	"go.uber.org/zap"
+
+	"fb2converter/processor/internal/mobi"
+)
+
+// UnpackKindle dumps mobi or azw3 file structure into directory: headers and EXTH, records, resources and text.
+func UnpackKindle(fname, outdir string, log *zap.Logger) (err error) {
+
+	defer func() {
+		// malformed books could have offsets pointing anywhere
+		if r := recover(); r != nil {
+			log.Debug("Unpacking ended with panic", zap.String("file", fname), zap.ByteString("stack", debug.Stack()))
+			err = fmt.Errorf("unable to parse book structure: %v", r)
+		}
+	}()
+
+	u, err := mobi.NewUnpacker(fname, log)
+	if err != nil {
+		return err
+	}
+	return u.SaveResult(outdir)
+}
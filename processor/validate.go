@@ -0,0 +1,203 @@
+package processor
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+
+	"fb2converter/etree"
+)
+
+// Validation issue levels.
+const (
+	IssueError   = "error"
+	IssueWarning = "warning"
+)
+
+// ValidationIssue describes single problem found in FB2 document.
+type ValidationIssue struct {
+	Level   string `json:"level"`
+	Path    string `json:"path,omitempty"`
+	Message string `json:"message"`
+}
+
+// all elements defined by "http://www.gribuser.ru/xml/fictionbook/2.2/xsd/FictionBook2.2.xsd"
+var fb2Elements = map[string]bool{
+	"FictionBook": true, "stylesheet": true, "description": true, "body": true, "binary": true,
+	"title-info": true, "src-title-info": true, "document-info": true, "publish-info": true, "custom-info": true,
+	"output": true, "part": true, "output-document-class": true,
+	"genre": true, "author": true, "first-name": true, "middle-name": true, "last-name": true, "nickname": true,
+	"home-page": true, "email": true, "id": true, "book-title": true, "annotation": true, "keywords": true, "date": true,
+	"coverpage": true, "lang": true, "src-lang": true, "translator": true, "sequence": true, "program-used": true,
+	"src-url": true, "src-ocr": true, "version": true, "history": true, "publisher": true, "book-name": true, "city": true,
+	"year": true, "isbn": true,
+	"title": true, "epigraph": true, "section": true, "p": true, "poem": true, "stanza": true, "v": true, "subtitle": true,
+	"cite": true, "text-author": true, "empty-line": true, "image": true, "table": true, "tr": true, "th": true, "td": true,
+	"strong": true, "emphasis": true, "style": true, "a": true, "strikethrough": true, "sub": true, "sup": true, "code": true,
+}
+
+// validator accumulates issues found in a single document.
+type validator struct {
+	doc    *etree.Document
+	issues []ValidationIssue
+}
+
+func (v *validator) add(level string, e *etree.Element, format string, args ...any) {
+	var path string
+	if e != nil {
+		path = e.GetPath()
+	}
+	v.issues = append(v.issues, ValidationIssue{Level: level, Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// ValidateFB2 reads FB2 document and checks it against FictionBook 2.x structure: unknown elements, required
+// description parts, internal links, images and binaries. Document which cannot be parsed is reported as an issue,
+// returned error means validation could not be performed at all.
+func ValidateFB2(r io.Reader, unknownEncoding bool) ([]ValidationIssue, error) {
+
+	v := &validator{doc: etree.NewDocument()}
+
+	var err error
+	if v.doc.ReadSettings, err = fb2ReadSettings(unknownEncoding); err != nil {
+		return nil, err
+	}
+	if _, err := v.doc.ReadFrom(r); err != nil {
+		v.add(IssueError, nil, "unable to parse FB2: %v", err)
+		return v.issues, nil
+	}
+
+	root := v.doc.Root()
+	if root == nil || root.Tag != "FictionBook" {
+		v.add(IssueError, root, "root element is not FictionBook")
+		return v.issues, nil
+	}
+
+	v.checkElements(root)
+	v.checkDescription(root)
+	if len(root.SelectElements("body")) == 0 {
+		v.add(IssueError, root, "document has no body")
+	}
+	v.checkLinks(root)
+	return v.issues, nil
+}
+
+// checkElements reports elements not defined by the schema, once per element name.
+func (v *validator) checkElements(root *etree.Element) {
+
+	var (
+		order  []*etree.Element
+		counts = make(map[string]int)
+	)
+	var walk func(e *etree.Element)
+	walk = func(e *etree.Element) {
+		if !fb2Elements[e.Tag] {
+			if counts[e.Tag] == 0 {
+				order = append(order, e)
+			}
+			counts[e.Tag]++
+		}
+		for _, c := range e.ChildElements() {
+			walk(c)
+		}
+	}
+	walk(root)
+
+	for _, e := range order {
+		v.add(IssueError, e, "unknown element <%s> (%d occurrence(s))", e.Tag, counts[e.Tag])
+	}
+}
+
+// checkDescription verifies presence of required metainformation.
+func (v *validator) checkDescription(root *etree.Element) {
+
+	desc := root.SelectElement("description")
+	if desc == nil {
+		v.add(IssueError, root, "document has no description")
+		return
+	}
+	ti := desc.SelectElement("title-info")
+	if ti == nil {
+		v.add(IssueError, desc, "description has no title-info")
+		return
+	}
+	if e := ti.SelectElement("book-title"); e == nil || len(strings.TrimSpace(e.Text())) == 0 {
+		v.add(IssueError, ti, "book title is missing")
+	}
+	for _, name := range []string{"genre", "author", "lang"} {
+		if ti.SelectElement(name) == nil {
+			v.add(IssueWarning, ti, "title-info has no %s", name)
+		}
+	}
+	if desc.SelectElement("document-info") == nil {
+		v.add(IssueWarning, desc, "description has no document-info")
+	}
+}
+
+// checkLinks verifies that internal links have targets, images refer to existing binaries, binaries are decodable and
+// used.
+func (v *validator) checkLinks(root *etree.Element) {
+
+	ids := make(map[string]*etree.Element)
+	for _, e := range root.FindElements("//*[@id]") {
+		id := getAttrValue(e, "id")
+		if _, ok := ids[id]; ok {
+			v.add(IssueWarning, e, "duplicate id %q", id)
+			continue
+		}
+		ids[id] = e
+	}
+
+	used := make(map[string]bool)
+	for _, e := range root.FindElements("//image") {
+		href := getAttrValue(e, "href")
+		switch {
+		case len(href) == 0:
+			v.add(IssueError, e, "image has no href")
+		case !strings.HasPrefix(href, "#"):
+			v.add(IssueWarning, e, "image refers to external resource %q", href)
+		default:
+			used[href[1:]] = true
+			if t, ok := ids[href[1:]]; !ok || t.Tag != "binary" {
+				v.add(IssueError, e, "image refers to missing binary %q", href)
+			}
+		}
+	}
+	for _, e := range root.FindElements("//a") {
+		href := getAttrValue(e, "href")
+		if len(href) == 0 {
+			v.add(IssueWarning, e, "link has no href")
+			continue
+		}
+		if !strings.HasPrefix(href, "#") {
+			continue
+		}
+		if _, ok := ids[href[1:]]; !ok {
+			v.add(IssueError, e, "dangling link %q", href)
+		}
+	}
+
+	for _, e := range root.SelectElements("binary") {
+		id := getAttrValue(e, "id")
+		if len(id) == 0 {
+			v.add(IssueError, e, "binary has no id")
+			continue
+		}
+		if len(getAttrValue(e, "content-type")) == 0 {
+			v.add(IssueWarning, e, "binary %q has no content-type", id)
+		}
+		// same leniency as when binaries are processed for conversion
+		s := strings.Replace(e.Text(), " ", "", -1)
+		n, err := base64.StdEncoding.Decode(make([]byte, base64.StdEncoding.DecodedLen(len(s))), []byte(s))
+		if err != nil {
+			if n == 0 {
+				v.add(IssueError, e, "binary %q is not valid base64: %v", id, err)
+			} else {
+				v.add(IssueWarning, e, "binary %q could only be partially decoded: %v", id, err)
+			}
+		}
+		if !used[id] {
+			v.add(IssueWarning, e, "binary %q is never referenced", id)
+		}
+	}
+}
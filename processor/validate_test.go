@@ -0,0 +1,58 @@
+package processor
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateFB2(t *testing.T) {
+
+	const doc = `<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+<description>
+  <title-info><genre>sf</genre><author><last-name>Author</last-name></author><book-title>Title</book-title><lang>en</lang></title-info>
+  <document-info><id>1</id></document-info>
+</description>
+<body>
+  <section id="s1">
+    <p>Text <a l:href="#s1">good</a> <a l:href="#nowhere">bad</a> <a l:href="http://example.com">external</a></p>
+    <image l:href="#img1"/>
+    <image l:href="#img2"/>
+    <font>unknown</font><font>again</font>
+  </section>
+</body>
+<binary id="img1" content-type="image/png">iVBORw0KGgo=</binary>
+<binary id="unused" content-type="image/png">iVBORw0KGgo=</binary>
+<binary id="broken" content-type="image/png">!!!!</binary>
+</FictionBook>`
+
+	issues, err := ValidateFB2(strings.NewReader(doc), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []ValidationIssue{
+		{IssueError, "/FictionBook/body/section/font", "unknown element <font> (2 occurrence(s))"},
+		{IssueError, "/FictionBook/body/section/image", `image refers to missing binary "#img2"`},
+		{IssueError, "/FictionBook/body/section/p/a", `dangling link "#nowhere"`},
+		{IssueWarning, "/FictionBook/binary", `binary "unused" is never referenced`},
+		{IssueError, "/FictionBook/binary", `binary "broken" is not valid base64: illegal base64 data at input byte 0`},
+		{IssueWarning, "/FictionBook/binary", `binary "broken" is never referenced`},
+	}
+	if len(issues) != len(expected) {
+		t.Fatalf("got %d issues, expected %d: %v", len(issues), len(expected), issues)
+	}
+	for i := range expected {
+		if issues[i] != expected[i] {
+			t.Errorf("issue %d: got %v, expected %v", i, issues[i], expected[i])
+		}
+	}
+
+	issues, err = ValidateFB2(strings.NewReader(`<FictionBook><body><p>x</p></body></FictionBook>`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issues) != 1 || issues[0].Message != "document has no description" {
+		t.Errorf("unexpected issues for document without description: %v", issues)
+	}
+}
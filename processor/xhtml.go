@@ -500,7 +500,7 @@ func (p *Processor) transfer(from, to *etree.Element, decorations ...string) err
 		// transfer children
 		var err error
 		for _, child := range from.ChildElements() {
-			if proc, ok := supportedTransfers[child.Tag]; ok {
+			if proc, ok := p.transferFunc(child); ok {
 				err = proc(p, child, inner)
 				if err == nil && from.Tag == "section" {
 					// NOTE: during inner section transfer we may open new xhtml file starting new chapter, so we want to sync up current node...
@@ -552,12 +552,12 @@ func (p *Processor) transfer(from, to *etree.Element, decorations ...string) err
 	return nil
 }
 
-var supportedTransfers map[string]func(p *Processor, from, to *etree.Element) error
+var supportedTransfers map[string]TransferFunc
 
 func init() {
 
 	// all tags mentioned in "http://www.gribuser.ru/xml/fictionbook/2.2/xsd/FictionBook2.2.xsd" and then some
-	supportedTransfers = map[string]func(p *Processor, from, to *etree.Element) error{
+	supportedTransfers = map[string]TransferFunc{
 
 		"title":    transferTitle,
 		"image":    transferImage,